@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/joomcode/errorx"
+	"go.dfds.cloud/aad-aws-sync/internal/handler"
+	"go.dfds.cloud/aad-aws-sync/internal/jobs"
+	"go.dfds.cloud/aad-aws-sync/internal/middleware"
+	"go.dfds.cloud/aad-aws-sync/internal/store"
+	"go.dfds.cloud/aad-aws-sync/internal/tracing"
+)
+
+// SyncCapability             godoc
+// @Summary      Sync a single Capability
+// @Description  Runs the whole pipeline for a single Capability: AAD group and members, enterprise app assignment, SSO permission set assignment, shared role assignments, aws-auth mapping and email aliases. Returns the result of each step, and responds with 500 if any step failed. Responds with 409 while the capSvc2Aad job is running, which syncs the AAD groups of all Capabilities.
+// @Tags         capabilities
+// @Produce      json
+// @Security     BearerToken
+// @Param        rootId path string true "Capability root ID"
+// @Success      200 {object} handler.CapabilitySyncResult
+// @Failure      401
+// @Failure      404
+// @Failure      409
+// @Failure      500 {object} handler.CapabilitySyncResult
+// @Failure      503
+// @Router       /capabilities/{rootId}/sync [post]
+func syncCapability(c *gin.Context) {
+	// Not using the context of the request, so a client that disconnects doesn't cancel the sync halfway through its
+	// changes. The trace context of the client is kept.
+	ctx := tracing.ExtractHttpHeaders(context.Background(), c.Request.Header)
+	var result *handler.CapabilitySyncResult
+	err := middleware.GetJobManager(c).RunExclusive(handler.CapabilityServiceToAzureAdName, func() (err error) {
+		result, err = handler.SyncCapability(ctx, c.Param("rootId"))
+		return err
+	})
+	if err != nil {
+		if errorx.IsOfType(err, handler.CapabilityNotFound) {
+			c.IndentedJSON(http.StatusNotFound, gin.H{"message": err.Error()})
+			return
+		}
+		if errorx.IsOfType(err, jobs.JobInProgress) {
+			c.IndentedJSON(http.StatusConflict, gin.H{"message": err.Error()})
+			return
+		}
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+		return
+	}
+
+	if result.Failed() {
+		c.IndentedJSON(http.StatusInternalServerError, result)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, result)
+}
+
+// GetCapabilityStatus             godoc
+// @Summary      Get the status of a Capability
+// @Description  Reads the state of a Capability in Capability-Service, AAD, the enterprise app assignments, the AWS Identity Store, SSO, aws-auth and Exchange Online without changing anything, and reports every discrepancy between them. Systems that could not be read are listed in errors.
+// @Tags         capabilities
+// @Produce      json
+// @Param        rootId path string true "Capability root ID"
+// @Success      200 {object} handler.CapabilityStatus
+// @Failure      404
+// @Router       /capabilities/{rootId}/status [get]
+func getCapabilityStatus(c *gin.Context) {
+	status, err := handler.GetCapabilityStatus(c.Request.Context(), c.Param("rootId"))
+	if err != nil {
+		if errorx.IsOfType(err, handler.CapabilityNotFound) {
+			c.IndentedJSON(http.StatusNotFound, gin.H{"message": err.Error()})
+			return
+		}
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, status)
+}
+
+// statusCommand prints the status of a Capability across all systems. It exits with 1 if the Capability is not in
+// sync.
+//
+//	orchestrator status <rootId> [-json]
+func statusCommand(args []string) int {
+	flags := flag.NewFlagSet("status", flag.ContinueOnError)
+	asJson := flags.Bool("json", false, "print the status as JSON")
+	positional, err := parseArgs(flags, args)
+	if err != nil {
+		return exitUsage
+	}
+	if len(positional) != 1 {
+		fmt.Fprintln(os.Stderr, "status needs the root ID of a Capability")
+		return exitUsage
+	}
+
+	_, cleanup, err := initCommand(nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	defer cleanup()
+
+	status, err := handler.GetCapabilityStatus(context.Background(), positional[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+
+	printResult(*asJson, status, func() {
+		if status.InSync {
+			fmt.Printf("%s is in sync\n", status.RootId)
+		} else {
+			fmt.Printf("%s is not in sync\n", status.RootId)
+		}
+		for _, discrepancy := range status.Discrepancies {
+			fmt.Printf("  %s: %s\n", discrepancy.System, discrepancy.Message)
+		}
+		for _, readErr := range status.Errors {
+			fmt.Printf("  unable to read %s: %s\n", readErr.System, readErr.Message)
+		}
+	})
+
+	if !status.InSync {
+		return exitFailure
+	}
+
+	return exitOk
+}
+
+// duplicatesCommand prints the latest reports of duplicated Capability groups found by capSvc2Aad.
+func duplicatesCommand(args []string) int {
+	flags := flag.NewFlagSet("duplicates", flag.ContinueOnError)
+	limit := flags.Int("limit", 5, "how many reports to print, newest first")
+	asJson := flags.Bool("json", false, "print the reports as JSON")
+	if _, err := parseArgs(flags, args); err != nil {
+		return exitUsage
+	}
+
+	_, cleanup, err := initCommand(nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	defer cleanup()
+
+	reports, err := handler.LoadDuplicateGroupsReports(store.Default(), *limit)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+
+	printResult(*asJson, reports, func() {
+		if len(reports) == 0 {
+			fmt.Println("no duplicate Capability groups found yet")
+		}
+		for _, report := range reports {
+			mode := ""
+			if report.ReportOnly {
+				mode = " (report only)"
+			}
+			fmt.Printf("%s%s\n", report.CreatedAt.Format(time.RFC3339), mode)
+			for _, capability := range report.Capabilities {
+				fmt.Printf("  %s: kept %s\n", capability.CapabilityRootId, capability.Survivor.ID)
+				for _, duplicate := range capability.Duplicates {
+					outcome := "not removed"
+					switch {
+					case duplicate.Removed:
+						outcome = "removed"
+					case duplicate.Kept != "":
+						outcome = "kept, " + duplicate.Kept
+					}
+					fmt.Printf("    %s: %s, %d members merged, %d app assignments moved\n", duplicate.ID, outcome, len(duplicate.MergedMembers), len(duplicate.MovedAppAssignments))
+				}
+			}
+		}
+	})
+
+	return exitOk
+}
+
+// registerCapabilityIdPropertyCommand registers the directory extension property AAD groups are bound to Capabilities
+// with, and prints the name to configure as azure.capabilityIdProperty. Registering a property that exists does
+// nothing.
+//
+//	orchestrator register-capability-id-property [-name capabilityRootId]
+func registerCapabilityIdPropertyCommand(args []string) int {
+	flags := flag.NewFlagSet("register-capability-id-property", flag.ContinueOnError)
+	name := flags.String("name", "capabilityRootId", "name of the property, without the extension_<app ID>_ prefix Graph adds")
+	positional, err := parseArgs(flags, args)
+	if err != nil {
+		return exitUsage
+	}
+	if len(positional) > 0 {
+		fmt.Fprintln(os.Stderr, "register-capability-id-property takes no arguments")
+		return exitUsage
+	}
+
+	conf, cleanup, err := initCommand(nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	defer cleanup()
+
+	property, err := handler.RegisterCapabilityIdProperty(context.Background(), conf, *name)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+
+	fmt.Printf("Registered %s, set azure.capabilityIdProperty (AAS_AZURE_CAPABILITYIDPROPERTY) to it\n", property)
+	return exitOk
+}
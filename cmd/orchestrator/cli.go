@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"go.dfds.cloud/aad-aws-sync/internal/audit"
+	"go.dfds.cloud/aad-aws-sync/internal/config"
+	"go.dfds.cloud/aad-aws-sync/internal/k8s"
+	"go.dfds.cloud/aad-aws-sync/internal/store"
+	"go.dfds.cloud/aad-aws-sync/internal/util"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Exit codes of the commands.
+const (
+	exitOk      = 0
+	exitFailure = 1
+	exitUsage   = 2
+)
+
+type command struct {
+	usage       string
+	description string
+	run         func(args []string) int
+}
+
+// commands are the subcommands of the binary. Without a subcommand it serves, as it always has.
+var commands = map[string]command{
+	"serve":                           {"serve", "run scheduled jobs, event handling and the API", serveCommand},
+	"run":                             {"run <job> [-dry-run] [-capability rootId] [-json]", "run a job once, or sync a single Capability", runCommand},
+	"plan":                            {"plan [-json]", "dry-run all enabled jobs and print the changes they would make", planCommand},
+	"status":                          {"status <rootId> [-json]", "report the discrepancies of a Capability across all systems", statusCommand},
+	"duplicates":                      {"duplicates [-limit n] [-json]", "print the latest reports of duplicated Capability groups", duplicatesCommand},
+	"events":                          {"events consume|replay [-id id] [-json]", "consume events, or replay the failed events of the webhook", eventsCommand},
+	"validate-config":                 {"validate-config [-file config.yaml] [-json]", "validate the config", validateConfigCommand},
+	"register-capability-id-property": {"register-capability-id-property [-name name]", "register the group property Capability groups are bound with", registerCapabilityIdPropertyCommand},
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: orchestrator <command> [arguments]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-50s %s\n", commands[name].usage, commands[name].description)
+	}
+}
+
+// parseArgs parses flags anywhere in args, not just before the positional arguments, so both
+// "run aws2K8s -dry-run" and "run -dry-run aws2K8s" work. It returns the positional arguments.
+func parseArgs(flags *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// printResult prints v as indented JSON, or as text using printText.
+func printResult(asJson bool, v any, printText func()) {
+	if !asJson {
+		printText()
+		return
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	_ = encoder.Encode(v)
+}
+
+// initCommand sets up what the handlers expect for commands that talk to downstream systems: the logger, a valid
+// config, the state store and the audit sink. Logs go to stderr, so they don't mix with the output of the command.
+// jobs returns the names of the jobs the command runs, whose settings are validated; nil for none. The returned
+// function releases the state store and the audit sink.
+func initCommand(jobs func(conf config.Config) []string) (config.Config, func(), error) {
+	util.InitializeLogger()
+
+	conf, err := config.LoadConfig()
+	if err != nil {
+		return conf, nil, err
+	}
+
+	var names []string
+	if jobs != nil {
+		names = jobs(conf)
+	}
+	if errs := config.Errors(config.Validate(conf, jobRequirements(names))); len(errs) > 0 {
+		for _, problem := range errs {
+			fmt.Fprintln(os.Stderr, problem)
+		}
+		return conf, nil, fmt.Errorf("invalid config, see validate-config")
+	}
+
+	stateStore, err := store.Open(conf.StateStore.Backend, conf.StateStore.Path)
+	if err != nil {
+		return conf, nil, fmt.Errorf("unable to open state store: %w", err)
+	}
+	store.SetDefault(stateStore)
+
+	auditSink, err := audit.Open(conf.Audit.Sink, conf.AuditFilePath())
+	if err != nil {
+		stateStore.Close()
+		return conf, nil, fmt.Errorf("unable to open audit sink: %w", err)
+	}
+	audit.SetDefault(auditSink)
+
+	return conf, func() {
+		auditSink.Close()
+		stateStore.Close()
+	}, nil
+}
+
+// requireNoLeader refuses to change downstream systems from the command line while an instance of the service holds
+// the leader election Lease, as its jobs and event handlers would race the command. Trigger jobs through the API of
+// the leader instead. Without leader election there is nothing to check.
+func requireNoLeader(ctx context.Context, conf config.Config) error {
+	if !conf.LeaderElection.Enabled {
+		return nil
+	}
+
+	client, err := k8s.GetK8sClient()
+	if err != nil {
+		return fmt.Errorf("unable to create Kubernetes client to check for a leader: %w", err)
+	}
+
+	return requireNoLeaderIn(ctx, conf, client)
+}
+
+func requireNoLeaderIn(ctx context.Context, conf config.Config, client kubernetes.Interface) error {
+	elector, err := k8s.NewLeaderElector(client, leaderElectionConfig(conf))
+	if err != nil {
+		return err
+	}
+
+	leader, err := elector.ActiveLeader(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to check for a leader: %w", err)
+	}
+	if leader != "" {
+		return fmt.Errorf("instance %s is the leader, use its API instead, e.g. POST /api/v1/jobs/<name>/runs", leader)
+	}
+
+	return nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.dfds.cloud/aad-aws-sync/internal/audit"
+	"go.dfds.cloud/aad-aws-sync/internal/config"
+	"go.dfds.cloud/aad-aws-sync/internal/jobs"
+	"go.dfds.cloud/aad-aws-sync/internal/store"
+	"go.dfds.cloud/aad-aws-sync/internal/util"
+	"go.uber.org/zap"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestParseArgs(t *testing.T) {
+	for _, args := range [][]string{
+		{"aws2K8s", "-dry-run"},
+		{"-dry-run", "aws2K8s"},
+	} {
+		flags := flag.NewFlagSet("run", flag.ContinueOnError)
+		dryRun := flags.Bool("dry-run", false, "")
+		positional, err := parseArgs(flags, args)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"aws2K8s"}, positional)
+		assert.True(t, *dryRun)
+	}
+
+	flags := flag.NewFlagSet("run", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	_, err := parseArgs(flags, []string{"aws2K8s", "-unknown"})
+	assert.Error(t, err)
+}
+
+func TestCommandUsageErrors(t *testing.T) {
+	for name, exitCode := range map[string]int{
+		"run with two jobs":           runCommand([]string{"aws2K8s", "awsMapping"}),
+		"run with an unknown job":     runCommand([]string{"unknownJob"}),
+		"run without a job":           runCommand(nil),
+		"run -capability with a job":  runCommand([]string{"aws2K8s", "-capability", "sandbox-abcde"}),
+		"plan with arguments":         planCommand([]string{"aws2K8s"}),
+		"events without a subcommand": eventsCommand(nil),
+		"events with an unknown one":  eventsCommand([]string{"produce"}),
+		"serve with arguments":        serveCommand([]string{"now"}),
+	} {
+		assert.Equal(t, exitUsage, exitCode, name)
+	}
+
+	// The settings of the job are validated before it runs
+	assert.Equal(t, exitFailure, runCommand([]string{"aws2K8s"}))
+}
+
+func TestValidateConfigCommand(t *testing.T) {
+	valid := filepath.Join(t.TempDir(), "valid.yaml")
+	assert.NoError(t, os.WriteFile(valid, []byte("tracing:\n  enable: false\n"), 0600))
+	assert.Equal(t, exitOk, validateConfigCommand([]string{"-file", valid}))
+
+	invalid := filepath.Join(t.TempDir(), "invalid.yaml")
+	assert.NoError(t, os.WriteFile(invalid, []byte("scheduler:\n  job:\n    aws2K8s:\n      enable: true\n"), 0600))
+	assert.Equal(t, exitFailure, validateConfigCommand([]string{"-file", invalid}))
+
+	assert.Equal(t, exitFailure, validateConfigCommand([]string{"-file", filepath.Join(t.TempDir(), "missing.yaml")}))
+	assert.Equal(t, exitUsage, validateConfigCommand([]string{"-unknown"}))
+}
+
+func TestRequireNoLeader(t *testing.T) {
+	var conf config.Config
+	assert.NoError(t, requireNoLeader(context.Background(), conf))
+
+	conf.LeaderElection.Enabled = true
+	conf.LeaderElection.LeaseName = "aad-aws-sync"
+	conf.LeaderElection.LeaseNamespace = "default"
+	conf.LeaderElection.Identity = "cli"
+	client := fake.NewSimpleClientset()
+	assert.NoError(t, requireNoLeaderIn(context.Background(), conf, client))
+
+	holder := "aad-aws-sync-0"
+	duration := int32(15)
+	_, err := client.CoordinationV1().Leases("default").Create(context.Background(), &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{Name: "aad-aws-sync", Namespace: "default"},
+		Spec: coordinationv1.LeaseSpec{
+			HolderIdentity:       &holder,
+			LeaseDurationSeconds: &duration,
+			RenewTime:            &metav1.MicroTime{Time: time.Now()},
+		},
+	}, metav1.CreateOptions{})
+	assert.NoError(t, err)
+	assert.ErrorContains(t, requireNoLeaderIn(context.Background(), conf, client), "instance aad-aws-sync-0 is the leader")
+}
+
+func TestRunJob(t *testing.T) {
+	util.Logger = zap.NewNop()
+	defer store.SetDefault(store.Default())
+	st := store.NewMemoryStore()
+	store.SetDefault(st)
+
+	var conf config.Config
+	conf.Jobs.HistorySize = 10
+	conf.StateStore.RunRetention = 10
+
+	var actor audit.Actor
+	job := func(ctx context.Context) error {
+		actor = audit.ActorFromContext(ctx)
+		jobs.CountMutation(ctx, "aadGroupCreated")
+		return errors.New("downstream error")
+	}
+
+	result := runJob(context.Background(), conf, "testJob", job, false)
+	assert.Equal(t, jobs.RunStatusFailed, result.Status)
+	assert.Equal(t, "downstream error", result.Error)
+	assert.Equal(t, map[string]int{"aadGroupCreated": 1}, result.Mutations)
+	assert.Equal(t, audit.Actor{Kind: audit.ActorKindCli, Name: "testJob", RunId: result.RunId}, actor)
+
+	// The run is persisted like those of the service, dry runs aren't
+	countRuns := func() int {
+		count := 0
+		assert.NoError(t, st.List(store.BucketRuns, "testJob/", func(key string, value []byte) error {
+			count++
+			return nil
+		}))
+		return count
+	}
+	assert.Equal(t, 1, countRuns())
+
+	result = runJob(context.Background(), conf, "testJob", func(ctx context.Context) error { return nil }, true)
+	assert.Equal(t, jobs.RunStatusSucceeded, result.Status)
+	assert.True(t, result.DryRun)
+	assert.Equal(t, 1, countRuns())
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"go.dfds.cloud/aad-aws-sync/internal/config"
+	"go.dfds.cloud/aad-aws-sync/internal/handler"
+	"go.dfds.cloud/aad-aws-sync/internal/k8s"
+)
+
+// jobConfigPrefix is the prefix of the environment variables the Orchestrator loads the schedules of the jobs from,
+// e.g. AAS_SCHEDULER_JOB_CAPSVC2AAD_ENABLE. They match those of config.JobSchedules.
+const jobConfigPrefix = "AAS_SCHEDULER_JOB"
+
+var scheduledJobs = []struct {
+	name    string
+	handler func(ctx context.Context) error
+	// requires are the settings the job needs, see config.Validate
+	requires []config.Requirement
+}{
+	{handler.CapabilityServiceToAzureAdName, handler.Capsvc2AadHandler, []config.Requirement{config.RequireAzure, config.RequireCapSvc}},
+	{handler.AzureAdToAwsName, handler.Azure2AwsHandler, []config.Requirement{config.RequireAzure, config.RequireAzureApplication, config.RequireCapSvc}},
+	{handler.AwsMappingName, handler.AwsMappingHandler, []config.Requirement{config.RequireAwsMapping}},
+	{handler.AwsToKubernetesName, handler.Aws2K8sHandler, []config.Requirement{config.RequireAws2K8s}},
+	{handler.CapabilityEmailAliasName, handler.CapabilityEmailAliasHandler, []config.Requirement{config.RequireAzure, config.RequireCapSvc, config.RequireExchange}},
+	{handler.AssignGroupsToAzureEnterpriseAppsName, handler.AssignGroupsToAzureEnterpriseAppsHandler, []config.Requirement{config.RequireAzure, config.RequireEnterpriseAppMappings}},
+}
+
+// enabledJobs returns the names of the jobs enabled in the config.
+func enabledJobs(conf config.Config) []string {
+	var names []string
+	for _, job := range scheduledJobs {
+		if schedule, _ := conf.Scheduler.Job.Get(job.name); schedule.Enable {
+			names = append(names, job.name)
+		}
+	}
+
+	return names
+}
+
+// jobRequirements returns the settings needed by the jobs. Unknown job names are ignored.
+func jobRequirements(names []string) []config.Requirement {
+	var requirements []config.Requirement
+	for _, job := range scheduledJobs {
+		for _, name := range names {
+			if job.name == name {
+				requirements = append(requirements, job.requires...)
+			}
+		}
+	}
+
+	return requirements
+}
+
+func leaderElectionConfig(conf config.Config) k8s.LeaderElectionConfig {
+	return k8s.LeaderElectionConfig{
+		LeaseName:      conf.LeaderElection.LeaseName,
+		LeaseNamespace: conf.LeaderElection.LeaseNamespace,
+		Identity:       conf.LeaderElection.Identity,
+		LeaseDuration:  conf.LeaderElection.LeaseDuration,
+		RenewDeadline:  conf.LeaderElection.RenewDeadline,
+		RetryPeriod:    conf.LeaderElection.RetryPeriod,
+		PodLabel:       conf.LeaderElection.PodLabel,
+	}
+}
+
+// validateConfigCommand loads and validates the config like the orchestrator does on startup, and prints the
+// problems found. It returns the exit code: 0 if the config is valid, 1 if it isn't, and 2 on usage errors.
+//
+//	orchestrator validate-config [-file config.yaml] [-json]
+func validateConfigCommand(args []string) int {
+	flags := flag.NewFlagSet("validate-config", flag.ContinueOnError)
+	file := flags.String("file", os.Getenv(config.CONF_FILE_ENV), "YAML or JSON config file, defaults to "+config.CONF_FILE_ENV)
+	asJson := flags.Bool("json", false, "print the problems as JSON")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	conf, warnings, err := config.LoadFile(*file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	problems := append(warnings, config.Validate(conf, jobRequirements(enabledJobs(conf)))...)
+	if problems == nil {
+		problems = []config.Problem{}
+	}
+
+	if *asJson {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		_ = encoder.Encode(problems)
+	} else {
+		for _, problem := range problems {
+			fmt.Println(problem)
+		}
+	}
+
+	if len(config.Errors(problems)) > 0 {
+		return 1
+	}
+	if !*asJson {
+		fmt.Println("Config is valid")
+	}
+
+	return 0
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.dfds.cloud/aad-aws-sync/internal/config"
+)
+
+func TestScheduledJobsHaveSchedules(t *testing.T) {
+	var conf config.Config
+	for _, job := range scheduledJobs {
+		_, exists := conf.Scheduler.Job.Get(job.name)
+		assert.True(t, exists, "job %s has no schedule in config.JobSchedules", job.name)
+	}
+}
+
+func TestEnabledJobs(t *testing.T) {
+	var conf config.Config
+	assert.Empty(t, enabledJobs(conf))
+
+	conf.Scheduler.Job.AwsMapping.Enable = true
+	conf.Scheduler.Job.CapSvc2Aad.Enable = true
+	assert.Equal(t, []string{"capSvc2Aad", "awsMapping"}, enabledJobs(conf))
+
+	assert.Equal(t, []config.Requirement{config.RequireAzure, config.RequireCapSvc, config.RequireAwsMapping}, jobRequirements(enabledJobs(conf)))
+	assert.Empty(t, jobRequirements([]string{"unknownJob"}))
+}
@@ -15,19 +15,71 @@ const docTemplate = `{
     "host": "{{.Host}}",
     "basePath": "{{.BasePath}}",
     "paths": {
-        "/aws2k8s": {
+        "/capabilities/{rootId}/status": {
+            "get": {
+                "description": "Reads the state of a Capability in Capability-Service, AAD, the enterprise app assignments, the AWS Identity Store, SSO, aws-auth and Exchange Online without changing anything, and reports every discrepancy between them. Systems that could not be read are listed in errors.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "capabilities"
+                ],
+                "summary": "Get the status of a Capability",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Capability root ID",
+                        "name": "rootId",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/handler.CapabilityStatus"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found"
+                    }
+                }
+            }
+        },
+        "/capabilities/{rootId}/sync": {
             "post": {
-                "description": "Triggers a run of the AWS2K8s Job and returns success",
+                "security": [
+                    {
+                        "BearerToken": []
+                    }
+                ],
+                "description": "Runs the whole pipeline for a single Capability: AAD group and members, enterprise app assignment, SSO permission set assignment, shared role assignments, aws-auth mapping and email aliases. Returns the result of each step, and responds with 500 if any step failed. Responds with 409 while the capSvc2Aad job is running, which syncs the AAD groups of all Capabilities.",
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
-                    "aws2k8s"
+                    "capabilities"
+                ],
+                "summary": "Sync a single Capability",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Capability root ID",
+                        "name": "rootId",
+                        "in": "path",
+                        "required": true
+                    }
                 ],
-                "summary": "Trigger a run of the AWS2K8s Job",
                 "responses": {
-                    "201": {
-                        "description": "Created"
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/handler.CapabilitySyncResult"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized"
                     },
                     "404": {
                         "description": "Not Found"
@@ -36,50 +88,157 @@ const docTemplate = `{
                         "description": "Conflict"
                     },
                     "500": {
-                        "description": "Internal Server Error"
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/handler.CapabilitySyncResult"
+                        }
+                    },
+                    "503": {
+                        "description": "Service Unavailable"
                     }
                 }
             }
         },
-        "/awsmapping": {
+        "/events": {
             "post": {
-                "description": "Triggers a run of the AwsMapping Job and returns success",
+                "security": [
+                    {
+                        "BearerToken": []
+                    }
+                ],
+                "description": "Accepts the same event envelope as the Kafka topic and runs its event handler synchronously. Events whose handler fails are kept in the failed event store. Events with a message ID that was handled before are skipped.",
+                "consumes": [
+                    "application/json"
+                ],
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
-                    "awsmapping"
+                    "events"
                 ],
-                "summary": "Trigger a run of the AwsMapping Job",
+                "summary": "Deliver an event",
                 "responses": {
-                    "201": {
-                        "description": "Created"
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/event.WebhookResponse"
+                        }
                     },
-                    "404": {
-                        "description": "Not Found"
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/event.WebhookResponse"
+                        }
                     },
-                    "409": {
-                        "description": "Conflict"
+                    "401": {
+                        "description": "Unauthorized"
+                    },
+                    "413": {
+                        "description": "Request Entity Too Large",
+                        "schema": {
+                            "$ref": "#/definitions/event.WebhookResponse"
+                        }
                     },
                     "500": {
-                        "description": "Internal Server Error"
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/event.WebhookResponse"
+                        }
+                    },
+                    "503": {
+                        "description": "Service Unavailable"
                     }
                 }
             }
         },
-        "/azure2aws": {
+        "/jobs": {
+            "get": {
+                "description": "Lists all jobs with their schedule, current status and most recent runs",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "jobs"
+                ],
+                "summary": "List jobs",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/jobs.Job"
+                            }
+                        }
+                    }
+                }
+            }
+        },
+        "/jobs/{name}": {
+            "get": {
+                "description": "Returns the schedule, current status and most recent runs of a job",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "jobs"
+                ],
+                "summary": "Get a job",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Job name",
+                        "name": "name",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/jobs.Job"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found"
+                    }
+                }
+            }
+        },
+        "/jobs/{name}/cancel": {
             "post": {
-                "description": "Triggers a run of the Azure2AWS Job and returns success",
+                "security": [
+                    {
+                        "BearerToken": []
+                    }
+                ],
+                "description": "Cancels the current run of a job and returns the ID of the cancelled run",
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
-                    "azure2aws"
+                    "jobs"
+                ],
+                "summary": "Cancel a running job",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Job name",
+                        "name": "name",
+                        "in": "path",
+                        "required": true
+                    }
                 ],
-                "summary": "Trigger a run of the Azure2AWS Job",
                 "responses": {
-                    "201": {
-                        "description": "Created"
+                    "202": {
+                        "description": "Accepted",
+                        "schema": {
+                            "$ref": "#/definitions/main.triggerJobResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized"
                     },
                     "404": {
                         "description": "Not Found"
@@ -87,25 +246,45 @@ const docTemplate = `{
                     "409": {
                         "description": "Conflict"
                     },
-                    "500": {
-                        "description": "Internal Server Error"
+                    "503": {
+                        "description": "Service Unavailable"
                     }
                 }
             }
         },
-        "/capsvc2azure": {
+        "/jobs/{name}/runs": {
             "post": {
-                "description": "Triggers a run of the CapSvc2Azure Job and returns success",
+                "security": [
+                    {
+                        "BearerToken": []
+                    }
+                ],
+                "description": "Starts a run of a job outside its schedule and returns the ID of the run",
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
-                    "capsvc2azure"
+                    "jobs"
+                ],
+                "summary": "Trigger a run of a job",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Job name",
+                        "name": "name",
+                        "in": "path",
+                        "required": true
+                    }
                 ],
-                "summary": "Trigger a run of the CapSvc2Azure Job",
                 "responses": {
-                    "201": {
-                        "description": "Created"
+                    "202": {
+                        "description": "Accepted",
+                        "schema": {
+                            "$ref": "#/definitions/main.triggerJobResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized"
                     },
                     "404": {
                         "description": "Not Found"
@@ -113,12 +292,443 @@ const docTemplate = `{
                     "409": {
                         "description": "Conflict"
                     },
-                    "500": {
-                        "description": "Internal Server Error"
+                    "503": {
+                        "description": "Service Unavailable"
+                    }
+                }
+            }
+        },
+        "/jobs/{name}/runs/{runId}": {
+            "get": {
+                "description": "Returns a run of a job, either in progress or from the run history. Responds with 503 on a standby for runs it doesn't know of, as only the leader can read the run history.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "jobs"
+                ],
+                "summary": "Get a run of a job",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Job name",
+                        "name": "name",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Run ID",
+                        "name": "runId",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/jobs.Run"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found"
+                    },
+                    "503": {
+                        "description": "Service Unavailable"
                     }
                 }
             }
         }
+    },
+    "definitions": {
+        "capsvc.GetCapabilitiesResponseContext": {
+            "type": "object",
+            "properties": {
+                "awsAccountId": {
+                    "type": "string"
+                },
+                "awsRoleArn": {
+                    "type": "string"
+                },
+                "awsRoleEmail": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "string"
+                },
+                "name": {
+                    "type": "string"
+                }
+            }
+        },
+        "event.WebhookResponse": {
+            "type": "object",
+            "properties": {
+                "error": {
+                    "type": "string"
+                },
+                "failedEventId": {
+                    "type": "string"
+                },
+                "messageId": {
+                    "type": "string"
+                },
+                "reason": {
+                    "type": "string"
+                },
+                "status": {
+                    "type": "string"
+                },
+                "type": {
+                    "type": "string"
+                }
+            }
+        },
+        "handler.AppAssignmentStatus": {
+            "type": "object",
+            "properties": {
+                "appId": {
+                    "type": "string"
+                },
+                "assigned": {
+                    "type": "boolean"
+                }
+            }
+        },
+        "handler.CapabilityServiceStatus": {
+            "type": "object",
+            "properties": {
+                "contexts": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/capsvc.GetCapabilitiesResponseContext"
+                    }
+                },
+                "members": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                }
+            }
+        },
+        "handler.CapabilityStatus": {
+            "type": "object",
+            "properties": {
+                "aadGroup": {
+                    "$ref": "#/definitions/handler.GroupStatus"
+                },
+                "appAssignments": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/handler.AppAssignmentStatus"
+                    }
+                },
+                "awsAuthMapping": {
+                    "$ref": "#/definitions/k8s.RoleMapping"
+                },
+                "capabilityService": {
+                    "$ref": "#/definitions/handler.CapabilityServiceStatus"
+                },
+                "discrepancies": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/handler.Discrepancy"
+                    }
+                },
+                "emailAliases": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/handler.EmailAliasStatus"
+                    }
+                },
+                "errors": {
+                    "description": "Errors lists the systems that could not be read, and which therefore may have discrepancies not reported.",
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/handler.Discrepancy"
+                    }
+                },
+                "identityStoreGroup": {
+                    "$ref": "#/definitions/handler.GroupStatus"
+                },
+                "inSync": {
+                    "type": "boolean"
+                },
+                "rootId": {
+                    "type": "string"
+                },
+                "ssoAssignments": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/handler.SsoAssignmentStatus"
+                    }
+                },
+                "unresolvedMembers": {
+                    "description": "UnresolvedMembers are the external members of the Capability not found in AAD",
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/handler.UnresolvedMember"
+                    }
+                }
+            }
+        },
+        "handler.CapabilitySyncResult": {
+            "type": "object",
+            "properties": {
+                "rootId": {
+                    "type": "string"
+                },
+                "runId": {
+                    "description": "RunId identifies the sync in the audit log",
+                    "type": "string"
+                },
+                "steps": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/handler.SyncStepResult"
+                    }
+                }
+            }
+        },
+        "handler.Discrepancy": {
+            "type": "object",
+            "properties": {
+                "message": {
+                    "type": "string"
+                },
+                "system": {
+                    "type": "string"
+                }
+            }
+        },
+        "handler.EmailAliasStatus": {
+            "type": "object",
+            "properties": {
+                "displayName": {
+                    "type": "string"
+                },
+                "email": {
+                    "type": "string"
+                },
+                "exists": {
+                    "type": "boolean"
+                },
+                "members": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                }
+            }
+        },
+        "handler.GroupStatus": {
+            "type": "object",
+            "properties": {
+                "displayName": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "string"
+                },
+                "members": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                }
+            }
+        },
+        "handler.GuestInvitation": {
+            "type": "object",
+            "properties": {
+                "email": {
+                    "type": "string"
+                },
+                "invitedAt": {
+                    "type": "string"
+                },
+                "redeemedAt": {
+                    "type": "string"
+                },
+                "rootId": {
+                    "description": "RootId is the Capability the member was first invited for",
+                    "type": "string"
+                },
+                "status": {
+                    "type": "string"
+                },
+                "userId": {
+                    "description": "UserId is the object ID of the guest user created by the invitation",
+                    "type": "string"
+                }
+            }
+        },
+        "handler.SsoAssignmentStatus": {
+            "type": "object",
+            "properties": {
+                "accountId": {
+                    "type": "string"
+                },
+                "assigned": {
+                    "type": "boolean"
+                },
+                "name": {
+                    "type": "string"
+                },
+                "permissionSetArn": {
+                    "type": "string"
+                }
+            }
+        },
+        "handler.SyncStepResult": {
+            "type": "object",
+            "properties": {
+                "message": {
+                    "type": "string"
+                },
+                "mutations": {
+                    "type": "object",
+                    "additionalProperties": {
+                        "type": "integer"
+                    }
+                },
+                "status": {
+                    "type": "string"
+                },
+                "step": {
+                    "type": "string"
+                }
+            }
+        },
+        "handler.UnresolvedMember": {
+            "type": "object",
+            "properties": {
+                "email": {
+                    "type": "string"
+                },
+                "invitation": {
+                    "$ref": "#/definitions/handler.GuestInvitation"
+                },
+                "invitationUnknown": {
+                    "description": "InvitationUnknown is set if the invitations can't be read, e.g. on a standby, which doesn't have the state store\nopen",
+                    "type": "boolean"
+                }
+            }
+        },
+        "jobs.Job": {
+            "type": "object",
+            "properties": {
+                "currentRun": {
+                    "$ref": "#/definitions/jobs.Run"
+                },
+                "enabled": {
+                    "type": "boolean"
+                },
+                "inProgress": {
+                    "type": "boolean"
+                },
+                "interval": {
+                    "type": "string"
+                },
+                "name": {
+                    "type": "string"
+                },
+                "runs": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/jobs.Run"
+                    }
+                },
+                "runsUnavailable": {
+                    "description": "RunsUnavailable is set if the run history can't be read, e.g. on a standby, which doesn't have the state store\nopen. Runs is empty then.",
+                    "type": "boolean"
+                }
+            }
+        },
+        "jobs.Run": {
+            "type": "object",
+            "properties": {
+                "durationSeconds": {
+                    "type": "number"
+                },
+                "endedAt": {
+                    "type": "string"
+                },
+                "error": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "string"
+                },
+                "job": {
+                    "type": "string"
+                },
+                "mutations": {
+                    "type": "object",
+                    "additionalProperties": {
+                        "type": "integer"
+                    }
+                },
+                "startedAt": {
+                    "type": "string"
+                },
+                "status": {
+                    "type": "string"
+                },
+                "trigger": {
+                    "type": "string"
+                }
+            }
+        },
+        "k8s.RoleMapping": {
+            "type": "object",
+            "properties": {
+                "createdat": {
+                    "description": "CreatedAt  is a custom field(not part of the original spec)",
+                    "type": "string"
+                },
+                "groups": {
+                    "description": "Groups is a list of Kubernetes groups this role will authenticate\nas (e.g., ` + "`" + `system:masters` + "`" + `). Each group name can include placeholders.",
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "lastupdated": {
+                    "description": "LastUpdated is a custom field(not part of the original spec)",
+                    "type": "string"
+                },
+                "managedby": {
+                    "description": "ManagedBy is a custom field(not part of the original spec) that is used for detecting objects managed by aad-aws-sync",
+                    "type": "string"
+                },
+                "rolearn": {
+                    "description": "RoleARN is the AWS Resource Name of the role. (e.g., \"arn:aws:iam::000000000000:role/Foo\").",
+                    "type": "string"
+                },
+                "username": {
+                    "description": "Username is the username pattern that this instances assuming this\nrole will have in Kubernetes.",
+                    "type": "string"
+                }
+            }
+        },
+        "main.triggerJobResponse": {
+            "type": "object",
+            "properties": {
+                "runId": {
+                    "type": "string"
+                }
+            }
+        }
+    },
+    "securityDefinitions": {
+        "BearerToken": {
+            "type": "apiKey",
+            "name": "Authorization",
+            "in": "header"
+        }
     }
 }`
 
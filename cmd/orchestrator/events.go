@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"go.dfds.cloud/aad-aws-sync/internal/event"
+	"go.dfds.cloud/aad-aws-sync/internal/tracing"
+)
+
+// eventsCommand consumes events from Kafka until interrupted, or replays the failed events the webhook stored. Events
+// are handled the same way the server does. It refuses to while an instance of the service leads, see requireNoLeader.
+//
+//	orchestrator events consume
+//	orchestrator events replay [-id id] [-json]
+func eventsCommand(args []string) int {
+	flags := flag.NewFlagSet("events", flag.ContinueOnError)
+	id := flags.String("id", "", "replay only the failed event with this ID")
+	asJson := flags.Bool("json", false, "print the replayed events as JSON")
+	positional, err := parseArgs(flags, args)
+	if err != nil {
+		return exitUsage
+	}
+	if len(positional) != 1 || (positional[0] != "consume" && positional[0] != "replay") {
+		fmt.Fprintln(os.Stderr, "events needs either consume or replay")
+		return exitUsage
+	}
+
+	conf, cleanup, err := initCommand(nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	defer cleanup()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := requireNoLeader(ctx, conf); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+
+	if conf.Tracing.Enabled {
+		shutdownTracing, err := tracing.Init(ctx, tracing.Config{
+			Endpoint:    conf.Tracing.Endpoint,
+			Insecure:    conf.Tracing.Insecure,
+			SampleRatio: conf.Tracing.SampleRatio,
+			ServiceName: conf.Tracing.ServiceName,
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "unable to set up tracing:", err)
+			return exitFailure
+		}
+		// Flushing pending spans outlives ctx, which is cancelled on shutdown
+		defer shutdownTracing(context.Background())
+	}
+
+	if positional[0] == "consume" {
+		wg := &sync.WaitGroup{}
+		err = event.StartEventHandlers(ctx, conf, wg)
+		wg.Wait()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitFailure
+		}
+		return exitOk
+	}
+
+	failedEventStore, err := event.NewFailedEventStore(conf.FailedEventsPath())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "unable to open failed event store:", err)
+		return exitFailure
+	}
+
+	results, err := failedEventStore.Replay(ctx, event.NewHandlerRegistry(), *id)
+	exitCode := exitOk
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		exitCode = exitFailure
+	}
+	for _, result := range results {
+		if result.Status == event.StatusFailed {
+			exitCode = exitFailure
+		}
+	}
+
+	printResult(*asJson, results, func() {
+		if len(results) == 0 && err == nil {
+			fmt.Println("No failed events")
+		}
+		for _, result := range results {
+			fmt.Printf("%s %s (%s): %s", result.ID, result.Type, result.MessageId, result.Status)
+			switch {
+			case result.Error != "":
+				fmt.Printf(", %s", result.Error)
+			case result.Reason != "":
+				fmt.Printf(", %s", result.Reason)
+			}
+			fmt.Println()
+		}
+	})
+
+	return exitCode
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/joomcode/errorx"
+	"go.dfds.cloud/aad-aws-sync/internal/jobs"
+	"go.dfds.cloud/aad-aws-sync/internal/middleware"
+)
+
+type triggerJobResponse struct {
+	RunId string `json:"runId"`
+}
+
+func jobErrorResponse(c *gin.Context, err error) {
+	switch {
+	case errorx.IsOfType(err, jobs.JobNotFound), errorx.IsOfType(err, jobs.RunNotFound):
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": err.Error()})
+	case errorx.IsOfType(err, jobs.JobInProgress), errorx.IsOfType(err, jobs.JobNotRunning):
+		c.IndentedJSON(http.StatusConflict, gin.H{"message": err.Error()})
+	case errorx.IsOfType(err, jobs.RunHistoryUnavailable):
+		c.IndentedJSON(http.StatusServiceUnavailable, gin.H{"message": err.Error()})
+	default:
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+	}
+}
+
+// ListJobs             godoc
+// @Summary      List jobs
+// @Description  Lists all jobs with their schedule, current status and most recent runs
+// @Tags         jobs
+// @Produce      json
+// @Success      200 {array} jobs.Job
+// @Router       /jobs [get]
+func listJobs(c *gin.Context) {
+	manager := middleware.GetJobManager(c)
+
+	c.IndentedJSON(http.StatusOK, manager.List())
+}
+
+// GetJob             godoc
+// @Summary      Get a job
+// @Description  Returns the schedule, current status and most recent runs of a job
+// @Tags         jobs
+// @Produce      json
+// @Param        name path string true "Job name"
+// @Success      200 {object} jobs.Job
+// @Failure      404
+// @Router       /jobs/{name} [get]
+func getJob(c *gin.Context) {
+	manager := middleware.GetJobManager(c)
+
+	job, err := manager.Get(c.Param("name"))
+	if err != nil {
+		jobErrorResponse(c, err)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, job)
+}
+
+// TriggerJob             godoc
+// @Summary      Trigger a run of a job
+// @Description  Starts a run of a job outside its schedule and returns the ID of the run
+// @Tags         jobs
+// @Produce      json
+// @Security     BearerToken
+// @Param        name path string true "Job name"
+// @Success      202 {object} triggerJobResponse
+// @Failure      401
+// @Failure      404
+// @Failure      409
+// @Failure      503
+// @Router       /jobs/{name}/runs [post]
+func triggerJob(c *gin.Context) {
+	manager := middleware.GetJobManager(c)
+
+	runId, err := manager.Trigger(c.Param("name"))
+	if err != nil {
+		jobErrorResponse(c, err)
+		return
+	}
+
+	c.IndentedJSON(http.StatusAccepted, triggerJobResponse{RunId: runId})
+}
+
+// GetJobRun             godoc
+// @Summary      Get a run of a job
+// @Description  Returns a run of a job, either in progress or from the run history. Responds with 503 on a standby for runs it doesn't know of, as only the leader can read the run history.
+// @Tags         jobs
+// @Produce      json
+// @Param        name path string true "Job name"
+// @Param        runId path string true "Run ID"
+// @Success      200 {object} jobs.Run
+// @Failure      404
+// @Failure      503
+// @Router       /jobs/{name}/runs/{runId} [get]
+func getJobRun(c *gin.Context) {
+	manager := middleware.GetJobManager(c)
+
+	run, err := manager.GetRun(c.Param("name"), c.Param("runId"))
+	if err != nil {
+		jobErrorResponse(c, err)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, run)
+}
+
+// CancelJob             godoc
+// @Summary      Cancel a running job
+// @Description  Cancels the current run of a job and returns the ID of the cancelled run
+// @Tags         jobs
+// @Produce      json
+// @Security     BearerToken
+// @Param        name path string true "Job name"
+// @Success      202 {object} triggerJobResponse
+// @Failure      401
+// @Failure      404
+// @Failure      409
+// @Failure      503
+// @Router       /jobs/{name}/cancel [post]
+func cancelJob(c *gin.Context) {
+	manager := middleware.GetJobManager(c)
+
+	runId, err := manager.Cancel(c.Param("name"))
+	if err != nil {
+		jobErrorResponse(c, err)
+		return
+	}
+
+	c.IndentedJSON(http.StatusAccepted, triggerJobResponse{RunId: runId})
+}
@@ -2,8 +2,13 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"go.dfds.cloud/aad-aws-sync/internal/audit"
 	"go.dfds.cloud/aad-aws-sync/internal/event"
-	"go.dfds.cloud/aad-aws-sync/internal/handler"
+	"go.dfds.cloud/aad-aws-sync/internal/jobs"
+	"go.dfds.cloud/aad-aws-sync/internal/k8s"
+	"go.dfds.cloud/aad-aws-sync/internal/store"
+	"go.dfds.cloud/aad-aws-sync/internal/tracing"
 	"go.uber.org/zap"
 	"log"
 	"net/http"
@@ -22,6 +27,7 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-co-op/gocron"
+	"github.com/joomcode/errorx"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	swaggerFiles "github.com/swaggo/files"
 	ginSwagger "github.com/swaggo/gin-swagger"
@@ -40,108 +46,70 @@ func metricsHandler() gin.HandlerFunc {
 	}
 }
 
-// PostAzure2Aws             godoc
-// @Summary      Trigger a run of the Azure2AWS Job
-// @Description  Triggers a run of the Azure2AWS Job and returns success
-// @Tags         azure2aws
-// @Produce      json
-// @Success      201
-// @Failure      404
-// @Failure      409
-// @Failure      500
-// @Router       /azure2aws [post]
-func runAzure2Aws(c *gin.Context) {
-	orc := middleware.GetOrchestrator(c)
-
-	if orc.Jobs["aadToAws"] != nil {
-		if !orc.Jobs["aadToAws"].Status.InProgress() {
-			orc.Jobs["aadToAws"].Run()
-			c.IndentedJSON(http.StatusCreated, gin.H{"message": "job created"})
-		} else {
-			c.IndentedJSON(http.StatusConflict, gin.H{"message": "job in progress"})
+// openLeaderStateStore opens the state store shared by all instances. The previous leader may not have closed it yet,
+// as it lets its running jobs finish first, so opening it is retried until ctx is cancelled.
+func openLeaderStateStore(ctx context.Context, conf config.Config) (store.Store, error) {
+	for {
+		stateStore, err := store.Open(conf.StateStore.Backend, conf.StateStore.Path)
+		if !errorx.IsOfType(err, store.Locked) {
+			return stateStore, err
 		}
-	} else {
-		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "job not found"})
-	}
-}
 
-// PostAws2K8s             godoc
-// @Summary      Trigger a run of the AWS2K8s Job
-// @Description  Triggers a run of the AWS2K8s Job and returns success
-// @Tags         aws2k8s
-// @Produce      json
-// @Success      201
-// @Failure      404
-// @Failure      409
-// @Failure      500
-// @Router       /aws2k8s [post]
-func runAws2K8s(c *gin.Context) {
-	orc := middleware.GetOrchestrator(c)
-
-	if orc.Jobs["awsToK8s"] != nil {
-		if !orc.Jobs["awsToK8s"].Status.InProgress() {
-			orc.Jobs["awsToK8s"].Run()
-			c.IndentedJSON(http.StatusCreated, gin.H{"message": "job created"})
-		} else {
-			c.IndentedJSON(http.StatusConflict, gin.H{"message": "job in progress"})
+		util.Logger.Info("State store is still open in another instance, waiting", zap.Error(err))
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
 		}
-	} else {
-		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "job not found"})
 	}
 }
 
-// AwsMapping             godoc
-// @Summary      Trigger a run of the AwsMapping Job
-// @Description  Triggers a run of the AwsMapping Job and returns success
-// @Tags         awsmapping
-// @Produce      json
-// @Success      201
-// @Failure      404
-// @Failure      409
-// @Failure      500
-// @Router       /awsmapping [post]
-func runAwsMapping(c *gin.Context) {
-	orc := middleware.GetOrchestrator(c)
-
-	if orc.Jobs["awsMapping"] != nil {
-		if !orc.Jobs["awsMapping"].Status.InProgress() {
-			orc.Jobs["awsMapping"].Run()
-			c.IndentedJSON(http.StatusCreated, gin.H{"message": "job created"})
-		} else {
-			c.IndentedJSON(http.StatusConflict, gin.H{"message": "job in progress"})
+// addApiRoutes adds the routes of the jobs and Capabilities API. Standbys serve the read-only routes, and report what
+// they can't read without the state store as unavailable. The routes that change anything need the API token, and are
+// only served by the leader.
+func addApiRoutes(v1 *gin.RouterGroup, conf config.Config, isLeader func() bool) {
+	requireToken := middleware.RequireBearerToken(conf.Api.Token)
+	leaderOnly := middleware.RequireLeader(isLeader)
+	v1.GET("/jobs", listJobs)
+	v1.GET("/jobs/:name", getJob)
+	v1.POST("/jobs/:name/runs", requireToken, leaderOnly, triggerJob)
+	v1.GET("/jobs/:name/runs/:runId", getJobRun)
+	v1.POST("/jobs/:name/cancel", requireToken, leaderOnly, cancelJob)
+	v1.POST("/capabilities/:rootId/sync", requireToken, leaderOnly, syncCapability)
+	v1.GET("/capabilities/:rootId/status", getCapabilityStatus)
+}
+
+// readinessHandler reports the service as not ready once the event consumer has stopped or keeps failing to fetch
+// messages, so it does not keep running without processing events. Standbys don't consume events, and are always
+// ready.
+func readinessHandler(conf config.Config, isLeader func() bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if conf.EventHandling.Enabled && isLeader() {
+			if err := event.Ready(); err != nil {
+				c.IndentedJSON(http.StatusServiceUnavailable, gin.H{"message": err.Error()})
+				return
+			}
 		}
-	} else {
-		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "job not found"})
+
+		c.IndentedJSON(http.StatusOK, gin.H{"message": "ready"})
 	}
 }
 
-// CapSvc2Azure            godoc
-// @Summary      Trigger a run of the CapSvc2Azure Job
-// @Description  Triggers a run of the CapSvc2Azure Job and returns success
-// @Tags         capsvc2azure
-// @Produce      json
-// @Success      201
-// @Failure      404
-// @Failure      409
-// @Failure      500
-// @Router       /capsvc2azure [post]
-func runCapSvc2Azure(c *gin.Context) {
-	orc := middleware.GetOrchestrator(c)
-
-	if orc.Jobs["capSvcToAad"] != nil {
-		if !orc.Jobs["capSvcToAad"].Status.InProgress() {
-			orc.Jobs["capSvcToAad"].Run()
-			c.IndentedJSON(http.StatusCreated, gin.H{"message": "job created"})
-		} else {
-			c.IndentedJSON(http.StatusConflict, gin.H{"message": "job in progress"})
+// livenessHandler reports the service as not live once the event consumer has failed or is stuck handling a message,
+// so the leader is restarted and a standby takes over. Standbys don't consume events, and are always live.
+func livenessHandler(conf config.Config, isLeader func() bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if conf.EventHandling.Enabled && isLeader() {
+			if err := event.Live(); err != nil {
+				c.IndentedJSON(http.StatusServiceUnavailable, gin.H{"message": err.Error()})
+				return
+			}
 		}
-	} else {
-		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "job not found"})
+
+		c.IndentedJSON(http.StatusOK, gin.H{"message": "live"})
 	}
 }
 
 // main
-// Sets up:
+// Runs the command given as the first argument, see commands, or serves if there is none. Serving sets up:
 // - Prometheus metrics
 // - Graceful shutdown via Context
 // - Background jobs via Orchestrator
@@ -149,7 +117,38 @@ func runCapSvc2Azure(c *gin.Context) {
 // @title           AAD AWS Sync
 // @version 1
 // @basePath /api/v1
+// @securityDefinitions.apikey BearerToken
+// @in header
+// @name Authorization
 func main() {
+	if len(os.Args) < 2 {
+		os.Exit(serveCommand(nil))
+	}
+
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		if os.Args[1] != "help" && os.Args[1] != "-h" && os.Args[1] != "--help" {
+			fmt.Fprintf(os.Stderr, "unknown command %s\n\n", os.Args[1])
+			usage(os.Stderr)
+			os.Exit(exitUsage)
+		}
+		usage(os.Stdout)
+		os.Exit(exitOk)
+	}
+
+	os.Exit(cmd.run(os.Args[2:]))
+}
+
+// serveCommand runs the service: scheduled jobs, event handling and the API on the leader, and the read-only API, probes
+// and metrics on all instances.
+//
+//	orchestrator [serve]
+func serveCommand(args []string) int {
+	if len(args) > 0 {
+		fmt.Fprintln(os.Stderr, "serve takes no arguments")
+		return exitUsage
+	}
+
 	util.InitializeLogger()
 	defer util.Logger.Sync()
 
@@ -158,9 +157,51 @@ func main() {
 		log.Fatal("Unable to load app config", err)
 	}
 
+	// Fail on startup rather than deep inside a job or event handler
+	if errs := config.Errors(config.Validate(conf, jobRequirements(enabledJobs(conf)))); len(errs) > 0 {
+		for _, problem := range errs {
+			util.Logger.Error("Invalid config", zap.String("setting", problem.Setting), zap.String("envVar", problem.EnvVar), zap.String("problem", problem.Message))
+		}
+		log.Fatal("Invalid app config, see validate-config")
+	}
+
+	// With leader election, the state store is shared by all instances, but only opened by the leader, see
+	// startLeading. Until then, reading it fails with a store.Unavailable error, which the read-only API reports.
+	if conf.LeaderElection.Enabled {
+		store.SetDefault(store.NewUnavailableStore("only the leader has the state store open"))
+	} else {
+		stateStore, err := store.Open(conf.StateStore.Backend, conf.StateStore.Path)
+		if err != nil {
+			log.Fatal("Unable to open state store", err)
+		}
+		defer stateStore.Close()
+		store.SetDefault(stateStore)
+	}
+
+	auditSink, err := audit.Open(conf.Audit.Sink, conf.AuditFilePath())
+	if err != nil {
+		log.Fatal("Unable to open audit sink", err)
+	}
+	defer auditSink.Close()
+	audit.SetDefault(auditSink)
+
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
+	if conf.Tracing.Enabled {
+		shutdownTracing, err := tracing.Init(ctx, tracing.Config{
+			Endpoint:    conf.Tracing.Endpoint,
+			Insecure:    conf.Tracing.Insecure,
+			SampleRatio: conf.Tracing.SampleRatio,
+			ServiceName: conf.Tracing.ServiceName,
+		})
+		if err != nil {
+			log.Fatal("Unable to set up tracing", err)
+		}
+		// Flushing pending spans outlives ctx, which is cancelled on shutdown
+		defer shutdownTracing(context.Background())
+	}
+
 	s := gocron.NewScheduler(time.UTC)
 	s.SingletonModeAll()
 
@@ -168,26 +209,75 @@ func main() {
 	orc := orchestrator.NewOrchestrator(ctx, backgroundJobWg, "aad_aws_sync")
 	orc.Init(util.Logger)
 	// Orchestrator goroutine; Handles scheduling jobs
-	configPrefix := "AAS_SCHEDULER_JOB"
-	orc.AddJob(configPrefix, orchestrator.NewJob("capSvc2Aad", handler.Capsvc2AadHandler), &orchestrator.Schedule{})
-	orc.AddJob(configPrefix, orchestrator.NewJob("aad2Aws", handler.Azure2AwsHandler), &orchestrator.Schedule{})
-	orc.AddJob(configPrefix, orchestrator.NewJob("awsMapping", handler.AwsMappingHandler), &orchestrator.Schedule{})
-	orc.AddJob(configPrefix, orchestrator.NewJob("aws2K8s", handler.Aws2K8sHandler), &orchestrator.Schedule{})
-	orc.AddJob(configPrefix, orchestrator.NewJob("capabilityEmailAlias", handler.CapabilityEmailAliasHandler), &orchestrator.Schedule{})
-	orc.AddJob(configPrefix, orchestrator.NewJob("assignGroups2AzureEnterpriseApps", handler.AssignGroupsToAzureEnterpriseAppsHandler), &orchestrator.Schedule{})
+	jobManager := jobs.NewManager(orc, store.Default(), conf.Jobs.HistorySize, conf.StateStore.RunRetention)
+	for _, job := range scheduledJobs {
+		schedule, _ := conf.Scheduler.Job.Get(job.name)
+		jobManager.AddJob(jobConfigPrefix, job.name, schedule, job.handler)
+	}
 
-	// Orchestrator goroutine; Handles scheduling jobs
-	orc.Run()
+	// Only the leader runs scheduled jobs and consumes events
+	leaderStateStore := make(chan store.Store, 1)
+	startLeading := func(ctx context.Context) {
+		if conf.LeaderElection.Enabled {
+			stateStore, err := openLeaderStateStore(ctx, conf)
+			if err != nil {
+				if ctx.Err() == nil {
+					util.Logger.Error("Unable to open state store, shutting down.", zap.Error(err))
+				}
+				stop()
+				return
+			}
+			// Closed on shutdown, once all jobs have stopped
+			leaderStateStore <- stateStore
+			store.SetDefault(stateStore)
+			jobManager.SetStore(stateStore)
+		}
+
+		// Orchestrator goroutine; Handles scheduling jobs
+		orc.Run()
+
+		// Event handling
+		if conf.EventHandling.Enabled {
+			go func() {
+				err := event.StartEventHandlers(ctx, conf, backgroundJobWg)
+				if err != nil {
+					util.Logger.Error("Event loop error, shutting down.", zap.Error(err))
+					stop()
+				}
+			}()
+		}
+	}
+
+	isLeader := func() bool { return true }
+	if conf.LeaderElection.Enabled {
+		k8sClient, err := k8s.GetK8sClient()
+		if err != nil {
+			log.Fatal("Unable to create Kubernetes client for leader election", err)
+		}
+
+		elector, err := k8s.NewLeaderElector(k8sClient, leaderElectionConfig(conf))
+		if err != nil {
+			log.Fatal("Unable to set up leader election", err)
+		}
+		isLeader = elector.IsLeader
 
-	// Event handling
-	if conf.EventHandling.Enabled {
+		// The orchestrator can't be stopped once running, so an instance that loses leadership shuts down and
+		// comes back as a standby
 		go func() {
-			err = event.StartEventHandlers(ctx, conf, backgroundJobWg)
+			err := elector.Run(ctx, func(ctx context.Context) {
+				util.Logger.Info("Elected leader, starting jobs and event handling")
+				startLeading(ctx)
+			}, func() {
+				util.Logger.Info("No longer leader, shutting down")
+				stop()
+			})
 			if err != nil {
-				util.Logger.Error("Event loop error, shutting down.", zap.Error(err))
+				util.Logger.Error("Leader election error, shutting down.", zap.Error(err))
 				stop()
 			}
 		}()
+	} else {
+		startLeading(ctx)
 	}
 
 	// Profiling endpoint
@@ -200,13 +290,23 @@ func main() {
 
 	router := gin.Default()
 	router.Use(middleware.AddOrchestrator(orc))
+	router.Use(middleware.AddJobManager(jobManager))
 
 	v1 := router.Group("/api/v1")
 	{
-		v1.POST("/azure2aws", runAzure2Aws)
-		v1.POST("/awsmapping", runAwsMapping)
-		v1.POST("/aws2k8s", runAws2K8s)
-		v1.POST("/capsvc2azure", runCapSvc2Azure)
+		addApiRoutes(v1, conf, isLeader)
+		if conf.EventHandling.Webhook.Enabled {
+			if conf.EventHandling.Webhook.Token == "" {
+				log.Fatal("Event webhook is enabled, but no token is configured")
+			}
+
+			failedEventStore, err := event.NewFailedEventStore(conf.FailedEventsPath())
+			if err != nil {
+				log.Fatal("Unable to set up failed event store", err)
+			}
+
+			v1.POST("/events", middleware.RequireBearerToken(conf.EventHandling.Webhook.Token), middleware.RequireLeader(isLeader), event.WebhookHandler(event.NewHandlerRegistry(), failedEventStore))
+		}
 		v1.GET("/mgmt/shutdown", func(c *gin.Context) {
 			go func() {
 				time.Sleep(time.Second * 2)
@@ -218,6 +318,8 @@ func main() {
 
 	router.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
 	router.GET("/metrics", metricsHandler())
+	router.GET("/readyz", readinessHandler(conf, isLeader))
+	router.GET("/livez", livenessHandler(conf, isLeader))
 
 	srv := &http.Server{
 		Addr:    ":8080",
@@ -243,4 +345,12 @@ func main() {
 
 	backgroundJobWg.Wait()
 	util.Logger.Info("All background jobs stopped")
+
+	select {
+	case stateStore := <-leaderStateStore:
+		stateStore.Close()
+	default:
+	}
+
+	return exitOk
 }
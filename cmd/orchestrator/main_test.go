@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"go.dfds.cloud/aad-aws-sync/internal/config"
+	"go.dfds.cloud/aad-aws-sync/internal/jobs"
+	"go.dfds.cloud/aad-aws-sync/internal/middleware"
+	"go.dfds.cloud/aad-aws-sync/internal/store"
+	"go.dfds.cloud/aad-aws-sync/internal/util"
+	"go.dfds.cloud/orchestrator"
+	"go.uber.org/zap"
+)
+
+func TestApiRoutesOnStandby(t *testing.T) {
+	util.Logger = zap.NewNop()
+	gin.SetMode(gin.TestMode)
+
+	orc := orchestrator.NewOrchestrator(context.Background(), &sync.WaitGroup{}, "api_test_standby")
+	manager := jobs.NewManager(orc, store.NewUnavailableStore("only the leader has the state store open"), 2, 3)
+	manager.AddJob("AAS_TEST_JOB", "standby", config.JobSchedule{}, func(ctx context.Context) error { return nil })
+
+	router := gin.New()
+	router.Use(middleware.AddJobManager(manager))
+	conf := config.Config{}
+	conf.Api.Token = "secret"
+	addApiRoutes(router.Group("/api/v1"), conf, func() bool { return false })
+
+	serve := func(method string, path string, token string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := serve(http.MethodGet, "/api/v1/jobs", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var list []jobs.Job
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	assert.Len(t, list, 1)
+	assert.True(t, list[0].RunsUnavailable)
+
+	w = serve(http.MethodGet, "/api/v1/jobs/standby", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var job jobs.Job
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &job))
+	assert.Equal(t, "standby", job.Name)
+	assert.True(t, job.RunsUnavailable)
+
+	// The run may be in the history the standby can't read, which the handler reports rather than the leader check
+	w = serve(http.MethodGet, "/api/v1/jobs/standby/runs/unknown", "")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), "can't be read from the store")
+
+	// Capability-Service isn't reachable here, so the handler fails to get a token without asking Entra ID. It has to
+	// get that far though, rather than the standby turning the request away.
+	t.Setenv("AAS_CAPSVC_AUTH_METHOD", "awsWebIdentity")
+	t.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", "")
+	w = serve(http.MethodGet, "/api/v1/capabilities/unknown/status", "")
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Contains(t, w.Body.String(), "federated token")
+
+	for _, path := range []string{"/api/v1/jobs/standby/runs", "/api/v1/jobs/standby/cancel"} {
+		w = serve(http.MethodPost, path, "")
+		assert.Equal(t, http.StatusUnauthorized, w.Code, path)
+		w = serve(http.MethodPost, path, "wrong")
+		assert.Equal(t, http.StatusUnauthorized, w.Code, path)
+		w = serve(http.MethodPost, path, "secret")
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code, path)
+	}
+}
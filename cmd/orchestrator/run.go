@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+
+	"github.com/google/uuid"
+	"go.dfds.cloud/aad-aws-sync/internal/audit"
+	"go.dfds.cloud/aad-aws-sync/internal/config"
+	"go.dfds.cloud/aad-aws-sync/internal/handler"
+	"go.dfds.cloud/aad-aws-sync/internal/jobs"
+	"go.dfds.cloud/aad-aws-sync/internal/store"
+	"go.dfds.cloud/orchestrator"
+)
+
+// runResult is the outcome of a job run started from the command line.
+type runResult struct {
+	Job    string `json:"job"`
+	RunId  string `json:"runId"`
+	DryRun bool   `json:"dryRun"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// Mutations counts the changes made, or planned in a dry run, by kind
+	Mutations map[string]int `json:"mutations"`
+	// Plan lists the changes a dry run would have made
+	Plan []audit.Mutation `json:"plan,omitempty"`
+	// Capability is the result of a Capability sync, see handler.SyncCapability
+	Capability *handler.CapabilitySyncResult `json:"capability,omitempty"`
+}
+
+func (r *runResult) print() {
+	fmt.Printf("%s %s (run %s)", r.Job, r.Status, r.RunId)
+	if r.DryRun {
+		fmt.Print(", dry run")
+	}
+	fmt.Println()
+	if r.Error != "" {
+		fmt.Printf("  error: %s\n", r.Error)
+	}
+
+	if r.Capability != nil {
+		for _, step := range r.Capability.Steps {
+			fmt.Printf("  step %s: %s", step.Step, step.Status)
+			if step.Message != "" {
+				fmt.Printf(" (%s)", step.Message)
+			}
+			fmt.Println()
+		}
+	}
+
+	kinds := make([]string, 0, len(r.Mutations))
+	for kind := range r.Mutations {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		fmt.Printf("  %s: %d\n", kind, r.Mutations[kind])
+	}
+
+	for _, mutation := range r.Plan {
+		fmt.Printf("  would %s in %s %v\n", mutation.Action, mutation.System, mutation.ObjectIds)
+	}
+}
+
+func jobHandler(name string) func(ctx context.Context) error {
+	for _, job := range scheduledJobs {
+		if job.name == name {
+			return job.handler
+		}
+	}
+
+	return nil
+}
+
+func jobNames() []string {
+	names := make([]string, 0, len(scheduledJobs))
+	for _, job := range scheduledJobs {
+		names = append(names, job.name)
+	}
+
+	return names
+}
+
+// runCommand runs a single job once, whether or not it is enabled, and prints what it changed. With -capability it
+// syncs a single Capability instead, like the capability sync API does. The scheduled jobs always reconcile all
+// Capabilities, as e.g. capSvc2Aad removes the groups of Capabilities it doesn't know, so they can't be limited to
+// one. Except for dry runs, it refuses to run while an instance of the service leads, see requireNoLeader.
+//
+//	orchestrator run <job> [-dry-run] [-json]
+//	orchestrator run [capabilitySync] -capability <rootId> [-dry-run] [-json]
+func runCommand(args []string) int {
+	flags := flag.NewFlagSet("run", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "don't change anything, print the changes that would be made")
+	capability := flags.String("capability", "", "sync only the Capability with this root ID")
+	asJson := flags.Bool("json", false, "print the result as JSON")
+	positional, err := parseArgs(flags, args)
+	if err != nil {
+		return exitUsage
+	}
+
+	var name string
+	var run func(ctx context.Context) error
+	switch {
+	case len(positional) > 1:
+		fmt.Fprintln(os.Stderr, "run takes a single job")
+		return exitUsage
+	case *capability != "":
+		if len(positional) == 1 && positional[0] != handler.CapabilitySyncName {
+			fmt.Fprintf(os.Stderr, "-capability can only be used with %s, job %s reconciles all Capabilities\n", handler.CapabilitySyncName, positional[0])
+			return exitUsage
+		}
+		name = handler.CapabilitySyncName
+	case len(positional) == 1:
+		name = positional[0]
+		run = jobHandler(name)
+		if run == nil {
+			fmt.Fprintf(os.Stderr, "unknown job %s, must be one of %v\n", name, jobNames())
+			return exitUsage
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "run needs a job, one of %v, or -capability\n", jobNames())
+		return exitUsage
+	}
+
+	var jobsToValidate func(conf config.Config) []string
+	if run != nil {
+		jobsToValidate = func(conf config.Config) []string { return []string{name} }
+	}
+	conf, cleanup, err := initCommand(jobsToValidate)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	defer cleanup()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if !*dryRun {
+		if err := requireNoLeader(ctx, conf); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitFailure
+		}
+	}
+
+	var result *runResult
+	if run != nil {
+		result = runJob(ctx, conf, name, run, *dryRun)
+	} else {
+		result = runCapabilitySync(ctx, *capability, *dryRun)
+	}
+
+	printResult(*asJson, result, result.print)
+	if result.Status != jobs.RunStatusSucceeded {
+		return exitFailure
+	}
+
+	return exitOk
+}
+
+// planCommand dry-runs all enabled jobs, one after the other, and prints the changes they would make.
+//
+//	orchestrator plan [-json]
+func planCommand(args []string) int {
+	flags := flag.NewFlagSet("plan", flag.ContinueOnError)
+	asJson := flags.Bool("json", false, "print the plan as JSON")
+	positional, err := parseArgs(flags, args)
+	if err != nil {
+		return exitUsage
+	}
+	if len(positional) > 0 {
+		fmt.Fprintln(os.Stderr, "plan takes no arguments")
+		return exitUsage
+	}
+
+	conf, cleanup, err := initCommand(enabledJobs)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	defer cleanup()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	results := []*runResult{}
+	exitCode := exitOk
+	for _, name := range enabledJobs(conf) {
+		result := runJob(ctx, conf, name, jobHandler(name), true)
+		if result.Status != jobs.RunStatusSucceeded {
+			exitCode = exitFailure
+		}
+		results = append(results, result)
+	}
+
+	printResult(*asJson, results, func() {
+		if len(results) == 0 {
+			fmt.Println("No jobs enabled")
+		}
+		for _, result := range results {
+			result.print()
+		}
+	})
+
+	return exitCode
+}
+
+// runJob runs a job once, attributing its changes to the command line in the audit log. The run goes through a
+// jobs.Manager, so it is persisted to the state store like the runs of the service, with the cli trigger. Dry runs
+// change nothing, and aren't persisted.
+func runJob(ctx context.Context, conf config.Config, name string, run func(ctx context.Context) error, dryRun bool) *runResult {
+	if !dryRun {
+		manager := jobs.NewManager(orchestrator.NewOrchestrator(ctx, &sync.WaitGroup{}, "aad_aws_sync"), store.Default(), conf.Jobs.HistorySize, conf.StateStore.RunRetention)
+		manager.AddJob(jobConfigPrefix, name, config.JobSchedule{}, run)
+		jobRun, err := manager.RunNow(ctx, name, jobs.TriggerCli)
+		if jobRun.ID == "" {
+			return &runResult{Job: name, Status: jobs.RunStatusFailed, Error: err.Error(), Mutations: map[string]int{}}
+		}
+
+		return &runResult{Job: name, RunId: jobRun.ID, Status: jobRun.Status, Error: jobRun.Error, Mutations: jobRun.Mutations}
+	}
+
+	result := &runResult{Job: name, RunId: uuid.NewString(), DryRun: dryRun, Status: jobs.RunStatusSucceeded}
+
+	ctx, mutations := jobs.TrackMutations(ctx)
+	ctx = audit.WithActor(ctx, audit.Actor{Kind: audit.ActorKindCli, Name: name, RunId: result.RunId})
+	var plan *handler.Plan
+	if dryRun {
+		plan = &handler.Plan{}
+		ctx = handler.WithDryRun(ctx, plan)
+	}
+
+	err := run(ctx)
+	switch {
+	case err == nil:
+	case errors.Is(err, context.Canceled):
+		result.Status = jobs.RunStatusCancelled
+		result.Error = err.Error()
+	default:
+		result.Status = jobs.RunStatusFailed
+		result.Error = err.Error()
+	}
+
+	result.Mutations = mutations()
+	if plan != nil {
+		result.Plan = plan.Mutations()
+	}
+
+	return result
+}
+
+// runCapabilitySync syncs a single Capability, see handler.SyncCapability.
+func runCapabilitySync(ctx context.Context, rootId string, dryRun bool) *runResult {
+	result := &runResult{Job: handler.CapabilitySyncName, DryRun: dryRun, Status: jobs.RunStatusSucceeded, Mutations: map[string]int{}}
+
+	ctx = audit.WithActor(ctx, audit.Actor{Kind: audit.ActorKindCli, Name: handler.CapabilitySyncName})
+	var plan *handler.Plan
+	if dryRun {
+		plan = &handler.Plan{}
+		ctx = handler.WithDryRun(ctx, plan)
+	}
+
+	syncResult, err := handler.SyncCapability(ctx, rootId)
+	if err != nil {
+		result.Status = jobs.RunStatusFailed
+		result.Error = err.Error()
+		return result
+	}
+
+	result.RunId = syncResult.RunId
+	result.Capability = syncResult
+	if syncResult.Failed() {
+		result.Status = jobs.RunStatusFailed
+	}
+	for _, step := range syncResult.Steps {
+		for kind, count := range step.Mutations {
+			result.Mutations[kind] += count
+		}
+	}
+	if plan != nil {
+		result.Plan = plan.Mutations()
+	}
+
+	return result
+}
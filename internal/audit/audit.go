@@ -0,0 +1,143 @@
+package audit
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/joomcode/errorx"
+	"go.dfds.cloud/aad-aws-sync/internal/handlerctx"
+	"go.dfds.cloud/aad-aws-sync/internal/util"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+const (
+	ActorKindJob   = "job"
+	ActorKindEvent = "event"
+	ActorKindApi   = "api"
+	ActorKindCli   = "cli"
+)
+
+// Systems mutated by the service.
+const (
+	SystemAzureAd          = "azureAd"
+	SystemAwsSso           = "awsSso"
+	SystemAwsIdentityStore = "awsIdentityStore"
+	SystemKubernetes       = "kubernetes"
+	SystemExchange         = "exchange"
+)
+
+const (
+	ResultSucceeded = "succeeded"
+	ResultFailed    = "failed"
+)
+
+var (
+	AuditError  = errorx.NewNamespace("audit")
+	UnknownSink = AuditError.NewType("unknown_sink")
+)
+
+// Actor is what caused a mutation: a job run, an event, an API request or a command run from the command line.
+type Actor struct {
+	Kind string `json:"kind"`
+	// Name is the name of the job, the type of the event or the name of the API operation
+	Name string `json:"name"`
+	// RunId identifies the job run, the event message or the API request
+	RunId string `json:"runId,omitempty"`
+}
+
+// Mutation describes a change made to a downstream system.
+type Mutation struct {
+	System string `json:"system"`
+	Action string `json:"action"`
+	// ObjectIds identifies the objects that were changed, e.g. {"groupId": "...", "userId": "..."}
+	ObjectIds map[string]string `json:"objectIds"`
+	Before    any               `json:"before,omitempty"`
+	After     any               `json:"after,omitempty"`
+}
+
+// Record is a single entry of the audit log.
+type Record struct {
+	ID        string            `json:"id"`
+	Time      time.Time         `json:"time"`
+	Actor     Actor             `json:"actor"`
+	System    string            `json:"system"`
+	Action    string            `json:"action"`
+	ObjectIds map[string]string `json:"objectIds"`
+	Before    any               `json:"before,omitempty"`
+	After     any               `json:"after,omitempty"`
+	Result    string            `json:"result"`
+	Error     string            `json:"error,omitempty"`
+	// TraceId identifies the trace of the job run, event or API request that made the mutation
+	TraceId string `json:"traceId,omitempty"`
+
+	spanContext trace.SpanContext
+}
+
+type actorCtxKey struct{}
+
+// WithActor returns a context in which mutations are attributed to actor. The context belongs to the handler named
+// after the actor, see handlerctx.
+func WithActor(ctx context.Context, actor Actor) context.Context {
+	return context.WithValue(handlerctx.WithName(ctx, actor.Name), actorCtxKey{}, actor)
+}
+
+// ActorFromContext returns the actor set with WithActor, or an empty Actor if there is none.
+func ActorFromContext(ctx context.Context) Actor {
+	actor, _ := ctx.Value(actorCtxKey{}).(Actor)
+	return actor
+}
+
+// Log writes a Record of mutation to the default Sink. err is the error returned by the downstream system, if any.
+// Failing to write the Record is logged, but doesn't fail the caller, since the mutation has already happened.
+func Log(ctx context.Context, mutation Mutation, err error) {
+	record := Record{
+		ID:        uuid.NewString(),
+		Time:      time.Now(),
+		Actor:     ActorFromContext(ctx),
+		System:    mutation.System,
+		Action:    mutation.Action,
+		ObjectIds: mutation.ObjectIds,
+		Before:    mutation.Before,
+		After:     mutation.After,
+		Result:    ResultSucceeded,
+	}
+	if spanContext := trace.SpanContextFromContext(ctx); spanContext.IsValid() {
+		record.TraceId = spanContext.TraceID().String()
+		record.spanContext = spanContext
+	}
+	if err != nil {
+		record.Result = ResultFailed
+		record.Error = err.Error()
+	}
+
+	if err := Default().Write(record); err != nil {
+		util.Logger.Warn("Unable to write audit record",
+			zap.String("system", record.System),
+			zap.String("action", record.Action),
+			zap.Any("objectIds", record.ObjectIds),
+			zap.Error(err))
+	}
+}
+
+var (
+	defaultMu   sync.RWMutex
+	defaultSink Sink = nopSink{}
+)
+
+// Default returns the Sink audit records are written to. Until SetDefault is called, e.g. in tests, records are
+// discarded.
+func Default() Sink {
+	defaultMu.RLock()
+	defer defaultMu.RUnlock()
+	return defaultSink
+}
+
+// SetDefault sets the Sink returned by Default.
+func SetDefault(s Sink) {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	defaultSink = s
+}
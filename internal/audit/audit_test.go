@@ -0,0 +1,167 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/joomcode/errorx"
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"go.dfds.cloud/aad-aws-sync/internal/handlerctx"
+	"go.dfds.cloud/aad-aws-sync/internal/kafkatest"
+	"go.dfds.cloud/aad-aws-sync/internal/store"
+	"go.dfds.cloud/aad-aws-sync/internal/util"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+type recordingSink struct {
+	records []Record
+}
+
+func (s *recordingSink) Write(record Record) error {
+	s.records = append(s.records, record)
+	return nil
+}
+
+func (s *recordingSink) Close() error { return nil }
+
+func TestLog(t *testing.T) {
+	util.Logger = zap.NewNop()
+	sink := &recordingSink{}
+	SetDefault(sink)
+	defer SetDefault(nopSink{})
+
+	ctx := WithActor(context.Background(), Actor{Kind: ActorKindJob, Name: "capSvc2Aad", RunId: "run-1"})
+	Log(ctx, Mutation{
+		System:    SystemAzureAd,
+		Action:    "aadGroupMemberAdded",
+		ObjectIds: map[string]string{"groupId": "group-1", "userId": "user@dfds.com"},
+	}, nil)
+	Log(context.Background(), Mutation{
+		System: SystemExchange,
+		Action: "emailAliasUpdated",
+		Before: []string{"a@dfds.com"},
+		After:  []string{"a@dfds.com", "b@dfds.com"},
+	}, errors.New("forbidden"))
+
+	assert.Len(t, sink.records, 2)
+	assert.NotEmpty(t, sink.records[0].ID)
+	assert.Equal(t, Actor{Kind: ActorKindJob, Name: "capSvc2Aad", RunId: "run-1"}, sink.records[0].Actor)
+	assert.Equal(t, "capSvc2Aad", handlerctx.Name(ctx))
+	assert.Equal(t, SystemAzureAd, sink.records[0].System)
+	assert.Equal(t, "aadGroupMemberAdded", sink.records[0].Action)
+	assert.Equal(t, map[string]string{"groupId": "group-1", "userId": "user@dfds.com"}, sink.records[0].ObjectIds)
+	assert.Equal(t, ResultSucceeded, sink.records[0].Result)
+	assert.Empty(t, sink.records[0].Error)
+
+	assert.Equal(t, Actor{}, sink.records[1].Actor)
+	assert.Equal(t, ResultFailed, sink.records[1].Result)
+	assert.Equal(t, "forbidden", sink.records[1].Error)
+	assert.Equal(t, []string{"a@dfds.com", "b@dfds.com"}, sink.records[1].After)
+}
+
+func TestFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit", "audit.jsonl")
+	sink, err := NewFileSink(path)
+	assert.NoError(t, err)
+
+	assert.NoError(t, sink.Write(Record{ID: "1", Action: "aadGroupCreated", Result: ResultSucceeded}))
+	assert.NoError(t, sink.Write(Record{ID: "2", Action: "aadGroupDeleted", Result: ResultFailed}))
+	assert.NoError(t, sink.Close())
+
+	// Records are appended to an existing file
+	sink, err = NewFileSink(path)
+	assert.NoError(t, err)
+	assert.NoError(t, sink.Write(Record{ID: "3", Action: "aadGroupMemberAdded", Result: ResultSucceeded}))
+	assert.NoError(t, sink.Close())
+
+	file, err := os.Open(path)
+	assert.NoError(t, err)
+	defer file.Close()
+
+	var ids []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record Record
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &record))
+		ids = append(ids, record.ID)
+	}
+	assert.Equal(t, []string{"1", "2", "3"}, ids)
+}
+
+func TestKafkaSink(t *testing.T) {
+	spanContext := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{0x0a, 0xf7, 0x65, 0x19, 0x16, 0xcd, 0x43, 0xdd, 0x84, 0x48, 0xeb, 0x21, 0x1c, 0x80, 0x31, 0x9c},
+		SpanID:     trace.SpanID{0xb7, 0xad, 0x6b, 0x71, 0x69, 0x20, 0x33, 0x31},
+		TraceFlags: trace.FlagsSampled,
+	})
+
+	producer := &kafkatest.MockKafkaProducer{}
+	producer.On("WriteMessages", mock.MatchedBy(func(ctx context.Context) bool {
+		_, hasDeadline := ctx.Deadline()
+		return hasDeadline
+	}), mock.MatchedBy(func(msg kafka.Message) bool {
+		var record Record
+		return string(msg.Key) == "1" && json.Unmarshal(msg.Value, &record) == nil && record.Action == "aadGroupCreated" &&
+			len(msg.Headers) == 1 && string(msg.Headers[0].Value) == "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	})).Return(nil)
+
+	sink := NewKafkaSink(producer)
+	assert.NoError(t, sink.Write(Record{ID: "1", Action: "aadGroupCreated", Result: ResultSucceeded, spanContext: spanContext}))
+	assert.NoError(t, sink.Close())
+	producer.AssertExpectations(t)
+}
+
+func TestStoreSink(t *testing.T) {
+	st := store.NewMemoryStore()
+	sink := NewStoreSink(st)
+
+	assert.NoError(t, sink.Write(Record{ID: "1", Action: "aadGroupCreated", Result: ResultSucceeded}))
+
+	var records []Record
+	assert.NoError(t, st.List(store.BucketAudit, "", func(key string, value []byte) error {
+		var record Record
+		if err := json.Unmarshal(value, &record); err != nil {
+			return err
+		}
+		records = append(records, record)
+		return nil
+	}))
+	assert.Len(t, records, 1)
+	assert.Equal(t, "aadGroupCreated", records[0].Action)
+
+	// Without a store, records are written to the default store at the time of writing
+	defer store.SetDefault(store.Default())
+	sink = NewStoreSink(nil)
+	defaultStore := store.NewMemoryStore()
+	store.SetDefault(defaultStore)
+	assert.NoError(t, sink.Write(Record{ID: "2", Action: "aadGroupDeleted", Result: ResultSucceeded}))
+
+	var keys []string
+	assert.NoError(t, defaultStore.List(store.BucketAudit, "", func(key string, value []byte) error {
+		keys = append(keys, key)
+		return nil
+	}))
+	assert.Len(t, keys, 1)
+}
+
+func TestOpen(t *testing.T) {
+	sink, err := Open(SinkFile, filepath.Join(t.TempDir(), "audit.jsonl"))
+	assert.NoError(t, err)
+	assert.IsType(t, &FileSink{}, sink)
+	assert.NoError(t, sink.Close())
+
+	sink, err = Open(SinkStore, "")
+	assert.NoError(t, err)
+	assert.IsType(t, &StoreSink{}, sink)
+
+	_, err = Open("syslog", "")
+	assert.True(t, errorx.IsOfType(err, UnknownSink))
+}
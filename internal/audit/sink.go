@@ -0,0 +1,175 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+	"github.com/segmentio/kafka-go"
+	"go.dfds.cloud/aad-aws-sync/internal/kafkautil"
+	"go.dfds.cloud/aad-aws-sync/internal/store"
+	"go.dfds.cloud/aad-aws-sync/internal/tracing"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	SinkFile  = "file"
+	SinkKafka = "kafka"
+	SinkStore = "store"
+)
+
+// Sink is where audit records are written to.
+type Sink interface {
+	Write(record Record) error
+	Close() error
+}
+
+// Open opens the Sink of the given kind. path is only used by the file Sink. The Kafka Sink reads the Kafka auth
+// settings from AAS_KAFKA_AUTH, like the event consumer, and its topic from AAS_KAFKA_AUDIT_PRODUCER. The store Sink
+// writes to the default state store at the time of writing, which a leader only opens once elected.
+func Open(kind string, path string) (Sink, error) {
+	switch kind {
+	case SinkFile:
+		return NewFileSink(path)
+	case SinkKafka:
+		var authConfig kafkautil.AuthConfig
+		if err := envconfig.Process("AAS_KAFKA_AUTH", &authConfig); err != nil {
+			return nil, err
+		}
+
+		var producerConfig kafkautil.ProducerConfig
+		if err := envconfig.Process("AAS_KAFKA_AUDIT_PRODUCER", &producerConfig); err != nil {
+			return nil, errors.New("failed to process audit producer configurations")
+		}
+
+		dialer, err := kafkautil.NewDialer(authConfig)
+		if err != nil {
+			return nil, err
+		}
+
+		writer := kafkautil.NewProducer(producerConfig, authConfig, dialer)
+		// Records are written one at a time, so waiting for a batch to fill up only delays the mutation
+		writer.BatchTimeout = 10 * time.Millisecond
+
+		return NewKafkaSink(writer), nil
+	case SinkStore:
+		return NewStoreSink(nil), nil
+	default:
+		return nil, UnknownSink.New("unknown audit sink %s", kind)
+	}
+}
+
+type nopSink struct{}
+
+func (nopSink) Write(record Record) error { return nil }
+func (nopSink) Close() error              { return nil }
+
+// FileSink appends audit records to a file, one JSON object per line.
+type FileSink struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func NewFileSink(path string) (*FileSink, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0o750)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileSink{file: file}, nil
+}
+
+func (s *FileSink) Write(record Record) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.file.Write(append(data, '\n'))
+
+	return err
+}
+
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
+
+// kafkaWriteTimeout bounds how long a mutation waits for its audit record to be produced.
+const kafkaWriteTimeout = 5 * time.Second
+
+type messageWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+}
+
+// KafkaSink produces audit records to a Kafka topic, keyed by record ID, with the trace context of the mutation in the
+// message headers.
+type KafkaSink struct {
+	writer messageWriter
+}
+
+func NewKafkaSink(writer messageWriter) *KafkaSink {
+	return &KafkaSink{writer: writer}
+}
+
+func (s *KafkaSink) Write(record Record) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	// Not using the context of the caller, so mutations of cancelled runs are still recorded
+	ctx, cancel := context.WithTimeout(context.Background(), kafkaWriteTimeout)
+	defer cancel()
+
+	return s.writer.WriteMessages(ctx, kafka.Message{
+		Key:     []byte(record.ID),
+		Value:   data,
+		Headers: tracing.InjectKafkaHeaders(trace.ContextWithSpanContext(context.Background(), record.spanContext), nil),
+	})
+}
+
+func (s *KafkaSink) Close() error {
+	if closer, ok := s.writer.(interface{ Close() error }); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
+
+// StoreSink keeps audit records in the audit bucket of a state store, in chronological order.
+type StoreSink struct {
+	store store.Store
+}
+
+// NewStoreSink creates a StoreSink writing to st, or to the default state store if st is nil.
+func NewStoreSink(st store.Store) *StoreSink {
+	return &StoreSink{store: st}
+}
+
+func (s *StoreSink) Write(record Record) error {
+	st := s.store
+	if st == nil {
+		st = store.Default()
+	}
+
+	return st.Put(store.BucketAudit, store.TimeKey(record.Time)+"/"+record.ID, record)
+}
+
+// Close does nothing, as the state store is closed by its owner.
+func (s *StoreSink) Close() error {
+	return nil
+}
@@ -10,6 +10,7 @@ import (
 	"net/http"
 	"strings"
 	"sync"
+	"time"
 
 	awsHttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	"github.com/aws/aws-sdk-go-v2/config"
@@ -22,6 +23,9 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/ssoadmin"
 	"github.com/aws/aws-sdk-go-v2/service/ssoadmin/types"
 	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"go.dfds.cloud/aad-aws-sync/internal/httpclient"
+	"go.dfds.cloud/aad-aws-sync/internal/metrics"
+	"go.dfds.cloud/aad-aws-sync/internal/tracing"
 	"go.dfds.cloud/aad-aws-sync/internal/util"
 	"go.uber.org/zap"
 	"golang.org/x/sync/semaphore"
@@ -46,7 +50,7 @@ func CreateScimClient(endpoint string, token string) *ScimClient {
 		token:    token,
 		endpoint: endpoint,
 	}
-	httpClient := http.DefaultClient
+	httpClient := httpclient.New(httpclient.DefaultConfig(metrics.TargetScim))
 	sc.http = httpClient
 
 	return sc
@@ -59,8 +63,8 @@ func (c *ScimClient) prepareHttpRequest(h *http.Request) error {
 	return nil
 }
 
-func (c *ScimClient) GetUserViaExternalId(id string) (*ScimGetUserResponse, error) {
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s/scim/v2/Users", c.endpoint), nil)
+func (c *ScimClient) GetUserViaExternalId(ctx context.Context, id string) (*ScimGetUserResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/scim/v2/Users", c.endpoint), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -100,8 +104,8 @@ func (c *ScimClient) GetUserViaExternalId(id string) (*ScimGetUserResponse, erro
 	return nil, errors.New("response didn't return 1 exact match")
 }
 
-func (c *ScimClient) GetGroupViaDisplayName(name string) (*ScimGetGroupResponse, error) {
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s/scim/v2/Groups", c.endpoint), nil)
+func (c *ScimClient) GetGroupViaDisplayName(ctx context.Context, name string) (*ScimGetGroupResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/scim/v2/Groups", c.endpoint), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -141,13 +145,13 @@ func (c *ScimClient) GetGroupViaDisplayName(name string) (*ScimGetGroupResponse,
 	return nil, errors.New("response didn't return 1 exact match")
 }
 
-func (c *ScimClient) CreateGroup(data ScimCreateGroupRequest) error {
+func (c *ScimClient) CreateGroup(ctx context.Context, data ScimCreateGroupRequest) error {
 	reqPayload, err := json.Marshal(data)
 	if err != nil {
 		return err
 	}
 
-	req, err := http.NewRequest("POST", fmt.Sprintf("%s/scim/v2/Groups", c.endpoint), bytes.NewBuffer(reqPayload))
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s/scim/v2/Groups", c.endpoint), bytes.NewBuffer(reqPayload))
 	if err != nil {
 		return err
 	}
@@ -166,18 +170,16 @@ func (c *ScimClient) CreateGroup(data ScimCreateGroupRequest) error {
 
 	defer resp.Body.Close()
 
-	if resp.StatusCode != 201 {
-		if resp.StatusCode == 409 {
-			return nil
-		}
-		return errors.New(fmt.Sprintf("Received unexpected status code response, %d", resp.StatusCode))
+	// The group or user already exists
+	if resp.StatusCode == http.StatusConflict {
+		return nil
 	}
 
-	return nil
+	return httpclient.CheckResponse(resp, ScimHttpError, http.StatusCreated)
 }
 
-func (c *ScimClient) RemoveUser(id string) error {
-	req, err := http.NewRequest("DELETE", fmt.Sprintf("%s/scim/v2/Users/%s", c.endpoint, id), nil)
+func (c *ScimClient) RemoveUser(ctx context.Context, id string) error {
+	req, err := http.NewRequestWithContext(ctx, "DELETE", fmt.Sprintf("%s/scim/v2/Users/%s", c.endpoint, id), nil)
 	if err != nil {
 		return err
 	}
@@ -194,15 +196,11 @@ func (c *ScimClient) RemoveUser(id string) error {
 
 	defer resp.Body.Close()
 
-	if resp.StatusCode != 204 {
-		return errors.New(fmt.Sprintf("Received unexpected status code response, %d", resp.StatusCode))
-	}
-
-	return nil
+	return httpclient.CheckResponse(resp, ScimHttpError, http.StatusNoContent)
 }
 
-func (c *ScimClient) RemoveGroup(id string) error {
-	req, err := http.NewRequest("DELETE", fmt.Sprintf("%s/scim/v2/Groups/%s", c.endpoint, id), nil)
+func (c *ScimClient) RemoveGroup(ctx context.Context, id string) error {
+	req, err := http.NewRequestWithContext(ctx, "DELETE", fmt.Sprintf("%s/scim/v2/Groups/%s", c.endpoint, id), nil)
 	if err != nil {
 		return err
 	}
@@ -219,20 +217,16 @@ func (c *ScimClient) RemoveGroup(id string) error {
 
 	defer resp.Body.Close()
 
-	if resp.StatusCode != 204 {
-		return errors.New(fmt.Sprintf("Received unexpected status code response, %d", resp.StatusCode))
-	}
-
-	return nil
+	return httpclient.CheckResponse(resp, ScimHttpError, http.StatusNoContent)
 }
 
-func (c *ScimClient) CreateUser(data ScimCreateUserRequest) error {
+func (c *ScimClient) CreateUser(ctx context.Context, data ScimCreateUserRequest) error {
 	reqPayload, err := json.Marshal(data)
 	if err != nil {
 		return err
 	}
 
-	req, err := http.NewRequest("POST", fmt.Sprintf("%s/scim/v2/Users", c.endpoint), bytes.NewBuffer(reqPayload))
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s/scim/v2/Users", c.endpoint), bytes.NewBuffer(reqPayload))
 	if err != nil {
 		return err
 	}
@@ -251,24 +245,22 @@ func (c *ScimClient) CreateUser(data ScimCreateUserRequest) error {
 
 	defer resp.Body.Close()
 
-	if resp.StatusCode != 201 {
-		if resp.StatusCode == 409 {
-			return nil
-		}
-		return errors.New(fmt.Sprintf("Received unexpected status code response, %d", resp.StatusCode))
+	// The group or user already exists
+	if resp.StatusCode == http.StatusConflict {
+		return nil
 	}
 
-	return nil
+	return httpclient.CheckResponse(resp, ScimHttpError, http.StatusCreated)
 }
 
-func (c *ScimClient) PatchAddMembersToGroup(groupId string, members ...string) error {
+func (c *ScimClient) PatchAddMembersToGroup(ctx context.Context, groupId string, members ...string) error {
 	reqPatch := NewScimPatchAddMembersToGroupRequest(members...)
 	reqPayload, err := json.Marshal(reqPatch)
 	if err != nil {
 		return err
 	}
 
-	req, err := http.NewRequest("PATCH", fmt.Sprintf("%s/scim/v2/Groups/%s", c.endpoint, groupId), bytes.NewBuffer(reqPayload))
+	req, err := http.NewRequestWithContext(ctx, "PATCH", fmt.Sprintf("%s/scim/v2/Groups/%s", c.endpoint, groupId), bytes.NewBuffer(reqPayload))
 	if err != nil {
 		return err
 	}
@@ -287,21 +279,17 @@ func (c *ScimClient) PatchAddMembersToGroup(groupId string, members ...string) e
 
 	defer resp.Body.Close()
 
-	if resp.StatusCode != 204 {
-		return errors.New(fmt.Sprintf("Received unexpected status code response, %d", resp.StatusCode))
-	}
-
-	return nil
+	return httpclient.CheckResponse(resp, ScimHttpError, http.StatusNoContent)
 }
 
-func (c *ScimClient) PatchRemoveMembersFromGroup(groupId string, members ...string) error {
+func (c *ScimClient) PatchRemoveMembersFromGroup(ctx context.Context, groupId string, members ...string) error {
 	reqPatch := NewScimPatchRemoveMembersToGroupRequest(members...)
 	reqPayload, err := json.Marshal(reqPatch)
 	if err != nil {
 		return err
 	}
 
-	req, err := http.NewRequest("PATCH", fmt.Sprintf("%s/scim/v2/Groups/%s", c.endpoint, groupId), bytes.NewBuffer(reqPayload))
+	req, err := http.NewRequestWithContext(ctx, "PATCH", fmt.Sprintf("%s/scim/v2/Groups/%s", c.endpoint, groupId), bytes.NewBuffer(reqPayload))
 	if err != nil {
 		return err
 	}
@@ -320,19 +308,15 @@ func (c *ScimClient) PatchRemoveMembersFromGroup(groupId string, members ...stri
 
 	defer resp.Body.Close()
 
-	if resp.StatusCode != 204 {
-		return errors.New(fmt.Sprintf("Received unexpected status code response, %d", resp.StatusCode))
-	}
-
-	return nil
+	return httpclient.CheckResponse(resp, ScimHttpError, http.StatusNoContent)
 }
 
-func GetAccounts(client *organizations.Client, parentId string) ([]orgTypes.Account, error) {
+func GetAccounts(ctx context.Context, client *organizations.Client, parentId string) ([]orgTypes.Account, error) {
 	var maxResults int32 = 20
 	var accounts []orgTypes.Account
 	resps := organizations.NewListAccountsForParentPaginator(client, &organizations.ListAccountsForParentInput{MaxResults: &maxResults, ParentId: &parentId})
 	for resps.HasMorePages() { // Due to the limit of only 20 accounts per query and wanting to avoid getting hit by a rate limit, this will take a while if you have a decent amount of AWS accounts
-		page, err := resps.NextPage(context.TODO())
+		page, err := resps.NextPage(ctx)
 		if err != nil {
 			util.Logger.Sugar().Errorf("Error getting accounts: %v", err)
 			return accounts, err
@@ -373,7 +357,7 @@ func GetAllOUsFromParent(ctx context.Context, client *organizations.Client, pare
 }
 
 func GetAllAccountsFromOuRecursive(ctx context.Context, client *organizations.Client, parentId string) ([]orgTypes.Account, error) {
-	orgUnits, err := GetAllOUsFromParent(context.TODO(), client, parentId)
+	orgUnits, err := GetAllOUsFromParent(ctx, client, parentId)
 	if err != nil {
 		return nil, err
 	}
@@ -382,7 +366,7 @@ func GetAllAccountsFromOuRecursive(ctx context.Context, client *organizations.Cl
 	var allAccounts []orgTypes.Account
 
 	for _, ou := range orgUnits {
-		orgUnitAccounts, err := GetAccounts(client, *ou.Id)
+		orgUnitAccounts, err := GetAccounts(ctx, client, *ou.Id)
 		if err != nil {
 			return nil, err
 		}
@@ -392,12 +376,12 @@ func GetAllAccountsFromOuRecursive(ctx context.Context, client *organizations.Cl
 	return allAccounts, nil
 }
 
-func GetGroups(client *identitystore.Client, identityStoreArn string) ([]identityTypes.Group, error) {
+func GetGroups(ctx context.Context, client *identitystore.Client, identityStoreArn string) ([]identityTypes.Group, error) {
 	var maxResults int32 = 100
 	var payload []identityTypes.Group
 	resps := identitystore.NewListGroupsPaginator(client, &identitystore.ListGroupsInput{MaxResults: &maxResults, IdentityStoreId: &identityStoreArn})
 	for resps.HasMorePages() {
-		page, err := resps.NextPage(context.TODO())
+		page, err := resps.NextPage(ctx)
 		if err != nil {
 			return payload, err
 		}
@@ -408,12 +392,32 @@ func GetGroups(client *identitystore.Client, identityStoreArn string) ([]identit
 	return payload, nil
 }
 
-func GetGroupMemberships(client *identitystore.Client, identityStoreArn string, groupId *string) ([]identityTypes.GroupMembership, error) {
+// GetGroupByDisplayName returns the Identity Store group with the given display name, or nil if no such group exists.
+func GetGroupByDisplayName(ctx context.Context, client *identitystore.Client, identityStoreArn string, displayName string) (*identityTypes.Group, error) {
+	attributePath := "DisplayName"
+	resp, err := client.ListGroups(ctx, &identitystore.ListGroupsInput{
+		IdentityStoreId: &identityStoreArn,
+		Filters: []identityTypes.Filter{
+			{AttributePath: &attributePath, AttributeValue: &displayName},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp.Groups) == 0 {
+		return nil, nil
+	}
+
+	return &resp.Groups[0], nil
+}
+
+func GetGroupMemberships(ctx context.Context, client *identitystore.Client, identityStoreArn string, groupId *string) ([]identityTypes.GroupMembership, error) {
 	var maxResults int32 = 100
 	var payload []identityTypes.GroupMembership
 	resps := identitystore.NewListGroupMembershipsPaginator(client, &identitystore.ListGroupMembershipsInput{MaxResults: &maxResults, IdentityStoreId: &identityStoreArn, GroupId: groupId})
 	for resps.HasMorePages() {
-		page, err := resps.NextPage(context.TODO())
+		page, err := resps.NextPage(ctx)
 		if err != nil {
 			return payload, err
 		}
@@ -424,12 +428,12 @@ func GetGroupMemberships(client *identitystore.Client, identityStoreArn string,
 	return payload, nil
 }
 
-func GetPermissionSets(client *ssoadmin.Client, instanceArn string) ([]string, error) {
+func GetPermissionSets(ctx context.Context, client *ssoadmin.Client, instanceArn string) ([]string, error) {
 	var maxResults int32 = 100
 	var payload []string
 	resps := ssoadmin.NewListPermissionSetsPaginator(client, &ssoadmin.ListPermissionSetsInput{MaxResults: &maxResults, InstanceArn: &instanceArn})
 	for resps.HasMorePages() {
-		page, err := resps.NextPage(context.TODO())
+		page, err := resps.NextPage(ctx)
 		if err != nil {
 			return payload, err
 		}
@@ -440,12 +444,12 @@ func GetPermissionSets(client *ssoadmin.Client, instanceArn string) ([]string, e
 	return payload, nil
 }
 
-func GetAccountsWithProvisionedPermissionSet(client *ssoadmin.Client, instanceArn string, permissionSetArn string) ([]string, error) {
+func GetAccountsWithProvisionedPermissionSet(ctx context.Context, client *ssoadmin.Client, instanceArn string, permissionSetArn string) ([]string, error) {
 	var maxResults int32 = 100
 	var payload []string
 	resps := ssoadmin.NewListAccountsForProvisionedPermissionSetPaginator(client, &ssoadmin.ListAccountsForProvisionedPermissionSetInput{MaxResults: &maxResults, InstanceArn: &instanceArn, PermissionSetArn: &permissionSetArn})
 	for resps.HasMorePages() {
-		page, err := resps.NextPage(context.TODO())
+		page, err := resps.NextPage(ctx)
 		if err != nil {
 			return payload, err
 		}
@@ -456,7 +460,7 @@ func GetAccountsWithProvisionedPermissionSet(client *ssoadmin.Client, instanceAr
 	return payload, nil
 }
 
-func GetAssignedForPermissionSetInAccount(client *ssoadmin.Client, ssoInstanceArn string, permissionSetArn string, accountId string) ([]types.AccountAssignment, error) {
+func GetAssignedForPermissionSetInAccount(ctx context.Context, client *ssoadmin.Client, ssoInstanceArn string, permissionSetArn string, accountId string) ([]types.AccountAssignment, error) {
 	var maxResults int32 = 100
 	var payload []types.AccountAssignment
 	resps := ssoadmin.NewListAccountAssignmentsPaginator(client, &ssoadmin.ListAccountAssignmentsInput{
@@ -467,7 +471,7 @@ func GetAssignedForPermissionSetInAccount(client *ssoadmin.Client, ssoInstanceAr
 	})
 
 	for resps.HasMorePages() {
-		page, err := resps.NextPage(context.TODO())
+		page, err := resps.NextPage(ctx)
 		if err != nil {
 			return payload, err
 		}
@@ -478,7 +482,40 @@ func GetAssignedForPermissionSetInAccount(client *ssoadmin.Client, ssoInstanceAr
 	return payload, nil
 }
 
-func GetSsoRoles(accounts []SsoRoleMapping, roleName string) (map[string]SsoRoleMapping, error) {
+// WaitForAccountAssignmentCreation polls the status of an account assignment creation request until it has either
+// succeeded, failed or the context is done.
+func WaitForAccountAssignmentCreation(ctx context.Context, client *ssoadmin.Client, ssoInstanceArn string, requestId string) error {
+	for {
+		resp, err := client.DescribeAccountAssignmentCreationStatus(ctx, &ssoadmin.DescribeAccountAssignmentCreationStatusInput{
+			InstanceArn:                        &ssoInstanceArn,
+			AccountAssignmentCreationRequestId: &requestId,
+		})
+		if err != nil {
+			return err
+		}
+
+		switch resp.AccountAssignmentCreationStatus.Status {
+		case types.StatusValuesSucceeded:
+			return nil
+		case types.StatusValuesFailed:
+			reason := ""
+			if resp.AccountAssignmentCreationStatus.FailureReason != nil {
+				reason = *resp.AccountAssignmentCreationStatus.FailureReason
+			}
+			return errors.New(fmt.Sprintf("account assignment %s failed: %s", requestId, reason))
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(accountAssignmentPollInterval):
+		}
+	}
+}
+
+const accountAssignmentPollInterval = 2 * time.Second
+
+func GetSsoRoles(ctx context.Context, accounts []SsoRoleMapping, roleName string) (map[string]SsoRoleMapping, error) {
 	payload := make(map[string]SsoRoleMapping)
 	rolePathPrefix := "/aws-reserved"
 	roleNamePrefix := "AWSReservedSSO_CapabilityAccess"
@@ -487,18 +524,20 @@ func GetSsoRoles(accounts []SsoRoleMapping, roleName string) (map[string]SsoRole
 	var waitGroup sync.WaitGroup
 	payloadMutex := &sync.Mutex{}
 	sem := semaphore.NewWeighted(maxConcurrentOps)
-	ctx := context.TODO()
 
-	cfg, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion("eu-west-1"), config.WithHTTPClient(CreateHttpClientWithoutKeepAlive()))
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion("eu-west-1"), config.WithHTTPClient(CreateHttpClientWithoutKeepAlive()), config.WithAPIOptions(metrics.AwsApiOptions), config.WithAPIOptions(tracing.AwsApiOptions))
 	if err != nil {
 		return payload, err
 	}
 
 	for _, acc := range accounts {
+		if err := sem.Acquire(ctx, 1); err != nil {
+			waitGroup.Wait()
+			return payload, err
+		}
 		waitGroup.Add(1)
 		acc := acc
 		go func() {
-			sem.Acquire(ctx, 1)
 			defer sem.Release(1)
 			defer waitGroup.Done()
 
@@ -506,13 +545,13 @@ func GetSsoRoles(accounts []SsoRoleMapping, roleName string) (map[string]SsoRole
 
 			stsClient := sts.NewFromConfig(cfg)
 			roleSessionName := "aad-aws-sync"
-			assumedRole, err := stsClient.AssumeRole(context.TODO(), &sts.AssumeRoleInput{RoleArn: &roleArn, RoleSessionName: &roleSessionName})
+			assumedRole, err := stsClient.AssumeRole(ctx, &sts.AssumeRoleInput{RoleArn: &roleArn, RoleSessionName: &roleSessionName})
 			if err != nil {
 				util.Logger.Debug(fmt.Sprintf("unable to assume role %s. Account %s (%s) is likely missing the IAM role 'sso-reader' or it is misconfigured, skipping account", roleArn, acc.AccountAlias, acc.AccountId), zap.Error(err))
 				return
 			}
 
-			assumedCfg, err := config.LoadDefaultConfig(context.TODO(), config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(*assumedRole.Credentials.AccessKeyId, *assumedRole.Credentials.SecretAccessKey, *assumedRole.Credentials.SessionToken)), config.WithRegion("eu-west-1"))
+			assumedCfg, err := config.LoadDefaultConfig(ctx, config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(*assumedRole.Credentials.AccessKeyId, *assumedRole.Credentials.SecretAccessKey, *assumedRole.Credentials.SessionToken)), config.WithRegion("eu-west-1"), config.WithAPIOptions(metrics.AwsApiOptions), config.WithAPIOptions(tracing.AwsApiOptions))
 			if err != nil {
 				util.Logger.Error(fmt.Sprintf("unable to load SDK config, %v", err))
 				return
@@ -520,7 +559,7 @@ func GetSsoRoles(accounts []SsoRoleMapping, roleName string) (map[string]SsoRole
 
 			// get a new client using the config we just generated
 			assumedClient := iam.NewFromConfig(assumedCfg)
-			resp, err := assumedClient.ListRoles(context.TODO(), &iam.ListRolesInput{PathPrefix: &rolePathPrefix})
+			resp, err := assumedClient.ListRoles(ctx, &iam.ListRolesInput{PathPrefix: &rolePathPrefix})
 			if err != nil {
 				util.Logger.Error(fmt.Sprintf("Unable to list IAM roles %v", err))
 				return
@@ -0,0 +1,10 @@
+package aws
+
+import (
+	"github.com/joomcode/errorx"
+)
+
+var (
+	AwsError      = errorx.NewNamespace("aws")
+	ScimHttpError = AwsError.NewType("scim_http_error")
+)
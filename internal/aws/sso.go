@@ -52,9 +52,9 @@ func (m *ManageSso) GetGroupByName(val string) *identityStoreTypes.Group {
 }
 
 // GetAccountsMissingCapabilityPermissionSet
-func (m *ManageSso) GetAccountsMissingCapabilityPermissionSet(client *ssoadmin.Client, ssoInstanceArn string, capabilityPermissionSetArn string, ssoGroupPrefix string, awsAccountPrefix string) ([]*GetAccountsMissingCapabilityPermissionSetResponse, error) {
+func (m *ManageSso) GetAccountsMissingCapabilityPermissionSet(ctx context.Context, client *ssoadmin.Client, ssoInstanceArn string, capabilityPermissionSetArn string, ssoGroupPrefix string, awsAccountPrefix string) ([]*GetAccountsMissingCapabilityPermissionSetResponse, error) {
 	var accountsWithMissingPermissionSet []*GetAccountsMissingCapabilityPermissionSetResponse
-	awsAccountsProvisionedWithCapabilityPermissions, err := GetAccountsWithProvisionedPermissionSet(client, ssoInstanceArn, capabilityPermissionSetArn)
+	awsAccountsProvisionedWithCapabilityPermissions, err := GetAccountsWithProvisionedPermissionSet(ctx, client, ssoInstanceArn, capabilityPermissionSetArn)
 	if err != nil {
 		return accountsWithMissingPermissionSet, err
 	}
@@ -80,8 +80,8 @@ func (m *ManageSso) GetAccountsMissingCapabilityPermissionSet(client *ssoadmin.C
 	return accountsWithMissingPermissionSet, nil
 }
 
-func (m *ManageSso) GetGroupsNotAssignedToAccountWithPermissionSet(client *ssoadmin.Client, ssoInstanceArn string, permissionSetArn string, accountId string, groupPrefix string) (*GetGroupsNotAssignedToAccountWithPermissionSetResponse, error) {
-	resp, err := GetAssignedForPermissionSetInAccount(client, ssoInstanceArn, permissionSetArn, accountId)
+func (m *ManageSso) GetGroupsNotAssignedToAccountWithPermissionSet(ctx context.Context, client *ssoadmin.Client, ssoInstanceArn string, permissionSetArn string, accountId string, groupPrefix string) (*GetGroupsNotAssignedToAccountWithPermissionSetResponse, error) {
+	resp, err := GetAssignedForPermissionSetInAccount(ctx, client, ssoInstanceArn, permissionSetArn, accountId)
 	if err != nil {
 		return nil, err
 	}
@@ -114,7 +114,7 @@ func RemoveAccountPrefix(prefix string, val string) string {
 	return strings.TrimPrefix(val, prefix)
 }
 
-func InitManageSso(cfg aws.Config, identityStoreArn string) (*ManageSso, error) {
+func InitManageSso(ctx context.Context, cfg aws.Config, identityStoreArn string) (*ManageSso, error) {
 	conf, err := config.LoadConfig()
 	if err != nil {
 		return nil, err
@@ -130,11 +130,11 @@ func InitManageSso(cfg aws.Config, identityStoreArn string) (*ManageSso, error)
 	orgClient := organizations.NewFromConfig(cfg)
 	identityStoreClient := identitystore.NewFromConfig(cfg)
 
-	awsAccounts, err := GetAllAccountsFromOuRecursive(context.TODO(), orgClient, conf.Aws.RootOrganizationsParentId)
+	awsAccounts, err := GetAllAccountsFromOuRecursive(ctx, orgClient, conf.Aws.RootOrganizationsParentId)
 	if err != nil {
 		return nil, err
 	}
-	groups, err := GetGroups(identityStoreClient, identityStoreArn)
+	groups, err := GetGroups(ctx, identityStoreClient, identityStoreArn)
 	if err != nil {
 		return nil, err
 	}
@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"golang.org/x/sync/semaphore"
 	"io"
@@ -12,7 +11,11 @@ import (
 	"net/url"
 	"strings"
 	"sync"
+	"time"
 
+	"go.dfds.cloud/aad-aws-sync/internal/entraid"
+	"go.dfds.cloud/aad-aws-sync/internal/httpclient"
+	"go.dfds.cloud/aad-aws-sync/internal/metrics"
 	"go.dfds.cloud/aad-aws-sync/internal/util"
 	"go.uber.org/zap"
 	"k8s.io/utils/env"
@@ -24,19 +27,27 @@ type Client struct {
 	httpClient  *http.Client
 	tokenClient *util.TokenClient
 	config      Config
+	// baseUrl overrides graphBaseUrl in tests
+	baseUrl string
 }
 
 type Config struct {
-	TenantId             string `json:"tenantId"`
-	ClientId             string `json:"clientId"`
-	ClientSecret         string `json:"clientSecret"`
-	InternalDomainSuffix string `json:"internalDomainSuffix"`
+	TenantId             string             `json:"tenantId"`
+	ClientId             string             `json:"clientId"`
+	ClientSecret         string             `json:"clientSecret"`
+	Auth                 entraid.AuthConfig `json:"auth"`
+	InternalDomainSuffix string             `json:"internalDomainSuffix"`
+	// TransitiveMembers resolves the members of groups nested in a group, see GetGroupWithMembers
+	TransitiveMembers bool `json:"transitiveMembers"`
+	// CapabilityIdProperty is the directory extension property of groups holding the root ID of the Capability a
+	// group belongs to, e.g. extension_<app ID>_capabilityRootId. Groups are only matched by display name if empty.
+	CapabilityIdProperty string `json:"capabilityIdProperty"`
 }
 
 func (c *Client) RefreshAuth() error {
 	envToken := env.GetString("AAS_AZURE_TOKEN", "")
 	if envToken != "" {
-		c.tokenClient.Token = util.NewBearerToken(envToken)
+		c.tokenClient.SetToken(util.NewBearerToken(envToken))
 		return nil
 	}
 
@@ -45,41 +56,12 @@ func (c *Client) RefreshAuth() error {
 }
 
 func (c *Client) getNewToken() (*util.RefreshAuthResponse, error) {
-	reqPayload := url.Values{}
-	reqPayload.Set("client_id", c.config.ClientId)
-	reqPayload.Set("grant_type", "client_credentials")
-	reqPayload.Set("scope", "https://graph.microsoft.com/.default")
-	reqPayload.Set("client_secret", c.config.ClientSecret)
-
-	req, err := http.NewRequest("POST", fmt.Sprintf("https://login.microsoftonline.com/%s/oauth2/v2.0/token", c.config.TenantId), strings.NewReader(reqPayload.Encode()))
-	if err != nil {
-		return nil, err
-	}
-
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-
-	resp, err := c.httpClient.Do(req)
-	if err != nil {
-		return nil, err
-	}
-
-	rawData, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	if resp.StatusCode != 200 {
-		return nil, err
-	}
-
-	var tokenResponse *util.RefreshAuthResponse
-
-	err = json.Unmarshal(rawData, &tokenResponse)
-	if err != nil {
-		return nil, err
-	}
-
-	return tokenResponse, nil
+	return entraid.RequestToken(c.httpClient, entraid.Credentials{
+		TenantId:     c.config.TenantId,
+		ClientId:     c.config.ClientId,
+		ClientSecret: c.config.ClientSecret,
+		Auth:         c.config.Auth,
+	}, "https://graph.microsoft.com/.default")
 }
 
 func (c *Client) prepareHttpRequest(req *http.Request) error {
@@ -88,7 +70,7 @@ func (c *Client) prepareHttpRequest(req *http.Request) error {
 		return err
 	}
 
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.tokenClient.Token.GetToken()))
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.tokenClient.GetToken()))
 	req.Header.Set("User-Agent", "aad-aws-sync - github.com/dfds/aad-aws-sync")
 	return nil
 }
@@ -104,113 +86,32 @@ func (c *Client) prepareJsonRequest(req *http.Request) error {
 }
 
 func (c *Client) HasTokenExpired() bool {
-	return c.tokenClient.Token.IsExpired()
+	return c.tokenClient.IsExpired()
 }
 
-func (c *Client) GetGroups(prefix string) (*GroupsListResponse, error) {
-	req, err := http.NewRequest("GET", "https://graph.microsoft.com/v1.0/groups", nil)
-	if err != nil {
-		return nil, err
-	}
-	err = c.prepareHttpRequest(req)
-	if err != nil {
-		return nil, err
-	}
-
-	urlQueryValues := req.URL.Query()
-	urlQueryValues.Set("$filter", fmt.Sprintf("startswith(displayName,'%s')", prefix))
-	req.URL.RawQuery = urlQueryValues.Encode()
+func (c *Client) GetGroups(ctx context.Context, prefix string) (*GroupsListResponse, error) {
+	query := url.Values{}
+	query.Set("$filter", fmt.Sprintf("startswith(displayName,'%s')", prefix))
+	query.Set("$top", maxPageSize)
 
-	resp, err := c.httpClient.Do(req)
-	if err != nil {
-		return nil, err
-	}
-
-	defer resp.Body.Close()
-
-	rawData, err := io.ReadAll(resp.Body)
+	groups, err := getAllPages[GroupsListResponseGroup](ctx, c, "/v1.0/groups", query)
 	if err != nil {
 		return nil, err
 	}
 
-	var payload *GroupsListResponse
-
-	err = json.Unmarshal(rawData, &payload)
-	if err != nil {
-		return nil, err
-	}
-
-	nextLink := payload.OdataNextLink
-
-	for nextLink != "" {
-		req, err := http.NewRequest("GET", nextLink, nil)
-		if err != nil {
-			return nil, err
-		}
-		err = c.prepareHttpRequest(req)
-		if err != nil {
-			return nil, err
-		}
-
-		resp, err := c.httpClient.Do(req)
-		if err != nil {
-			return nil, err
-		}
-
-		rawData, err := io.ReadAll(resp.Body)
-		if err != nil {
-			return nil, err
-		}
-
-		var buffer *GroupsListResponse
-
-		err = json.Unmarshal(rawData, &buffer)
-		if err != nil {
-			return nil, err
-		}
-
-		nextLink = buffer.OdataNextLink
-
-		payload.Value = append(payload.Value, buffer.Value...)
-	}
-
-	return payload, nil
+	return &GroupsListResponse{Value: groups}, nil
 }
 
-func (c *Client) GetAdministrativeUnits() (*GetAdministrativeUnitsResponse, error) {
-	req, err := http.NewRequest("GET", "https://graph.microsoft.com/v1.0/directory/administrativeUnits", nil)
-	if err != nil {
-		return nil, err
-	}
-	err = c.prepareHttpRequest(req)
-	if err != nil {
-		return nil, err
-	}
-
-	urlQueryValues := req.URL.Query()
-	urlQueryValues.Set("$filter", "startswith(displayName,'Team - Cloud Engineering')")
-	req.URL.RawQuery = urlQueryValues.Encode()
+func (c *Client) GetAdministrativeUnits(ctx context.Context) (*GetAdministrativeUnitsResponse, error) {
+	query := url.Values{}
+	query.Set("$filter", "startswith(displayName,'Team - Cloud Engineering')")
 
-	resp, err := c.httpClient.Do(req)
-	if err != nil {
-		return nil, err
-	}
-
-	defer resp.Body.Close()
-
-	rawData, err := io.ReadAll(resp.Body)
+	units, err := getAllPages[*GetAdministrativeUnitsResponseUnit](ctx, c, "/v1.0/directory/administrativeUnits", query)
 	if err != nil {
 		return nil, err
 	}
 
-	var payload *GetAdministrativeUnitsResponse
-
-	err = json.Unmarshal(rawData, &payload)
-	if err != nil {
-		return nil, err
-	}
-
-	return payload, nil
+	return &GetAdministrativeUnitsResponse{Value: units}, nil
 }
 
 func (c *Client) CreateAdministrativeUnitGroup(ctx context.Context, requestPayload CreateAdministrativeUnitGroupRequest) (*CreateAdministrativeUnitGroupResponse, error) {
@@ -220,7 +121,7 @@ func (c *Client) CreateAdministrativeUnitGroup(ctx context.Context, requestPaylo
 	}
 
 	req, err := http.NewRequestWithContext(ctx, "POST",
-		fmt.Sprintf("https://graph.microsoft.com/v1.0/directory/administrativeUnits/%s/members",
+		fmt.Sprintf(c.graphUrl("/v1.0/directory/administrativeUnits/%s/members"),
 			requestPayload.ParentAdministrativeUnitId), bytes.NewBuffer(serialised))
 	if err != nil {
 		return nil, err
@@ -236,13 +137,13 @@ func (c *Client) CreateAdministrativeUnitGroup(ctx context.Context, requestPaylo
 	}
 	defer resp.Body.Close()
 
-	rawData, err := io.ReadAll(resp.Body)
-	if err != nil {
+	if err := httpclient.CheckResponse(resp, HttpError, http.StatusCreated); err != nil {
 		return nil, err
 	}
 
-	if resp.StatusCode != http.StatusCreated {
-		return nil, ApiError{resp.StatusCode}
+	rawData, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
 	}
 
 	var payload CreateAdministrativeUnitGroupResponse
@@ -254,8 +155,8 @@ func (c *Client) CreateAdministrativeUnitGroup(ctx context.Context, requestPaylo
 	return &payload, nil
 }
 
-func (c *Client) DeleteAdministrativeUnitGroup(aUnitId string, groupId string) error {
-	req, err := http.NewRequest("DELETE", fmt.Sprintf("https://graph.microsoft.com/v1.0/directory/administrativeUnits/%s/members/%s", aUnitId, groupId), nil)
+func (c *Client) DeleteAdministrativeUnitGroup(ctx context.Context, aUnitId string, groupId string) error {
+	req, err := http.NewRequestWithContext(ctx, "DELETE", fmt.Sprintf(c.graphUrl("/v1.0/directory/administrativeUnits/%s/members/%s"), aUnitId, groupId), nil)
 	if err != nil {
 		return err
 	}
@@ -271,59 +172,53 @@ func (c *Client) DeleteAdministrativeUnitGroup(aUnitId string, groupId string) e
 
 	defer resp.Body.Close()
 
-	if resp.StatusCode != 204 {
-		return fmt.Errorf("response returned unexpected status code: %d", resp.StatusCode)
-	}
-
-	return nil
+	return httpclient.CheckResponse(resp, HttpError, http.StatusNoContent)
 }
 
-func (c *Client) PopulateGroupsWithMembers(groups *GroupsListResponse) (map[string]*Group, error) {
-	var payload map[string]*Group
-	ctx := context.Background()
+// PopulateGroupsWithMembers returns groups with their members, by display name. It fails if the members of any group
+// can't be read, as a group missing from the result would look like it doesn't exist.
+func (c *Client) PopulateGroupsWithMembers(ctx context.Context, groups *GroupsListResponse) (map[string]*Group, error) {
+	payload := map[string]*Group{}
 	var waitGroup sync.WaitGroup
 	sem := semaphore.NewWeighted(50)
 	var lock *sync.Mutex = &sync.Mutex{}
+	var firstErr error
 
 	for _, grp := range groups.Value {
+		if err := sem.Acquire(ctx, 1); err != nil {
+			waitGroup.Wait()
+			return nil, err
+		}
 		waitGroup.Add(1)
 
 		grp := grp
 		go func() {
-			sem.Acquire(ctx, 1)
 			defer sem.Release(1)
 			defer waitGroup.Done()
 
-			group := &Group{
-				DisplayName: grp.DisplayName,
-				Members:     []*Member{},
-				ID:          grp.ID,
-			}
-			groupMembers, err := c.GetGroupMembers(grp.ID)
-			if err != nil {
-				fmt.Println(fmt.Sprintf("GetGroupMembers failed: %v", err), zap.Error(err))
-			}
-
-			for _, groupMember := range groupMembers.Value {
-				group.Members = append(group.Members, &Member{
-					ID:                groupMember.ID,
-					DisplayName:       groupMember.DisplayName,
-					UserPrincipalName: groupMember.UserPrincipalName,
-				})
-			}
+			group, err := c.GetGroupWithMembers(ctx, grp.ID, grp.DisplayName)
 
 			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
 			payload[group.DisplayName] = group
-			lock.Unlock()
 		}()
 	}
 
 	waitGroup.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
 
 	return payload, nil
 }
 
-func (c *Client) AddGroupMember(groupId string, upn string) error {
+func (c *Client) AddGroupMember(ctx context.Context, groupId string, upn string) error {
 	requestPayload := AddGroupMemberRequest{
 		OdataId: fmt.Sprintf("https://graph.microsoft.com/v1.0/users/%s", url.QueryEscape(upn)),
 	}
@@ -333,7 +228,7 @@ func (c *Client) AddGroupMember(groupId string, upn string) error {
 		return err
 	}
 
-	req, err := http.NewRequest("POST", fmt.Sprintf("https://graph.microsoft.com/v1.0/groups/%s/members/$ref", groupId), bytes.NewBuffer([]byte(serialised)))
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf(c.graphUrl("/v1.0/groups/%s/members/$ref"), groupId), bytes.NewBuffer([]byte(serialised)))
 	if err != nil {
 		return err
 	}
@@ -363,15 +258,15 @@ func (c *Client) AddGroupMember(groupId string, upn string) error {
 			return nil
 		}
 
-		return HttpError.New(fmt.Sprintf("Unexpected HTTP response. Status code: %d", resp.StatusCode))
+		return httpclient.CheckResponse(resp, HttpError, http.StatusNoContent)
 	}
 
 	return nil
 }
 
-func (c *Client) DeleteGroupMember(groupId string, memberId string) error {
+func (c *Client) DeleteGroupMember(ctx context.Context, groupId string, memberId string) error {
 
-	req, err := http.NewRequest("DELETE", fmt.Sprintf("https://graph.microsoft.com/v1.0/groups/%s/members/%s/$ref", groupId, memberId), nil)
+	req, err := http.NewRequestWithContext(ctx, "DELETE", fmt.Sprintf(c.graphUrl("/v1.0/groups/%s/members/%s/$ref"), groupId, memberId), nil)
 	if err != nil {
 		return err
 	}
@@ -398,81 +293,45 @@ func (c *Client) DeleteGroupMember(groupId string, memberId string) error {
 			return nil
 		}
 
-		return HttpError.New(fmt.Sprintf("Unexpected HTTP response. Status code: %d", resp.StatusCode))
+		return httpclient.CheckResponse(resp, HttpError, http.StatusNoContent)
 	}
 
 	return nil
 }
 
-func (c *Client) GetAdministrativeUnitMembers(id string) (*GetAdministrativeUnitMembersResponse, error) {
-	req, err := http.NewRequest("GET", fmt.Sprintf("https://graph.microsoft.com/v1.0/directory/administrativeUnits/%s/members", id), nil)
-	if err != nil {
-		return nil, err
-	}
-
-	err = c.prepareHttpRequest(req)
-	if err != nil {
-		return nil, err
-	}
-
-	resp, err := c.httpClient.Do(req)
-	if err != nil {
-		return nil, err
-	}
-
-	defer resp.Body.Close()
-
-	rawData, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
+// GetAdministrativeUnitMembers returns the members of an administrative unit. If the client is configured with a
+// CapabilityIdProperty, the Capability each group is bound to is read too.
+func (c *Client) GetAdministrativeUnitMembers(ctx context.Context, id string) (*GetAdministrativeUnitMembersResponse, error) {
+	query := url.Values{}
+	query.Set("$top", maxPageSize)
+	if c.config.CapabilityIdProperty != "" {
+		// Extension properties are only returned when selected
+		query.Set("$select", "id,displayName,description,mailNickname,createdDateTime,securityEnabled,"+c.config.CapabilityIdProperty)
 	}
 
-	var payload *GetAdministrativeUnitMembersResponse
-
-	err = json.Unmarshal(rawData, &payload)
+	members, err := getAllPages[json.RawMessage](ctx, c, fmt.Sprintf("/v1.0/directory/administrativeUnits/%s/members", id), query)
 	if err != nil {
 		return nil, err
 	}
 
-	nextLink := payload.OdataNextLink
-
-	for nextLink != "" {
-		req, err := http.NewRequest("GET", nextLink, nil)
-		if err != nil {
-			return nil, err
-		}
-		err = c.prepareHttpRequest(req)
-		if err != nil {
-			return nil, err
-		}
-
-		resp, err := c.httpClient.Do(req)
-		if err != nil {
-			return nil, err
-		}
-
-		rawData, err := io.ReadAll(resp.Body)
-		if err != nil {
+	units := make([]GetAdministrativeUnitMembersResponseUnit, 0, len(members))
+	for _, member := range members {
+		var unit GetAdministrativeUnitMembersResponseUnit
+		if err := json.Unmarshal(member, &unit); err != nil {
 			return nil, err
 		}
-
-		var buffer *GetAdministrativeUnitMembersResponse
-
-		err = json.Unmarshal(rawData, &buffer)
+		unit.CapabilityRootId, err = c.capabilityRootId(member)
 		if err != nil {
 			return nil, err
 		}
-
-		nextLink = buffer.OdataNextLink
-
-		payload.Value = append(payload.Value, buffer.Value...)
+		units = append(units, unit)
 	}
 
-	return payload, nil
+	return &GetAdministrativeUnitMembersResponse{Value: units}, nil
 }
 
-func (c *Client) GetUserViaUPN(upn string) (*GetUserViaUPNResponse, error) {
-	req, err := http.NewRequest("GET", fmt.Sprintf("https://graph.microsoft.com/v1.0/users/%s", url.QueryEscape(upn)), nil)
+func (c *Client) GetUserViaUPN(ctx context.Context, upn string) (*GetUserViaUPNResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf(c.graphUrl("/v1.0/users/%s"), url.QueryEscape(upn)), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -488,6 +347,13 @@ func (c *Client) GetUserViaUPN(upn string) (*GetUserViaUPNResponse, error) {
 
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, AdUserNotFound.New("User %s not found", upn)
+	}
+	if err := httpclient.CheckResponse(resp, HttpError); err != nil {
+		return nil, err
+	}
+
 	rawData, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return nil, err
@@ -503,8 +369,8 @@ func (c *Client) GetUserViaUPN(upn string) (*GetUserViaUPNResponse, error) {
 	return payload, nil
 }
 
-func (c *Client) GetUserViaEmail(email string) (*GetUserViaUPNResponse, error) {
-	req, err := http.NewRequest("GET", "https://graph.microsoft.com/v1.0/users", nil)
+func (c *Client) GetUserViaEmail(ctx context.Context, email string) (*GetUserViaUPNResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.graphUrl("/v1.0/users"), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -523,6 +389,9 @@ func (c *Client) GetUserViaEmail(email string) (*GetUserViaUPNResponse, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := httpclient.CheckResponse(resp, HttpError); err != nil {
+		return nil, err
+	}
 
 	defer resp.Body.Close()
 
@@ -539,7 +408,7 @@ func (c *Client) GetUserViaEmail(email string) (*GetUserViaUPNResponse, error) {
 	}
 
 	if len(payload.Value) == 0 {
-		return nil, errors.New("GetUserViaEmail user not found")
+		return nil, AdUserNotFound.New("User with e-mail %s not found", email)
 	}
 
 	return payload.Value[0], nil
@@ -549,142 +418,104 @@ func (c *Client) IsUserExternal(value string) bool {
 	return !strings.HasSuffix(strings.ToLower(value), c.config.InternalDomainSuffix)
 }
 
-func (c *Client) GetGroupMembers(id string) (*GroupMembers, error) {
-	req, err := http.NewRequest("GET", fmt.Sprintf("https://graph.microsoft.com/v1.0/groups/%s/members", id), nil)
-	if err != nil {
-		return nil, err
-	}
-	err = c.prepareHttpRequest(req)
-	if err != nil {
-		return nil, err
-	}
+// GetGroupMembers returns the direct members of a group: users, but also nested groups and other directory objects.
+func (c *Client) GetGroupMembers(ctx context.Context, id string) (*GroupMembers, error) {
+	query := url.Values{}
+	query.Set("$top", maxPageSize)
 
-	resp, err := c.httpClient.Do(req)
+	members, err := getAllPages[GroupMember](ctx, c, fmt.Sprintf("/v1.0/groups/%s/members", id), query)
 	if err != nil {
 		return nil, err
 	}
 
-	defer resp.Body.Close()
-
-	rawData, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
+	return &GroupMembers{Value: members}, nil
+}
 
-	var payload *GroupMembers
+// GetGroupTransitiveMembers returns the members of a group, and of the groups nested in it, recursively.
+func (c *Client) GetGroupTransitiveMembers(ctx context.Context, id string) (*GroupMembers, error) {
+	query := url.Values{}
+	query.Set("$top", maxPageSize)
 
-	err = json.Unmarshal(rawData, &payload)
+	members, err := getAllPages[GroupMember](ctx, c, fmt.Sprintf("/v1.0/groups/%s/transitiveMembers", id), query)
 	if err != nil {
 		return nil, err
 	}
 
-	return payload, nil
+	return &GroupMembers{Value: members}, nil
 }
 
-func (c *Client) GetApplicationRoles(appId string) (*GetApplicationRolesResponse, error) {
-	req, err := http.NewRequest("GET", "https://graph.microsoft.com/v1.0/applications", nil)
-	if err != nil {
-		return nil, err
-	}
-	err = c.prepareHttpRequest(req)
+// GetGroupWithMembers returns a group with its members. Members are the users that are direct members of the group;
+// nested groups are left out, as they are not members of a Capability. If the client is configured with
+// TransitiveMembers, the users that are only members through nested groups are included as InheritedMembers.
+func (c *Client) GetGroupWithMembers(ctx context.Context, id string, displayName string) (*Group, error) {
+	group := &Group{ID: id, DisplayName: displayName, Members: []*Member{}, InheritedMembers: []*Member{}}
+
+	directMembers, err := c.GetGroupMembers(ctx, id)
 	if err != nil {
 		return nil, err
 	}
 
-	urlQueryValues := req.URL.Query()
-	urlQueryValues.Set("$filter", fmt.Sprintf("appId eq '%s'", appId))
-	urlQueryValues.Set("$select", "displayName, appId, appRoles")
-	req.URL.RawQuery = urlQueryValues.Encode()
-
-	resp, err := c.httpClient.Do(req)
-	if err != nil {
-		return nil, err
+	direct := map[string]bool{}
+	for _, groupMember := range directMembers.Value {
+		if !groupMember.IsUser() {
+			continue
+		}
+		direct[groupMember.ID] = true
+		group.Members = append(group.Members, groupMember.toMember())
 	}
 
-	defer resp.Body.Close()
+	if !c.config.TransitiveMembers {
+		return group, nil
+	}
 
-	rawData, err := io.ReadAll(resp.Body)
+	transitiveMembers, err := c.GetGroupTransitiveMembers(ctx, id)
 	if err != nil {
 		return nil, err
 	}
 
-	var payload *GetApplicationRolesResponse
-
-	err = json.Unmarshal(rawData, &payload)
-	if err != nil {
-		return nil, err
+	for _, groupMember := range transitiveMembers.Value {
+		if !groupMember.IsUser() || direct[groupMember.ID] {
+			continue
+		}
+		// A user can be a member of several nested groups
+		direct[groupMember.ID] = true
+		group.InheritedMembers = append(group.InheritedMembers, groupMember.toMember())
 	}
 
-	return payload, nil
+	return group, nil
 }
 
-func (c *Client) GetAssignmentsForApplication(appObjectId string) (*GetAssignmentsForApplicationResponse, error) {
-	req, err := http.NewRequest("GET", fmt.Sprintf("https://graph.microsoft.com/beta/servicePrincipals/%s/appRoleAssignedTo", appObjectId), nil)
-	if err != nil {
-		return nil, err
-	}
-	err = c.prepareHttpRequest(req)
-	if err != nil {
-		return nil, err
-	}
+func (c *Client) GetApplicationRoles(ctx context.Context, appId string) (*GetApplicationRolesResponse, error) {
+	query := url.Values{}
+	query.Set("$filter", fmt.Sprintf("appId eq '%s'", appId))
+	query.Set("$select", "displayName, appId, appRoles")
 
-	resp, err := c.httpClient.Do(req)
+	apps, err := getAllPages[GetApplicationRolesResponseApplication](ctx, c, "/v1.0/applications", query)
 	if err != nil {
 		return nil, err
 	}
 
-	defer resp.Body.Close()
-
-	rawData, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
+	return &GetApplicationRolesResponse{Value: apps}, nil
+}
 
-	var payload *GetAssignmentsForApplicationResponse
+func (c *Client) GetAssignmentsForApplication(ctx context.Context, appObjectId string) (*GetAssignmentsForApplicationResponse, error) {
+	query := url.Values{}
+	query.Set("$top", maxPageSize)
 
-	err = json.Unmarshal(rawData, &payload)
+	assignments, err := getAllPages[*GetAssignmentsForApplicationResponseAssignment](ctx, c, fmt.Sprintf("/beta/servicePrincipals/%s/appRoleAssignedTo", appObjectId), query)
 	if err != nil {
 		return nil, err
 	}
 
-	nextLink := payload.OdataNextLink
-
-	for nextLink != "" {
-		req, err := http.NewRequest("GET", nextLink, nil)
-		if err != nil {
-			return nil, err
-		}
-		err = c.prepareHttpRequest(req)
-		if err != nil {
-			return nil, err
-		}
-
-		resp, err := c.httpClient.Do(req)
-		if err != nil {
-			return nil, err
-		}
-
-		rawData, err := io.ReadAll(resp.Body)
-		if err != nil {
-			return nil, err
-		}
-
-		var buffer *GetAssignmentsForApplicationResponse
-
-		err = json.Unmarshal(rawData, &buffer)
-		if err != nil {
-			return nil, err
-		}
-
-		nextLink = buffer.OdataNextLink
-
-		payload.Value = append(payload.Value, buffer.Value...)
-	}
+	return &GetAssignmentsForApplicationResponse{Value: assignments}, nil
+}
 
-	return payload, nil
+// GetGroupAppRoleAssignments returns the app roles a group is assigned to, across all enterprise applications.
+func (c *Client) GetGroupAppRoleAssignments(ctx context.Context, groupId string) ([]*GetAssignmentsForApplicationResponseAssignment, error) {
+	return getAllPages[*GetAssignmentsForApplicationResponseAssignment](ctx, c, fmt.Sprintf("/v1.0/groups/%s/appRoleAssignments", groupId), nil)
 }
 
-func (c *Client) AssignGroupToApplication(appObjectId string, groupId string, roleId string) (*AssignGroupToApplicationResponse, error) {
+func (c *Client) AssignGroupToApplication(ctx context.Context, appObjectId string, groupId string, roleId string) (*AssignGroupToApplicationResponse, error) {
 	requestPayload := AssignGroupToApplicationRequest{
 		PrincipalID: groupId,
 		ResourceID:  appObjectId,
@@ -696,7 +527,7 @@ func (c *Client) AssignGroupToApplication(appObjectId string, groupId string, ro
 		return nil, err
 	}
 
-	req, err := http.NewRequest("POST", fmt.Sprintf("https://graph.microsoft.com/v1.0/groups/%s/appRoleAssignments", groupId), bytes.NewBuffer([]byte(serialised)))
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf(c.graphUrl("/v1.0/groups/%s/appRoleAssignments"), groupId), bytes.NewBuffer([]byte(serialised)))
 	if err != nil {
 		return nil, err
 	}
@@ -712,13 +543,13 @@ func (c *Client) AssignGroupToApplication(appObjectId string, groupId string, ro
 
 	defer resp.Body.Close()
 
-	rawData, err := io.ReadAll(resp.Body)
-	if err != nil {
+	if err := httpclient.CheckResponse(resp, HttpError, http.StatusCreated); err != nil {
 		return nil, err
 	}
 
-	if resp.StatusCode != 201 {
-		return nil, fmt.Errorf("response returned unexpected status code: %d", resp.StatusCode)
+	rawData, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
 	}
 
 	var payload *AssignGroupToApplicationResponse
@@ -731,10 +562,10 @@ func (c *Client) AssignGroupToApplication(appObjectId string, groupId string, ro
 	return payload, nil
 }
 
-func (c *Client) UnassignGroupFromApplication(groupId string, assignmentId string) error {
-	req, err := http.NewRequest("DELETE", fmt.Sprintf("https://graph.microsoft.com/v1.0/groups/%s/appRoleAssignments/%s", groupId, assignmentId), nil)
+func (c *Client) UnassignGroupFromApplication(ctx context.Context, groupId string, assignmentId string) error {
+	req, err := http.NewRequestWithContext(ctx, "DELETE", fmt.Sprintf(c.graphUrl("/v1.0/groups/%s/appRoleAssignments/%s"), groupId, assignmentId), nil)
 	if err != nil {
-		return nil
+		return err
 	}
 	err = c.prepareHttpRequest(req)
 	if err != nil {
@@ -743,29 +574,40 @@ func (c *Client) UnassignGroupFromApplication(groupId string, assignmentId strin
 
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		return nil
+		return err
 	}
 
 	defer resp.Body.Close()
 
-	if resp.StatusCode != 204 {
-		return fmt.Errorf("response returned unexpected status code: %d", resp.StatusCode)
-	}
-
-	return nil
+	return httpclient.CheckResponse(resp, HttpError, http.StatusNoContent)
 }
 
 func NewAzureClient(conf Config) *Client {
 	payload := &Client{
-		httpClient: http.DefaultClient,
+		httpClient: httpclient.New(httpclient.DefaultConfig(metrics.TargetGraph)),
 		config:     conf,
 	}
 
-	payload.tokenClient = util.NewTokenClient(payload.getNewToken)
+	payload.tokenClient = entraid.NewTokenClient(conf.Auth, payload.getNewToken)
 
 	return payload
 }
 
+// NewAzureClientForUrl creates a Client sending Graph requests to baseUrl with a static token, e.g. to test code using
+// the Client against a fake Graph.
+func NewAzureClientForUrl(conf Config, baseUrl string) *Client {
+	client := NewAzureClient(conf)
+	client.baseUrl = baseUrl
+	client.tokenClient = util.NewTokenClient(func() (*util.RefreshAuthResponse, error) {
+		return &util.RefreshAuthResponse{
+			ExpiresIn:   time.Now().Add(time.Hour).Unix(),
+			AccessToken: "static",
+		}, nil
+	})
+
+	return client
+}
+
 const AZURE_CAPABILITY_GROUP_PREFIX = "CI_SSU_Cap -"
 const AZURE_CAPABILITY_GROUP_MAIL_PREFIX = "ci-ssu_cap_"
 
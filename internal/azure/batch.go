@@ -0,0 +1,424 @@
+package azure
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.dfds.cloud/aad-aws-sync/internal/httpclient"
+)
+
+const (
+	// maxBatchSize is the most requests Graph accepts in a single $batch request
+	maxBatchSize = 20
+	// maxBindSize is the most members Graph accepts in a single members@odata.bind update
+	maxBindSize = 20
+	// maxBatchAttempts is how often a throttled request of a batch is sent
+	maxBatchAttempts = 3
+	// maxBatchRetryAfter is the longest Retry-After of a throttled request of a batch that is waited for
+	maxBatchRetryAfter = 30 * time.Second
+)
+
+// BatchRequest is a single request of a Graph $batch request. URL is relative to the Graph version, e.g.
+// /users/{id}.
+type BatchRequest struct {
+	ID      string            `json:"id"`
+	Method  string            `json:"method"`
+	URL     string            `json:"url"`
+	Body    any               `json:"body,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// BatchResponse is the response to a single request of a Graph $batch request.
+type BatchResponse struct {
+	ID      string            `json:"id"`
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers"`
+	Body    json.RawMessage   `json:"body"`
+}
+
+type batchRequestPayload struct {
+	Requests []BatchRequest `json:"requests"`
+}
+
+type batchResponsePayload struct {
+	Responses []BatchResponse `json:"responses"`
+}
+
+// err returns the error of a failed request of a batch, of the same types the single requests return: AdUserNotFound
+// for 404, HttpError403 for 403 and HttpError otherwise. what describes the object of the request.
+func (r BatchResponse) err(what string) error {
+	switch {
+	case r.Status >= 200 && r.Status < 300:
+		return nil
+	case r.Status == http.StatusNotFound:
+		return AdUserNotFound.New("%s not found", what)
+	case r.Status == http.StatusForbidden:
+		return HttpError403.New("Response for %s returned with unexpected 403", what)
+	}
+
+	return HttpError.New("unexpected batch response for %s: %d %s", what, r.Status, string(r.Body)).
+		WithProperty(httpclient.PropertyStatusCode, r.Status).
+		WithProperty(httpclient.PropertyResponseBody, string(r.Body))
+}
+
+func (r BatchResponse) throttled() (time.Duration, bool) {
+	if r.Status != http.StatusTooManyRequests && r.Status != http.StatusServiceUnavailable {
+		return 0, false
+	}
+
+	for key, value := range r.Headers {
+		if strings.EqualFold(key, "Retry-After") {
+			if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+				delay := time.Duration(seconds) * time.Second
+				return delay, delay <= maxBatchRetryAfter
+			}
+		}
+	}
+
+	return time.Second, true
+}
+
+// Batch sends requests to Graph in $batch requests of up to 20, and returns the responses by request ID. The IDs of
+// requests must be unique. Requests that are throttled are sent again after the delay Graph asks for, so the
+// responses of those throttled for too long have status 429.
+func (c *Client) Batch(ctx context.Context, requests []BatchRequest) (map[string]BatchResponse, error) {
+	responses := make(map[string]BatchResponse, len(requests))
+
+	pending := requests
+	for attempt := 1; len(pending) > 0; attempt++ {
+		var throttled []BatchRequest
+		var delay time.Duration
+		for start := 0; start < len(pending); start += maxBatchSize {
+			end := start + maxBatchSize
+			if end > len(pending) {
+				end = len(pending)
+			}
+
+			batchResponses, err := c.sendBatch(ctx, pending[start:end])
+			if err != nil {
+				return nil, err
+			}
+
+			for _, req := range pending[start:end] {
+				resp, ok := batchResponses[req.ID]
+				if !ok {
+					return nil, HttpError.New("no response to request %s of batch", req.ID)
+				}
+				responses[req.ID] = resp
+
+				if retryAfter, retry := resp.throttled(); retry && attempt < maxBatchAttempts {
+					throttled = append(throttled, req)
+					if retryAfter > delay {
+						delay = retryAfter
+					}
+				}
+			}
+		}
+
+		pending = throttled
+		if len(pending) > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(delay):
+			}
+		}
+	}
+
+	return responses, nil
+}
+
+func (c *Client) sendBatch(ctx context.Context, requests []BatchRequest) (map[string]BatchResponse, error) {
+	serialised, err := json.Marshal(batchRequestPayload{Requests: requests})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", c.graphUrl("/v1.0/$batch"), bytes.NewBuffer(serialised))
+	if err != nil {
+		return nil, err
+	}
+	err = c.prepareJsonRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := httpclient.CheckResponse(resp, HttpError, http.StatusOK); err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	rawData, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var payload batchResponsePayload
+	err = json.Unmarshal(rawData, &payload)
+	if err != nil {
+		return nil, err
+	}
+
+	responses := make(map[string]BatchResponse, len(payload.Responses))
+	for _, batchResponse := range payload.Responses {
+		responses[batchResponse.ID] = batchResponse
+	}
+
+	return responses, nil
+}
+
+// UserResult is the outcome of looking up a single user in a batch.
+type UserResult struct {
+	User *GetUserViaUPNResponse
+	// Err is AdUserNotFound if there is no such user
+	Err error
+}
+
+// GetUsersViaUPN looks up users by user principal name in batches, see GetUserViaUPN. It returns the result of each
+// lookup by UPN.
+func (c *Client) GetUsersViaUPN(ctx context.Context, upns []string) (map[string]UserResult, error) {
+	requests := make([]BatchRequest, 0, len(upns))
+	for i, upn := range upns {
+		requests = append(requests, BatchRequest{ID: strconv.Itoa(i), Method: "GET", URL: fmt.Sprintf("/users/%s", url.PathEscape(upn))})
+	}
+
+	responses, err := c.Batch(ctx, requests)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make(map[string]UserResult, len(upns))
+	for i, upn := range upns {
+		resp := responses[strconv.Itoa(i)]
+		if err := resp.err(fmt.Sprintf("User %s", upn)); err != nil {
+			results[upn] = UserResult{Err: err}
+			continue
+		}
+
+		var user *GetUserViaUPNResponse
+		if err := json.Unmarshal(resp.Body, &user); err != nil {
+			return nil, err
+		}
+		results[upn] = UserResult{User: user}
+	}
+
+	return results, nil
+}
+
+// GetUsersViaEmail looks up users by e-mail address in batches, see GetUserViaEmail. It returns the result of each
+// lookup by e-mail address.
+func (c *Client) GetUsersViaEmail(ctx context.Context, emails []string) (map[string]UserResult, error) {
+	requests := make([]BatchRequest, 0, len(emails))
+	for i, email := range emails {
+		query := url.Values{}
+		query.Set("$top", "5")
+		query.Set("$filter", fmt.Sprintf("mail eq '%s'", strings.ReplaceAll(email, "'", "''")))
+		requests = append(requests, BatchRequest{ID: strconv.Itoa(i), Method: "GET", URL: "/users?" + query.Encode()})
+	}
+
+	responses, err := c.Batch(ctx, requests)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make(map[string]UserResult, len(emails))
+	for i, email := range emails {
+		resp := responses[strconv.Itoa(i)]
+		if err := resp.err(fmt.Sprintf("User with e-mail %s", email)); err != nil {
+			results[email] = UserResult{Err: err}
+			continue
+		}
+
+		var users *GetUsersResponse
+		if err := json.Unmarshal(resp.Body, &users); err != nil {
+			return nil, err
+		}
+		if len(users.Value) == 0 {
+			results[email] = UserResult{Err: AdUserNotFound.New("User with e-mail %s not found", email)}
+			continue
+		}
+		results[email] = UserResult{User: users.Value[0]}
+	}
+
+	return results, nil
+}
+
+// AddGroupMembers adds the users with the given object IDs to a group, up to 20 at a time with a single
+// members@odata.bind update. If an update is rejected, e.g. because one of the users is already a member or doesn't
+// exist, its users are added one by one in a batch instead, to find out which. It returns the error of each user that
+// couldn't be added by object ID, mapped like AddGroupMember does. Graph answers with 404 whether the user or the group
+// is missing, so a GroupNotFound error is returned if the group doesn't exist.
+func (c *Client) AddGroupMembers(ctx context.Context, groupId string, userIds []string) (map[string]error, error) {
+	errs := map[string]error{}
+
+	var individually []string
+	for start := 0; start < len(userIds); start += maxBindSize {
+		end := start + maxBindSize
+		if end > len(userIds) {
+			end = len(userIds)
+		}
+
+		bound, err := c.bindGroupMembers(ctx, groupId, userIds[start:end])
+		if err != nil {
+			return nil, err
+		}
+		if !bound {
+			individually = append(individually, userIds[start:end]...)
+		}
+	}
+
+	if len(individually) == 0 {
+		return errs, nil
+	}
+
+	requests := make([]BatchRequest, 0, len(individually))
+	for _, userId := range individually {
+		requests = append(requests, BatchRequest{
+			ID:      userId,
+			Method:  "POST",
+			URL:     fmt.Sprintf("/groups/%s/members/$ref", groupId),
+			Body:    AddGroupMemberRequest{OdataId: fmt.Sprintf("https://graph.microsoft.com/v1.0/directoryObjects/%s", userId)},
+			Headers: map[string]string{"Content-Type": "application/json"},
+		})
+	}
+
+	responses, err := c.Batch(ctx, requests)
+	if err != nil {
+		return nil, err
+	}
+
+	notFound := false
+	for _, userId := range individually {
+		resp := responses[userId]
+		// Like AddGroupMember, a 400 most likely means the user is already a member
+		if resp.Status == http.StatusBadRequest {
+			continue
+		}
+		if resp.Status == http.StatusNotFound {
+			notFound = true
+		}
+		if err := resp.err(fmt.Sprintf("User %s", userId)); err != nil {
+			errs[userId] = err
+		}
+	}
+
+	if notFound {
+		exists, err := c.groupExists(ctx, groupId)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			return nil, GroupNotFound.New("group %s not found", groupId)
+		}
+	}
+
+	return errs, nil
+}
+
+// groupExists reports whether there is a group with the given object ID.
+func (c *Client) groupExists(ctx context.Context, groupId string) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.graphUrl(fmt.Sprintf("/v1.0/groups/%s?$select=id", groupId)), nil)
+	if err != nil {
+		return false, err
+	}
+	err = c.prepareJsonRequest(req)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if err := httpclient.CheckResponse(resp, HttpError, http.StatusOK); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// bindGroupMembers adds users to a group with a single update. It returns false if Graph rejected the update, e.g.
+// with 404 for a missing user or group, which AddGroupMembers tells apart by adding the users one by one.
+func (c *Client) bindGroupMembers(ctx context.Context, groupId string, userIds []string) (bool, error) {
+	bind := make([]string, 0, len(userIds))
+	for _, userId := range userIds {
+		bind = append(bind, fmt.Sprintf("https://graph.microsoft.com/v1.0/directoryObjects/%s", userId))
+	}
+
+	serialised, err := json.Marshal(map[string][]string{"members@odata.bind": bind})
+	if err != nil {
+		return false, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "PATCH", c.graphUrl(fmt.Sprintf("/v1.0/groups/%s", groupId)), bytes.NewBuffer(serialised))
+	if err != nil {
+		return false, err
+	}
+	err = c.prepareJsonRequest(req)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNoContent:
+		return true, nil
+	case http.StatusBadRequest, http.StatusNotFound, http.StatusForbidden:
+		return false, nil
+	}
+
+	return false, httpclient.CheckResponse(resp, HttpError, http.StatusNoContent)
+}
+
+// DeleteGroupMembers removes the members with the given object IDs from a group in batches. Like DeleteGroupMember,
+// members that are not found or can't be removed for lack of permissions are skipped. It returns the error of each
+// member that couldn't be removed otherwise, by object ID.
+func (c *Client) DeleteGroupMembers(ctx context.Context, groupId string, memberIds []string) (map[string]error, error) {
+	requests := make([]BatchRequest, 0, len(memberIds))
+	for _, memberId := range memberIds {
+		requests = append(requests, BatchRequest{ID: memberId, Method: "DELETE", URL: fmt.Sprintf("/groups/%s/members/%s/$ref", groupId, memberId)})
+	}
+
+	responses, err := c.Batch(ctx, requests)
+	if err != nil {
+		return nil, err
+	}
+
+	errs := map[string]error{}
+	for _, memberId := range memberIds {
+		resp := responses[memberId]
+		if resp.Status == http.StatusNotFound || resp.Status == http.StatusForbidden {
+			continue
+		}
+		if err := resp.err(fmt.Sprintf("Member %s", memberId)); err != nil {
+			errs[memberId] = err
+		}
+	}
+
+	return errs, nil
+}
@@ -0,0 +1,196 @@
+package azure
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/joomcode/errorx"
+	"github.com/stretchr/testify/assert"
+)
+
+// batchServer returns a handler answering each request of a $batch with respond, and the number of $batch requests
+// it got.
+func batchServer(t *testing.T, respond func(req BatchRequest) BatchResponse) (http.HandlerFunc, func() int) {
+	var lock sync.Mutex
+	batches := 0
+
+	return func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/v1.0/$batch" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			var payload struct {
+				Requests []BatchRequest `json:"requests"`
+			}
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+			assert.LessOrEqual(t, len(payload.Requests), 20)
+
+			lock.Lock()
+			batches++
+			lock.Unlock()
+
+			responses := []BatchResponse{}
+			for _, req := range payload.Requests {
+				resp := respond(req)
+				resp.ID = req.ID
+				responses = append(responses, resp)
+			}
+			assert.NoError(t, json.NewEncoder(w).Encode(map[string]any{"responses": responses}))
+		}, func() int {
+			lock.Lock()
+			defer lock.Unlock()
+			return batches
+		}
+}
+
+func TestClient_Batch(t *testing.T) {
+	attempts := map[string]int{}
+	handler, batches := batchServer(t, func(req BatchRequest) BatchResponse {
+		attempts[req.ID]++
+		if req.ID == "7" && attempts[req.ID] == 1 {
+			return BatchResponse{Status: http.StatusTooManyRequests, Headers: map[string]string{"Retry-After": "0"}}
+		}
+		return BatchResponse{Status: http.StatusOK, Body: json.RawMessage(`{}`)}
+	})
+	az := newTestClient(t, Config{}, handler)
+
+	var requests []BatchRequest
+	for i := 0; i < 45; i++ {
+		requests = append(requests, BatchRequest{ID: fmt.Sprint(i), Method: "GET", URL: fmt.Sprintf("/users/%d", i)})
+	}
+
+	responses, err := az.Batch(context.Background(), requests)
+	assert.NoError(t, err)
+	assert.Len(t, responses, 45)
+	// 45 requests take 3 batches, and the throttled request a 4th
+	assert.Equal(t, 4, batches())
+	assert.Equal(t, http.StatusOK, responses["7"].Status)
+	assert.Equal(t, 2, attempts["7"])
+}
+
+func TestClient_GetUsersViaEmail(t *testing.T) {
+	handler, _ := batchServer(t, func(req BatchRequest) BatchResponse {
+		switch {
+		case strings.Contains(req.URL, "o%27%27brien"):
+			return BatchResponse{Status: http.StatusOK, Body: json.RawMessage(`{"value":[{"id":"1","userPrincipalName":"obrien_example.com#EXT#@dfds.onmicrosoft.com"}]}`)}
+		case strings.Contains(req.URL, "forbidden"):
+			return BatchResponse{Status: http.StatusForbidden}
+		default:
+			return BatchResponse{Status: http.StatusOK, Body: json.RawMessage(`{"value":[]}`)}
+		}
+	})
+	az := newTestClient(t, Config{}, handler)
+
+	results, err := az.GetUsersViaEmail(context.Background(), []string{"o'brien@example.com", "missing@example.com", "forbidden@example.com"})
+	assert.NoError(t, err)
+	assert.NoError(t, results["o'brien@example.com"].Err)
+	assert.Equal(t, "1", results["o'brien@example.com"].User.ID)
+	assert.True(t, errorx.IsOfType(results["missing@example.com"].Err, AdUserNotFound))
+	assert.True(t, errorx.IsOfType(results["forbidden@example.com"].Err, HttpError403))
+}
+
+func TestClient_GetUsersViaUPN(t *testing.T) {
+	handler, _ := batchServer(t, func(req BatchRequest) BatchResponse {
+		if req.URL == "/users/user@dfds.com" {
+			return BatchResponse{Status: http.StatusOK, Body: json.RawMessage(`{"id":"1","mail":"user@dfds.com"}`)}
+		}
+		if req.URL == "/users/broken@dfds.com" {
+			return BatchResponse{Status: http.StatusInternalServerError, Body: json.RawMessage(`{"error":{"code":"generalException"}}`)}
+		}
+		return BatchResponse{Status: http.StatusNotFound}
+	})
+	az := newTestClient(t, Config{}, handler)
+
+	results, err := az.GetUsersViaUPN(context.Background(), []string{"user@dfds.com", "missing@dfds.com", "broken@dfds.com"})
+	assert.NoError(t, err)
+	assert.Equal(t, "user@dfds.com", results["user@dfds.com"].User.Mail)
+	assert.True(t, errorx.IsOfType(results["missing@dfds.com"].Err, AdUserNotFound))
+	assert.True(t, errorx.IsOfType(results["broken@dfds.com"].Err, HttpError))
+}
+
+func TestClient_AddGroupMembers(t *testing.T) {
+	var bound [][]string
+	batch, _ := batchServer(t, func(req BatchRequest) BatchResponse {
+		switch {
+		case req.URL == "/groups/gone/members/$ref":
+			return BatchResponse{Status: http.StatusNotFound}
+		case strings.HasSuffix(req.Body.(map[string]any)["@odata.id"].(string), "/member"):
+			return BatchResponse{Status: http.StatusBadRequest}
+		case strings.HasSuffix(req.Body.(map[string]any)["@odata.id"].(string), "/missing"):
+			return BatchResponse{Status: http.StatusNotFound}
+		}
+		return BatchResponse{Status: http.StatusNoContent}
+	})
+	az := newTestClient(t, Config{}, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/v1.0/groups/group-1":
+			fmt.Fprint(w, `{"id":"group-1"}`)
+			return
+		case r.URL.Path == "/v1.0/groups/gone":
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Method == http.MethodPatch {
+			assert.Equal(t, "/v1.0/groups/group-1", r.URL.Path)
+			body, _ := io.ReadAll(r.Body)
+			var payload map[string][]string
+			assert.NoError(t, json.Unmarshal(body, &payload))
+			bound = append(bound, payload["members@odata.bind"])
+			if strings.Contains(string(body), "missing") {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		batch(w, r)
+	})
+
+	// Up to 20 members are added with a single update
+	var userIds []string
+	for i := 0; i < 25; i++ {
+		userIds = append(userIds, fmt.Sprintf("user-%d", i))
+	}
+	errs, err := az.AddGroupMembers(context.Background(), "group-1", userIds)
+	assert.NoError(t, err)
+	assert.Empty(t, errs)
+	assert.Len(t, bound, 2)
+	assert.Len(t, bound[0], 20)
+	assert.Equal(t, "https://graph.microsoft.com/v1.0/directoryObjects/user-0", bound[0][0])
+
+	// A rejected update is retried member by member, to find the one that failed
+	errs, err = az.AddGroupMembers(context.Background(), "group-1", []string{"new", "member", "missing"})
+	assert.NoError(t, err)
+	assert.Len(t, errs, 1)
+	assert.True(t, errorx.IsOfType(errs["missing"], AdUserNotFound))
+
+	// Graph answers with 404 for a missing group as well, which isn't mistaken for missing users
+	_, err = az.AddGroupMembers(context.Background(), "gone", []string{"new", "member"})
+	assert.True(t, errorx.IsOfType(err, GroupNotFound))
+}
+
+func TestClient_DeleteGroupMembers(t *testing.T) {
+	handler, _ := batchServer(t, func(req BatchRequest) BatchResponse {
+		assert.Equal(t, "DELETE", req.Method)
+		switch req.ID {
+		case "gone":
+			return BatchResponse{Status: http.StatusNotFound}
+		case "broken":
+			return BatchResponse{Status: http.StatusInternalServerError}
+		}
+		return BatchResponse{Status: http.StatusNoContent}
+	})
+	az := newTestClient(t, Config{}, handler)
+
+	errs, err := az.DeleteGroupMembers(context.Background(), "group-1", []string{"stale", "gone", "broken"})
+	assert.NoError(t, err)
+	assert.Len(t, errs, 1)
+	assert.True(t, errorx.IsOfType(errs["broken"], HttpError))
+}
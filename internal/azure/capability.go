@@ -0,0 +1,89 @@
+package azure
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"go.dfds.cloud/aad-aws-sync/internal/httpclient"
+)
+
+// CapabilityGroupDescription is the description of the AAD group of the Capability with the given name.
+func CapabilityGroupDescription(capabilityName string) string {
+	return fmt.Sprintf("[Automated] - aad-aws-sync - %s", capabilityName)
+}
+
+// capabilityRootId reads the root ID of the Capability a group is bound to from the group as returned by Graph.
+func (c *Client) capabilityRootId(group json.RawMessage) (string, error) {
+	if c.config.CapabilityIdProperty == "" {
+		return "", nil
+	}
+
+	var properties map[string]any
+	if err := json.Unmarshal(group, &properties); err != nil {
+		return "", err
+	}
+	rootId, _ := properties[c.config.CapabilityIdProperty].(string)
+
+	return rootId, nil
+}
+
+// BindsGroups reports whether the client is configured to bind groups to Capabilities, see
+// Config.CapabilityIdProperty.
+func (c *Client) BindsGroups() bool {
+	return c.config.CapabilityIdProperty != ""
+}
+
+// GetCapabilityGroups returns the groups bound to the Capability with the given root ID. Returns no groups if the
+// client isn't configured to bind groups to Capabilities.
+func (c *Client) GetCapabilityGroups(ctx context.Context, rootId string) (*GroupsListResponse, error) {
+	if !c.BindsGroups() {
+		return &GroupsListResponse{Value: []GroupsListResponseGroup{}}, nil
+	}
+
+	query := url.Values{}
+	query.Set("$filter", fmt.Sprintf("%s eq '%s'", c.config.CapabilityIdProperty, strings.ReplaceAll(rootId, "'", "''")))
+	query.Set("$top", maxPageSize)
+
+	groups, err := getAllPages[GroupsListResponseGroup](ctx, c, "/v1.0/groups", query)
+	if err != nil {
+		return nil, err
+	}
+
+	return &GroupsListResponse{Value: groups}, nil
+}
+
+// BindGroupToCapability stores the root ID of a Capability on its group, if the client is configured to bind groups
+// to Capabilities, and sets the description of the group to the name of the Capability.
+func (c *Client) BindGroupToCapability(ctx context.Context, groupId string, rootId string, capabilityName string) error {
+	requestPayload := map[string]string{"description": CapabilityGroupDescription(capabilityName)}
+	if c.BindsGroups() {
+		requestPayload[c.config.CapabilityIdProperty] = rootId
+	}
+
+	serialised, err := json.Marshal(requestPayload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "PATCH", fmt.Sprintf(c.graphUrl("/v1.0/groups/%s"), groupId), bytes.NewBuffer(serialised))
+	if err != nil {
+		return err
+	}
+	err = c.prepareJsonRequest(req)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return httpclient.CheckResponse(resp, HttpError, http.StatusNoContent)
+}
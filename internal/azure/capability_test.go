@@ -0,0 +1,63 @@
+package azure
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testCapabilityIdProperty = "extension_app_capabilityRootId"
+
+func TestClient_GetAdministrativeUnitMembersCapability(t *testing.T) {
+	az := newTestClient(t, Config{CapabilityIdProperty: testCapabilityIdProperty}, func(w http.ResponseWriter, r *http.Request) {
+		assert.Contains(t, r.URL.Query().Get("$select"), testCapabilityIdProperty)
+		fmt.Fprintf(w, `{"value":[
+			{"id":"1","displayName":"CI_SSU_Cap - sandbox-abcde","description":"[Automated] - aad-aws-sync","%[1]s":"sandbox-abcde"},
+			{"id":"2","displayName":"CI_SSU_Cap - other-fghij"}
+		]}`, testCapabilityIdProperty)
+	})
+
+	members, err := az.GetAdministrativeUnitMembers(context.Background(), "unit")
+	assert.NoError(t, err)
+	assert.Len(t, members.Value, 2)
+	assert.Equal(t, "sandbox-abcde", members.Value[0].CapabilityRootId)
+	assert.Equal(t, "[Automated] - aad-aws-sync", members.Value[0].Description)
+	assert.Equal(t, "", members.Value[1].CapabilityRootId)
+}
+
+func TestClient_GetCapabilityGroups(t *testing.T) {
+	az := newTestClient(t, Config{CapabilityIdProperty: testCapabilityIdProperty}, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1.0/groups", r.URL.Path)
+		assert.Equal(t, testCapabilityIdProperty+" eq 'sandbox-abcde'", r.URL.Query().Get("$filter"))
+		fmt.Fprint(w, `{"value":[{"id":"1","displayName":"Sandbox"}]}`)
+	})
+
+	groups, err := az.GetCapabilityGroups(context.Background(), "sandbox-abcde")
+	assert.NoError(t, err)
+	assert.Len(t, groups.Value, 1)
+
+	// Without a capability ID property no group is bound
+	groups, err = NewAzureClient(Config{}).GetCapabilityGroups(context.Background(), "sandbox-abcde")
+	assert.NoError(t, err)
+	assert.Empty(t, groups.Value)
+}
+
+func TestClient_BindGroupToCapability(t *testing.T) {
+	var payload map[string]string
+	az := newTestClient(t, Config{CapabilityIdProperty: testCapabilityIdProperty}, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPatch, r.Method)
+		assert.Equal(t, "/v1.0/groups/group-1", r.URL.Path)
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	assert.NoError(t, az.BindGroupToCapability(context.Background(), "group-1", "sandbox-abcde", "Sandbox"))
+	assert.Equal(t, map[string]string{
+		"description":            "[Automated] - aad-aws-sync - Sandbox",
+		testCapabilityIdProperty: "sandbox-abcde",
+	}, payload)
+}
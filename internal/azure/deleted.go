@@ -0,0 +1,141 @@
+package azure
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"go.dfds.cloud/aad-aws-sync/internal/httpclient"
+)
+
+// DeletedGroup is a soft-deleted group, which can be restored for 30 days after it was deleted.
+type DeletedGroup struct {
+	ID              string    `json:"id"`
+	DisplayName     string    `json:"displayName"`
+	DeletedDateTime time.Time `json:"deletedDateTime"`
+	// CapabilityRootId is the root ID of the Capability the group was bound to, see Config.CapabilityIdProperty
+	CapabilityRootId string `json:"capabilityRootId,omitempty"`
+}
+
+// GetDeletedCapabilityGroups returns the soft-deleted groups of the Capability with the given root ID: the groups
+// that were bound to it, and the groups with the display name of its group. The most recently deleted group comes
+// first.
+func (c *Client) GetDeletedCapabilityGroups(ctx context.Context, rootId string) ([]*DeletedGroup, error) {
+	filters := []string{fmt.Sprintf("displayName eq '%s'", strings.ReplaceAll(GenerateAzureGroupDisplayName(rootId), "'", "''"))}
+	if c.BindsGroups() {
+		filters = append(filters, fmt.Sprintf("%s eq '%s'", c.config.CapabilityIdProperty, strings.ReplaceAll(rootId, "'", "''")))
+	}
+
+	groups := []*DeletedGroup{}
+	seen := map[string]bool{}
+	for _, filter := range filters {
+		query := url.Values{}
+		query.Set("$filter", filter)
+		query.Set("$top", maxPageSize)
+		if c.BindsGroups() {
+			query.Set("$select", "id,displayName,deletedDateTime,"+c.config.CapabilityIdProperty)
+		}
+
+		items, err := getAllPages[json.RawMessage](ctx, c, "/v1.0/directory/deletedItems/microsoft.graph.group", query)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range items {
+			var group DeletedGroup
+			if err := json.Unmarshal(item, &group); err != nil {
+				return nil, err
+			}
+			group.CapabilityRootId, err = c.capabilityRootId(item)
+			if err != nil {
+				return nil, err
+			}
+			// A group bound to another Capability only has the display name of this one
+			if seen[group.ID] || (group.CapabilityRootId != "" && group.CapabilityRootId != rootId) {
+				continue
+			}
+			seen[group.ID] = true
+			groups = append(groups, &group)
+		}
+	}
+
+	sort.SliceStable(groups, func(i, j int) bool {
+		return groups[i].DeletedDateTime.After(groups[j].DeletedDateTime)
+	})
+
+	return groups, nil
+}
+
+// RestoreDeletedGroup restores a soft-deleted group, with the object ID, members and app assignments it had.
+func (c *Client) RestoreDeletedGroup(ctx context.Context, id string) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf(c.graphUrl("/v1.0/directory/deletedItems/%s/restore"), id), nil)
+	if err != nil {
+		return err
+	}
+	err = c.prepareJsonRequest(req)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := httpclient.CheckResponse(resp, HttpError, http.StatusOK); err != nil {
+		return err
+	}
+	_, err = io.Copy(io.Discard, resp.Body)
+
+	return err
+}
+
+// AddAdministrativeUnitMember adds a group to an administrative unit. Adding a group that is already a member is not
+// an error.
+func (c *Client) AddAdministrativeUnitMember(ctx context.Context, aUnitId string, groupId string) error {
+	serialised, err := json.Marshal(AddGroupMemberRequest{
+		OdataId: fmt.Sprintf("https://graph.microsoft.com/v1.0/groups/%s", groupId),
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf(c.graphUrl("/v1.0/directory/administrativeUnits/%s/members/$ref"), aUnitId), bytes.NewBuffer(serialised))
+	if err != nil {
+		return err
+	}
+	err = c.prepareJsonRequest(req)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusBadRequest {
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		if strings.Contains(string(body), "already exist") {
+			return nil
+		}
+
+		return HttpError.New("unexpected response adding group %s to administrative unit %s: %d %s", groupId, aUnitId, resp.StatusCode, string(body)).
+			WithProperty(httpclient.PropertyStatusCode, resp.StatusCode).
+			WithProperty(httpclient.PropertyResponseBody, string(body))
+	}
+
+	return httpclient.CheckResponse(resp, HttpError, http.StatusNoContent)
+}
@@ -0,0 +1,71 @@
+package azure
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClient_GetDeletedCapabilityGroups(t *testing.T) {
+	az := newTestClient(t, Config{CapabilityIdProperty: testCapabilityIdProperty}, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1.0/directory/deletedItems/microsoft.graph.group", r.URL.Path)
+		switch r.URL.Query().Get("$filter") {
+		case "displayName eq 'CI_SSU_Cap - sandbox-abcde'":
+			fmt.Fprintf(w, `{"value":[
+				{"id":"named","displayName":"CI_SSU_Cap - sandbox-abcde","deletedDateTime":"2023-01-01T00:00:00Z"},
+				{"id":"bound","displayName":"CI_SSU_Cap - sandbox-abcde","deletedDateTime":"2023-01-03T00:00:00Z","%[1]s":"sandbox-abcde"},
+				{"id":"other","displayName":"CI_SSU_Cap - sandbox-abcde","deletedDateTime":"2023-01-04T00:00:00Z","%[1]s":"other-fghij"}
+			]}`, testCapabilityIdProperty)
+		case testCapabilityIdProperty + " eq 'sandbox-abcde'":
+			fmt.Fprintf(w, `{"value":[
+				{"id":"bound","displayName":"CI_SSU_Cap - sandbox-abcde","deletedDateTime":"2023-01-03T00:00:00Z","%[1]s":"sandbox-abcde"},
+				{"id":"renamed","displayName":"Sandbox","deletedDateTime":"2023-01-02T00:00:00Z","%[1]s":"sandbox-abcde"}
+			]}`, testCapabilityIdProperty)
+		default:
+			t.Errorf("unexpected filter %s", r.URL.Query().Get("$filter"))
+		}
+	})
+
+	groups, err := az.GetDeletedCapabilityGroups(context.Background(), "sandbox-abcde")
+	assert.NoError(t, err)
+	ids := []string{}
+	for _, group := range groups {
+		ids = append(ids, group.ID)
+	}
+	// Most recently deleted first, without the group bound to another Capability
+	assert.Equal(t, []string{"bound", "renamed", "named"}, ids)
+	assert.Equal(t, "sandbox-abcde", groups[0].CapabilityRootId)
+}
+
+func TestClient_RestoreDeletedGroup(t *testing.T) {
+	az := newTestClient(t, Config{}, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "/v1.0/directory/deletedItems/group-1/restore", r.URL.Path)
+		fmt.Fprint(w, `{"id":"group-1"}`)
+	})
+
+	assert.NoError(t, az.RestoreDeletedGroup(context.Background(), "group-1"))
+}
+
+func TestClient_AddAdministrativeUnitMember(t *testing.T) {
+	status := http.StatusNoContent
+	body := ""
+	az := newTestClient(t, Config{}, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1.0/directory/administrativeUnits/unit/members/$ref", r.URL.Path)
+		w.WriteHeader(status)
+		fmt.Fprint(w, body)
+	})
+
+	assert.NoError(t, az.AddAdministrativeUnitMember(context.Background(), "unit", "group-1"))
+
+	// A group that is already a member is not an error
+	status = http.StatusBadRequest
+	body = `{"error":{"code":"Request_BadRequest","message":"One or more added object references already exist for the following modified properties: 'members'."}}`
+	assert.NoError(t, az.AddAdministrativeUnitMember(context.Background(), "unit", "group-1"))
+
+	body = `{"error":{"code":"Request_BadRequest","message":"Invalid object identifier"}}`
+	assert.Error(t, az.AddAdministrativeUnitMember(context.Background(), "unit", "group-1"))
+}
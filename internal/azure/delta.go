@@ -0,0 +1,116 @@
+package azure
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+
+	"go.dfds.cloud/aad-aws-sync/internal/httpclient"
+)
+
+// DeltaRemoved marks an object of a delta response that was removed since the previous delta query.
+type DeltaRemoved struct {
+	Reason string `json:"reason"`
+}
+
+// GroupDelta is a group of a groups delta response. DisplayName is only set if it changed, and MembersDelta only lists
+// the members added or removed. A group with many members can be returned as several objects, spread over pages.
+type GroupDelta struct {
+	ID           string        `json:"id"`
+	DisplayName  string        `json:"displayName"`
+	MembersDelta []GroupMember `json:"members@delta"`
+	Removed      *DeltaRemoved `json:"@removed,omitempty"`
+}
+
+// UserDelta is a user of a users delta response. Properties are only set if they changed.
+type UserDelta struct {
+	ID                string        `json:"id"`
+	DisplayName       string        `json:"displayName"`
+	UserPrincipalName string        `json:"userPrincipalName"`
+	Removed           *DeltaRemoved `json:"@removed,omitempty"`
+}
+
+// deltaPage is a single page of a Graph delta response. The last page has a delta link instead of a next link.
+type deltaPage[T any] struct {
+	OdataNextLink  string `json:"@odata.nextLink"`
+	OdataDeltaLink string `json:"@odata.deltaLink"`
+	Value          []T    `json:"value"`
+}
+
+// GetGroupsDelta returns the groups, and their members, that changed since the delta query that returned deltaLink,
+// and the delta link of the next query. An empty deltaLink returns every group. Returns a DeltaLinkExpired error if
+// Graph no longer accepts deltaLink.
+func (c *Client) GetGroupsDelta(ctx context.Context, deltaLink string) ([]GroupDelta, string, error) {
+	if deltaLink == "" {
+		query := url.Values{}
+		query.Set("$select", "displayName,members")
+		deltaLink = c.graphUrl("/v1.0/groups/delta") + "?" + query.Encode()
+	}
+
+	return getDelta[GroupDelta](ctx, c, deltaLink)
+}
+
+// GetUsersDelta returns the users that changed since the delta query that returned deltaLink, and the delta link of
+// the next query. An empty deltaLink returns every user. Returns a DeltaLinkExpired error if Graph no longer accepts
+// deltaLink.
+func (c *Client) GetUsersDelta(ctx context.Context, deltaLink string) ([]UserDelta, string, error) {
+	if deltaLink == "" {
+		query := url.Values{}
+		query.Set("$select", "displayName,userPrincipalName")
+		deltaLink = c.graphUrl("/v1.0/users/delta") + "?" + query.Encode()
+	}
+
+	return getDelta[UserDelta](ctx, c, deltaLink)
+}
+
+// GetGroupsDeltaLink returns the delta link of a groups delta query returning the changes from now on, without reading
+// any groups.
+func (c *Client) GetGroupsDeltaLink(ctx context.Context) (string, error) {
+	return c.latestDeltaLink(ctx, "/v1.0/groups/delta", "displayName,members")
+}
+
+// GetUsersDeltaLink returns the delta link of a users delta query returning the changes from now on, without reading
+// any users.
+func (c *Client) GetUsersDeltaLink(ctx context.Context) (string, error) {
+	return c.latestDeltaLink(ctx, "/v1.0/users/delta", "displayName,userPrincipalName")
+}
+
+func (c *Client) latestDeltaLink(ctx context.Context, path string, selectProperties string) (string, error) {
+	query := url.Values{}
+	query.Set("$select", selectProperties)
+	query.Set("$deltatoken", "latest")
+
+	_, deltaLink, err := getDelta[json.RawMessage](ctx, c, c.graphUrl(path)+"?"+query.Encode())
+
+	return deltaLink, err
+}
+
+// getDelta follows the next links of a delta query from link until the delta link of the next query.
+func getDelta[T any](ctx context.Context, c *Client, link string) ([]T, string, error) {
+	values := []T{}
+	for {
+		current, err := c.getPage(ctx, link)
+		if err != nil {
+			if status, ok := httpclient.StatusCode(err); ok && status == http.StatusGone {
+				return nil, "", DeltaLinkExpired.Wrap(err, "delta link expired")
+			}
+			return nil, "", err
+		}
+
+		var buffer deltaPage[T]
+		err = json.Unmarshal(current, &buffer)
+		if err != nil {
+			return nil, "", err
+		}
+
+		values = append(values, buffer.Value...)
+		if buffer.OdataDeltaLink != "" {
+			return values, buffer.OdataDeltaLink, nil
+		}
+		if buffer.OdataNextLink == "" {
+			return nil, "", HttpError.New("delta response has neither a next nor a delta link")
+		}
+		link = buffer.OdataNextLink
+	}
+}
@@ -2,21 +2,15 @@ package azure
 
 import (
 	"github.com/joomcode/errorx"
-	"net/http"
 )
 
-type ApiError struct {
-	StatusCode int
-}
-
-func (e ApiError) Error() string {
-	return http.StatusText(e.StatusCode)
-
-}
-
 var (
 	AzureError     = errorx.NewNamespace("azure")
 	AdUserNotFound = AzureError.NewType("ad_user_not_found")
 	HttpError403   = AzureError.NewType("http_error_403")
 	HttpError      = AzureError.NewType("http_error")
+	// GroupNotFound is returned for changes to the members of a group that doesn't exist
+	GroupNotFound = AzureError.NewType("group_not_found")
+	// DeltaLinkExpired is returned for a delta link Graph no longer accepts, which requires a full sync
+	DeltaLinkExpired = AzureError.NewType("delta_link_expired")
 )
@@ -0,0 +1,313 @@
+package azure
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/joomcode/errorx"
+	"go.dfds.cloud/aad-aws-sync/internal/store"
+	"go.dfds.cloud/aad-aws-sync/internal/util"
+	"go.uber.org/zap"
+)
+
+// GroupCache keeps the members of the groups whose display name starts with a prefix in a Store, and updates them
+// with Graph delta queries, instead of reading the members of every group on every run.
+//
+// Delta queries only return the object IDs of members, so the cache also keeps the display name and UPN of the users
+// that are members of a cached group, updated with a users delta query.
+//
+// Applying a delta twice gives the same result, so caches of the same prefix racing to save their state only cost a
+// larger delta next time.
+type GroupCache struct {
+	client *Client
+	store  store.Store
+	prefix string
+}
+
+// groupCacheState is the state of a GroupCache kept in the Store.
+type groupCacheState struct {
+	GroupsDeltaLink string                  `json:"groupsDeltaLink"`
+	UsersDeltaLink  string                  `json:"usersDeltaLink"`
+	Groups          map[string]*cachedGroup `json:"groups"`
+	Users           map[string]*Member      `json:"users"`
+	SyncedAt        time.Time               `json:"syncedAt"`
+}
+
+// cachedGroup is a group of a GroupCache, with the object IDs of its direct members.
+type cachedGroup struct {
+	ID          string          `json:"id"`
+	DisplayName string          `json:"displayName"`
+	Users       map[string]bool `json:"users"`
+	// Groups are the groups nested in the group
+	Groups map[string]bool `json:"groups"`
+}
+
+func NewGroupCache(client *Client, st store.Store, prefix string) *GroupCache {
+	return &GroupCache{client: client, store: st, prefix: prefix}
+}
+
+func (g *GroupCache) key() string {
+	return "groups:" + g.prefix
+}
+
+func (g *GroupCache) matches(displayName string) bool {
+	// Like the startswith filter of GetGroups, which ignores case
+	return strings.HasPrefix(strings.ToLower(displayName), strings.ToLower(g.prefix))
+}
+
+func (g *GroupCache) load() (*groupCacheState, error) {
+	state := &groupCacheState{}
+	err := g.store.Get(store.BucketGraphDelta, g.key(), state)
+	if err != nil && !errorx.IsOfType(err, store.NotFound) {
+		return nil, err
+	}
+	if state.Groups == nil {
+		state.Groups = map[string]*cachedGroup{}
+	}
+	if state.Users == nil {
+		state.Users = map[string]*Member{}
+	}
+
+	return state, nil
+}
+
+// Groups updates the cache, and returns the groups whose display name starts with the prefix, with their members, by
+// object ID. The first call, and any call after Graph expired the delta links, reads the groups and their members like
+// GetGroups and GetGroupMembers do.
+func (g *GroupCache) Groups(ctx context.Context) (map[string]*Group, error) {
+	state, err := g.load()
+	if err != nil {
+		return nil, err
+	}
+
+	err = g.sync(ctx, state)
+	if errorx.IsOfType(err, DeltaLinkExpired) {
+		util.Logger.Info("Graph delta link expired, reading every group again", zap.String("prefix", g.prefix), zap.Error(err))
+		state = &groupCacheState{Groups: map[string]*cachedGroup{}, Users: map[string]*Member{}}
+		err = g.sync(ctx, state)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	state.SyncedAt = time.Now()
+	if err := g.store.Put(store.BucketGraphDelta, g.key(), state); err != nil {
+		return nil, err
+	}
+
+	return g.groups(ctx, state)
+}
+
+// fullSync reads the groups whose display name starts with the prefix with their members into state, rather than
+// reading every group and user of the tenant with a delta query without delta link. The delta links are taken first,
+// so changes made while reading are applied again by the next sync, which is harmless.
+func (g *GroupCache) fullSync(ctx context.Context, state *groupCacheState) error {
+	groupsDeltaLink, err := g.client.GetGroupsDeltaLink(ctx)
+	if err != nil {
+		return err
+	}
+	usersDeltaLink, err := g.client.GetUsersDeltaLink(ctx)
+	if err != nil {
+		return err
+	}
+
+	groups, err := g.client.GetGroups(ctx, g.prefix)
+	if err != nil {
+		return err
+	}
+
+	for _, group := range groups.Value {
+		members, err := g.client.GetGroupMembers(ctx, group.ID)
+		if err != nil {
+			return err
+		}
+
+		cached := &cachedGroup{ID: group.ID, DisplayName: group.DisplayName, Users: map[string]bool{}, Groups: map[string]bool{}}
+		for _, member := range members.Value {
+			if member.IsUser() {
+				cached.Users[member.ID] = true
+				state.Users[member.ID] = member.toMember()
+			} else {
+				cached.Groups[member.ID] = true
+			}
+		}
+		state.Groups[group.ID] = cached
+	}
+
+	state.GroupsDeltaLink = groupsDeltaLink
+	state.UsersDeltaLink = usersDeltaLink
+
+	return nil
+}
+
+// sync applies the changes since the delta links of state to it. Without delta links, it does a full sync.
+func (g *GroupCache) sync(ctx context.Context, state *groupCacheState) error {
+	if state.GroupsDeltaLink == "" || state.UsersDeltaLink == "" {
+		return g.fullSync(ctx, state)
+	}
+
+	groups, groupsDeltaLink, err := g.client.GetGroupsDelta(ctx, state.GroupsDeltaLink)
+	if err != nil {
+		return err
+	}
+
+	// The members delta of a group that wasn't cached before can't be trusted, as the group may have been renamed to
+	// match the prefix, so its members are read instead
+	refetch := map[string]string{}
+	for _, delta := range groups {
+		cached, ok := state.Groups[delta.ID]
+		switch {
+		case delta.Removed != nil:
+			delete(state.Groups, delta.ID)
+			delete(refetch, delta.ID)
+			continue
+		case delta.DisplayName != "" && !g.matches(delta.DisplayName):
+			delete(state.Groups, delta.ID)
+			delete(refetch, delta.ID)
+			continue
+		case ok:
+			if delta.DisplayName != "" {
+				cached.DisplayName = delta.DisplayName
+			}
+		case delta.DisplayName == "":
+			// Only members changed, of a group that isn't cached
+			continue
+		default:
+			cached = &cachedGroup{ID: delta.ID, DisplayName: delta.DisplayName, Users: map[string]bool{}, Groups: map[string]bool{}}
+			state.Groups[delta.ID] = cached
+			refetch[delta.ID] = delta.DisplayName
+		}
+
+		if _, ok := refetch[delta.ID]; ok {
+			continue
+		}
+		for _, member := range delta.MembersDelta {
+			members := cached.Groups
+			if member.IsUser() {
+				members = cached.Users
+			}
+			if member.Removed != nil {
+				delete(members, member.ID)
+			} else {
+				members[member.ID] = true
+			}
+		}
+	}
+
+	for id, displayName := range refetch {
+		members, err := g.client.GetGroupMembers(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		cached := &cachedGroup{ID: id, DisplayName: displayName, Users: map[string]bool{}, Groups: map[string]bool{}}
+		for _, member := range members.Value {
+			if member.IsUser() {
+				cached.Users[member.ID] = true
+				state.Users[member.ID] = member.toMember()
+			} else {
+				cached.Groups[member.ID] = true
+			}
+		}
+		state.Groups[id] = cached
+	}
+
+	referenced := map[string]bool{}
+	for _, cached := range state.Groups {
+		for id := range cached.Users {
+			referenced[id] = true
+		}
+	}
+
+	users, usersDeltaLink, err := g.client.GetUsersDelta(ctx, state.UsersDeltaLink)
+	if err != nil {
+		return err
+	}
+	for _, delta := range users {
+		if delta.Removed != nil {
+			delete(state.Users, delta.ID)
+			continue
+		}
+		if !referenced[delta.ID] {
+			continue
+		}
+
+		user, ok := state.Users[delta.ID]
+		if !ok {
+			user = &Member{ID: delta.ID}
+			state.Users[delta.ID] = user
+		}
+		if delta.DisplayName != "" {
+			user.DisplayName = delta.DisplayName
+		}
+		if delta.UserPrincipalName != "" {
+			user.UserPrincipalName = delta.UserPrincipalName
+		}
+	}
+
+	// Users that became members without changing themselves since the users delta link
+	missing := []string{}
+	for id := range referenced {
+		if user, ok := state.Users[id]; !ok || user.UserPrincipalName == "" {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) > 0 {
+		// Graph looks users up by object ID the same way as by UPN
+		results, err := g.client.GetUsersViaUPN(ctx, missing)
+		if err != nil {
+			return err
+		}
+		for id, result := range results {
+			if result.Err != nil {
+				if errorx.IsOfType(result.Err, AdUserNotFound) {
+					continue
+				}
+				return result.Err
+			}
+			state.Users[id] = &Member{ID: id, DisplayName: result.User.DisplayName, UserPrincipalName: result.User.UserPrincipalName}
+		}
+	}
+
+	for id := range state.Users {
+		if !referenced[id] {
+			delete(state.Users, id)
+		}
+	}
+
+	state.GroupsDeltaLink = groupsDeltaLink
+	state.UsersDeltaLink = usersDeltaLink
+
+	return nil
+}
+
+// groups returns the cached groups with their members. Groups with nested groups are read from Graph if the client is
+// configured with TransitiveMembers, as the cache only knows the direct members of groups.
+func (g *GroupCache) groups(ctx context.Context, state *groupCacheState) (map[string]*Group, error) {
+	groups := make(map[string]*Group, len(state.Groups))
+	for id, cached := range state.Groups {
+		if g.client.config.TransitiveMembers && len(cached.Groups) > 0 {
+			group, err := g.client.GetGroupWithMembers(ctx, id, cached.DisplayName)
+			if err != nil {
+				return nil, err
+			}
+			groups[id] = group
+			continue
+		}
+
+		group := &Group{ID: id, DisplayName: cached.DisplayName, Members: []*Member{}, InheritedMembers: []*Member{}}
+		for userId := range cached.Users {
+			user, ok := state.Users[userId]
+			if !ok {
+				// A user deleted since becoming a member
+				continue
+			}
+			member := *user
+			group.Members = append(group.Members, &member)
+		}
+		groups[id] = group
+	}
+
+	return groups, nil
+}
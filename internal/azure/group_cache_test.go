@@ -0,0 +1,177 @@
+package azure
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.dfds.cloud/aad-aws-sync/internal/store"
+	"go.dfds.cloud/aad-aws-sync/internal/util"
+	"go.uber.org/zap"
+)
+
+// fakeDeltaGraph serves groups and users delta queries, keyed by their $deltatoken or $skiptoken, and other requests
+// keyed by path. Unknown tokens, including none, are answered like expired delta links.
+type fakeDeltaGraph struct {
+	t         *testing.T
+	groups    map[string]string
+	users     map[string]string
+	members   map[string]string
+	lookups   []string
+	filters   []string
+	fullSyncs int
+}
+
+func (f *fakeDeltaGraph) handler(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("$deltatoken") + r.URL.Query().Get("$skiptoken")
+	switch r.URL.Path {
+	case "/v1.0/groups/delta":
+		if token == "latest" {
+			f.fullSyncs++
+		}
+		f.respond(w, f.groups, token)
+	case "/v1.0/users/delta":
+		f.respond(w, f.users, token)
+	case "/v1.0/$batch":
+		var payload batchRequestPayload
+		assert.NoError(f.t, json.NewDecoder(r.Body).Decode(&payload))
+		responses := []BatchResponse{}
+		for _, req := range payload.Requests {
+			f.lookups = append(f.lookups, req.URL)
+			if req.URL == "/users/user-3" {
+				responses = append(responses, BatchResponse{ID: req.ID, Status: http.StatusOK, Body: json.RawMessage(`{"id":"user-3","displayName":"Three","userPrincipalName":"three@dfds.com"}`)})
+				continue
+			}
+			responses = append(responses, BatchResponse{ID: req.ID, Status: http.StatusNotFound})
+		}
+		assert.NoError(f.t, json.NewEncoder(w).Encode(batchResponsePayload{Responses: responses}))
+	case "/v1.0/groups":
+		f.filters = append(f.filters, r.URL.Query().Get("$filter"))
+		f.respond(w, f.members, r.URL.Path)
+	default:
+		f.respond(w, f.members, r.URL.Path)
+	}
+}
+
+func (f *fakeDeltaGraph) respond(w http.ResponseWriter, responses map[string]string, key string) {
+	body, ok := responses[key]
+	if !ok {
+		w.WriteHeader(http.StatusGone)
+		fmt.Fprint(w, `{"error":{"code":"syncStateNotFound"}}`)
+		return
+	}
+	fmt.Fprint(w, body)
+}
+
+func memberNames(group *Group) []string {
+	names := []string{}
+	for _, member := range group.Members {
+		names = append(names, member.UserPrincipalName)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func TestGroupCache_Groups(t *testing.T) {
+	util.Logger = zap.NewNop()
+	fake := &fakeDeltaGraph{t: t}
+	az := newTestClient(t, Config{}, fake.handler)
+	link := func(path string, token string) string {
+		return fmt.Sprintf("%s/v1.0/%s?%s", az.baseUrl, path, token)
+	}
+
+	fake.groups = map[string]string{
+		"latest": fmt.Sprintf(`{"@odata.deltaLink":%q,"value":[]}`, link("groups/delta", "$deltatoken=g1")),
+		// The changes are spread over two pages
+		"g1": fmt.Sprintf(`{"@odata.nextLink":%q,"value":[
+			{"id":"group-1","members@delta":[{"@odata.type":"#microsoft.graph.user","id":"user-1","@removed":{"reason":"deleted"}}]}
+		]}`, link("groups/delta", "$skiptoken=s2")),
+		"s2": fmt.Sprintf(`{"@odata.deltaLink":%q,"value":[
+			{"id":"group-1","members@delta":[{"@odata.type":"#microsoft.graph.user","id":"user-3"}]},
+			{"id":"group-2","displayName":"CI_SSU_Cap - two"},
+			{"id":"other","members@delta":[{"@odata.type":"#microsoft.graph.user","id":"user-1"}]}
+		]}`, link("groups/delta", "$deltatoken=g2")),
+	}
+	fake.users = map[string]string{
+		"latest": fmt.Sprintf(`{"@odata.deltaLink":%q,"value":[]}`, link("users/delta", "$deltatoken=u1")),
+		"u1": fmt.Sprintf(`{"@odata.deltaLink":%q,"value":[
+			{"id":"user-2","userPrincipalName":"renamed@dfds.com"}
+		]}`, link("users/delta", "$deltatoken=u2")),
+	}
+	fake.members = map[string]string{
+		"/v1.0/groups": `{"value":[{"id":"group-1","displayName":"CI_SSU_Cap - one"}]}`,
+		"/v1.0/groups/group-1/members": `{"value":[
+			{"@odata.type":"#microsoft.graph.user","id":"user-1","displayName":"One","userPrincipalName":"one@dfds.com"},
+			{"@odata.type":"#microsoft.graph.user","id":"user-2","displayName":"Two","userPrincipalName":"two@dfds.com"},
+			{"@odata.type":"#microsoft.graph.group","id":"nested"}
+		]}`,
+		"/v1.0/groups/group-2/members": `{"value":[{"@odata.type":"#microsoft.graph.user","id":"user-5","userPrincipalName":"five@dfds.com"}]}`,
+	}
+
+	st := store.NewMemoryStore()
+	cache := NewGroupCache(az, st, "CI_SSU_Cap -")
+
+	// A full sync reads the groups matching the prefix, rather than every group and user of the tenant
+	groups, err := cache.Groups(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, groups, 1)
+	assert.Equal(t, "CI_SSU_Cap - one", groups["group-1"].DisplayName)
+	assert.Equal(t, []string{"one@dfds.com", "two@dfds.com"}, memberNames(groups["group-1"]))
+	assert.Empty(t, fake.lookups)
+	assert.Equal(t, []string{"startswith(displayName,'CI_SSU_Cap -')"}, fake.filters)
+
+	var state groupCacheState
+	assert.NoError(t, st.Get(store.BucketGraphDelta, "groups:CI_SSU_Cap -", &state))
+	assert.Equal(t, link("groups/delta", "$deltatoken=g1"), state.GroupsDeltaLink)
+	assert.Equal(t, link("users/delta", "$deltatoken=u1"), state.UsersDeltaLink)
+	assert.True(t, state.Groups["group-1"].Groups["nested"])
+
+	// An incremental sync applies the changes since the delta links
+	groups, err = cache.Groups(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, groups, 2)
+	assert.Equal(t, []string{"renamed@dfds.com", "three@dfds.com"}, memberNames(groups["group-1"]))
+	// A group new to the cache has its members read
+	assert.Equal(t, []string{"five@dfds.com"}, memberNames(groups["group-2"]))
+	// A new member that didn't change since the users delta link is looked up
+	assert.Equal(t, []string{"/users/user-3"}, fake.lookups)
+	assert.Equal(t, 1, fake.fullSyncs)
+
+	// An expired delta link falls back to a full sync
+	groups, err = cache.Groups(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, fake.fullSyncs)
+	assert.Len(t, groups, 1)
+	assert.Equal(t, []string{"one@dfds.com", "two@dfds.com"}, memberNames(groups["group-1"]))
+	assert.NoError(t, st.Get(store.BucketGraphDelta, "groups:CI_SSU_Cap -", &state))
+	assert.Equal(t, link("groups/delta", "$deltatoken=g1"), state.GroupsDeltaLink)
+}
+
+func TestGroupCache_GroupsTransitiveMembers(t *testing.T) {
+	util.Logger = zap.NewNop()
+	fake := &fakeDeltaGraph{t: t}
+	az := newTestClient(t, Config{TransitiveMembers: true}, fake.handler)
+
+	fake.groups = map[string]string{
+		"latest": fmt.Sprintf(`{"@odata.deltaLink":"%s/v1.0/groups/delta?$deltatoken=g1","value":[]}`, az.baseUrl),
+	}
+	fake.users = map[string]string{
+		"latest": fmt.Sprintf(`{"@odata.deltaLink":"%s/v1.0/users/delta?$deltatoken=u1","value":[]}`, az.baseUrl),
+	}
+	fake.members = map[string]string{
+		"/v1.0/groups":                           `{"value":[{"id":"group-1","displayName":"CI_SSU_Cap - one"}]}`,
+		"/v1.0/groups/group-1/members":           `{"value":[{"@odata.type":"#microsoft.graph.group","id":"nested"}]}`,
+		"/v1.0/groups/group-1/transitiveMembers": `{"value":[{"@odata.type":"#microsoft.graph.group","id":"nested"},{"@odata.type":"#microsoft.graph.user","id":"user-1","userPrincipalName":"one@dfds.com"}]}`,
+	}
+
+	// The cache only knows direct members, so groups with nested groups are read from Graph
+	groups, err := NewGroupCache(az, store.NewMemoryStore(), "CI_SSU_Cap -").Groups(context.Background())
+	assert.NoError(t, err)
+	assert.Empty(t, groups["group-1"].Members)
+	assert.True(t, groups["group-1"].HasTransitiveMember("one@dfds.com"))
+}
@@ -0,0 +1,133 @@
+package azure
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"go.dfds.cloud/aad-aws-sync/internal/httpclient"
+)
+
+// External user states of a guest user, see GuestUser.
+const (
+	ExternalUserStatePendingAcceptance = "PendingAcceptance"
+	ExternalUserStateAccepted          = "Accepted"
+)
+
+type InviteGuestUserRequest struct {
+	InvitedUserEmailAddress string `json:"invitedUserEmailAddress"`
+	InviteRedirectUrl       string `json:"inviteRedirectUrl"`
+	SendInvitationMessage   bool   `json:"sendInvitationMessage"`
+}
+
+// Invitation is a B2B invitation of an external user to the tenant. The guest user it creates exists right away, and
+// can be added to groups before the invitation is redeemed.
+type Invitation struct {
+	ID                      string `json:"id"`
+	InvitedUserEmailAddress string `json:"invitedUserEmailAddress"`
+	InviteRedeemUrl         string `json:"inviteRedeemUrl"`
+	Status                  string `json:"status"`
+	InvitedUser             struct {
+		ID string `json:"id"`
+	} `json:"invitedUser"`
+}
+
+// GuestUser is a user with its external user state, which tells whether a guest redeemed its invitation.
+type GuestUser struct {
+	ID                string `json:"id"`
+	Mail              string `json:"mail"`
+	UserPrincipalName string `json:"userPrincipalName"`
+	// ExternalUserState is PendingAcceptance until the invitation is redeemed, Accepted after, and empty for users
+	// that weren't invited
+	ExternalUserState string `json:"externalUserState"`
+}
+
+// InviteGuestUser sends a B2B invitation to an external user, which creates a guest user for them. redirectUrl is
+// where the user is sent after redeeming the invitation.
+func (c *Client) InviteGuestUser(ctx context.Context, email string, redirectUrl string) (*Invitation, error) {
+	serialised, err := json.Marshal(InviteGuestUserRequest{
+		InvitedUserEmailAddress: email,
+		InviteRedirectUrl:       redirectUrl,
+		SendInvitationMessage:   true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", c.graphUrl("/v1.0/invitations"), bytes.NewBuffer(serialised))
+	if err != nil {
+		return nil, err
+	}
+	err = c.prepareJsonRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := httpclient.CheckResponse(resp, HttpError, http.StatusCreated); err != nil {
+		return nil, err
+	}
+
+	rawData, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var payload *Invitation
+	err = json.Unmarshal(rawData, &payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return payload, nil
+}
+
+// GuestUserResult is the outcome of looking up a single guest user in a batch.
+type GuestUserResult struct {
+	User *GuestUser
+	// Err is AdUserNotFound if there is no such user
+	Err error
+}
+
+// GetGuestUsers looks up users by object ID in batches, with their external user state. It returns the result of each
+// lookup by object ID.
+func (c *Client) GetGuestUsers(ctx context.Context, ids []string) (map[string]GuestUserResult, error) {
+	requests := make([]BatchRequest, 0, len(ids))
+	for i, id := range ids {
+		query := url.Values{}
+		query.Set("$select", "id,mail,userPrincipalName,externalUserState")
+		requests = append(requests, BatchRequest{ID: strconv.Itoa(i), Method: "GET", URL: fmt.Sprintf("/users/%s?%s", url.PathEscape(id), query.Encode())})
+	}
+
+	responses, err := c.Batch(ctx, requests)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make(map[string]GuestUserResult, len(ids))
+	for i, id := range ids {
+		resp := responses[strconv.Itoa(i)]
+		if err := resp.err(fmt.Sprintf("User %s", id)); err != nil {
+			results[id] = GuestUserResult{Err: err}
+			continue
+		}
+
+		var user *GuestUser
+		if err := json.Unmarshal(resp.Body, &user); err != nil {
+			return nil, err
+		}
+		results[id] = GuestUserResult{User: user}
+	}
+
+	return results, nil
+}
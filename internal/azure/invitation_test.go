@@ -0,0 +1,53 @@
+package azure
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/joomcode/errorx"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClient_InviteGuestUser(t *testing.T) {
+	az := newTestClient(t, Config{}, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "/v1.0/invitations", r.URL.Path)
+
+		var payload InviteGuestUserRequest
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+		assert.Equal(t, InviteGuestUserRequest{InvitedUserEmailAddress: "contractor@example.com", InviteRedirectUrl: "https://myapps.microsoft.com", SendInvitationMessage: true}, payload)
+
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"id":"invitation-1","invitedUserEmailAddress":"contractor@example.com","status":"PendingAcceptance","invitedUser":{"id":"guest-1"}}`)
+	})
+
+	invitation, err := az.InviteGuestUser(context.Background(), "contractor@example.com", "https://myapps.microsoft.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "guest-1", invitation.InvitedUser.ID)
+}
+
+func TestClient_GetGuestUsers(t *testing.T) {
+	az := newTestClient(t, Config{}, func(w http.ResponseWriter, r *http.Request) {
+		var payload batchRequestPayload
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+
+		responses := []BatchResponse{}
+		for _, req := range payload.Requests {
+			switch req.URL {
+			case "/users/guest-1?%24select=id%2Cmail%2CuserPrincipalName%2CexternalUserState":
+				responses = append(responses, BatchResponse{ID: req.ID, Status: http.StatusOK, Body: json.RawMessage(`{"id":"guest-1","externalUserState":"Accepted"}`)})
+			default:
+				responses = append(responses, BatchResponse{ID: req.ID, Status: http.StatusNotFound})
+			}
+		}
+		assert.NoError(t, json.NewEncoder(w).Encode(batchResponsePayload{Responses: responses}))
+	})
+
+	results, err := az.GetGuestUsers(context.Background(), []string{"guest-1", "deleted"})
+	assert.NoError(t, err)
+	assert.Equal(t, ExternalUserStateAccepted, results["guest-1"].User.ExternalUserState)
+	assert.True(t, errorx.IsOfType(results["deleted"].Err, AdUserNotFound))
+}
@@ -7,65 +7,89 @@ import (
 )
 
 type GroupsListResponse struct {
-	OdataContext  string `json:"@odata.context"`
-	OdataNextLink string `json:"@odata.nextLink"`
-	Value         []struct {
-		ID                            string        `json:"id"`
-		DeletedDateTime               interface{}   `json:"deletedDateTime"`
-		Classification                interface{}   `json:"classification"`
-		CreatedDateTime               time.Time     `json:"createdDateTime"`
-		CreationOptions               []interface{} `json:"creationOptions"`
-		Description                   string        `json:"description"`
-		DisplayName                   string        `json:"displayName"`
-		ExpirationDateTime            interface{}   `json:"expirationDateTime"`
-		GroupTypes                    []interface{} `json:"groupTypes"`
-		IsAssignableToRole            interface{}   `json:"isAssignableToRole"`
-		Mail                          interface{}   `json:"mail"`
-		MailEnabled                   bool          `json:"mailEnabled"`
-		MailNickname                  string        `json:"mailNickname"`
-		MembershipRule                interface{}   `json:"membershipRule"`
-		MembershipRuleProcessingState interface{}   `json:"membershipRuleProcessingState"`
-		OnPremisesDomainName          string        `json:"onPremisesDomainName"`
-		OnPremisesLastSyncDateTime    time.Time     `json:"onPremisesLastSyncDateTime"`
-		OnPremisesNetBiosName         string        `json:"onPremisesNetBiosName"`
-		OnPremisesSamAccountName      string        `json:"onPremisesSamAccountName"`
-		OnPremisesSecurityIdentifier  string        `json:"onPremisesSecurityIdentifier"`
-		OnPremisesSyncEnabled         bool          `json:"onPremisesSyncEnabled"`
-		PreferredDataLocation         interface{}   `json:"preferredDataLocation"`
-		PreferredLanguage             interface{}   `json:"preferredLanguage"`
-		ProxyAddresses                []interface{} `json:"proxyAddresses"`
-		RenewedDateTime               time.Time     `json:"renewedDateTime"`
-		ResourceBehaviorOptions       []interface{} `json:"resourceBehaviorOptions"`
-		ResourceProvisioningOptions   []interface{} `json:"resourceProvisioningOptions"`
-		SecurityEnabled               bool          `json:"securityEnabled"`
-		SecurityIdentifier            string        `json:"securityIdentifier"`
-		Theme                         interface{}   `json:"theme"`
-		Visibility                    interface{}   `json:"visibility"`
-		OnPremisesProvisioningErrors  []interface{} `json:"onPremisesProvisioningErrors"`
-	} `json:"value"`
+	OdataContext  string                    `json:"@odata.context"`
+	OdataNextLink string                    `json:"@odata.nextLink"`
+	Value         []GroupsListResponseGroup `json:"value"`
+}
+
+type GroupsListResponseGroup struct {
+	ID                            string        `json:"id"`
+	DeletedDateTime               interface{}   `json:"deletedDateTime"`
+	Classification                interface{}   `json:"classification"`
+	CreatedDateTime               time.Time     `json:"createdDateTime"`
+	CreationOptions               []interface{} `json:"creationOptions"`
+	Description                   string        `json:"description"`
+	DisplayName                   string        `json:"displayName"`
+	ExpirationDateTime            interface{}   `json:"expirationDateTime"`
+	GroupTypes                    []interface{} `json:"groupTypes"`
+	IsAssignableToRole            interface{}   `json:"isAssignableToRole"`
+	Mail                          interface{}   `json:"mail"`
+	MailEnabled                   bool          `json:"mailEnabled"`
+	MailNickname                  string        `json:"mailNickname"`
+	MembershipRule                interface{}   `json:"membershipRule"`
+	MembershipRuleProcessingState interface{}   `json:"membershipRuleProcessingState"`
+	OnPremisesDomainName          string        `json:"onPremisesDomainName"`
+	OnPremisesLastSyncDateTime    time.Time     `json:"onPremisesLastSyncDateTime"`
+	OnPremisesNetBiosName         string        `json:"onPremisesNetBiosName"`
+	OnPremisesSamAccountName      string        `json:"onPremisesSamAccountName"`
+	OnPremisesSecurityIdentifier  string        `json:"onPremisesSecurityIdentifier"`
+	OnPremisesSyncEnabled         bool          `json:"onPremisesSyncEnabled"`
+	PreferredDataLocation         interface{}   `json:"preferredDataLocation"`
+	PreferredLanguage             interface{}   `json:"preferredLanguage"`
+	ProxyAddresses                []interface{} `json:"proxyAddresses"`
+	RenewedDateTime               time.Time     `json:"renewedDateTime"`
+	ResourceBehaviorOptions       []interface{} `json:"resourceBehaviorOptions"`
+	ResourceProvisioningOptions   []interface{} `json:"resourceProvisioningOptions"`
+	SecurityEnabled               bool          `json:"securityEnabled"`
+	SecurityIdentifier            string        `json:"securityIdentifier"`
+	Theme                         interface{}   `json:"theme"`
+	Visibility                    interface{}   `json:"visibility"`
+	OnPremisesProvisioningErrors  []interface{} `json:"onPremisesProvisioningErrors"`
 }
 
 type GroupMembers struct {
-	OdataContext string `json:"@odata.context"`
-	Value        []struct {
-		OdataType         string        `json:"@odata.type"`
-		ID                string        `json:"id"`
-		BusinessPhones    []interface{} `json:"businessPhones"`
-		DisplayName       string        `json:"displayName"`
-		GivenName         string        `json:"givenName"`
-		JobTitle          string        `json:"jobTitle"`
-		Mail              string        `json:"mail"`
-		MobilePhone       string        `json:"mobilePhone"`
-		OfficeLocation    interface{}   `json:"officeLocation"`
-		PreferredLanguage interface{}   `json:"preferredLanguage"`
-		Surname           string        `json:"surname"`
-		UserPrincipalName string        `json:"userPrincipalName"`
-	} `json:"value"`
+	OdataContext string        `json:"@odata.context"`
+	Value        []GroupMember `json:"value"`
+}
+
+// odataTypeUser is the @odata.type of users in lists of directory objects, such as the members of a group.
+const odataTypeUser = "#microsoft.graph.user"
+
+// GroupMember is a member of a group. Groups can contain other groups, devices and service principals besides users.
+type GroupMember struct {
+	OdataType         string        `json:"@odata.type"`
+	ID                string        `json:"id"`
+	BusinessPhones    []interface{} `json:"businessPhones"`
+	DisplayName       string        `json:"displayName"`
+	GivenName         string        `json:"givenName"`
+	JobTitle          string        `json:"jobTitle"`
+	Mail              string        `json:"mail"`
+	MobilePhone       string        `json:"mobilePhone"`
+	OfficeLocation    interface{}   `json:"officeLocation"`
+	PreferredLanguage interface{}   `json:"preferredLanguage"`
+	Surname           string        `json:"surname"`
+	UserPrincipalName string        `json:"userPrincipalName"`
+	// Removed is set for members removed from a group in a groups delta response
+	Removed *DeltaRemoved `json:"@removed,omitempty"`
+}
+
+// IsUser reports whether the member is a user, as opposed to e.g. a nested group.
+func (m GroupMember) IsUser() bool {
+	return m.OdataType == odataTypeUser
+}
+
+func (m GroupMember) toMember() *Member {
+	return &Member{
+		ID:                m.ID,
+		DisplayName:       m.DisplayName,
+		UserPrincipalName: m.UserPrincipalName,
+	}
 }
 
 type GetAdministrativeUnitsResponse struct {
-	OdataContext string                                `json:"@odata.context"`
-	Value        []*GetAdministrativeUnitsResponseUnit `json:"value"`
+	OdataContext  string                                `json:"@odata.context"`
+	OdataNextLink string                                `json:"@odata.nextLink,omitempty"`
+	Value         []*GetAdministrativeUnitsResponseUnit `json:"value"`
 }
 
 type CreateAdministrativeUnitGroupRequest struct {
@@ -175,7 +199,7 @@ type GetAdministrativeUnitMembersResponseUnit struct {
 	Classification                interface{}   `json:"classification"`
 	CreatedDateTime               time.Time     `json:"createdDateTime"`
 	CreationOptions               []interface{} `json:"creationOptions"`
-	Description                   interface{}   `json:"description"`
+	Description                   string        `json:"description"`
 	DisplayName                   string        `json:"displayName"`
 	ExpirationDateTime            interface{}   `json:"expirationDateTime"`
 	GroupTypes                    []interface{} `json:"groupTypes"`
@@ -202,23 +226,29 @@ type GetAdministrativeUnitMembersResponseUnit struct {
 	Theme                         interface{}   `json:"theme"`
 	Visibility                    interface{}   `json:"visibility"`
 	OnPremisesProvisioningErrors  []interface{} `json:"onPremisesProvisioningErrors"`
+	// CapabilityRootId is the root ID of the Capability the group is bound to, read from the property named by
+	// Config.CapabilityIdProperty. Empty if the group isn't bound.
+	CapabilityRootId string `json:"-"`
 }
 
 type GetApplicationRolesResponse struct {
-	OdataContext string `json:"@odata.context"`
-	Value        []struct {
-		DisplayName string `json:"displayName"`
-		AppID       string `json:"appId"`
-		AppRoles    []struct {
-			AllowedMemberTypes []string    `json:"allowedMemberTypes"`
-			Description        string      `json:"description"`
-			DisplayName        string      `json:"displayName"`
-			ID                 string      `json:"id"`
-			IsEnabled          bool        `json:"isEnabled"`
-			Origin             string      `json:"origin"`
-			Value              interface{} `json:"value"`
-		} `json:"appRoles"`
-	} `json:"value"`
+	OdataContext  string                                   `json:"@odata.context"`
+	OdataNextLink string                                   `json:"@odata.nextLink,omitempty"`
+	Value         []GetApplicationRolesResponseApplication `json:"value"`
+}
+
+type GetApplicationRolesResponseApplication struct {
+	DisplayName string `json:"displayName"`
+	AppID       string `json:"appId"`
+	AppRoles    []struct {
+		AllowedMemberTypes []string    `json:"allowedMemberTypes"`
+		Description        string      `json:"description"`
+		DisplayName        string      `json:"displayName"`
+		ID                 string      `json:"id"`
+		IsEnabled          bool        `json:"isEnabled"`
+		Origin             string      `json:"origin"`
+		Value              interface{} `json:"value"`
+	} `json:"appRoles"`
 }
 
 func (g *GetApplicationRolesResponse) GetRoleId(name string) (string, error) {
@@ -292,13 +322,28 @@ func (g *GetAssignmentsForApplicationResponse) GetAssignmentByGroupName(name str
 }
 
 type Group struct {
-	ID          string    `json:"id"`
-	DisplayName string    `json:"displayName"`
-	Members     []*Member `json:"members"`
+	ID          string `json:"id"`
+	DisplayName string `json:"displayName"`
+	// Members are the users that are direct members of the group
+	Members []*Member `json:"members"`
+	// InheritedMembers are the users that are only members through groups nested in the group, see
+	// Client.GetGroupWithMembers
+	InheritedMembers []*Member `json:"inheritedMembers,omitempty"`
 }
 
+// HasMember reports whether the user with the given UPN is a direct member of the group.
 func (g *Group) HasMember(email string) bool {
-	for _, member := range g.Members {
+	return hasMember(g.Members, email)
+}
+
+// HasTransitiveMember reports whether the user with the given UPN is a member of the group, directly or through a
+// nested group.
+func (g *Group) HasTransitiveMember(email string) bool {
+	return hasMember(g.Members, email) || hasMember(g.InheritedMembers, email)
+}
+
+func hasMember(members []*Member, email string) bool {
+	for _, member := range members {
 		if strings.ToLower(member.UserPrincipalName) == strings.ToLower(email) {
 			return true
 		}
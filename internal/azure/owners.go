@@ -0,0 +1,138 @@
+package azure
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"go.dfds.cloud/aad-aws-sync/internal/httpclient"
+)
+
+// GetGroupOwners returns the owners of a group. Owners can be service principals besides users, e.g. the app that
+// created the group.
+func (c *Client) GetGroupOwners(ctx context.Context, groupId string) ([]GroupMember, error) {
+	query := url.Values{}
+	query.Set("$top", maxPageSize)
+
+	return getAllPages[GroupMember](ctx, c, fmt.Sprintf("/v1.0/groups/%s/owners", groupId), query)
+}
+
+// AddGroupOwner makes the user with the given object ID an owner of a group.
+func (c *Client) AddGroupOwner(ctx context.Context, groupId string, userId string) error {
+	serialised, err := json.Marshal(AddGroupMemberRequest{
+		OdataId: fmt.Sprintf("https://graph.microsoft.com/v1.0/users/%s", userId),
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf(c.graphUrl("/v1.0/groups/%s/owners/$ref"), groupId), bytes.NewBuffer(serialised))
+	if err != nil {
+		return err
+	}
+	err = c.prepareJsonRequest(req)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return AdUserNotFound.New("user %s not found", userId)
+	}
+
+	return httpclient.CheckResponse(resp, HttpError, http.StatusNoContent)
+}
+
+// DeleteGroupOwner removes the owner with the given object ID from a group. An owner that is already gone is ignored.
+func (c *Client) DeleteGroupOwner(ctx context.Context, groupId string, ownerId string) error {
+	req, err := http.NewRequestWithContext(ctx, "DELETE", fmt.Sprintf(c.graphUrl("/v1.0/groups/%s/owners/%s/$ref"), groupId, ownerId), nil)
+	if err != nil {
+		return err
+	}
+	err = c.prepareJsonRequest(req)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+
+	return httpclient.CheckResponse(resp, HttpError, http.StatusNoContent)
+}
+
+// ExtensionProperty is a directory extension property registered on an app.
+type ExtensionProperty struct {
+	ID            string   `json:"id,omitempty"`
+	Name          string   `json:"name"`
+	DataType      string   `json:"dataType"`
+	TargetObjects []string `json:"targetObjects"`
+}
+
+// RegisterGroupExtensionProperty registers a string directory extension property of groups on the app with the given
+// object ID, unless it is registered already. Graph names the property extension_<app ID without dashes>_<name>,
+// which is returned; see Config.CapabilityIdProperty.
+func (c *Client) RegisterGroupExtensionProperty(ctx context.Context, appObjectId string, name string) (*ExtensionProperty, error) {
+	path := fmt.Sprintf("/v1.0/applications/%s/extensionProperties", appObjectId)
+	registered, err := getAllPages[ExtensionProperty](ctx, c, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, property := range registered {
+		if extensionPropertyHasName(property.Name, name) {
+			return &property, nil
+		}
+	}
+
+	serialised, err := json.Marshal(ExtensionProperty{Name: name, DataType: "String", TargetObjects: []string{"Group"}})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", c.graphUrl(path), bytes.NewBuffer(serialised))
+	if err != nil {
+		return nil, err
+	}
+	err = c.prepareJsonRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := httpclient.CheckResponse(resp, HttpError, http.StatusCreated); err != nil {
+		return nil, err
+	}
+
+	var property ExtensionProperty
+	if err := json.NewDecoder(resp.Body).Decode(&property); err != nil {
+		return nil, err
+	}
+
+	return &property, nil
+}
+
+// extensionPropertyHasName reports whether the full name of an extension property, extension_<app ID>_<name>, ends
+// in name.
+func extensionPropertyHasName(fullName string, name string) bool {
+	return strings.HasPrefix(fullName, "extension_") && strings.HasSuffix(fullName, "_"+name)
+}
@@ -0,0 +1,83 @@
+package azure
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/joomcode/errorx"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClient_GroupOwners(t *testing.T) {
+	var added map[string]string
+	az := newTestClient(t, Config{}, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.Path {
+		case "GET /v1.0/groups/group-1/owners":
+			fmt.Fprint(w, `{"value":[
+				{"@odata.type":"#microsoft.graph.user","id":"user-a","userPrincipalName":"a@dfds.com"},
+				{"@odata.type":"#microsoft.graph.servicePrincipal","id":"app"}
+			]}`)
+		case "POST /v1.0/groups/group-1/owners/$ref":
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&added))
+			w.WriteHeader(http.StatusNoContent)
+		case "POST /v1.0/groups/group-2/owners/$ref":
+			w.WriteHeader(http.StatusNotFound)
+		case "DELETE /v1.0/groups/group-1/owners/user-a/$ref":
+			w.WriteHeader(http.StatusNoContent)
+		case "DELETE /v1.0/groups/group-1/owners/gone/$ref":
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+	})
+
+	owners, err := az.GetGroupOwners(context.Background(), "group-1")
+	assert.NoError(t, err)
+	assert.Len(t, owners, 2)
+	assert.True(t, owners[0].IsUser())
+	assert.False(t, owners[1].IsUser())
+
+	assert.NoError(t, az.AddGroupOwner(context.Background(), "group-1", "user-b"))
+	assert.Equal(t, "https://graph.microsoft.com/v1.0/users/user-b", added["@odata.id"])
+	assert.True(t, errorx.IsOfType(az.AddGroupOwner(context.Background(), "group-2", "user-b"), AdUserNotFound))
+
+	assert.NoError(t, az.DeleteGroupOwner(context.Background(), "group-1", "user-a"))
+	// Owners that are already gone are ignored
+	assert.NoError(t, az.DeleteGroupOwner(context.Background(), "group-1", "gone"))
+}
+
+func TestClient_RegisterGroupExtensionProperty(t *testing.T) {
+	var registered *ExtensionProperty
+	az := newTestClient(t, Config{}, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1.0/applications/app-object/extensionProperties", r.URL.Path)
+		switch r.Method {
+		case http.MethodGet:
+			properties := []*ExtensionProperty{{ID: "1", Name: "extension_0123_other", DataType: "String", TargetObjects: []string{"Group"}}}
+			if registered != nil {
+				properties = append(properties, registered)
+			}
+			assert.NoError(t, json.NewEncoder(w).Encode(map[string]any{"value": properties}))
+		case http.MethodPost:
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&registered))
+			registered.ID = "2"
+			registered.Name = "extension_0123_" + registered.Name
+			w.WriteHeader(http.StatusCreated)
+			assert.NoError(t, json.NewEncoder(w).Encode(registered))
+		}
+	})
+
+	property, err := az.RegisterGroupExtensionProperty(context.Background(), "app-object", "capabilityRootId")
+	assert.NoError(t, err)
+	assert.Equal(t, "extension_0123_capabilityRootId", property.Name)
+	assert.Equal(t, "String", registered.DataType)
+	assert.Equal(t, []string{"Group"}, registered.TargetObjects)
+
+	// A registered property isn't registered again
+	registered.Name = "extension_0123_capabilityRootId"
+	property, err = az.RegisterGroupExtensionProperty(context.Background(), "app-object", "capabilityRootId")
+	assert.NoError(t, err)
+	assert.Equal(t, "2", property.ID)
+}
@@ -0,0 +1,82 @@
+package azure
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+
+	"go.dfds.cloud/aad-aws-sync/internal/httpclient"
+)
+
+// graphBaseUrl is the Microsoft Graph endpoint the Client talks to, unless overridden for tests.
+const graphBaseUrl = "https://graph.microsoft.com"
+
+// maxPageSize is the largest page size Graph accepts for lists of directory objects.
+const maxPageSize = "999"
+
+// page is a single page of a Graph list response.
+type page[T any] struct {
+	OdataNextLink string `json:"@odata.nextLink"`
+	Value         []T    `json:"value"`
+}
+
+func (c *Client) graphUrl(path string) string {
+	if c.baseUrl != "" {
+		return c.baseUrl + path
+	}
+
+	return graphBaseUrl + path
+}
+
+// getAllPages requests the Graph list at path, and follows @odata.nextLink until every page is read. Graph pages
+// lists by default, e.g. 100 members of a group at a time, and a truncated list would make members look stale.
+func getAllPages[T any](ctx context.Context, c *Client, path string, query url.Values) ([]T, error) {
+	nextLink := c.graphUrl(path)
+	if len(query) > 0 {
+		nextLink += "?" + query.Encode()
+	}
+
+	values := []T{}
+	for nextLink != "" {
+		current, err := c.getPage(ctx, nextLink)
+		if err != nil {
+			return nil, err
+		}
+
+		var buffer page[T]
+		err = json.Unmarshal(current, &buffer)
+		if err != nil {
+			return nil, err
+		}
+
+		values = append(values, buffer.Value...)
+		nextLink = buffer.OdataNextLink
+	}
+
+	return values, nil
+}
+
+func (c *Client) getPage(ctx context.Context, pageUrl string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", pageUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = c.prepareHttpRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := httpclient.CheckResponse(resp, HttpError); err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	return io.ReadAll(resp.Body)
+}
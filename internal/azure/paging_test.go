@@ -0,0 +1,112 @@
+package azure
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/joomcode/errorx"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestClient returns a Client talking to a fake Graph serving handler.
+func newTestClient(t *testing.T, conf Config, handler http.HandlerFunc) *Client {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	return NewAzureClientForUrl(conf, server.URL)
+}
+
+func TestClient_GetGroupMembersPaging(t *testing.T) {
+	var serverUrl string
+	az := newTestClient(t, Config{}, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1.0/groups/group-1/members", r.URL.Path)
+		switch r.URL.Query().Get("$skiptoken") {
+		case "":
+			assert.Equal(t, "999", r.URL.Query().Get("$top"))
+			fmt.Fprintf(w, `{"@odata.nextLink":"%s/v1.0/groups/group-1/members?$skiptoken=2","value":[{"@odata.type":"#microsoft.graph.user","id":"1","userPrincipalName":"one@dfds.com"}]}`, serverUrl)
+		case "2":
+			fmt.Fprintf(w, `{"@odata.nextLink":"%s/v1.0/groups/group-1/members?$skiptoken=3","value":[{"@odata.type":"#microsoft.graph.user","id":"2","userPrincipalName":"two@dfds.com"}]}`, serverUrl)
+		default:
+			fmt.Fprint(w, `{"value":[{"@odata.type":"#microsoft.graph.group","id":"3","displayName":"Department"}]}`)
+		}
+	})
+	serverUrl = az.baseUrl
+
+	members, err := az.GetGroupMembers(context.Background(), "group-1")
+	assert.NoError(t, err)
+	assert.Len(t, members.Value, 3)
+	assert.True(t, members.Value[1].IsUser())
+	assert.False(t, members.Value[2].IsUser())
+}
+
+func TestClient_GetGroupMembersPageFails(t *testing.T) {
+	var serverUrl string
+	az := newTestClient(t, Config{}, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("$skiptoken") == "" {
+			fmt.Fprintf(w, `{"@odata.nextLink":"%s/v1.0/groups/group-1/members?$skiptoken=2","value":[{"@odata.type":"#microsoft.graph.user","id":"1"}]}`, serverUrl)
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+	})
+	serverUrl = az.baseUrl
+
+	// A truncated list must not be mistaken for the full one
+	members, err := az.GetGroupMembers(context.Background(), "group-1")
+	assert.Nil(t, members)
+	assert.True(t, errorx.IsOfType(err, HttpError))
+}
+
+func TestClient_GetGroupWithMembers(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1.0/groups/group-1/members":
+			fmt.Fprint(w, `{"value":[
+				{"@odata.type":"#microsoft.graph.user","id":"1","userPrincipalName":"direct@dfds.com"},
+				{"@odata.type":"#microsoft.graph.group","id":"department","displayName":"Department"}]}`)
+		case "/v1.0/groups/group-1/transitiveMembers":
+			fmt.Fprint(w, `{"value":[
+				{"@odata.type":"#microsoft.graph.user","id":"1","userPrincipalName":"direct@dfds.com"},
+				{"@odata.type":"#microsoft.graph.group","id":"department","displayName":"Department"},
+				{"@odata.type":"#microsoft.graph.user","id":"2","userPrincipalName":"nested@dfds.com"}]}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}
+
+	// Nested groups are not members themselves
+	group, err := newTestClient(t, Config{}, handler).GetGroupWithMembers(context.Background(), "group-1", "CI_SSU_Cap - sandbox-abcde")
+	assert.NoError(t, err)
+	assert.Len(t, group.Members, 1)
+	assert.Empty(t, group.InheritedMembers)
+	assert.True(t, group.HasMember("DIRECT@dfds.com"))
+	assert.False(t, group.HasTransitiveMember("nested@dfds.com"))
+
+	group, err = newTestClient(t, Config{TransitiveMembers: true}, handler).GetGroupWithMembers(context.Background(), "group-1", "CI_SSU_Cap - sandbox-abcde")
+	assert.NoError(t, err)
+	assert.Len(t, group.Members, 1)
+	assert.Len(t, group.InheritedMembers, 1)
+	assert.False(t, group.HasMember("nested@dfds.com"))
+	assert.True(t, group.HasTransitiveMember("nested@dfds.com"))
+}
+
+func TestClient_PopulateGroupsWithMembers(t *testing.T) {
+	az := newTestClient(t, Config{}, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1.0/groups/group-1/members":
+			fmt.Fprint(w, `{"value":[{"@odata.type":"#microsoft.graph.user","id":"1","userPrincipalName":"one@dfds.com"}]}`)
+		default:
+			w.WriteHeader(http.StatusForbidden)
+		}
+	})
+
+	groups, err := az.PopulateGroupsWithMembers(context.Background(), &GroupsListResponse{Value: []GroupsListResponseGroup{{ID: "group-1", DisplayName: "one"}}})
+	assert.NoError(t, err)
+	assert.Len(t, groups["one"].Members, 1)
+
+	// A group whose members can't be read fails the whole call, rather than going missing
+	_, err = az.PopulateGroupsWithMembers(context.Background(), &GroupsListResponse{Value: []GroupsListResponseGroup{{ID: "group-1", DisplayName: "one"}, {ID: "group-2", DisplayName: "two"}}})
+	assert.Error(t, err)
+}
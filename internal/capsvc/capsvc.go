@@ -1,13 +1,15 @@
 package capsvc
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
-	"net/url"
-	"strings"
 
+	"go.dfds.cloud/aad-aws-sync/internal/entraid"
+	"go.dfds.cloud/aad-aws-sync/internal/httpclient"
+	"go.dfds.cloud/aad-aws-sync/internal/metrics"
 	"go.dfds.cloud/aad-aws-sync/internal/util"
 	"k8s.io/utils/env"
 )
@@ -20,10 +22,11 @@ type Client struct {
 
 type Config struct {
 	Host         string
-	TenantId     string `json:"tenantId"`
-	ClientId     string `json:"clientId"`
-	ClientSecret string `json:"clientSecret"`
-	Scope        string `json:"scope"`
+	TenantId     string             `json:"tenantId"`
+	ClientId     string             `json:"clientId"`
+	ClientSecret string             `json:"clientSecret"`
+	Auth         entraid.AuthConfig `json:"auth"`
+	Scope        string             `json:"scope"`
 }
 
 func (c *Client) prepareHttpRequest(h *http.Request) error {
@@ -32,14 +35,14 @@ func (c *Client) prepareHttpRequest(h *http.Request) error {
 		return err
 	}
 
-	h.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.tokenClient.Token.GetToken()))
+	h.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.tokenClient.GetToken()))
 	h.Header.Set("User-Agent", "aad-aws-sync - github.com/dfds/aad-aws-sync")
 
 	return nil
 }
 
-func (c *Client) GetCapabilities() ([]*GetCapabilitiesResponseContextCapability, error) {
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s/system/legacy/aad-aws-sync", c.config.Host), nil)
+func (c *Client) GetCapabilities(ctx context.Context) ([]*GetCapabilitiesResponseContextCapability, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/system/legacy/aad-aws-sync", c.config.Host), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -55,8 +58,8 @@ func (c *Client) GetCapabilities() ([]*GetCapabilitiesResponseContextCapability,
 
 	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("response returned unexpected status code: %d", resp.StatusCode)
+	if err := httpclient.CheckResponse(resp, HttpError, http.StatusOK); err != nil {
+		return nil, err
 	}
 
 	rawData, err := io.ReadAll(resp.Body)
@@ -77,7 +80,7 @@ func (c *Client) GetCapabilities() ([]*GetCapabilitiesResponseContextCapability,
 func (c *Client) RefreshAuth() error {
 	envToken := env.GetString("AAS_CAPSVC_TOKEN", "")
 	if envToken != "" {
-		c.tokenClient.Token = util.NewBearerToken(envToken)
+		c.tokenClient.SetToken(util.NewBearerToken(envToken))
 		return nil
 	}
 
@@ -86,50 +89,19 @@ func (c *Client) RefreshAuth() error {
 }
 
 func (c *Client) getNewToken() (*util.RefreshAuthResponse, error) {
-	reqPayload := url.Values{}
-	reqPayload.Set("client_id", c.config.ClientId)
-	reqPayload.Set("grant_type", "client_credentials")
-	reqPayload.Set("scope", c.config.Scope)
-	reqPayload.Set("client_secret", c.config.ClientSecret)
-
-	req, err := http.NewRequest("POST", fmt.Sprintf("https://login.microsoftonline.com/%s/oauth2/v2.0/token", c.config.TenantId), strings.NewReader(reqPayload.Encode()))
-	if err != nil {
-		return nil, err
-	}
-
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-
-	resp, err := c.httpClient.Do(req)
-	if err != nil {
-		return nil, err
-	}
-
-	defer resp.Body.Close()
-
-	rawData, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("response returned unexpected status code: %d", resp.StatusCode)
-	}
-
-	var tokenResponse *util.RefreshAuthResponse
-
-	err = json.Unmarshal(rawData, &tokenResponse)
-	if err != nil {
-		return nil, err
-	}
-
-	return tokenResponse, nil
+	return entraid.RequestToken(c.httpClient, entraid.Credentials{
+		TenantId:     c.config.TenantId,
+		ClientId:     c.config.ClientId,
+		ClientSecret: c.config.ClientSecret,
+		Auth:         c.config.Auth,
+	}, c.config.Scope)
 }
 
 func NewCapSvcClient(conf Config) *Client {
 	payload := &Client{
-		httpClient: http.DefaultClient,
+		httpClient: httpclient.New(httpclient.DefaultConfig(metrics.TargetCapabilityService)),
 		config:     conf,
 	}
-	payload.tokenClient = util.NewTokenClient(payload.getNewToken)
+	payload.tokenClient = entraid.NewTokenClient(conf.Auth, payload.getNewToken)
 	return payload
 }
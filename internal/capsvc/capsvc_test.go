@@ -1,7 +1,9 @@
 package capsvc
 
 import (
+	"github.com/joomcode/errorx"
 	"github.com/stretchr/testify/assert"
+	"go.dfds.cloud/aad-aws-sync/internal/store"
 	"go.dfds.cloud/aad-aws-sync/internal/util"
 	"net/http"
 	"testing"
@@ -41,3 +43,29 @@ func TestNewCapSvcClient(t *testing.T) {
 	capsvc := NewCapSvcClient(capsvcTestConfig)
 	assert.NotNil(t, capsvc)
 }
+
+func TestSnapshot(t *testing.T) {
+	st := store.NewMemoryStore()
+
+	_, err := LoadSnapshot(st)
+	assert.True(t, errorx.IsOfType(err, store.NotFound))
+
+	capabilities := []*GetCapabilitiesResponseContextCapability{{ID: "sandbox-abcde", RootID: "sandbox-abcde"}}
+	assert.NoError(t, SaveSnapshot(st, capabilities))
+
+	snapshot, err := LoadSnapshot(st)
+	assert.NoError(t, err)
+	assert.Equal(t, capabilities, snapshot.Capabilities)
+	assert.WithinDuration(t, time.Now(), snapshot.TakenAt, time.Minute)
+}
+
+func TestSnapshotCapability(t *testing.T) {
+	snapshot := Snapshot{Capabilities: []*GetCapabilitiesResponseContextCapability{
+		{ID: "0d03e3ad-2118-46b7-970e-0ca87b59a202", RootID: "legacy-capability"},
+		{ID: "sandbox-abcde", RootID: "sandbox-abcde"},
+	}}
+
+	assert.Equal(t, "legacy-capability", snapshot.Capability("0d03e3ad-2118-46b7-970e-0ca87b59a202").RootID)
+	assert.Equal(t, "sandbox-abcde", snapshot.Capability("sandbox-abcde").RootID)
+	assert.Nil(t, snapshot.Capability("legacy-capability"))
+}
@@ -0,0 +1,10 @@
+package capsvc
+
+import (
+	"github.com/joomcode/errorx"
+)
+
+var (
+	CapSvcError = errorx.NewNamespace("capsvc")
+	HttpError   = CapSvcError.NewType("http_error")
+)
@@ -0,0 +1,44 @@
+package capsvc
+
+import (
+	"time"
+
+	"go.dfds.cloud/aad-aws-sync/internal/store"
+)
+
+const latestSnapshotKey = "latest"
+
+// Snapshot is the last known good list of Capabilities fetched from Capability-Service.
+type Snapshot struct {
+	TakenAt      time.Time                                   `json:"takenAt"`
+	Capabilities []*GetCapabilitiesResponseContextCapability `json:"capabilities"`
+}
+
+// SaveSnapshot replaces the latest snapshot with capabilities.
+func SaveSnapshot(st store.Store, capabilities []*GetCapabilitiesResponseContextCapability) error {
+	return st.Put(store.BucketCapSvcSnapshots, latestSnapshotKey, Snapshot{
+		TakenAt:      time.Now(),
+		Capabilities: capabilities,
+	})
+}
+
+// LoadSnapshot returns the latest snapshot. Returns a store.NotFound error if no snapshot was saved yet.
+func LoadSnapshot(st store.Store) (*Snapshot, error) {
+	var snapshot Snapshot
+	if err := st.Get(store.BucketCapSvcSnapshots, latestSnapshotKey, &snapshot); err != nil {
+		return nil, err
+	}
+
+	return &snapshot, nil
+}
+
+// Capability returns the Capability with the given ID, or nil if the snapshot doesn't contain it.
+func (s *Snapshot) Capability(id string) *GetCapabilitiesResponseContextCapability {
+	for _, capability := range s.Capabilities {
+		if capability.ID == id {
+			return capability
+		}
+	}
+
+	return nil
+}
@@ -1,7 +1,10 @@
 package config
 
 import (
-	"github.com/kelseyhightower/envconfig"
+	"os"
+	"path/filepath"
+	"reflect"
+	"time"
 )
 
 type Config struct {
@@ -22,59 +25,192 @@ type Config struct {
 		Scim struct {
 			Endpoint string `json:"endpoint"`
 			Token    string `json:"token"`
-		}
+		} `json:"scim"`
 		OrganizationsParentId     string `json:"organizationsParentId"`
 		RootOrganizationsParentId string `json:"rootOrganizationsParentId"`
 	} `json:"aws"`
 	Azure struct {
-		TenantId             string `json:"tenantId"`
-		ClientId             string `json:"clientId"`
-		ClientSecret         string `json:"clientSecret"`
-		ApplicationId        string `json:"applicationId"`
-		ApplicationObjectId  string `json:"applicationObjectId"`
-		InternalDomainSuffix string `json:"internalDomainSuffix"`
+		TenantId             string      `json:"tenantId"`
+		ClientId             string      `json:"clientId"`
+		ClientSecret         string      `json:"clientSecret"`
+		Auth                 EntraIdAuth `json:"auth"`
+		ApplicationId        string      `json:"applicationId"`
+		ApplicationObjectId  string      `json:"applicationObjectId"`
+		InternalDomainSuffix string      `json:"internalDomainSuffix"`
+		// TransitiveMembers counts the members of groups nested in Capability groups as members of the Capability
+		TransitiveMembers bool `json:"transitiveMembers"`
+		// DeltaSync keeps the members of Capability and distribution groups in the state store, updated with Graph
+		// delta queries, instead of reading every group on every run. Until the state store has delta links, e.g. on
+		// its first run, the groups are read like without it.
+		DeltaSync bool `json:"deltaSync" default:"true"`
+		// CapabilityIdProperty is the directory extension property of groups that binds Capability groups to the root
+		// ID of their Capability, e.g. extension_<app ID>_capabilityRootId. The property has to be registered on an app
+		// beforehand, see the register-capability-id-property command. Capability groups are only matched by display
+		// name if empty.
+		CapabilityIdProperty string `json:"capabilityIdProperty"`
 	} `json:"azure"`
 	CapSvc struct { // Capability-Service
-		Host         string `json:"host"`
-		TokenScope   string `json:"tokenScope"`
-		ClientId     string `json:"clientId"`
-		ClientSecret string `json:"clientSecret"`
+		Host         string      `json:"host"`
+		TokenScope   string      `json:"tokenScope"`
+		ClientId     string      `json:"clientId"`
+		ClientSecret string      `json:"clientSecret"`
+		Auth         EntraIdAuth `json:"auth"`
 	} `json:"capSvc"`
 	Exchange struct {
-		ManagedBy    string `json:"managedBy"`
-		BaseUrl      string `json:"baseUrl"`
-		EmailSuffix  string `json:"emailSuffix"`
-		CcEmail      string `json:"ccEmail"`
-		ClientId     string `json:"clientId"`
-		ClientSecret string `json:"clientSecret"`
-	}
+		ManagedBy    string      `json:"managedBy"`
+		BaseUrl      string      `json:"baseUrl"`
+		EmailSuffix  string      `json:"emailSuffix"`
+		CcEmail      string      `json:"ccEmail"`
+		ClientId     string      `json:"clientId"`
+		ClientSecret string      `json:"clientSecret"`
+		Auth         EntraIdAuth `json:"auth"`
+	} `json:"exchange"`
 	Handler struct {
 		AssignGroups2AzureEnterpriseApps struct {
 			DataFilePath string `json:"dataFilePath"`
 		} `json:"assignGroups2AzureEnterpriseApps"`
+		Capsvc2Aad struct {
+			// ReportDuplicatesOnly reports duplicated Capability groups without merging or removing them
+			ReportDuplicatesOnly bool `json:"reportDuplicatesOnly"`
+			// InviteGuests sends a B2B invitation to external Capability members not found in AAD, and adds the guest
+			// users created by the invitations to the Capability groups
+			InviteGuests bool `json:"inviteGuests"`
+			// InviteRedirectUrl is where invited guests are sent after redeeming their invitation
+			InviteRedirectUrl string `json:"inviteRedirectUrl" default:"https://myapps.microsoft.com"`
+			// SetGroupOwners makes the members of a Capability the owners of its group. Capability-Service has no
+			// owner role, every member can manage the Capability. Owners that aren't users, e.g. the app, are kept.
+			SetGroupOwners bool `json:"setGroupOwners"`
+		} `json:"capSvc2Aad"`
 	} `json:"handler"`
 	Log struct {
 		Level string `json:"level"`
 		Debug bool   `json:"debug"`
-	}
+	} `json:"log"`
 	EventHandling struct {
 		Enabled bool `json:"enable"`
-	}
+		Webhook struct {
+			Enabled bool   `json:"enable"`
+			Token   string `json:"token"`
+			// FailedEventsPath is the directory failed events are kept in, see FailedEventsPath
+			FailedEventsPath string `json:"failedEventsPath"`
+		} `json:"webhook"`
+	} `json:"eventHandling"`
+	Api struct {
+		// Token is the bearer token required by API operations that change anything, i.e. triggering and cancelling
+		// jobs and syncing a Capability. Those operations are refused if empty.
+		Token string `json:"token"`
+	} `json:"api"`
+	LeaderElection struct {
+		Enabled        bool          `json:"enable"`
+		LeaseName      string        `json:"leaseName" default:"aad-aws-sync"`
+		LeaseNamespace string        `json:"leaseNamespace"`
+		Identity       string        `json:"identity"`
+		LeaseDuration  time.Duration `json:"leaseDuration" default:"15s"`
+		RenewDeadline  time.Duration `json:"renewDeadline" default:"10s"`
+		RetryPeriod    time.Duration `json:"retryPeriod" default:"2s"`
+		// PodLabel is set on the Pod of the leader, see k8s/service.yml
+		PodLabel string `json:"podLabel" default:"aad-aws-sync/leader"`
+	} `json:"leaderElection"`
+	Jobs struct {
+		HistorySize int `json:"historySize" default:"10"`
+	} `json:"jobs"`
+	StateStore struct {
+		Backend                 string        `json:"backend" default:"bolt"`
+		Path                    string        `json:"path" default:"data/state.db"`
+		RunRetention            int           `json:"runRetention" default:"500"`
+		ProcessedEventRetention time.Duration `json:"processedEventRetention" default:"168h"`
+	} `json:"stateStore"`
+	Audit struct {
+		Sink string `json:"sink" default:"store"`
+		// FilePath is where the file sink writes to, see AuditFilePath
+		FilePath string `json:"filePath"`
+	} `json:"audit"`
+	Tracing struct {
+		Enabled     bool    `json:"enable"`
+		Endpoint    string  `json:"endpoint" default:"localhost:4317"`
+		Insecure    bool    `json:"insecure"`
+		SampleRatio float64 `json:"sampleRatio" default:"1"`
+		ServiceName string  `json:"serviceName" default:"aad-aws-sync"`
+	} `json:"tracing"`
 	Scheduler struct {
-		Frequency                  string `json:"scheduleFrequency" default:"30m"`
-		EnableCapsvc2Azure         bool   `json:"enableCapsvc2Azure"`
-		EnableAzure2Aws            bool   `json:"enableAzure2Aws"`
-		EnableAwsMapping           bool   `json:"enableAwsMapping"`
-		EnableAws2K8s              bool   `json:"enableAws2K8S"`
-		EnableCapabilityEmailAlias bool   `json:"enableCapabilityEmailAlias"`
+		Frequency string `json:"scheduleFrequency" default:"30m"`
+		// Job holds the schedules of the scheduled jobs, e.g. AAS_SCHEDULER_JOB_CAPSVC2AAD_ENABLE
+		Job JobSchedules `json:"job"`
+	} `json:"scheduler"`
+}
+
+// AuditFilePath returns the file the file audit sink writes to: audit.filePath, or audit.jsonl next to the state
+// store, which is on the persistent volume when deployed, see k8s/pvc.yml.
+func (c Config) AuditFilePath() string {
+	if c.Audit.FilePath != "" {
+		return c.Audit.FilePath
+	}
+
+	return filepath.Join(filepath.Dir(c.StateStore.Path), "audit.jsonl")
+}
+
+// FailedEventsPath returns the directory the webhook keeps failed events in: eventHandling.webhook.failedEventsPath,
+// or failed-events next to the state store, see AuditFilePath.
+func (c Config) FailedEventsPath() string {
+	if c.EventHandling.Webhook.FailedEventsPath != "" {
+		return c.EventHandling.Webhook.FailedEventsPath
+	}
+
+	return filepath.Join(filepath.Dir(c.StateStore.Path), "failed-events")
+}
+
+// JobSchedules are the schedules of the scheduled jobs. The json name of every field is the name of its job, see the
+// handler.*Name constants.
+type JobSchedules struct {
+	CapSvc2Aad                       JobSchedule `json:"capSvc2Aad"`
+	Aad2Aws                          JobSchedule `json:"aad2Aws"`
+	AwsMapping                       JobSchedule `json:"awsMapping"`
+	Aws2K8s                          JobSchedule `json:"aws2K8s"`
+	CapabilityEmailAlias             JobSchedule `json:"capabilityEmailAlias"`
+	AssignGroups2AzureEnterpriseApps JobSchedule `json:"assignGroups2AzureEnterpriseApps"`
+}
+
+// Get returns the schedule of a job by name, and false if there's no job by that name.
+func (s JobSchedules) Get(name string) (JobSchedule, bool) {
+	v := reflect.ValueOf(s)
+	for i := 0; i < v.NumField(); i++ {
+		if settingName(v.Type().Field(i)) == name {
+			return v.Field(i).Interface().(JobSchedule), true
+		}
 	}
+
+	return JobSchedule{}, false
+}
+
+// JobSchedule is when a scheduled job runs. The environment variables match those the Orchestrator reads, see
+// jobs.Manager.AddJob.
+type JobSchedule struct {
+	Enable   bool   `json:"enable"`
+	Interval string `json:"interval" default:"1h"`
+}
+
+// EntraIdAuth chooses how a client authenticates to Entra ID. It is set per client, e.g. AAS_AZURE_AUTH_METHOD, and
+// used as is by the entraid package, where it is known as entraid.AuthConfig.
+type EntraIdAuth struct {
+	// Method is one of the entraid.AuthMethod constants
+	Method string `json:"method" default:"secret"`
+	// TokenFile is the file holding the federated token of the workloadIdentity and awsWebIdentity methods. It is
+	// re-read for every token request, as the token is rotated. Defaults to AZURE_FEDERATED_TOKEN_FILE and
+	// AWS_WEB_IDENTITY_TOKEN_FILE respectively.
+	TokenFile string `json:"tokenFile"`
+	// CertificatePath is the PEM file holding the certificate and RSA private key of the certificate method
+	CertificatePath string `json:"certificatePath"`
+	// RefreshSkew is how long before the expiry of a token a new one is requested, see util.TokenClient. Defaults to
+	// util.DefaultRefreshSkew if zero.
+	RefreshSkew time.Duration `json:"refreshSkew" default:"2m"`
 }
 
 const APP_CONF_PREFIX = "AAS"
 
+// LoadConfig loads the config from the environment variables, layered over the config file named by CONF_FILE_ENV
+// if set, see LoadFile.
 func LoadConfig() (Config, error) {
-	var conf Config
-	err := envconfig.Process(APP_CONF_PREFIX, &conf)
+	conf, _, err := LoadFile(os.Getenv(CONF_FILE_ENV))
 
 	return conf, err
 }
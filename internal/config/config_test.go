@@ -18,3 +18,29 @@ func TestLoadConfig(t *testing.T) {
 
 	t.Log(string(serialised))
 }
+
+func TestAuditFilePath(t *testing.T) {
+	var conf Config
+	conf.StateStore.Path = "/app/state/state.db"
+	if path := conf.AuditFilePath(); path != "/app/state/audit.jsonl" {
+		t.Errorf("expected the audit file next to the state store, got %s", path)
+	}
+
+	conf.Audit.FilePath = "/var/log/audit.jsonl"
+	if path := conf.AuditFilePath(); path != "/var/log/audit.jsonl" {
+		t.Errorf("expected the configured audit file, got %s", path)
+	}
+}
+
+func TestFailedEventsPath(t *testing.T) {
+	var conf Config
+	conf.StateStore.Path = "/app/state/state.db"
+	if path := conf.FailedEventsPath(); path != "/app/state/failed-events" {
+		t.Errorf("expected failed events next to the state store, got %s", path)
+	}
+
+	conf.EventHandling.Webhook.FailedEventsPath = "/var/lib/failed-events"
+	if path := conf.FailedEventsPath(); path != "/var/lib/failed-events" {
+		t.Errorf("expected the configured directory, got %s", path)
+	}
+}
@@ -0,0 +1,230 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+	"sigs.k8s.io/yaml"
+)
+
+// CONF_FILE_ENV names the optional YAML or JSON config file loaded by LoadConfig.
+const CONF_FILE_ENV = "AAS_CONFIG_FILE"
+
+// LoadFile loads the config from the defaults, the YAML or JSON file at path, and the environment variables, in
+// increasing order of precedence. The file is skipped if path is empty. Its keys are the json names of the Config
+// fields, e.g.
+//
+//	azure:
+//	  tenantId: 00000000-0000-0000-0000-000000000000
+//	leaderElection:
+//	  leaseDuration: 15s
+//
+// The returned warnings list the settings of the file that are overridden by environment variables.
+func LoadFile(path string) (Config, []Problem, error) {
+	var conf Config
+	err := envconfig.Process(APP_CONF_PREFIX, &conf)
+	if err != nil {
+		return conf, nil, err
+	}
+
+	if path == "" {
+		return conf, nil, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return conf, nil, err
+	}
+
+	// JSON is YAML, so this handles both. Strict decoding rejects duplicate keys.
+	jsonData, err := yaml.YAMLToJSONStrict(data)
+	if err != nil {
+		return conf, nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+
+	var values map[string]interface{}
+	err = json.Unmarshal(jsonData, &values)
+	if err != nil {
+		return conf, nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+
+	var warnings []Problem
+	err = applyFile(reflect.ValueOf(&conf).Elem(), values, "", APP_CONF_PREFIX, &warnings)
+	if err != nil {
+		return conf, nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+
+	return conf, warnings, nil
+}
+
+// applyFile sets the fields of the struct v to values, skipping fields set through their environment variable.
+func applyFile(v reflect.Value, values map[string]interface{}, path string, envPrefix string, warnings *[]Problem) error {
+	// Keys are matched case-insensitively, like encoding/json does, so e.g. tenantId and tenantid would both set
+	// the same field
+	keys := make(map[string]string, len(values))
+	for key := range values {
+		if other, exists := keys[strings.ToLower(key)]; exists {
+			return fmt.Errorf("duplicate setting %s: both %q and %q are set", settingPath(path, key), other, key)
+		}
+		keys[strings.ToLower(key)] = key
+	}
+
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		name := settingName(field)
+		key, ok := keys[strings.ToLower(name)]
+		if !ok {
+			continue
+		}
+		delete(keys, strings.ToLower(name))
+
+		setting := settingPath(path, name)
+		envKey := settingEnvVar(envPrefix, field)
+		value := values[key]
+
+		if field.Type.Kind() == reflect.Struct {
+			nested, ok := value.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("%s must be a map of settings", setting)
+			}
+
+			err := applyFile(v.Field(i), nested, setting, envKey, warnings)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if _, set := os.LookupEnv(envKey); set {
+			*warnings = append(*warnings, Problem{
+				Setting: setting,
+				EnvVar:  envKey,
+				Message: "set in both the config file and the environment, the environment variable takes precedence",
+				Warning: true,
+			})
+			continue
+		}
+
+		err := setValue(v.Field(i), value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", setting, err)
+		}
+	}
+
+	if len(keys) > 0 {
+		unknown := make([]string, 0, len(keys))
+		for _, key := range keys {
+			unknown = append(unknown, settingPath(path, key))
+		}
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown setting %s", strings.Join(unknown, ", "))
+	}
+
+	return nil
+}
+
+// settingName returns the name of field in the config file, its json name.
+func settingName(field reflect.StructField) string {
+	name := strings.Split(field.Tag.Get("json"), ",")[0]
+	if name == "" {
+		return field.Name
+	}
+
+	return name
+}
+
+func settingPath(path string, name string) string {
+	if path == "" {
+		return name
+	}
+
+	return path + "." + name
+}
+
+// settingEnvVar returns the environment variable envconfig reads field from.
+func settingEnvVar(prefix string, field reflect.StructField) string {
+	name := field.Name
+	if alt := field.Tag.Get("envconfig"); alt != "" {
+		name = alt
+	}
+
+	return strings.ToUpper(prefix + "_" + name)
+}
+
+// setValue sets the field v to the value decoded from the config file.
+func setValue(v reflect.Value, value interface{}) error {
+	if v.Type() == reflect.TypeOf(time.Duration(0)) {
+		str, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("must be a duration such as \"15s\", got %v", value)
+		}
+		duration, err := time.ParseDuration(str)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(duration))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		switch value.(type) {
+		case string, float64, bool:
+			v.SetString(fmt.Sprint(value))
+			return nil
+		}
+	case reflect.Bool:
+		switch typed := value.(type) {
+		case bool:
+			v.SetBool(typed)
+			return nil
+		case string:
+			parsed, err := strconv.ParseBool(typed)
+			if err != nil {
+				return err
+			}
+			v.SetBool(parsed)
+			return nil
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		switch typed := value.(type) {
+		case float64:
+			if typed != float64(int64(typed)) {
+				return fmt.Errorf("must be a whole number, got %v", typed)
+			}
+			v.SetInt(int64(typed))
+			return nil
+		case string:
+			parsed, err := strconv.ParseInt(typed, 10, 64)
+			if err != nil {
+				return err
+			}
+			v.SetInt(parsed)
+			return nil
+		}
+	case reflect.Float32, reflect.Float64:
+		switch typed := value.(type) {
+		case float64:
+			v.SetFloat(typed)
+			return nil
+		case string:
+			parsed, err := strconv.ParseFloat(typed, 64)
+			if err != nil {
+				return err
+			}
+			v.SetFloat(parsed)
+			return nil
+		}
+	default:
+		return fmt.Errorf("settings of type %s are not supported in the config file", v.Type())
+	}
+
+	return fmt.Errorf("invalid value %v", value)
+}
@@ -0,0 +1,132 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeConfigFile(t *testing.T, name string, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestLoadFile(t *testing.T) {
+	path := writeConfigFile(t, "config.yaml", `
+azure:
+  tenantId: tenant
+  clientId: file-client
+  auth:
+    method: certificate
+    certificatePath: /etc/aad-aws-sync/certificate.pem
+    refreshSkew: 5m
+aws:
+  scim:
+    endpoint: https://scim.eu-west-1.amazonaws.com/abc
+exchange:
+  managedBy: cloud.engineering@dfds.com
+leaderElection:
+  enable: true
+  leaseDuration: 30s
+stateStore:
+  runRetention: 100
+tracing:
+  sampleRatio: 0.25
+scheduler:
+  job:
+    capSvc2Aad:
+      enable: true
+      interval: 5m
+    awsMapping:
+      enable: true
+`)
+	t.Setenv("AAS_AZURE_CLIENTID", "env-client")
+	t.Setenv("AAS_SCHEDULER_JOB_AWSMAPPING_ENABLE", "false")
+
+	conf, warnings, err := LoadFile(path)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "tenant", conf.Azure.TenantId)
+	assert.Equal(t, "certificate", conf.Azure.Auth.Method)
+	assert.Equal(t, "/etc/aad-aws-sync/certificate.pem", conf.Azure.Auth.CertificatePath)
+	assert.Equal(t, 5*time.Minute, conf.Azure.Auth.RefreshSkew)
+	assert.Equal(t, "https://scim.eu-west-1.amazonaws.com/abc", conf.Aws.Scim.Endpoint)
+	assert.Equal(t, "cloud.engineering@dfds.com", conf.Exchange.ManagedBy)
+	assert.True(t, conf.LeaderElection.Enabled)
+	assert.Equal(t, 30*time.Second, conf.LeaderElection.LeaseDuration)
+	assert.Equal(t, 100, conf.StateStore.RunRetention)
+	assert.Equal(t, 0.25, conf.Tracing.SampleRatio)
+	assert.Equal(t, JobSchedule{Enable: true, Interval: "5m"}, conf.Scheduler.Job.CapSvc2Aad)
+
+	// Settings missing from the file keep their defaults
+	assert.Equal(t, 10*time.Second, conf.LeaderElection.RenewDeadline)
+	assert.Equal(t, "bolt", conf.StateStore.Backend)
+	assert.Equal(t, "secret", conf.CapSvc.Auth.Method)
+	assert.Equal(t, 2*time.Minute, conf.CapSvc.Auth.RefreshSkew)
+	assert.True(t, conf.Azure.DeltaSync)
+	assert.Equal(t, "https://myapps.microsoft.com", conf.Handler.Capsvc2Aad.InviteRedirectUrl)
+	assert.Equal(t, JobSchedule{Interval: "1h"}, conf.Scheduler.Job.Aad2Aws)
+
+	schedule, exists := conf.Scheduler.Job.Get("capSvc2Aad")
+	assert.True(t, exists)
+	assert.Equal(t, conf.Scheduler.Job.CapSvc2Aad, schedule)
+	_, exists = conf.Scheduler.Job.Get("unknownJob")
+	assert.False(t, exists)
+
+	// Environment variables take precedence over the file
+	assert.Equal(t, "env-client", conf.Azure.ClientId)
+	assert.False(t, conf.Scheduler.Job.AwsMapping.Enable)
+	assert.Equal(t, []Problem{{
+		Setting: "azure.clientId",
+		EnvVar:  "AAS_AZURE_CLIENTID",
+		Message: "set in both the config file and the environment, the environment variable takes precedence",
+		Warning: true,
+	}, {
+		Setting: "scheduler.job.awsMapping.enable",
+		EnvVar:  "AAS_SCHEDULER_JOB_AWSMAPPING_ENABLE",
+		Message: "set in both the config file and the environment, the environment variable takes precedence",
+		Warning: true,
+	}}, warnings)
+}
+
+func TestLoadFileJson(t *testing.T) {
+	path := writeConfigFile(t, "config.json", `{"capSvc": {"host": "https://capsvc.dfds.cloud", "tokenScope": "api://capsvc/.default"}}`)
+
+	conf, warnings, err := LoadFile(path)
+	assert.NoError(t, err)
+	assert.Empty(t, warnings)
+	assert.Equal(t, "https://capsvc.dfds.cloud", conf.CapSvc.Host)
+	assert.Equal(t, "api://capsvc/.default", conf.CapSvc.TokenScope)
+}
+
+func TestLoadFileInvalid(t *testing.T) {
+	for name, content := range map[string]string{
+		"unknown setting":  "azure:\n  tenant: tenant\n",
+		"duplicate key":    "azure:\n  tenantId: a\n  tenantId: b\n",
+		"duplicate casing": "azure:\n  tenantId: a\n  tenantid: b\n",
+		"not a map":        "azure: tenant\n",
+		"invalid duration": "leaderElection:\n  leaseDuration: 15\n",
+		"invalid bool":     "tracing:\n  enable: maybe\n",
+		"invalid yaml":     "azure: [\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, _, err := LoadFile(writeConfigFile(t, "config.yaml", content))
+			assert.Error(t, err)
+		})
+	}
+
+	_, _, err := LoadFile(filepath.Join(t.TempDir(), "missing.yaml"))
+	assert.Error(t, err)
+}
+
+func TestLoadConfigFromFile(t *testing.T) {
+	t.Setenv(CONF_FILE_ENV, writeConfigFile(t, "config.yaml", "azure:\n  tenantId: tenant\n"))
+
+	conf, err := LoadConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, "tenant", conf.Azure.TenantId)
+}
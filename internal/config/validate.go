@@ -0,0 +1,312 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Problem is a setting that failed validation, or a warning about a setting.
+type Problem struct {
+	// Setting is the path of the setting in the config file, e.g. azure.tenantId
+	Setting string `json:"setting"`
+	// EnvVar is the environment variable of the setting, e.g. AAS_AZURE_TENANTID
+	EnvVar  string `json:"envVar"`
+	Message string `json:"message"`
+	Warning bool   `json:"warning,omitempty"`
+}
+
+func (p Problem) String() string {
+	severity := "error"
+	if p.Warning {
+		severity = "warning"
+	}
+
+	return fmt.Sprintf("%s: %s (%s): %s", severity, p.Setting, p.EnvVar, p.Message)
+}
+
+// Errors returns the problems that aren't warnings.
+func Errors(problems []Problem) []Problem {
+	var errs []Problem
+	for _, problem := range problems {
+		if !problem.Warning {
+			errs = append(errs, problem)
+		}
+	}
+
+	return errs
+}
+
+// arnPattern matches the ARN of an AWS resource. The account ID is empty for global resources, e.g. those of IAM
+// Identity Center.
+var arnPattern = regexp.MustCompile(`^arn:aws[a-z-]*:([a-z0-9-]+):[a-z0-9-]*:(\d{12})?:(.+)$`)
+
+// capabilityIdPropertyPattern matches the name of a directory extension property, extension_<app ID without dashes>_<name>.
+var capabilityIdPropertyPattern = regexp.MustCompile(`^extension_[0-9a-fA-F]{32}_[A-Za-z0-9_]+$`)
+
+// Requirement is a group of settings a job needs, see Validate.
+type Requirement int
+
+const (
+	RequireAzure Requirement = iota
+	RequireAzureApplication
+	RequireCapSvc
+	RequireExchange
+	RequireAwsMapping
+	RequireAws2K8s
+	RequireEnterpriseAppMappings
+)
+
+var requirementChecks = map[Requirement]func(v *validator){
+	RequireAzure:                 requireAzure,
+	RequireAzureApplication:      requireAzureApplication,
+	RequireCapSvc:                requireCapSvc,
+	RequireExchange:              requireExchange,
+	RequireAwsMapping:            requireAwsMapping,
+	RequireAws2K8s:               requireAws2K8s,
+	RequireEnterpriseAppMappings: requireEnterpriseAppMappings,
+}
+
+// Validate checks that the settings in requirements, those needed by the jobs that will run, and those needed by
+// event handling if enabled, are set, and that all settings that are set are well-formed.
+func Validate(conf Config, requirements []Requirement) []Problem {
+	v := &validator{conf: conf, envVars: settingEnvVars(), checked: map[string]bool{}}
+
+	for _, requirement := range requirements {
+		requirementChecks[requirement](v)
+	}
+
+	if conf.EventHandling.Enabled {
+		requireAzure(v)
+		requireAzureApplication(v)
+		requireCapSvc(v)
+		requireExchange(v)
+		v.required("aws.scim.token", conf.Aws.Scim.Token)
+		v.url("aws.scim.endpoint", conf.Aws.Scim.Endpoint, true)
+		v.required("aws.assumableRoles.capabilityAccountRoleName", conf.Aws.AssumableRoles.CapabilityAccountRoleName)
+	}
+	if conf.EventHandling.Webhook.Enabled {
+		v.required("eventHandling.webhook.token", conf.EventHandling.Webhook.Token)
+	}
+
+	// Settings that are optional, but must be well-formed when set
+	v.arn("aws.assumableRoles.ssoManagementArn", conf.Aws.AssumableRoles.SsoManagementArn, "iam", "role/", false)
+	v.url("capSvc.host", conf.CapSvc.Host, false)
+	v.url("exchange.baseUrl", conf.Exchange.BaseUrl, false)
+	v.url("aws.scim.endpoint", conf.Aws.Scim.Endpoint, false)
+	v.url("handler.capSvc2Aad.inviteRedirectUrl", conf.Handler.Capsvc2Aad.InviteRedirectUrl, conf.Handler.Capsvc2Aad.InviteGuests)
+	if property := conf.Azure.CapabilityIdProperty; property != "" && !capabilityIdPropertyPattern.MatchString(property) {
+		v.problem("azure.capabilityIdProperty", "must be the name of a directory extension property, extension_<app ID without dashes>_<name>, got %q", property)
+	}
+	v.jobSchedules(conf.Scheduler.Job)
+
+	if conf.LeaderElection.Enabled {
+		if conf.LeaderElection.RenewDeadline >= conf.LeaderElection.LeaseDuration {
+			v.problem("leaderElection.renewDeadline", "must be shorter than leaderElection.leaseDuration")
+		}
+		if conf.LeaderElection.RetryPeriod >= conf.LeaderElection.RenewDeadline {
+			v.problem("leaderElection.retryPeriod", "must be shorter than leaderElection.renewDeadline")
+		}
+	}
+	if conf.Tracing.Enabled && (conf.Tracing.SampleRatio < 0 || conf.Tracing.SampleRatio > 1) {
+		v.problem("tracing.sampleRatio", "must be between 0 and 1")
+	}
+
+	sort.SliceStable(v.problems, func(i, j int) bool { return v.problems[i].Setting < v.problems[j].Setting })
+	return v.problems
+}
+
+type validator struct {
+	conf     Config
+	envVars  map[string]string
+	problems []Problem
+	// checked holds the settings already checked, so those needed by several jobs are only reported once
+	checked map[string]bool
+}
+
+func (v *validator) problem(setting string, format string, args ...interface{}) {
+	v.problems = append(v.problems, Problem{Setting: setting, EnvVar: v.envVars[setting], Message: fmt.Sprintf(format, args...)})
+}
+
+// check returns false if setting was checked before.
+func (v *validator) check(setting string) bool {
+	if v.checked[setting] {
+		return false
+	}
+	v.checked[setting] = true
+	return true
+}
+
+func (v *validator) required(setting string, value string) {
+	if v.check(setting) && value == "" {
+		v.problem(setting, "is required")
+	}
+}
+
+func (v *validator) url(setting string, value string, required bool) {
+	if value == "" {
+		if required {
+			v.required(setting, value)
+		}
+		return
+	}
+	if !v.check(setting) {
+		return
+	}
+
+	parsed, err := url.Parse(value)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		v.problem(setting, "must be an absolute http or https URL, got %q", value)
+	}
+}
+
+// arn checks that value is the ARN of a resource of service, with a resource part starting with resourcePrefix.
+func (v *validator) arn(setting string, value string, service string, resourcePrefix string, required bool) {
+	if value == "" {
+		if required {
+			v.required(setting, value)
+		}
+		return
+	}
+	if !v.check(setting) {
+		return
+	}
+
+	match := arnPattern.FindStringSubmatch(value)
+	if match == nil || match[1] != service || !strings.HasPrefix(match[3], resourcePrefix) {
+		v.problem(setting, "must be the ARN of a %s %s, got %q", service, strings.TrimSuffix(resourcePrefix, "/"), value)
+	}
+}
+
+// entraIdAuth checks the credentials of a client authenticating to Entra ID, see entraid.AuthConfig.
+func (v *validator) entraIdAuth(section string, clientSecret string, auth EntraIdAuth) {
+	if !v.check(section + ".auth") {
+		return
+	}
+
+	switch auth.Method {
+	case "secret", "":
+		v.required(section+".clientSecret", clientSecret)
+	case "certificate":
+		v.required(section+".auth.certificatePath", auth.CertificatePath)
+	case "workloadIdentity":
+	case "awsWebIdentity":
+		if auth.TokenFile == "" && os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE") == "" {
+			v.problem(section+".auth.tokenFile", "is required when AWS_WEB_IDENTITY_TOKEN_FILE is not set")
+		}
+	default:
+		v.problem(section+".auth.method", "must be one of secret, workloadIdentity, awsWebIdentity or certificate, got %q", auth.Method)
+	}
+
+	if auth.RefreshSkew < 0 {
+		v.problem(section+".auth.refreshSkew", "must not be negative, got %s", auth.RefreshSkew)
+	}
+}
+
+// jobSchedules checks the intervals of the enabled jobs, which the Orchestrator fails to start with if malformed.
+func (v *validator) jobSchedules(schedules JobSchedules) {
+	value := reflect.ValueOf(schedules)
+	for i := 0; i < value.NumField(); i++ {
+		schedule := value.Field(i).Interface().(JobSchedule)
+		if !schedule.Enable {
+			continue
+		}
+
+		setting := settingPath("scheduler.job."+settingName(value.Type().Field(i)), "interval")
+		if _, err := time.ParseDuration(schedule.Interval); err != nil {
+			v.problem(setting, "must be a duration such as \"30m\", got %q", schedule.Interval)
+		}
+	}
+}
+
+func requireAzure(v *validator) {
+	v.required("azure.tenantId", v.conf.Azure.TenantId)
+	v.required("azure.clientId", v.conf.Azure.ClientId)
+	v.entraIdAuth("azure", v.conf.Azure.ClientSecret, v.conf.Azure.Auth)
+}
+
+func requireAzureApplication(v *validator) {
+	v.required("azure.applicationId", v.conf.Azure.ApplicationId)
+	v.required("azure.applicationObjectId", v.conf.Azure.ApplicationObjectId)
+}
+
+func requireCapSvc(v *validator) {
+	// The Capability Service is in the tenant of Azure
+	v.required("azure.tenantId", v.conf.Azure.TenantId)
+	v.url("capSvc.host", v.conf.CapSvc.Host, true)
+	v.required("capSvc.tokenScope", v.conf.CapSvc.TokenScope)
+	v.required("capSvc.clientId", v.conf.CapSvc.ClientId)
+	v.entraIdAuth("capSvc", v.conf.CapSvc.ClientSecret, v.conf.CapSvc.Auth)
+}
+
+func requireExchange(v *validator) {
+	v.required("exchange.clientId", v.conf.Exchange.ClientId)
+	v.required("exchange.managedBy", v.conf.Exchange.ManagedBy)
+	v.required("exchange.emailSuffix", v.conf.Exchange.EmailSuffix)
+	v.entraIdAuth("exchange", v.conf.Exchange.ClientSecret, v.conf.Exchange.Auth)
+}
+
+func requireAwsMapping(v *validator) {
+	aws := v.conf.Aws
+	v.required("aws.identityStoreArn", aws.IdentityStoreArn)
+	v.arn("aws.ssoInstanceArn", aws.SsoInstanceArn, "sso", "instance/", true)
+	v.arn("aws.capabilityPermissionSetArn", aws.CapabilityPermissionSetArn, "sso", "permissionSet/", true)
+	v.arn("aws.capabilityLogsPermissionSetArn", aws.CapabilityLogsPermissionSetArn, "sso", "permissionSet/", true)
+	v.arn("aws.sharedEcrPullPermissionSetArn", aws.SharedEcrPullPermissionSetArn, "sso", "permissionSet/", true)
+	v.required("aws.capabilityLogsAwsAccountAlias", aws.CapabilityLogsAwsAccountAlias)
+	v.required("aws.sharedEcrPullAwsAccountAlias", aws.SharedEcrPullAwsAccountAlias)
+	v.required("aws.accountNamePrefix", aws.AccountNamePrefix)
+	v.required("aws.ssoRegion", aws.SsoRegion)
+
+	if aws.CapabilityPermissionSetArn != "" && aws.CapabilityPermissionSetArn == aws.CapabilityLogsPermissionSetArn {
+		v.problem("aws.capabilityLogsPermissionSetArn", "must differ from aws.capabilityPermissionSetArn")
+	}
+	if aws.CapabilityPermissionSetArn != "" && aws.CapabilityPermissionSetArn == aws.SharedEcrPullPermissionSetArn {
+		v.problem("aws.sharedEcrPullPermissionSetArn", "must differ from aws.capabilityPermissionSetArn")
+	}
+}
+
+func requireAws2K8s(v *validator) {
+	v.required("aws.organizationsParentId", v.conf.Aws.OrganizationsParentId)
+	v.required("aws.assumableRoles.capabilityAccountRoleName", v.conf.Aws.AssumableRoles.CapabilityAccountRoleName)
+}
+
+func requireEnterpriseAppMappings(v *validator) {
+	setting := "handler.assignGroups2AzureEnterpriseApps.dataFilePath"
+	path := v.conf.Handler.AssignGroups2AzureEnterpriseApps.DataFilePath
+	v.required(setting, path)
+	if path == "" {
+		return
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		v.problem(setting, "unable to read the enterprise app mappings: %v", err)
+	}
+}
+
+// settingEnvVars returns the environment variables of all settings, by the path of the setting in the config file.
+func settingEnvVars() map[string]string {
+	envVars := map[string]string{}
+
+	var walk func(t reflect.Type, path string, envPrefix string)
+	walk = func(t reflect.Type, path string, envPrefix string) {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			setting := settingPath(path, settingName(field))
+			envVar := settingEnvVar(envPrefix, field)
+			if field.Type.Kind() == reflect.Struct {
+				walk(field.Type, setting, envVar)
+				continue
+			}
+			envVars[setting] = envVar
+		}
+	}
+	walk(reflect.TypeOf(Config{}), "", APP_CONF_PREFIX)
+
+	return envVars
+}
@@ -0,0 +1,151 @@
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func settingsOf(problems []Problem) []string {
+	settings := make([]string, 0, len(problems))
+	for _, problem := range problems {
+		settings = append(settings, problem.Setting)
+	}
+
+	return settings
+}
+
+func TestValidateNothingEnabled(t *testing.T) {
+	assert.Empty(t, Validate(Config{}, nil))
+}
+
+func TestValidateRequiredPerJob(t *testing.T) {
+	var conf Config
+	conf.Azure.TenantId = "tenant"
+	conf.Azure.ClientId = "client"
+	conf.CapSvc.Host = "capsvc.dfds.cloud"
+
+	problems := Validate(conf, []Requirement{RequireAzure, RequireCapSvc, RequireAzure, RequireCapSvc, RequireExchange})
+	assert.Equal(t, []string{
+		"azure.clientSecret",
+		"capSvc.clientId",
+		"capSvc.clientSecret",
+		"capSvc.host",
+		"capSvc.tokenScope",
+		"exchange.clientId",
+		"exchange.clientSecret",
+		"exchange.emailSuffix",
+		"exchange.managedBy",
+	}, settingsOf(problems))
+
+	assert.Equal(t, "AAS_AZURE_CLIENTSECRET", problems[0].EnvVar)
+	assert.Equal(t, "is required", problems[0].Message)
+	assert.Contains(t, problems[3].Message, "absolute http or https URL")
+	assert.Equal(t, problems, Errors(problems))
+}
+
+func TestValidateEntraIdAuth(t *testing.T) {
+	var conf Config
+	conf.Azure.TenantId = "tenant"
+	conf.Azure.ClientId = "client"
+
+	conf.Azure.Auth.Method = "workloadIdentity"
+	assert.NotContains(t, settingsOf(Validate(conf, []Requirement{RequireAzure, RequireAzureApplication, RequireCapSvc})), "azure.clientSecret")
+
+	conf.Azure.Auth.Method = "certificate"
+	assert.Contains(t, settingsOf(Validate(conf, []Requirement{RequireAzure, RequireAzureApplication, RequireCapSvc})), "azure.auth.certificatePath")
+
+	t.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", "")
+	conf.Azure.Auth.Method = "awsWebIdentity"
+	assert.Contains(t, settingsOf(Validate(conf, []Requirement{RequireAzure, RequireAzureApplication, RequireCapSvc})), "azure.auth.tokenFile")
+	t.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", "/var/run/secrets/eks.amazonaws.com/serviceaccount/token")
+	assert.NotContains(t, settingsOf(Validate(conf, []Requirement{RequireAzure, RequireAzureApplication, RequireCapSvc})), "azure.auth.tokenFile")
+
+	conf.Azure.Auth.Method = "password"
+	assert.Contains(t, settingsOf(Validate(conf, []Requirement{RequireAzure, RequireAzureApplication, RequireCapSvc})), "azure.auth.method")
+
+	conf.Azure.Auth.RefreshSkew = -time.Minute
+	assert.Contains(t, settingsOf(Validate(conf, []Requirement{RequireAzure, RequireAzureApplication, RequireCapSvc})), "azure.auth.refreshSkew")
+}
+
+func TestValidateAwsMapping(t *testing.T) {
+	var conf Config
+	conf.Aws.IdentityStoreArn = "d-1234567890"
+	conf.Aws.SsoInstanceArn = "arn:aws:sso:::instance/ssoins-1234567890abcdef"
+	conf.Aws.CapabilityPermissionSetArn = "arn:aws:sso:::permissionSet/ssoins-1234567890abcdef/ps-1234567890abcdef"
+	conf.Aws.CapabilityLogsPermissionSetArn = "arn:aws:sso:::permissionSet/ssoins-1234567890abcdef/ps-1234567890abcdef"
+	conf.Aws.SharedEcrPullPermissionSetArn = "arn:aws:iam::123456789012:role/ecr-pull"
+	conf.Aws.CapabilityLogsAwsAccountAlias = "dfds-logs"
+	conf.Aws.SharedEcrPullAwsAccountAlias = "dfds-ecr"
+	conf.Aws.AccountNamePrefix = "dfds-"
+	conf.Aws.SsoRegion = "eu-west-1"
+	conf.Aws.AssumableRoles.SsoManagementArn = "sso-management"
+
+	problems := Validate(conf, []Requirement{RequireAwsMapping})
+	assert.Equal(t, []string{
+		"aws.assumableRoles.ssoManagementArn",
+		"aws.capabilityLogsPermissionSetArn",
+		"aws.sharedEcrPullPermissionSetArn",
+	}, settingsOf(problems))
+	assert.Equal(t, "must differ from aws.capabilityPermissionSetArn", problems[1].Message)
+	assert.Contains(t, problems[2].Message, "ARN of a sso permissionSet")
+
+	conf.Aws.CapabilityLogsPermissionSetArn = "arn:aws:sso:::permissionSet/ssoins-1234567890abcdef/ps-fedcba0987654321"
+	conf.Aws.SharedEcrPullPermissionSetArn = "arn:aws:sso:::permissionSet/ssoins-1234567890abcdef/ps-0000000000000000"
+	conf.Aws.AssumableRoles.SsoManagementArn = "arn:aws:iam::123456789012:role/sso-management"
+	assert.Empty(t, Validate(conf, []Requirement{RequireAwsMapping}))
+}
+
+func TestValidateEventHandlingAndServices(t *testing.T) {
+	var conf Config
+	conf.EventHandling.Enabled = true
+	conf.EventHandling.Webhook.Enabled = true
+	conf.LeaderElection.Enabled = true
+	conf.LeaderElection.LeaseDuration = 10
+	conf.LeaderElection.RenewDeadline = 10
+	conf.LeaderElection.RetryPeriod = 2
+	conf.Tracing.Enabled = true
+	conf.Tracing.SampleRatio = 2
+
+	settings := settingsOf(Validate(conf, nil))
+	for _, setting := range []string{
+		"aws.scim.endpoint",
+		"aws.scim.token",
+		"aws.assumableRoles.capabilityAccountRoleName",
+		"azure.applicationId",
+		"eventHandling.webhook.token",
+		"exchange.managedBy",
+		"leaderElection.renewDeadline",
+		"tracing.sampleRatio",
+	} {
+		assert.Contains(t, settings, setting)
+	}
+	assert.NotContains(t, settings, "leaderElection.retryPeriod")
+}
+
+func TestValidateFormats(t *testing.T) {
+	var conf Config
+	conf.Azure.CapabilityIdProperty = "capabilityRootId"
+	conf.Handler.Capsvc2Aad.InviteGuests = true
+	conf.Scheduler.Job.CapSvc2Aad = JobSchedule{Enable: true, Interval: "5"}
+	conf.Scheduler.Job.Aad2Aws = JobSchedule{Interval: "5"}
+
+	problems := Validate(conf, nil)
+	assert.Equal(t, []string{
+		"azure.capabilityIdProperty",
+		"handler.capSvc2Aad.inviteRedirectUrl",
+		"scheduler.job.capSvc2Aad.interval",
+	}, settingsOf(problems))
+	assert.Equal(t, "AAS_SCHEDULER_JOB_CAPSVC2AAD_INTERVAL", problems[2].EnvVar)
+
+	conf.Azure.CapabilityIdProperty = "extension_0123456789abcdef0123456789abcdef_capabilityRootId"
+	conf.Handler.Capsvc2Aad.InviteRedirectUrl = "https://myapps.microsoft.com"
+	conf.Scheduler.Job.CapSvc2Aad.Interval = "5m"
+	assert.Empty(t, Validate(conf, nil))
+}
+
+func TestProblemString(t *testing.T) {
+	assert.Equal(t, "error: azure.tenantId (AAS_AZURE_TENANTID): is required", Problem{Setting: "azure.tenantId", EnvVar: "AAS_AZURE_TENANTID", Message: "is required"}.String())
+	assert.Equal(t, "warning: azure.clientId (AAS_AZURE_CLIENTID): overridden", Problem{Setting: "azure.clientId", EnvVar: "AAS_AZURE_CLIENTID", Message: "overridden", Warning: true}.String())
+}
@@ -0,0 +1,131 @@
+package entraid
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// assertionLifetime is how long a certificate assertion is valid. It is only used for a single token request.
+const assertionLifetime = 10 * time.Minute
+
+// newCertificateAssertion returns a JWT identifying clientId to the token endpoint audience, signed by the
+// certificate and private key in the PEM file at certificatePath.
+func newCertificateAssertion(certificatePath string, clientId string, audience string) (string, error) {
+	if certificatePath == "" {
+		return "", InvalidConfig.New("no certificate path configured")
+	}
+
+	certificate, key, err := loadCertificate(certificatePath)
+	if err != nil {
+		return "", err
+	}
+
+	// Entra ID finds the certificate to verify the assertion with by its SHA-1 thumbprint
+	thumbprint := sha1.Sum(certificate.Raw)
+	header := map[string]string{
+		"alg": "RS256",
+		"typ": "JWT",
+		"x5t": base64.RawURLEncoding.EncodeToString(thumbprint[:]),
+	}
+
+	now := time.Now()
+	claims := map[string]interface{}{
+		"aud": audience,
+		"iss": clientId,
+		"sub": clientId,
+		"jti": uuid.NewString(),
+		"iat": now.Unix(),
+		"nbf": now.Unix(),
+		"exp": now.Add(assertionLifetime).Unix(),
+	}
+
+	encodedHeader, err := encodeSegment(header)
+	if err != nil {
+		return "", err
+	}
+	encodedClaims, err := encodeSegment(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := encodedHeader + "." + encodedClaims
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func encodeSegment(value interface{}) (string, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// loadCertificate returns the first certificate and the RSA private key in the PEM file at path.
+func loadCertificate(path string) (*x509.Certificate, *rsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, InvalidConfig.Wrap(err, "unable to read certificate")
+	}
+
+	var certificate *x509.Certificate
+	var key *rsa.PrivateKey
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		switch block.Type {
+		case "CERTIFICATE":
+			if certificate == nil {
+				certificate, err = x509.ParseCertificate(block.Bytes)
+				if err != nil {
+					return nil, nil, InvalidConfig.Wrap(err, "unable to parse certificate")
+				}
+			}
+		case "RSA PRIVATE KEY":
+			key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, nil, InvalidConfig.Wrap(err, "unable to parse private key")
+			}
+		case "PRIVATE KEY":
+			parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, nil, InvalidConfig.Wrap(err, "unable to parse private key")
+			}
+			rsaKey, ok := parsed.(*rsa.PrivateKey)
+			if !ok {
+				return nil, nil, InvalidConfig.New("private key of certificate %s is not an RSA key", path)
+			}
+			key = rsaKey
+		}
+	}
+
+	if certificate == nil {
+		return nil, nil, InvalidConfig.New("no certificate found in %s", path)
+	}
+	if key == nil {
+		return nil, nil, InvalidConfig.New("no private key found in %s", path)
+	}
+
+	return certificate, key, nil
+}
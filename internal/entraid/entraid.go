@@ -0,0 +1,168 @@
+package entraid
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/joomcode/errorx"
+	"go.dfds.cloud/aad-aws-sync/internal/config"
+	"go.dfds.cloud/aad-aws-sync/internal/httpclient"
+	"go.dfds.cloud/aad-aws-sync/internal/util"
+)
+
+// Methods clients can authenticate to Entra ID with, see AuthConfig.
+const (
+	// AuthMethodSecret authenticates with the client secret of the app registration
+	AuthMethodSecret = "secret"
+	// AuthMethodWorkloadIdentity authenticates with a projected Kubernetes service account token, trusted by a
+	// federated credential of the app registration
+	AuthMethodWorkloadIdentity = "workloadIdentity"
+	// AuthMethodAwsWebIdentity authenticates with the web identity token AWS issues to the pod, the one used for IAM
+	// roles for service accounts, trusted by a federated credential of the app registration
+	AuthMethodAwsWebIdentity = "awsWebIdentity"
+	// AuthMethodCertificate authenticates with an assertion signed by a certificate uploaded to the app registration
+	AuthMethodCertificate = "certificate"
+)
+
+const (
+	clientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+	// defaultWorkloadIdentityTokenFile is where the Azure workload identity webhook projects the service account token
+	defaultWorkloadIdentityTokenFile = "/var/run/secrets/azure/tokens/azure-identity-token"
+)
+
+var (
+	EntraIdError  = errorx.NewNamespace("entraId")
+	HttpError     = EntraIdError.NewType("http_error")
+	InvalidConfig = EntraIdError.NewType("invalid_config")
+)
+
+// AuthConfig chooses how a client authenticates to Entra ID, see config.EntraIdAuth.
+type AuthConfig = config.EntraIdAuth
+
+// NewTokenClient creates a util.TokenClient refreshing its token with authFunc, at the refresh skew of auth.
+func NewTokenClient(auth AuthConfig, authFunc func() (*util.RefreshAuthResponse, error)) *util.TokenClient {
+	tokenClient := util.NewTokenClient(authFunc)
+	if auth.RefreshSkew > 0 {
+		tokenClient.SetRefreshSkew(auth.RefreshSkew)
+	}
+
+	return tokenClient
+}
+
+// Credentials identify the app registration a client requests tokens for.
+type Credentials struct {
+	TenantId     string
+	ClientId     string
+	ClientSecret string
+	Auth         AuthConfig
+	// TokenEndpoint overrides the v2.0 token endpoint of the tenant
+	TokenEndpoint string
+}
+
+func (c Credentials) tokenEndpoint() string {
+	if c.TokenEndpoint != "" {
+		return c.TokenEndpoint
+	}
+
+	return fmt.Sprintf("https://login.microsoftonline.com/%s/oauth2/v2.0/token", c.TenantId)
+}
+
+// RequestToken requests a token for scope with the client credentials grant, authenticating as configured by
+// creds.Auth.
+func RequestToken(httpClient *http.Client, creds Credentials, scope string) (*util.RefreshAuthResponse, error) {
+	reqPayload := url.Values{}
+	reqPayload.Set("client_id", creds.ClientId)
+	reqPayload.Set("grant_type", "client_credentials")
+	reqPayload.Set("scope", scope)
+
+	err := setClientAuthentication(reqPayload, creds)
+	if err != nil {
+		return nil, err
+	}
+
+	// Token requests change nothing, so they are retried like idempotent ones
+	req, err := http.NewRequestWithContext(httpclient.WithRepeatable(context.Background()), "POST", creds.tokenEndpoint(), strings.NewReader(reqPayload.Encode()))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if err := httpclient.CheckResponse(resp, HttpError, http.StatusOK); err != nil {
+		return nil, err
+	}
+
+	rawData, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var tokenResponse *util.RefreshAuthResponse
+
+	err = json.Unmarshal(rawData, &tokenResponse)
+	if err != nil {
+		return nil, err
+	}
+
+	return tokenResponse, nil
+}
+
+// setClientAuthentication adds the client secret or client assertion of creds to the token request.
+func setClientAuthentication(reqPayload url.Values, creds Credentials) error {
+	switch creds.Auth.Method {
+	case AuthMethodSecret, "":
+		reqPayload.Set("client_secret", creds.ClientSecret)
+		return nil
+	case AuthMethodWorkloadIdentity:
+		return setFederatedAssertion(reqPayload, creds.Auth.TokenFile, "AZURE_FEDERATED_TOKEN_FILE", defaultWorkloadIdentityTokenFile)
+	case AuthMethodAwsWebIdentity:
+		return setFederatedAssertion(reqPayload, creds.Auth.TokenFile, "AWS_WEB_IDENTITY_TOKEN_FILE", "")
+	case AuthMethodCertificate:
+		assertion, err := newCertificateAssertion(creds.Auth.CertificatePath, creds.ClientId, creds.tokenEndpoint())
+		if err != nil {
+			return err
+		}
+		reqPayload.Set("client_assertion_type", clientAssertionType)
+		reqPayload.Set("client_assertion", assertion)
+		return nil
+	}
+
+	return InvalidConfig.New("unknown Entra ID auth method %q", creds.Auth.Method)
+}
+
+// setFederatedAssertion uses the token read from tokenFile, or the file named by the environment variable envVar, as
+// the client assertion.
+func setFederatedAssertion(reqPayload url.Values, tokenFile string, envVar string, defaultTokenFile string) error {
+	if tokenFile == "" {
+		tokenFile = os.Getenv(envVar)
+	}
+	if tokenFile == "" {
+		tokenFile = defaultTokenFile
+	}
+	if tokenFile == "" {
+		return InvalidConfig.New("no federated token file configured, and %s is not set", envVar)
+	}
+
+	token, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return InvalidConfig.Wrap(err, "unable to read federated token")
+	}
+
+	reqPayload.Set("client_assertion_type", clientAssertionType)
+	reqPayload.Set("client_assertion", strings.TrimSpace(string(token)))
+	return nil
+}
@@ -0,0 +1,201 @@
+package entraid
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/joomcode/errorx"
+	"github.com/stretchr/testify/assert"
+	"go.dfds.cloud/aad-aws-sync/internal/util"
+)
+
+// tokenServer returns a token endpoint recording the form of the last token request.
+func tokenServer(t *testing.T) (*httptest.Server, *url.Values) {
+	form := &url.Values{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, r.ParseForm())
+		*form = r.PostForm
+		_, _ = w.Write([]byte(`{"token_type":"Bearer","expires_in":3599,"access_token":"access-token"}`))
+	}))
+	t.Cleanup(server.Close)
+
+	return server, form
+}
+
+func writeFile(t *testing.T, name string, data []byte) string {
+	path := filepath.Join(t.TempDir(), name)
+	assert.NoError(t, os.WriteFile(path, data, 0600))
+	return path
+}
+
+func TestRequestTokenWithSecret(t *testing.T) {
+	server, form := tokenServer(t)
+
+	resp, err := RequestToken(http.DefaultClient, Credentials{
+		ClientId:      "client",
+		ClientSecret:  "secret",
+		TokenEndpoint: server.URL,
+	}, "https://graph.microsoft.com/.default")
+	assert.NoError(t, err)
+	assert.Equal(t, "access-token", resp.AccessToken)
+	assert.Equal(t, int64(3599), resp.ExpiresIn)
+
+	assert.Equal(t, "client", form.Get("client_id"))
+	assert.Equal(t, "client_credentials", form.Get("grant_type"))
+	assert.Equal(t, "https://graph.microsoft.com/.default", form.Get("scope"))
+	assert.Equal(t, "secret", form.Get("client_secret"))
+	assert.Empty(t, form.Get("client_assertion"))
+}
+
+func TestRequestTokenWithWorkloadIdentity(t *testing.T) {
+	server, form := tokenServer(t)
+	tokenFile := writeFile(t, "token", []byte("service-account-token\n"))
+
+	_, err := RequestToken(http.DefaultClient, Credentials{
+		ClientId:      "client",
+		ClientSecret:  "unused",
+		Auth:          AuthConfig{Method: AuthMethodWorkloadIdentity, TokenFile: tokenFile},
+		TokenEndpoint: server.URL,
+	}, "scope")
+	assert.NoError(t, err)
+
+	assert.Equal(t, clientAssertionType, form.Get("client_assertion_type"))
+	assert.Equal(t, "service-account-token", form.Get("client_assertion"))
+	assert.Empty(t, form.Get("client_secret"))
+}
+
+func TestRequestTokenWithAwsWebIdentity(t *testing.T) {
+	server, form := tokenServer(t)
+	t.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", writeFile(t, "token", []byte("aws-web-identity-token")))
+
+	_, err := RequestToken(http.DefaultClient, Credentials{
+		ClientId:      "client",
+		Auth:          AuthConfig{Method: AuthMethodAwsWebIdentity},
+		TokenEndpoint: server.URL,
+	}, "scope")
+	assert.NoError(t, err)
+	assert.Equal(t, "aws-web-identity-token", form.Get("client_assertion"))
+
+	t.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", "")
+	_, err = RequestToken(http.DefaultClient, Credentials{Auth: AuthConfig{Method: AuthMethodAwsWebIdentity}, TokenEndpoint: server.URL}, "scope")
+	assert.True(t, errorx.IsOfType(err, InvalidConfig))
+}
+
+func TestRequestTokenWithCertificate(t *testing.T) {
+	server, form := tokenServer(t)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "aad-aws-sync"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	assert.NoError(t, err)
+	certificatePath := writeFile(t, "certificate.pem", append(
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8})...))
+
+	_, err = RequestToken(http.DefaultClient, Credentials{
+		ClientId:      "client",
+		Auth:          AuthConfig{Method: AuthMethodCertificate, CertificatePath: certificatePath},
+		TokenEndpoint: server.URL,
+	}, "scope")
+	assert.NoError(t, err)
+	assert.Equal(t, clientAssertionType, form.Get("client_assertion_type"))
+
+	segments := strings.Split(form.Get("client_assertion"), ".")
+	assert.Len(t, segments, 3)
+
+	var header map[string]string
+	decodeSegment(t, segments[0], &header)
+	thumbprint := sha1.Sum(der)
+	assert.Equal(t, "RS256", header["alg"])
+	assert.Equal(t, base64.RawURLEncoding.EncodeToString(thumbprint[:]), header["x5t"])
+
+	var claims map[string]interface{}
+	decodeSegment(t, segments[1], &claims)
+	assert.Equal(t, server.URL, claims["aud"])
+	assert.Equal(t, "client", claims["iss"])
+	assert.Equal(t, "client", claims["sub"])
+	assert.NotEmpty(t, claims["jti"])
+
+	signature, err := base64.RawURLEncoding.DecodeString(segments[2])
+	assert.NoError(t, err)
+	digest := sha256.Sum256([]byte(segments[0] + "." + segments[1]))
+	assert.NoError(t, rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature))
+}
+
+func decodeSegment(t *testing.T, segment string, value interface{}) {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	assert.NoError(t, err)
+	assert.NoError(t, json.Unmarshal(data, value))
+}
+
+func TestRequestTokenInvalidConfig(t *testing.T) {
+	server, _ := tokenServer(t)
+
+	_, err := RequestToken(http.DefaultClient, Credentials{Auth: AuthConfig{Method: "password"}, TokenEndpoint: server.URL}, "scope")
+	assert.True(t, errorx.IsOfType(err, InvalidConfig))
+
+	_, err = RequestToken(http.DefaultClient, Credentials{Auth: AuthConfig{Method: AuthMethodCertificate}, TokenEndpoint: server.URL}, "scope")
+	assert.True(t, errorx.IsOfType(err, InvalidConfig))
+
+	_, err = RequestToken(http.DefaultClient, Credentials{Auth: AuthConfig{Method: AuthMethodCertificate, CertificatePath: writeFile(t, "empty.pem", nil)}, TokenEndpoint: server.URL}, "scope")
+	assert.True(t, errorx.IsOfType(err, InvalidConfig))
+}
+
+func TestRequestTokenRejected(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte(`{"error":"invalid_client"}`))
+	}))
+	defer server.Close()
+
+	resp, err := RequestToken(http.DefaultClient, Credentials{ClientSecret: "expired", TokenEndpoint: server.URL}, "scope")
+	assert.Nil(t, resp)
+	assert.True(t, errorx.IsOfType(err, HttpError))
+	assert.Contains(t, err.Error(), "invalid_client")
+}
+
+func TestNewTokenClient(t *testing.T) {
+	requests := 0
+	authFunc := func() (*util.RefreshAuthResponse, error) {
+		requests++
+		return &util.RefreshAuthResponse{AccessToken: "token", ExpiresIn: int64((5 * time.Minute).Seconds())}, nil
+	}
+
+	// A token expiring in 5 minutes is kept at the default skew
+	tc := NewTokenClient(AuthConfig{}, authFunc)
+	assert.NoError(t, tc.RefreshAuth())
+	assert.NoError(t, tc.RefreshAuth())
+	assert.Equal(t, 1, requests)
+
+	// and refreshed on every call at a skew of 10 minutes
+	requests = 0
+	tc = NewTokenClient(AuthConfig{RefreshSkew: 10 * time.Minute}, authFunc)
+	assert.NoError(t, tc.RefreshAuth())
+	assert.NoError(t, tc.RefreshAuth())
+	assert.Equal(t, 2, requests)
+}
@@ -0,0 +1,106 @@
+package event
+
+import (
+	"context"
+	"time"
+
+	"go.dfds.cloud/aad-aws-sync/internal/audit"
+	"go.dfds.cloud/aad-aws-sync/internal/event/model"
+	"go.dfds.cloud/aad-aws-sync/internal/store"
+	"go.dfds.cloud/aad-aws-sync/internal/tracing"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+const (
+	StatusHandled = "handled"
+	StatusSkipped = "skipped"
+	StatusFailed  = "failed"
+)
+
+// DispatchResult describes the outcome of dispatching a single message to its event handler.
+type DispatchResult struct {
+	Event  *model.Envelope
+	Status string
+	// Reason is set when the message was skipped
+	Reason string
+	// Err is the error returned by the event handler when Status is StatusFailed
+	Err error
+	// SpanContext identifies the span the event was handled in, so it can be propagated to dead-lettered messages
+	SpanContext trace.SpanContext
+}
+
+// Dispatch deserialises msg into an event envelope and runs the handler registered for its type. It is shared by all
+// event transports, which decide what to do with failed events themselves. Events with a message ID that were handled
+// before are skipped, so redelivered events are only handled once. If ctx carries the trace context of the publisher,
+// the span of the event links to it.
+func Dispatch(ctx context.Context, registry *Registry, msg []byte, msgLog *zap.Logger) DispatchResult {
+	event, err := GetEventFromMsg(msg)
+	if err != nil {
+		msgLog.Info("Unable to deserialise message payload. Quite likely the message is not valid JSON. Skipping message")
+		metricMessagesFetched.WithLabelValues(unknownEventType).Inc()
+		metricMessagesSkipped.WithLabelValues(unknownEventType, "invalid_payload").Inc()
+		return DispatchResult{Status: StatusSkipped, Reason: "invalid_payload"}
+	}
+
+	if event == nil || event.Type == "" {
+		msgLog.Info("Unable to recognise event envelope, skipping message")
+		metricMessagesFetched.WithLabelValues(unknownEventType).Inc()
+		metricMessagesSkipped.WithLabelValues(unknownEventType, "invalid_envelope").Inc()
+		return DispatchResult{Event: event, Status: StatusSkipped, Reason: "invalid_envelope"}
+	}
+	metricMessagesFetched.WithLabelValues(event.Type).Inc()
+
+	ctx, span := tracing.StartEventSpan(ctx, event.Type, event.MessageId)
+	defer span.End()
+	result := dispatchEvent(ctx, registry, event, msg, msgLog)
+	result.SpanContext = span.SpanContext()
+	span.SetAttributes(tracing.AttrEventStatus.String(result.Status))
+	if result.Reason != "" {
+		span.SetAttributes(tracing.AttrEventReason.String(result.Reason))
+	}
+	tracing.RecordError(span, result.Err)
+
+	return result
+}
+
+// dispatchEvent runs the handler registered for the type of event, unless the event was processed before.
+func dispatchEvent(ctx context.Context, registry *Registry, event *model.Envelope, msg []byte, msgLog *zap.Logger) DispatchResult {
+	eventLog := msgLog.With(zap.String("eventName", event.Type))
+
+	handler := registry.GetHandler(event.Type)
+	if handler == nil {
+		eventLog.Info("No handler registered for event, skipping.")
+		metricMessagesSkipped.WithLabelValues(event.Type, "no_handler").Inc()
+		return DispatchResult{Event: event, Status: StatusSkipped, Reason: "no_handler"}
+	}
+
+	processed, err := isProcessed(store.Default(), event)
+	if err != nil {
+		eventLog.Warn("Unable to check whether event was processed before, handling it anyway", zap.Error(err))
+	}
+	if processed {
+		eventLog.Info("Event was processed before, skipping.", zap.String("messageId", event.MessageId))
+		metricMessagesSkipped.WithLabelValues(event.Type, "duplicate").Inc()
+		return DispatchResult{Event: event, Status: StatusSkipped, Reason: "duplicate"}
+	}
+
+	handlerStart := time.Now()
+	ctx = audit.WithActor(ctx, audit.Actor{Kind: audit.ActorKindEvent, Name: event.Type, RunId: event.MessageId})
+	err = handler(ctx, model.HandlerContext{
+		Event: event,
+		Msg:   msg,
+	})
+	if err != nil {
+		metricHandlerDuration.WithLabelValues(event.Type, StatusFailed).Observe(time.Since(handlerStart).Seconds())
+		eventLog.Error("Handler for event failed", zap.Error(err))
+		return DispatchResult{Event: event, Status: StatusFailed, Err: err}
+	}
+
+	metricHandlerDuration.WithLabelValues(event.Type, StatusHandled).Observe(time.Since(handlerStart).Seconds())
+	metricMessagesHandled.WithLabelValues(event.Type).Inc()
+	if err := markProcessed(store.Default(), event); err != nil {
+		eventLog.Warn("Unable to record event as processed", zap.Error(err))
+	}
+	return DispatchResult{Event: event, Status: StatusHandled}
+}
@@ -4,16 +4,20 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/kelseyhightower/envconfig"
 	"github.com/segmentio/kafka-go"
 	"go.dfds.cloud/aad-aws-sync/internal/config"
-	"go.dfds.cloud/aad-aws-sync/internal/event/handlers"
 	"go.dfds.cloud/aad-aws-sync/internal/event/model"
 	"go.dfds.cloud/aad-aws-sync/internal/kafkautil"
+	"go.dfds.cloud/aad-aws-sync/internal/store"
+	"go.dfds.cloud/aad-aws-sync/internal/tracing"
 	"go.dfds.cloud/aad-aws-sync/internal/util"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"io"
 	"sync"
+	"time"
 )
 
 func GetEventFromMsg(data []byte) (*model.Envelope, error) {
@@ -65,10 +69,14 @@ func StartEventHandlers(ctx context.Context, conf config.Config, wg *sync.WaitGr
 		return errors.New("failed to process error producer configurations")
 	}
 
-	registry := NewRegistry()
-	//registry.Register("capability_created", handlers.CapabilityCreatedHandler)
-	registry.Register("user-has-joined-capability", handlers.MemberJoinedCapabilityHandler)
-	registry.Register("member_left_capability", handlers.MemberLeftCapabilityHandler)
+	registry := NewHandlerRegistry()
+
+	pruned, err := PruneProcessedEvents(store.Default(), conf.StateStore.ProcessedEventRetention)
+	if err != nil {
+		util.Logger.Warn("Unable to prune processed events from state store", zap.Error(err))
+	} else {
+		util.Logger.Debug("Pruned processed events from state store", zap.Int("count", pruned))
+	}
 
 	dialer, err := kafkautil.NewDialer(authConfig)
 	if err != nil {
@@ -90,18 +98,26 @@ func StartEventHandlers(ctx context.Context, conf config.Config, wg *sync.WaitGr
 
 	wg.Add(1)
 	defer wg.Done()
+	consumerStatus.start()
+	monitorCtx, stopMonitor := context.WithCancel(ctx)
+	defer stopMonitor()
+	go monitorConsumer(monitorCtx, consumer)
 	for {
 		util.Logger.Debug("Awaiting new message from topic")
 		msg, err := consumer.FetchMessage(ctx)
-		if err == io.EOF {
-			util.Logger.Info("Connection closed")
-			break
-		} else if err == context.Canceled {
+		if err == context.Canceled {
 			util.Logger.Info("Processing canceled")
 			break
+		} else if err == io.EOF {
+			util.Logger.Error("Connection closed, stopping event loop")
+			consumerStatus.stop(errors.New("event consumer connection closed"))
+			cleanupOnce.Do(cleanup)
+			return err
 		} else if err != nil {
-			util.Logger.Error("Error fetching message", zap.Error(err))
-			break
+			util.Logger.Error("Error fetching message, stopping event loop", zap.Error(err))
+			consumerStatus.stop(fmt.Errorf("event consumer failed to fetch message: %w", err))
+			cleanupOnce.Do(cleanup)
+			return err
 		}
 		msgLog := util.Logger.With(zap.String("topic", msg.Topic),
 			zap.Int("partition", msg.Partition),
@@ -109,57 +125,35 @@ func StartEventHandlers(ctx context.Context, conf config.Config, wg *sync.WaitGr
 			zap.String("key", string(msg.Key)),
 			zap.String("value", string(msg.Value)))
 		msgLog.Debug("Message fetched")
+		updateConsumerLag(msg)
+		consumerStatus.handling(time.Now())
 
-		// Convert msg to Event
-		var handler HandlerFunc
-		var eventLog *zap.Logger
-
-		event, err := GetEventFromMsg(msg.Value)
-		if err != nil {
-			msgLog.Info("Unable to deserialise message payload. Quite likely the message is not valid JSON. Skipping message")
-			goto CommitOffset
-		}
-
-		if event == nil || event.Type == "" {
-			msgLog.Info("Unable to recognise event envelope, skipping message")
-			goto CommitOffset
-		}
-
-		eventLog = util.Logger.With(zap.String("topic", msg.Topic),
-			zap.Int("partition", msg.Partition),
-			zap.Int64("offset", msg.Offset),
-			zap.String("key", string(msg.Key)),
-			zap.String("eventName", event.Type))
-
-		handler = registry.GetHandler(event.Type)
-		if handler == nil {
-			eventLog.Info("No handler registered for event, skipping.")
-			goto CommitOffset
-		}
-
-		err = handler(ctx, model.HandlerContext{
-			Event: event,
-			Msg:   msg.Value,
-		})
-		if err != nil {
-			eventLog.Error("Handler for event failed. Forwarding event to DLQ", zap.Error(err))
+		result := Dispatch(tracing.ExtractKafkaHeaders(ctx, msg.Headers), registry, msg.Value, msgLog)
+		if result.Status == StatusFailed {
+			eventLog := msgLog.With(zap.String("eventName", result.Event.Type))
+			eventLog.Info("Forwarding event to DLQ")
 			forwardedMsg := msg
 			forwardedMsg.Topic = ""
+			forwardedMsg.Headers = tracing.InjectKafkaHeaders(trace.ContextWithSpanContext(ctx, result.SpanContext), msg.Headers)
 			err = dlqProducer.WriteMessages(ctx, forwardedMsg)
 			if err != nil {
 				eventLog.Error("Unable to forward event to DLQ, stopping event loop.", zap.Error(err))
+				consumerStatus.stop(fmt.Errorf("unable to forward event to DLQ: %w", err))
 				cleanupOnce.Do(cleanup)
 				return err
 			}
+			metricMessagesDeadLettered.WithLabelValues(result.Event.Type).Inc()
 		}
 
-	CommitOffset:
 		err = commitMsg(ctx, msg, consumer)
 		if err != nil {
+			metricCommitFailures.Inc()
 			msgLog.Error("Unable to update commit for consumer group", zap.Error(err)) // TODO: Trigger graceful shutdown
 		}
+		consumerStatus.handling(time.Time{})
 	}
 
+	consumerStatus.stop(nil)
 	cleanupOnce.Do(cleanup)
 
 	return nil
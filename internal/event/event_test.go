@@ -13,12 +13,12 @@ func TestGetEventFromMsg(t *testing.T) {
 	envelope, err = GetEventFromMsg([]byte("{}"))
 	assert.NoError(t, err)
 	assert.NotNil(t, envelope)
-	assert.Equal(t, envelope.Name, "")
-	assert.Equal(t, envelope.Version, "")
+	assert.Equal(t, envelope.Type, "")
+	assert.Equal(t, envelope.MessageId, "")
 
-	envelope, err = GetEventFromMsg([]byte("{\"eventName\":\"capability_created\",\"version\":\"0.1\"}"))
+	envelope, err = GetEventFromMsg([]byte("{\"type\":\"capability-deleted\",\"messageId\":\"0001\"}"))
 	assert.NoError(t, err)
 	assert.NotNil(t, envelope)
-	assert.Equal(t, envelope.Name, "capability_created")
-	assert.Equal(t, envelope.Version, "0.1")
+	assert.Equal(t, envelope.Type, "capability-deleted")
+	assert.Equal(t, envelope.MessageId, "0001")
 }
@@ -0,0 +1,206 @@
+package event
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.dfds.cloud/aad-aws-sync/internal/event/model"
+	"go.dfds.cloud/aad-aws-sync/internal/util"
+	"go.uber.org/zap"
+)
+
+// FailedEvent is an event whose handler failed, kept so it can be inspected and replayed later.
+type FailedEvent struct {
+	ID        string          `json:"id"`
+	Type      string          `json:"type"`
+	MessageId string          `json:"messageId"`
+	Source    string          `json:"source"`
+	Error     string          `json:"error"`
+	FailedAt  time.Time       `json:"failedAt"`
+	Msg       json.RawMessage `json:"msg"`
+}
+
+// FailedEventStore persists failed events as JSON files in a directory. It takes the place of the DLQ topic for
+// transports that have no Kafka available.
+type FailedEventStore struct {
+	path string
+	mu   sync.Mutex
+}
+
+func NewFailedEventStore(path string) (*FailedEventStore, error) {
+	if path == "" {
+		return nil, errors.New("no path configured for the failed event store")
+	}
+
+	err := os.MkdirAll(path, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FailedEventStore{path: path}, nil
+}
+
+// Save stores msg together with the error its handler returned.
+func (s *FailedEventStore) Save(event *model.Envelope, msg []byte, source string, handlerErr error) (*FailedEvent, error) {
+	id, err := newFailedEventId()
+	if err != nil {
+		return nil, err
+	}
+
+	failedEvent := &FailedEvent{
+		ID:       id,
+		Source:   source,
+		FailedAt: time.Now().UTC(),
+		Msg:      msg,
+	}
+	if event != nil {
+		failedEvent.Type = event.Type
+		failedEvent.MessageId = event.MessageId
+	}
+	if handlerErr != nil {
+		failedEvent.Error = handlerErr.Error()
+	}
+
+	data, err := json.Marshal(failedEvent)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Write to a temporary file first, so a crash never leaves a partially written event behind
+	tmpPath := filepath.Join(s.path, fmt.Sprintf(".%s.tmp", id))
+	err = os.WriteFile(tmpPath, data, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.Rename(tmpPath, s.filePath(id))
+	if err != nil {
+		os.Remove(tmpPath)
+		return nil, err
+	}
+
+	return failedEvent, nil
+}
+
+// List returns all stored failed events, oldest first.
+func (s *FailedEventStore) List() ([]*FailedEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries, err := os.ReadDir(s.path)
+	if err != nil {
+		return nil, err
+	}
+
+	var failedEvents []*FailedEvent
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(s.path, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		var failedEvent *FailedEvent
+		err = json.Unmarshal(data, &failedEvent)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read failed event %s: %w", entry.Name(), err)
+		}
+		failedEvents = append(failedEvents, failedEvent)
+	}
+
+	sort.Slice(failedEvents, func(i, j int) bool {
+		return failedEvents[i].FailedAt.Before(failedEvents[j].FailedAt)
+	})
+
+	return failedEvents, nil
+}
+
+// Delete removes a failed event, e.g. after it has been replayed successfully.
+func (s *FailedEventStore) Delete(id string) error {
+	if id == "" || filepath.Base(id) != id || strings.HasPrefix(id, ".") {
+		return fmt.Errorf("invalid failed event id %q", id)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return os.Remove(s.filePath(id))
+}
+
+func (s *FailedEventStore) filePath(id string) string {
+	return filepath.Join(s.path, fmt.Sprintf("%s.json", id))
+}
+
+func newFailedEventId() (string, error) {
+	buf := make([]byte, 4)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%d-%s", time.Now().UnixNano(), hex.EncodeToString(buf)), nil
+}
+
+// ReplayResult is the outcome of replaying a single failed event.
+type ReplayResult struct {
+	ID        string `json:"id"`
+	Type      string `json:"type"`
+	MessageId string `json:"messageId"`
+	Status    string `json:"status"`
+	Reason    string `json:"reason,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Replay dispatches the failed events again, oldest first, or only the one with ID id if it's set. Events that are
+// handled or skipped this time are removed from the store; those that fail again are kept.
+func (s *FailedEventStore) Replay(ctx context.Context, registry *Registry, id string) ([]ReplayResult, error) {
+	failedEvents, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+
+	results := []ReplayResult{}
+	for _, failedEvent := range failedEvents {
+		if id != "" && failedEvent.ID != id {
+			continue
+		}
+
+		msgLog := util.Logger.With(zap.String("transport", "replay"), zap.String("failedEventId", failedEvent.ID))
+		dispatched := Dispatch(ctx, registry, failedEvent.Msg, msgLog)
+		result := ReplayResult{
+			ID:        failedEvent.ID,
+			Type:      failedEvent.Type,
+			MessageId: failedEvent.MessageId,
+			Status:    dispatched.Status,
+			Reason:    dispatched.Reason,
+		}
+		if dispatched.Err != nil {
+			result.Error = dispatched.Err.Error()
+		} else if err := s.Delete(failedEvent.ID); err != nil {
+			return results, err
+		}
+		results = append(results, result)
+	}
+
+	if id != "" && len(results) == 0 {
+		return nil, fmt.Errorf("no failed event with id %q", id)
+	}
+
+	return results, nil
+}
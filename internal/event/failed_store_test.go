@@ -0,0 +1,109 @@
+package event
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.dfds.cloud/aad-aws-sync/internal/event/model"
+	statestore "go.dfds.cloud/aad-aws-sync/internal/store"
+	"go.dfds.cloud/aad-aws-sync/internal/util"
+	"go.uber.org/zap"
+)
+
+func TestFailedEventStore(t *testing.T) {
+	store, err := NewFailedEventStore(filepath.Join(t.TempDir(), "failed-events"))
+	assert.NoError(t, err)
+
+	failedEvents, err := store.List()
+	assert.NoError(t, err)
+	assert.Len(t, failedEvents, 0)
+
+	msg := []byte(`{"type":"capability-deleted","messageId":"0001","data":{"capabilityId":"sandbox-xyz"}}`)
+	saved, err := store.Save(&model.Envelope{Type: "capability-deleted", MessageId: "0001"}, msg, "webhook", errors.New("handler failed"))
+	assert.NoError(t, err)
+	assert.NotEmpty(t, saved.ID)
+
+	_, err = store.Save(&model.Envelope{Type: "member_left_capability", MessageId: "0002"}, []byte(`{}`), "webhook", errors.New("handler failed again"))
+	assert.NoError(t, err)
+
+	failedEvents, err = store.List()
+	assert.NoError(t, err)
+	assert.Len(t, failedEvents, 2)
+	assert.Equal(t, saved.ID, failedEvents[0].ID)
+	assert.Equal(t, "capability-deleted", failedEvents[0].Type)
+	assert.Equal(t, "0001", failedEvents[0].MessageId)
+	assert.Equal(t, "webhook", failedEvents[0].Source)
+	assert.Equal(t, "handler failed", failedEvents[0].Error)
+	assert.JSONEq(t, string(msg), string(failedEvents[0].Msg))
+
+	assert.NoError(t, store.Delete(saved.ID))
+	failedEvents, err = store.List()
+	assert.NoError(t, err)
+	assert.Len(t, failedEvents, 1)
+	assert.Equal(t, "0002", failedEvents[0].MessageId)
+
+	assert.Error(t, store.Delete(saved.ID))
+	assert.Error(t, store.Delete("../"+failedEvents[0].ID))
+}
+
+func TestNewFailedEventStore(t *testing.T) {
+	_, err := NewFailedEventStore("")
+	assert.Error(t, err)
+
+	file := filepath.Join(t.TempDir(), "file")
+	assert.NoError(t, os.WriteFile(file, []byte{}, 0600))
+	_, err = NewFailedEventStore(file)
+	assert.Error(t, err)
+}
+
+func TestFailedEventStoreReplay(t *testing.T) {
+	util.Logger = zap.NewNop()
+	statestore.SetDefault(statestore.NewMemoryStore())
+
+	var handled []string
+	registry := NewRegistry()
+	registry.Register("capability-deleted", func(ctx context.Context, event model.HandlerContext) error {
+		handled = append(handled, event.Event.MessageId)
+		return nil
+	})
+	registry.Register("member_left_capability", func(ctx context.Context, event model.HandlerContext) error {
+		return errors.New("user not found")
+	})
+
+	store, err := NewFailedEventStore(t.TempDir())
+	assert.NoError(t, err)
+	first, err := store.Save(&model.Envelope{Type: "capability-deleted", MessageId: "0001"}, []byte(`{"type":"capability-deleted","messageId":"0001"}`), "webhook", errors.New("handler failed"))
+	assert.NoError(t, err)
+	_, err = store.Save(&model.Envelope{Type: "member_left_capability", MessageId: "0002"}, []byte(`{"type":"member_left_capability","messageId":"0002"}`), "webhook", errors.New("handler failed"))
+	assert.NoError(t, err)
+	_, err = store.Save(&model.Envelope{Type: "capability-deleted", MessageId: "0003"}, []byte(`{"type":"capability-deleted","messageId":"0003"}`), "webhook", errors.New("handler failed"))
+	assert.NoError(t, err)
+
+	// A single event
+	results, err := store.Replay(context.Background(), registry, first.ID)
+	assert.NoError(t, err)
+	assert.Len(t, results, 1)
+	assert.Equal(t, StatusHandled, results[0].Status)
+	assert.Equal(t, []string{"0001"}, handled)
+
+	// Events that fail again are kept
+	results, err = store.Replay(context.Background(), registry, "")
+	assert.NoError(t, err)
+	assert.Len(t, results, 2)
+	assert.Equal(t, StatusFailed, results[0].Status)
+	assert.Equal(t, "user not found", results[0].Error)
+	assert.Equal(t, StatusHandled, results[1].Status)
+	assert.Equal(t, []string{"0001", "0003"}, handled)
+
+	failedEvents, err := store.List()
+	assert.NoError(t, err)
+	assert.Len(t, failedEvents, 1)
+	assert.Equal(t, "0002", failedEvents[0].MessageId)
+
+	_, err = store.Replay(context.Background(), registry, first.ID)
+	assert.Error(t, err)
+}
@@ -34,16 +34,16 @@ func CapabilityCreatedHandler(ctx context.Context, event model.HandlerContext) e
 		return err
 	}
 
-	groupsInAzure := make(map[string]*azure.Group)
 	client := capsvc.NewCapSvcClient(capsvc.Config{
 		Host:         conf.CapSvc.Host,
 		TenantId:     conf.Azure.TenantId,
 		ClientId:     conf.CapSvc.ClientId,
 		ClientSecret: conf.CapSvc.ClientSecret,
+		Auth:         conf.CapSvc.Auth,
 		Scope:        conf.CapSvc.TokenScope,
 	})
 
-	capabilities, err := client.GetCapabilities()
+	capabilities, err := client.GetCapabilities(ctx)
 	if err != nil {
 		return err
 	}
@@ -64,10 +64,12 @@ func CapabilityCreatedHandler(ctx context.Context, event model.HandlerContext) e
 		TenantId:             conf.Azure.TenantId,
 		ClientId:             conf.Azure.ClientId,
 		ClientSecret:         conf.Azure.ClientSecret,
+		Auth:                 conf.Azure.Auth,
 		InternalDomainSuffix: conf.Azure.InternalDomainSuffix,
+		CapabilityIdProperty: conf.Azure.CapabilityIdProperty,
 	})
 
-	aUnits, err := azureClient.GetAdministrativeUnits()
+	aUnits, err := azureClient.GetAdministrativeUnits(ctx)
 	if err != nil {
 		return err
 	}
@@ -77,50 +79,32 @@ func CapabilityCreatedHandler(ctx context.Context, event model.HandlerContext) e
 		return errors.New("unable to find administrative unit")
 	}
 
-	aUnitMembers, err := azureClient.GetAdministrativeUnitMembers(aUnit.ID)
+	aUnitMembers, err := azureClient.GetAdministrativeUnitMembers(ctx, aUnit.ID)
 	if err != nil {
 		return err
 	}
 
-	for _, member := range aUnitMembers.Value {
-		select {
-		case <-ctx.Done():
-			msgLog.Info("Job cancelled")
-			return errors.New("event handling cancelled via context")
-		default:
-			group := &azure.Group{
-				DisplayName: member.DisplayName,
-				ID:          member.ID,
-				Members:     []*azure.Member{},
-			}
-			groupsInAzure[group.DisplayName] = group
-		}
+	identityStoreGroups := handler.AwsIdentityStoreGroups(conf)
+	unit, _, err := handler.CapabilityGroupOf(ctx, aUnitMembers.Value, capability.RootID, identityStoreGroups)
+	if err != nil {
+		return err
 	}
-
-	azureGroupName := fmt.Sprintf("%s %s", handler.CAPABILITY_GROUP_PREFIX, capability.RootID)
 	var azureGroup *azure.Group
 	// Check if Capability has a group in Azure AD, if it doesn't create it
-	if resp, ok := groupsInAzure[azureGroupName]; !ok {
+	if unit == nil {
 		msgLog.Info(fmt.Sprintf("Capability %s doesn't exist in Azure, creating.", capability.RootID))
-		createGroupRequest := azure.CreateAdministrativeUnitGroupRequest{
-			OdataType:       "#Microsoft.Graph.Group",
-			Description:     "[Automated] - aad-aws-sync",
-			DisplayName:     azure.GenerateAzureGroupDisplayName(capability.RootID),
-			MailNickname:    azure.GenerateAzureGroupMailPrefix(capability.RootID),
-			GroupTypes:      []interface{}{},
-			MailEnabled:     false,
-			SecurityEnabled: true,
-
-			ParentAdministrativeUnitId: aUnit.ID,
-		}
-		resp, err := azureClient.CreateAdministrativeUnitGroup(ctx, createGroupRequest)
+		azureGroup, err = handler.CreateCapabilityAzureGroup(ctx, azureClient, aUnit.ID, capability, identityStoreGroups)
 		if err != nil {
 			return err
 		}
-
-		azureGroup = &azure.Group{ID: resp.ID, DisplayName: resp.DisplayName}
 	} else {
-		azureGroup = resp
+		azureGroup = &azure.Group{ID: unit.ID, DisplayName: unit.DisplayName, Members: []*azure.Member{}}
+		if handler.CapabilityGroupNeedsBinding(azureClient, *unit, capability) {
+			err = handler.BindCapabilityGroup(ctx, azureClient, azureGroup.ID, capability)
+			if err != nil {
+				return err
+			}
+		}
 	}
 
 	select {
@@ -130,7 +114,7 @@ func CapabilityCreatedHandler(ctx context.Context, event model.HandlerContext) e
 	default:
 	}
 
-	appRoles, err := azureClient.GetApplicationRoles(conf.Azure.ApplicationId)
+	appRoles, err := azureClient.GetApplicationRoles(ctx, conf.Azure.ApplicationId)
 	if err != nil {
 		return err
 	}
@@ -140,14 +124,14 @@ func CapabilityCreatedHandler(ctx context.Context, event model.HandlerContext) e
 		return err
 	}
 
-	appAssignments, err := azureClient.GetAssignmentsForApplication(conf.Azure.ApplicationObjectId)
+	appAssignments, err := azureClient.GetAssignmentsForApplication(ctx, conf.Azure.ApplicationObjectId)
 	if err != nil {
 		return err
 	}
 
 	if !appAssignments.ContainsGroup(azureGroup.DisplayName) {
 		msgLog.Info(fmt.Sprintf("Group %s has not been assigned to application yet, assigning", azureGroup.DisplayName))
-		_, err := azureClient.AssignGroupToApplication(conf.Azure.ApplicationObjectId, azureGroup.ID, appRoleId)
+		err := handler.AssignGroupToApplication(ctx, azureClient, conf.Azure.ApplicationObjectId, azureGroup.ID, appRoleId)
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,216 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/joomcode/errorx"
+	"go.dfds.cloud/aad-aws-sync/internal/audit"
+	"go.dfds.cloud/aad-aws-sync/internal/azure"
+	"go.dfds.cloud/aad-aws-sync/internal/capsvc"
+	"go.dfds.cloud/aad-aws-sync/internal/config"
+	"go.dfds.cloud/aad-aws-sync/internal/event/model"
+	"go.dfds.cloud/aad-aws-sync/internal/handler"
+	"go.dfds.cloud/aad-aws-sync/internal/ssu_exchange"
+	"go.dfds.cloud/aad-aws-sync/internal/store"
+	"go.dfds.cloud/aad-aws-sync/internal/util"
+	"go.uber.org/zap"
+)
+
+type capabilityDeleted struct {
+	CapabilityID string `json:"capabilityId"`
+}
+
+// CapabilityDeletedHandler removes the AAD group of a deleted Capability, including its enterprise application
+// assignment, and the Exchange aliases of the Capability.
+//
+// The Capability is expected to be gone from Capability-Service at this point, so its root ID is looked up in the last
+// snapshot of Capability-Service taken by capSvc2Aad. If the snapshot doesn't contain the Capability, the Capability ID
+// from the event is used as the root ID, which holds for every Capability but the oldest ones.
+func CapabilityDeletedHandler(ctx context.Context, event model.HandlerContext) error {
+	msgLog := util.Logger.With(zap.String("event_handler", "CapabilityDeletedHandler"), zap.String("event", event.Event.Type))
+	msg, err := GetEventWithPayloadFromMsg[capabilityDeleted](event.Msg)
+	if err != nil {
+		return err
+	}
+	if msg.Payload.CapabilityID == "" {
+		return errors.New("capability-deleted event is missing a Capability ID")
+	}
+	msgLog = msgLog.With(zap.String("capabilityId", msg.Payload.CapabilityID))
+
+	conf, err := config.LoadConfig()
+	if err != nil {
+		return err
+	}
+
+	capSvcClient := capsvc.NewCapSvcClient(capsvc.Config{
+		Host:         conf.CapSvc.Host,
+		TenantId:     conf.Azure.TenantId,
+		ClientId:     conf.CapSvc.ClientId,
+		ClientSecret: conf.CapSvc.ClientSecret,
+		Auth:         conf.CapSvc.Auth,
+		Scope:        conf.CapSvc.TokenScope,
+	})
+
+	azureClient := azure.NewAzureClient(azure.Config{
+		TenantId:             conf.Azure.TenantId,
+		ClientId:             conf.Azure.ClientId,
+		ClientSecret:         conf.Azure.ClientSecret,
+		Auth:                 conf.Azure.Auth,
+		InternalDomainSuffix: conf.Azure.InternalDomainSuffix,
+		CapabilityIdProperty: conf.Azure.CapabilityIdProperty,
+	})
+
+	exchangeClient := ssu_exchange.NewSsuExchangeClientO365UnofficialApi(ssu_exchange.Config{
+		TenantId:     conf.Azure.TenantId,
+		ClientId:     conf.Exchange.ClientId,
+		ClientSecret: conf.Exchange.ClientSecret,
+		Auth:         conf.Exchange.Auth,
+		BaseUrl:      conf.Exchange.BaseUrl,
+		ManagedBy:    conf.Exchange.ManagedBy,
+		EmailSuffix:  conf.Exchange.EmailSuffix,
+	})
+
+	// If the Capability is still listed, the next capSvc2Aad run would just recreate everything we remove here.
+	capabilities, err := capSvcClient.GetCapabilities(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, capa := range capabilities {
+		if capa.ID == msg.Payload.CapabilityID || capa.RootID == msg.Payload.CapabilityID {
+			return errors.New("capability from event still exists in Capability-Service, refusing to clean up")
+		}
+	}
+
+	rootId, err := deletedCapabilityRootId(store.Default(), msg.Payload.CapabilityID)
+	if err != nil {
+		return err
+	}
+	msgLog = msgLog.With(zap.String("capabilityRootId", rootId))
+	msgLog.Info(fmt.Sprintf("Capability %s deleted. Cleaning up AAD group and Exchange aliases", rootId))
+
+	aUnits, err := azureClient.GetAdministrativeUnits(ctx)
+	if err != nil {
+		return err
+	}
+
+	aUnit := aUnits.GetUnit("Team - Cloud Engineering - Self service")
+	if aUnit == nil {
+		return errors.New("unable to find administrative unit")
+	}
+
+	aUnitMembers, err := azureClient.GetAdministrativeUnitMembers(ctx, aUnit.ID)
+	if err != nil {
+		return err
+	}
+
+	var azureGroups []*azure.Group
+	for _, member := range handler.CapabilityGroupsOf(aUnitMembers.Value, rootId) {
+		azureGroups = append(azureGroups, &azure.Group{
+			DisplayName: member.DisplayName,
+			ID:          member.ID,
+		})
+	}
+
+	if len(azureGroups) == 0 {
+		msgLog.Info("No AAD group found for Capability, skipping group removal")
+	}
+
+	if len(azureGroups) > 0 {
+		appAssignments, err := azureClient.GetAssignmentsForApplication(ctx, conf.Azure.ApplicationObjectId)
+		if err != nil {
+			return err
+		}
+
+		for _, azureGroup := range azureGroups {
+			select {
+			case <-ctx.Done():
+				msgLog.Info("Job cancelled")
+				return errors.New("event handling cancelled via context")
+			default:
+			}
+
+			for _, assignment := range appAssignments.Value {
+				if assignment.PrincipalID != azureGroup.ID {
+					continue
+				}
+				msgLog.Info(fmt.Sprintf("Removing assignment of group %s (%s) from application", azureGroup.DisplayName, azureGroup.ID))
+				err = azureClient.UnassignGroupFromApplication(ctx, azureGroup.ID, assignment.ID)
+				handler.RecordMutation(ctx, audit.Mutation{
+					System:    audit.SystemAzureAd,
+					Action:    handler.MutationAppAssignmentRemoved,
+					ObjectIds: map[string]string{"applicationObjectId": conf.Azure.ApplicationObjectId, "groupId": azureGroup.ID, "assignmentId": assignment.ID},
+					Before:    assignment,
+				}, err)
+				if err != nil {
+					return err
+				}
+			}
+
+			msgLog.Info(fmt.Sprintf("Removing group %s (%s)", azureGroup.DisplayName, azureGroup.ID))
+			err = azureClient.DeleteAdministrativeUnitGroup(ctx, aUnit.ID, azureGroup.ID)
+			handler.RecordMutation(ctx, audit.Mutation{
+				System:    audit.SystemAzureAd,
+				Action:    handler.MutationAadGroupDeleted,
+				ObjectIds: map[string]string{"administrativeUnitId": aUnit.ID, "groupId": azureGroup.ID},
+				Before:    azureGroup,
+			}, err)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	aliases, err := exchangeClient.GetAliases(ctx)
+	if err != nil {
+		return err
+	}
+
+	aliasesByDisplayName := make(map[string]ssu_exchange.GetAliasesResponse)
+	for _, alias := range aliases {
+		aliasesByDisplayName[alias.Identity] = alias
+	}
+
+	for _, alias := range append([]handler.Alias{handler.MainAlias}, handler.SubAliases...) {
+		select {
+		case <-ctx.Done():
+			msgLog.Info("Job cancelled")
+			return errors.New("event handling cancelled via context")
+		default:
+		}
+
+		aliasName := alias.GroupDisplayName(rootId)
+		if _, exists := aliasesByDisplayName[ssu_exchange.GenerateExchangeDistributionGroupDisplayName(aliasName)]; !exists {
+			continue
+		}
+
+		msgLog.Info(fmt.Sprintf("Removing email alias %s", aliasName))
+		err = handler.RemoveAlias(ctx, exchangeClient, aliasName)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deletedCapabilityRootId returns the root ID of the Capability with the given ID from the last Capability-Service
+// snapshot, falling back to the ID itself if the snapshot is missing or doesn't contain the Capability.
+func deletedCapabilityRootId(st store.Store, capabilityId string) (string, error) {
+	snapshot, err := capsvc.LoadSnapshot(st)
+	if err != nil {
+		if errorx.IsOfType(err, store.NotFound) {
+			return capabilityId, nil
+		}
+		return "", err
+	}
+
+	capability := snapshot.Capability(capabilityId)
+	if capability == nil || capability.RootID == "" {
+		return capabilityId, nil
+	}
+
+	return capability.RootID, nil
+}
@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/service/identitystore"
+	"github.com/aws/aws-sdk-go-v2/service/organizations"
+	"github.com/aws/aws-sdk-go-v2/service/ssoadmin"
+	"github.com/joomcode/errorx"
+	"go.dfds.cloud/aad-aws-sync/internal/aws"
+	"go.dfds.cloud/aad-aws-sync/internal/capsvc"
+	"go.dfds.cloud/aad-aws-sync/internal/config"
+	"go.dfds.cloud/aad-aws-sync/internal/event/model"
+	"go.dfds.cloud/aad-aws-sync/internal/handler"
+	"go.dfds.cloud/aad-aws-sync/internal/k8s"
+	"go.dfds.cloud/aad-aws-sync/internal/util"
+	"go.uber.org/zap"
+)
+
+type contextCreated struct {
+	ContextID    string `json:"contextId"`
+	CapabilityID string `json:"capabilityId"`
+	AccountID    string `json:"accountId"`
+}
+
+// ContextCreatedHandler gives a Capability access to its newly created AWS account right away, instead of waiting for
+// the awsMapping and aws2K8s jobs. For that one account it assigns the Capability permission set, looks up the
+// resulting SSO role and adds the role to the aws-auth ConfigMap.
+func ContextCreatedHandler(ctx context.Context, event model.HandlerContext) error {
+	msgLog := util.Logger.With(zap.String("event_handler", "ContextCreatedHandler"), zap.String("event", event.Event.Type))
+	msg, err := GetEventWithPayloadFromMsg[contextCreated](event.Msg)
+	if err != nil {
+		return err
+	}
+	msgLog = msgLog.With(zap.String("capabilityId", msg.Payload.CapabilityID), zap.String("contextId", msg.Payload.ContextID))
+
+	var capability *capsvc.GetCapabilitiesResponseContextCapability
+
+	conf, err := config.LoadConfig()
+	if err != nil {
+		return err
+	}
+
+	capSvcClient := capsvc.NewCapSvcClient(capsvc.Config{
+		Host:         conf.CapSvc.Host,
+		TenantId:     conf.Azure.TenantId,
+		ClientId:     conf.CapSvc.ClientId,
+		ClientSecret: conf.CapSvc.ClientSecret,
+		Auth:         conf.CapSvc.Auth,
+		Scope:        conf.CapSvc.TokenScope,
+	})
+
+	capabilities, err := capSvcClient.GetCapabilities(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, capa := range capabilities {
+		if capa.ID == msg.Payload.CapabilityID {
+			capability = capa
+			break
+		}
+	}
+
+	if capability == nil {
+		return errors.New("capability from event not found in Capability-Service")
+	}
+	msgLog = msgLog.With(zap.String("capabilityRootId", capability.RootID))
+
+	accountId := msg.Payload.AccountID
+	if accountId == "" {
+		capaContext, err := capability.GetContext()
+		if err != nil {
+			return err
+		}
+		accountId = capaContext.AwsAccountID
+	}
+	msgLog = msgLog.With(zap.String("accountId", accountId))
+	msgLog.Info(fmt.Sprintf("AWS account %s created for Capability %s. Setting up access", accountId, capability.RootID))
+
+	cfg, err := handler.LoadAwsConfig(ctx, conf, "contextCreated")
+	if err != nil {
+		return err
+	}
+
+	orgClient := organizations.NewFromConfig(cfg)
+	ssoClient := ssoadmin.NewFromConfig(cfg)
+	identityStoreClient := identitystore.NewFromConfig(cfg)
+
+	account, err := orgClient.DescribeAccount(ctx, &organizations.DescribeAccountInput{AccountId: &accountId})
+	if err != nil {
+		return err
+	}
+
+	err = handler.AssignCapabilityPermissionSet(ctx, ssoClient, identityStoreClient, conf, capability.RootID, accountId)
+	if err != nil {
+		if errorx.IsOfType(err, handler.SsoGroupNotFound) {
+			msgLog.Info("Group is not yet provisioned to AWS. Skipping direct provisioning, letting the scheduled jobs handle the account")
+			return nil
+		}
+		return err
+	}
+
+	roles, err := aws.GetSsoRoles(ctx, []aws.SsoRoleMapping{
+		{
+			AccountAlias: *account.Account.Name,
+			AccountId:    accountId,
+			RootId:       capability.RootID,
+		},
+	}, conf.Aws.AssumableRoles.CapabilityAccountRoleName)
+	if err != nil {
+		return err
+	}
+
+	role, ok := roles[*account.Account.Name]
+	if !ok {
+		return errors.New(fmt.Sprintf("SSO role for Capability access not found in AWS account %s", accountId))
+	}
+
+	k8sClient, err := k8s.GetK8sClient()
+	if err != nil {
+		return err
+	}
+
+	return handler.AddAwsAuthRoleMapping(ctx, k8sClient, role)
+}
@@ -2,6 +2,8 @@ package handlers
 
 import (
 	"github.com/stretchr/testify/assert"
+	"go.dfds.cloud/aad-aws-sync/internal/capsvc"
+	"go.dfds.cloud/aad-aws-sync/internal/store"
 	"testing"
 )
 
@@ -14,13 +16,53 @@ func TestGetEventWithPayloadFromMsg(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotNil(t, ep)
 
-	assert.Equal(t, ep.Payload.CapabilityId, "")
-	assert.Equal(t, ep.Payload.MemberEmail, "")
+	assert.Equal(t, ep.Payload.CapabilityID, "")
+	assert.Equal(t, ep.Payload.UserID, "")
 
-	ep, err = GetEventWithPayloadFromMsg[memberJoinedCapability]([]byte("{\"eventName\":\"capability_created\",\"version\":\"0.1\",\"payload\":{\"capabilityId\":\"9999\", \"memberEmail\": \"dummy@dfds.cloud\"}}"))
+	ep, err = GetEventWithPayloadFromMsg[memberJoinedCapability]([]byte("{\"type\":\"user-has-joined-capability\",\"messageId\":\"0001\",\"data\":{\"capabilityId\":\"9999\", \"userId\": \"dummy@dfds.cloud\"}}"))
 	assert.NoError(t, err)
 	assert.NotNil(t, ep)
 
-	assert.Equal(t, ep.Payload.CapabilityId, "9999")
-	assert.Equal(t, ep.Payload.MemberEmail, "dummy@dfds.cloud")
+	assert.Equal(t, ep.Type, "user-has-joined-capability")
+	assert.Equal(t, ep.Payload.CapabilityID, "9999")
+	assert.Equal(t, ep.Payload.UserID, "dummy@dfds.cloud")
+}
+
+func TestGetEventWithPayloadFromMsg_CapabilityDeleted(t *testing.T) {
+	ep, err := GetEventWithPayloadFromMsg[capabilityDeleted]([]byte("{\"type\":\"capability-deleted\",\"messageId\":\"0002\",\"data\":{\"capabilityId\":\"sandbox-dummy-abcd\"}}"))
+	assert.NoError(t, err)
+	assert.NotNil(t, ep)
+
+	assert.Equal(t, ep.Payload.CapabilityID, "sandbox-dummy-abcd")
+}
+
+func TestGetEventWithPayloadFromMsg_ContextCreated(t *testing.T) {
+	ep, err := GetEventWithPayloadFromMsg[contextCreated]([]byte("{\"type\":\"aws-context-account-created\",\"messageId\":\"0003\",\"data\":{\"contextId\":\"1234\",\"capabilityId\":\"sandbox-dummy-abcd\",\"accountId\":\"123456789012\"}}"))
+	assert.NoError(t, err)
+	assert.NotNil(t, ep)
+
+	assert.Equal(t, ep.Payload.ContextID, "1234")
+	assert.Equal(t, ep.Payload.CapabilityID, "sandbox-dummy-abcd")
+	assert.Equal(t, ep.Payload.AccountID, "123456789012")
+}
+
+func TestDeletedCapabilityRootId(t *testing.T) {
+	st := store.NewMemoryStore()
+
+	// Without a snapshot the Capability ID is used as the root ID
+	rootId, err := deletedCapabilityRootId(st, "sandbox-abcde")
+	assert.NoError(t, err)
+	assert.Equal(t, "sandbox-abcde", rootId)
+
+	assert.NoError(t, capsvc.SaveSnapshot(st, []*capsvc.GetCapabilitiesResponseContextCapability{
+		{ID: "0d03e3ad-2118-46b7-970e-0ca87b59a202", RootID: "legacy-capability"},
+	}))
+
+	rootId, err = deletedCapabilityRootId(st, "0d03e3ad-2118-46b7-970e-0ca87b59a202")
+	assert.NoError(t, err)
+	assert.Equal(t, "legacy-capability", rootId)
+
+	rootId, err = deletedCapabilityRootId(st, "sandbox-abcde")
+	assert.NoError(t, err)
+	assert.Equal(t, "sandbox-abcde", rootId)
 }
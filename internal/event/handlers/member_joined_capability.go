@@ -4,12 +4,14 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"go.dfds.cloud/aad-aws-sync/internal/audit"
 	"go.dfds.cloud/aad-aws-sync/internal/aws"
 	"go.dfds.cloud/aad-aws-sync/internal/azure"
 	"go.dfds.cloud/aad-aws-sync/internal/capsvc"
 	"go.dfds.cloud/aad-aws-sync/internal/config"
 	"go.dfds.cloud/aad-aws-sync/internal/event/model"
 	"go.dfds.cloud/aad-aws-sync/internal/handler"
+	"go.dfds.cloud/aad-aws-sync/internal/ssu_exchange"
 	"go.dfds.cloud/aad-aws-sync/internal/util"
 	"go.uber.org/zap"
 )
@@ -35,12 +37,12 @@ func MemberJoinedCapabilityHandler(ctx context.Context, event model.HandlerConte
 		return err
 	}
 
-	groupsInAzure := make(map[string]*azure.Group)
 	capSvcClient := capsvc.NewCapSvcClient(capsvc.Config{
 		Host:         conf.CapSvc.Host,
 		TenantId:     conf.Azure.TenantId,
 		ClientId:     conf.CapSvc.ClientId,
 		ClientSecret: conf.CapSvc.ClientSecret,
+		Auth:         conf.CapSvc.Auth,
 		Scope:        conf.CapSvc.TokenScope,
 	})
 
@@ -48,12 +50,24 @@ func MemberJoinedCapabilityHandler(ctx context.Context, event model.HandlerConte
 		TenantId:             conf.Azure.TenantId,
 		ClientId:             conf.Azure.ClientId,
 		ClientSecret:         conf.Azure.ClientSecret,
+		Auth:                 conf.Azure.Auth,
 		InternalDomainSuffix: conf.Azure.InternalDomainSuffix,
+		CapabilityIdProperty: conf.Azure.CapabilityIdProperty,
 	})
 
 	scimClient := aws.CreateScimClient(conf.Aws.Scim.Endpoint, conf.Aws.Scim.Token)
 
-	capabilities, err := capSvcClient.GetCapabilities()
+	exchangeClient := ssu_exchange.NewSsuExchangeClientO365UnofficialApi(ssu_exchange.Config{
+		TenantId:     conf.Azure.TenantId,
+		ClientId:     conf.Exchange.ClientId,
+		ClientSecret: conf.Exchange.ClientSecret,
+		Auth:         conf.Exchange.Auth,
+		BaseUrl:      conf.Exchange.BaseUrl,
+		ManagedBy:    conf.Exchange.ManagedBy,
+		EmailSuffix:  conf.Exchange.EmailSuffix,
+	})
+
+	capabilities, err := capSvcClient.GetCapabilities(ctx)
 	if err != nil {
 		return err
 	}
@@ -69,9 +83,9 @@ func MemberJoinedCapabilityHandler(ctx context.Context, event model.HandlerConte
 		return errors.New("capability from event not found in Capability-Service")
 	}
 	msgLog = msgLog.With(zap.String("capabilityRootId", capability.RootID))
-	msgLog.Info(fmt.Sprintf("%s joined Capability %s. Updating AAD group", msg.Payload.UserID, capability.RootID))
+	msgLog.Info(fmt.Sprintf("%s joined Capability %s. Updating AAD group and email alias", msg.Payload.UserID, capability.RootID))
 
-	aUnits, err := azureClient.GetAdministrativeUnits()
+	aUnits, err := azureClient.GetAdministrativeUnits(ctx)
 	if err != nil {
 		return err
 	}
@@ -81,57 +95,63 @@ func MemberJoinedCapabilityHandler(ctx context.Context, event model.HandlerConte
 		return errors.New("unable to find administrative unit")
 	}
 
-	aUnitMembers, err := azureClient.GetAdministrativeUnitMembers(aUnit.ID)
+	aUnitMembers, err := azureClient.GetAdministrativeUnitMembers(ctx, aUnit.ID)
 	if err != nil {
 		return err
 	}
 
-	for _, member := range aUnitMembers.Value {
-		select {
-		case <-ctx.Done():
-			msgLog.Info("Job cancelled")
-			return errors.New("event handling cancelled via context")
-		default:
-			group := &azure.Group{
-				DisplayName: member.DisplayName,
-				ID:          member.ID,
-				Members:     []*azure.Member{},
-			}
-			groupsInAzure[group.DisplayName] = group
-		}
+	unit, _, err := handler.CapabilityGroupOf(ctx, aUnitMembers.Value, capability.RootID, handler.AwsIdentityStoreGroups(conf))
+	if err != nil {
+		return err
 	}
-
-	azureGroupName := fmt.Sprintf("%s %s", handler.CAPABILITY_GROUP_PREFIX, capability.RootID)
-	var azureGroup *azure.Group
-	if resp, ok := groupsInAzure[azureGroupName]; !ok {
+	if unit == nil {
 		return errors.New(fmt.Sprintf("Capability %s doesn't exist in Azure. Unable to add new member", capability.RootID))
-	} else {
-		azureGroup = resp
+	}
+	azureGroup := &azure.Group{
+		DisplayName: unit.DisplayName,
+		ID:          unit.ID,
+		Members:     []*azure.Member{},
 	}
 
-	err = azureClient.AddGroupMember(azureGroup.ID, msg.Payload.UserID)
+	// Resolve the user before changing anything, so a failed lookup doesn't fail an event whose changes were applied
+	aadUser, err := azureClient.GetUserViaUPN(ctx, msg.Payload.UserID)
 	if err != nil {
 		return err
 	}
 
-	aadUser, err := azureClient.GetUserViaUPN(msg.Payload.UserID)
+	exchangeMember, err := handler.ResolveExchangeMember(ctx, azureClient, msg.Payload.UserID)
 	if err != nil {
 		return err
 	}
 
-	scimUser, err := scimClient.GetUserViaExternalId(aadUser.ID)
+	err = azureClient.AddGroupMember(ctx, azureGroup.ID, msg.Payload.UserID)
+	handler.RecordMutation(ctx, handler.MembershipMutation(audit.SystemAzureAd, handler.MutationAadGroupMemberAdded, map[string]string{"groupId": azureGroup.ID, "userId": aadUser.ID, "userPrincipalName": msg.Payload.UserID}, true), err)
+	if err != nil {
+		return err
+	}
+
+	err = handler.AddMainAliasMember(ctx, exchangeClient, capability.RootID, exchangeMember)
+	if err != nil {
+		if !handler.IsExchangeNotFound(err) {
+			return err
+		}
+		msgLog.Info(fmt.Sprintf("Unable to add %s in main email alias of Capability %s, user or alias not found. Letting the capabilityEmailAlias job handle it", msg.Payload.UserID, capability.RootID))
+	}
+
+	scimUser, err := scimClient.GetUserViaExternalId(ctx, aadUser.ID)
 	if err != nil {
 		msgLog.Info("User is not yet provisioned to AWS. Skipping direct provisioning, letting Azure handle the initial provisioning of user and memberships")
 		return nil
 	}
 
-	scimGroup, err := scimClient.GetGroupViaDisplayName(azureGroupName)
+	scimGroup, err := scimClient.GetGroupViaDisplayName(ctx, azureGroup.DisplayName)
 	if err != nil {
 		msgLog.Info("Group is not yet provisioned to AWS. Skipping direct provisioning, letting Azure handle the initial provisioning of group")
 		return nil
 	}
 
-	err = scimClient.PatchAddMembersToGroup(scimGroup.ID, scimUser.ID)
+	err = scimClient.PatchAddMembersToGroup(ctx, scimGroup.ID, scimUser.ID)
+	handler.RecordMutation(ctx, handler.MembershipMutation(audit.SystemAwsIdentityStore, handler.MutationScimGroupMemberAdded, map[string]string{"groupId": scimGroup.ID, "userId": scimUser.ID}, true), err)
 	if err != nil {
 		return err
 	}
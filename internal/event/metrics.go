@@ -0,0 +1,70 @@
+package event
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/segmentio/kafka-go"
+)
+
+// unknownEventType is used as event_type label for messages that could not be parsed into an event envelope.
+const unknownEventType = "unknown"
+
+var metricMessagesFetched = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name:      "event_messages_fetched_total",
+	Help:      "Messages fetched from the event topic",
+	Namespace: "aad_aws_sync",
+}, []string{"event_type"})
+
+var metricMessagesHandled = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name:      "event_messages_handled_total",
+	Help:      "Messages successfully processed by an event handler",
+	Namespace: "aad_aws_sync",
+}, []string{"event_type"})
+
+var metricMessagesSkipped = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name:      "event_messages_skipped_total",
+	Help:      "Messages skipped without being handled",
+	Namespace: "aad_aws_sync",
+}, []string{"event_type", "reason"})
+
+var metricMessagesDeadLettered = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name:      "event_messages_dead_lettered_total",
+	Help:      "Messages forwarded to the DLQ after their event handler failed",
+	Namespace: "aad_aws_sync",
+}, []string{"event_type"})
+
+var metricHandlerDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:      "event_handler_duration_seconds",
+	Help:      "Time spent in event handlers",
+	Namespace: "aad_aws_sync",
+	Buckets:   []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120},
+}, []string{"event_type", "result"})
+
+var metricCommitFailures = promauto.NewCounter(prometheus.CounterOpts{
+	Name:      "event_commit_failures_total",
+	Help:      "Failed attempts at committing offsets for the consumer group",
+	Namespace: "aad_aws_sync",
+})
+
+var metricConsumerLag = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name:      "event_consumer_lag",
+	Help:      "Messages between the last fetched message and the high water mark of the partition",
+	Namespace: "aad_aws_sync",
+}, []string{"topic", "partition"})
+
+var metricConsumerUp = promauto.NewGauge(prometheus.GaugeOpts{
+	Name:      "event_consumer_up",
+	Help:      "1 while the event consumer is fetching messages, 0 once it has stopped",
+	Namespace: "aad_aws_sync",
+})
+
+// updateConsumerLag sets the lag of the partition msg was fetched from, based on the high water mark reported with it.
+func updateConsumerLag(msg kafka.Message) {
+	lag := msg.HighWaterMark - msg.Offset - 1
+	if lag < 0 {
+		lag = 0
+	}
+	metricConsumerLag.WithLabelValues(msg.Topic, strconv.Itoa(msg.Partition)).Set(float64(lag))
+}
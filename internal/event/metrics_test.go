@@ -0,0 +1,30 @@
+package event
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpdateConsumerLag(t *testing.T) {
+	updateConsumerLag(kafka.Message{Topic: "events", Partition: 2, Offset: 10, HighWaterMark: 15})
+	assert.Equal(t, float64(4), gaugeValue(t, metricConsumerLag.WithLabelValues("events", "2")))
+
+	updateConsumerLag(kafka.Message{Topic: "events", Partition: 2, Offset: 14, HighWaterMark: 15})
+	assert.Equal(t, float64(0), gaugeValue(t, metricConsumerLag.WithLabelValues("events", "2")))
+
+	updateConsumerLag(kafka.Message{Topic: "events", Partition: 3, Offset: 5, HighWaterMark: 0})
+	assert.Equal(t, float64(0), gaugeValue(t, metricConsumerLag.WithLabelValues("events", "3")))
+}
+
+func gaugeValue(t *testing.T, gauge prometheus.Gauge) float64 {
+	var m dto.Metric
+	if err := gauge.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+
+	return m.GetGauge().GetValue()
+}
@@ -0,0 +1,71 @@
+package event
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/joomcode/errorx"
+	"go.dfds.cloud/aad-aws-sync/internal/event/model"
+	"go.dfds.cloud/aad-aws-sync/internal/store"
+)
+
+// ProcessedEvent records that an event was handled, so redelivered copies of it are skipped.
+type ProcessedEvent struct {
+	MessageId   string    `json:"messageId"`
+	Type        string    `json:"type"`
+	ProcessedAt time.Time `json:"processedAt"`
+}
+
+func isProcessed(st store.Store, event *model.Envelope) (bool, error) {
+	if event.MessageId == "" {
+		return false, nil
+	}
+
+	var processed ProcessedEvent
+	err := st.Get(store.BucketProcessedEvents, event.MessageId, &processed)
+	if errorx.IsOfType(err, store.NotFound) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+func markProcessed(st store.Store, event *model.Envelope) error {
+	if event.MessageId == "" {
+		return nil
+	}
+
+	return st.Put(store.BucketProcessedEvents, event.MessageId, ProcessedEvent{
+		MessageId:   event.MessageId,
+		Type:        event.Type,
+		ProcessedAt: time.Now(),
+	})
+}
+
+// PruneProcessedEvents forgets events processed longer than retention ago. Returns the number of records removed.
+func PruneProcessedEvents(st store.Store, retention time.Duration) (int, error) {
+	cutoff := time.Now().Add(-retention)
+
+	var expired []string
+	err := st.List(store.BucketProcessedEvents, "", func(key string, value []byte) error {
+		var processed ProcessedEvent
+		if err := json.Unmarshal(value, &processed); err != nil {
+			return err
+		}
+		if processed.ProcessedAt.Before(cutoff) {
+			expired = append(expired, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, key := range expired {
+		if err := st.Delete(store.BucketProcessedEvents, key); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(expired), nil
+}
@@ -0,0 +1,47 @@
+package event
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.dfds.cloud/aad-aws-sync/internal/event/model"
+	"go.dfds.cloud/aad-aws-sync/internal/store"
+)
+
+func TestProcessedEvents(t *testing.T) {
+	st := store.NewMemoryStore()
+	event := &model.Envelope{Type: "capability-deleted", MessageId: "0001"}
+
+	processed, err := isProcessed(st, event)
+	assert.NoError(t, err)
+	assert.False(t, processed)
+
+	assert.NoError(t, markProcessed(st, event))
+	processed, err = isProcessed(st, event)
+	assert.NoError(t, err)
+	assert.True(t, processed)
+
+	// Events without a message ID can't be recognised when redelivered
+	anonymous := &model.Envelope{Type: "capability-deleted"}
+	assert.NoError(t, markProcessed(st, anonymous))
+	processed, err = isProcessed(st, anonymous)
+	assert.NoError(t, err)
+	assert.False(t, processed)
+
+	assert.NoError(t, st.Put(store.BucketProcessedEvents, "0000", ProcessedEvent{
+		MessageId:   "0000",
+		Type:        "capability-deleted",
+		ProcessedAt: time.Now().Add(-48 * time.Hour),
+	}))
+	pruned, err := PruneProcessedEvents(st, 24*time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, pruned)
+
+	processed, err = isProcessed(st, &model.Envelope{MessageId: "0000"})
+	assert.NoError(t, err)
+	assert.False(t, processed)
+	processed, err = isProcessed(st, event)
+	assert.NoError(t, err)
+	assert.True(t, processed)
+}
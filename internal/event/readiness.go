@@ -0,0 +1,120 @@
+package event
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	// consumerStatsInterval is how often the stats of the Kafka reader are checked, see monitorConsumer
+	consumerStatsInterval = 15 * time.Second
+	// maxHandlingDuration is how long a single message may take to be handled before the consumer is considered stuck
+	maxHandlingDuration = 15 * time.Minute
+)
+
+// consumerState tracks whether the event loop is still consuming, so it can be reported through the readiness and
+// liveness checks.
+type consumerState struct {
+	mu      sync.RWMutex
+	running bool
+	err     error
+	// fetchErr is set while the reader fails to fetch messages without stopping, see observe
+	fetchErr error
+	// handlingSince is when the event loop started handling the current message, zero between messages
+	handlingSince time.Time
+}
+
+var consumerStatus = &consumerState{}
+
+func (s *consumerState) start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running = true
+	s.err = nil
+	s.fetchErr = nil
+	s.handlingSince = time.Time{}
+	metricConsumerUp.Set(1)
+}
+
+func (s *consumerState) stop(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running = false
+	s.err = err
+	s.handlingSince = time.Time{}
+	metricConsumerUp.Set(0)
+}
+
+// handling records that the event loop started handling a message at t, or finished handling it if t is zero.
+func (s *consumerState) handling(t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlingSince = t
+}
+
+// observe records the stats of the Kafka reader since the previous call. The reader retries failed fetches by itself,
+// so FetchMessage blocks rather than return an error; errors without any message fetched in between are reported by
+// Ready. The lag in the stats is that of a single partition in group mode, so it is left to updateConsumerLag.
+func (s *consumerState) observe(stats kafka.ReaderStats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if stats.Errors > 0 && stats.Messages == 0 {
+		s.fetchErr = fmt.Errorf("event consumer failed to fetch messages %d times in the last %s", stats.Errors, consumerStatsInterval)
+	} else {
+		s.fetchErr = nil
+	}
+}
+
+// monitorConsumer observes the stats of reader until ctx is cancelled. Reading the stats resets their counters, so
+// nothing else may read them.
+func monitorConsumer(ctx context.Context, reader interface{ Stats() kafka.ReaderStats }) {
+	ticker := time.NewTicker(consumerStatsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			consumerStatus.observe(reader.Stats())
+		}
+	}
+}
+
+// Ready returns an error if the event consumer is not running, e.g. because it has not started yet or stopped after
+// failing to fetch messages, or if it keeps failing to fetch messages.
+func Ready() error {
+	consumerStatus.mu.RLock()
+	defer consumerStatus.mu.RUnlock()
+
+	if consumerStatus.running {
+		return consumerStatus.fetchErr
+	}
+	if consumerStatus.err != nil {
+		return consumerStatus.err
+	}
+
+	return errors.New("event consumer is not running")
+}
+
+// Live returns an error if the event consumer won't recover without a restart: it stopped after failing, or has been
+// handling a single message for longer than maxHandlingDuration. A consumer that hasn't started yet, or was stopped,
+// is live.
+func Live() error {
+	consumerStatus.mu.RLock()
+	defer consumerStatus.mu.RUnlock()
+
+	if consumerStatus.err != nil {
+		return consumerStatus.err
+	}
+	if !consumerStatus.handlingSince.IsZero() && time.Since(consumerStatus.handlingSince) > maxHandlingDuration {
+		return fmt.Errorf("event consumer has been handling a message since %s", consumerStatus.handlingSince.Format(time.RFC3339))
+	}
+
+	return nil
+}
@@ -0,0 +1,64 @@
+package event
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReady(t *testing.T) {
+	consumerStatus = &consumerState{}
+	assert.Error(t, Ready())
+
+	consumerStatus.start()
+	assert.NoError(t, Ready())
+	assert.Equal(t, float64(1), gaugeValue(t, metricConsumerUp))
+
+	consumerStatus.stop(errors.New("fetch failed"))
+	assert.EqualError(t, Ready(), "fetch failed")
+	assert.Equal(t, float64(0), gaugeValue(t, metricConsumerUp))
+
+	consumerStatus.start()
+	consumerStatus.stop(nil)
+	assert.Error(t, Ready())
+}
+
+func TestReadyFetchErrors(t *testing.T) {
+	consumerStatus = &consumerState{}
+	consumerStatus.start()
+
+	// The reader retries failed fetches by itself
+	consumerStatus.observe(kafka.ReaderStats{Topic: "events", Errors: 3})
+	assert.Error(t, Ready())
+	assert.NoError(t, Live())
+
+	// Messages fetched in between mean it recovered
+	consumerStatus.observe(kafka.ReaderStats{Topic: "events", Errors: 1, Messages: 2})
+	assert.NoError(t, Ready())
+}
+
+func TestLive(t *testing.T) {
+	consumerStatus = &consumerState{}
+	assert.NoError(t, Live())
+
+	consumerStatus.start()
+	consumerStatus.handling(time.Now())
+	assert.NoError(t, Live())
+
+	// Stuck handling a message
+	consumerStatus.handling(time.Now().Add(-maxHandlingDuration - time.Minute))
+	assert.Error(t, Live())
+
+	consumerStatus.handling(time.Time{})
+	assert.NoError(t, Live())
+
+	consumerStatus.stop(nil)
+	assert.NoError(t, Live())
+
+	consumerStatus.start()
+	consumerStatus.stop(errors.New("fetch failed"))
+	assert.EqualError(t, Live(), "fetch failed")
+}
@@ -2,6 +2,7 @@ package event
 
 import (
 	"context"
+	"go.dfds.cloud/aad-aws-sync/internal/event/handlers"
 	"go.dfds.cloud/aad-aws-sync/internal/event/model"
 )
 
@@ -24,3 +25,16 @@ func (r *Registry) Register(eventName string, f HandlerFunc) {
 func (r *Registry) GetHandler(eventName string) HandlerFunc {
 	return r.handlers[eventName]
 }
+
+// NewHandlerRegistry returns a Registry with the handlers of every supported event, so all event transports dispatch
+// events the same way.
+func NewHandlerRegistry() *Registry {
+	registry := NewRegistry()
+	//registry.Register("capability_created", handlers.CapabilityCreatedHandler)
+	registry.Register("user-has-joined-capability", handlers.MemberJoinedCapabilityHandler)
+	registry.Register("member_left_capability", handlers.MemberLeftCapabilityHandler)
+	registry.Register("capability-deleted", handlers.CapabilityDeletedHandler)
+	registry.Register("aws-context-account-created", handlers.ContextCreatedHandler)
+
+	return registry
+}
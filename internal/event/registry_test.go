@@ -28,3 +28,12 @@ func TestRegistry_Register(t *testing.T) {
 		return nil
 	})
 }
+
+func TestNewHandlerRegistry(t *testing.T) {
+	r := NewHandlerRegistry()
+	assert.NotNil(t, r.GetHandler("user-has-joined-capability"))
+	assert.NotNil(t, r.GetHandler("member_left_capability"))
+	assert.NotNil(t, r.GetHandler("capability-deleted"))
+	assert.NotNil(t, r.GetHandler("aws-context-account-created"))
+	assert.Nil(t, r.GetHandler("capability_created"))
+}
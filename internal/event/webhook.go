@@ -0,0 +1,92 @@
+package event
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.dfds.cloud/aad-aws-sync/internal/tracing"
+	"go.dfds.cloud/aad-aws-sync/internal/util"
+	"go.uber.org/zap"
+)
+
+// maxWebhookBodySize limits the size of events accepted through the webhook.
+const maxWebhookBodySize = 1 << 20
+
+// WebhookResponse is the synchronous result of an event delivered through the webhook.
+type WebhookResponse struct {
+	Type          string `json:"type,omitempty"`
+	MessageId     string `json:"messageId,omitempty"`
+	Status        string `json:"status"`
+	Reason        string `json:"reason,omitempty"`
+	Error         string `json:"error,omitempty"`
+	FailedEventId string `json:"failedEventId,omitempty"`
+}
+
+// WebhookHandler             godoc
+// @Summary      Deliver an event
+// @Description  Accepts the same event envelope as the Kafka topic and runs its event handler synchronously. Events whose handler fails are kept in the failed event store. Events with a message ID that was handled before are skipped.
+// @Tags         events
+// @Accept       json
+// @Produce      json
+// @Security     BearerToken
+// @Success      200 {object} WebhookResponse
+// @Failure      400 {object} WebhookResponse
+// @Failure      401
+// @Failure      413 {object} WebhookResponse
+// @Failure      500 {object} WebhookResponse
+// @Failure      503
+// @Router       /events [post]
+func WebhookHandler(registry *Registry, store *FailedEventStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// One byte more than allowed tells a body at the limit from one cut off by it
+		msg, err := io.ReadAll(io.LimitReader(c.Request.Body, maxWebhookBodySize+1))
+		if err != nil {
+			c.IndentedJSON(http.StatusBadRequest, WebhookResponse{Status: StatusSkipped, Error: err.Error()})
+			return
+		}
+		if len(msg) > maxWebhookBodySize {
+			c.IndentedJSON(http.StatusRequestEntityTooLarge, WebhookResponse{Status: StatusSkipped, Error: fmt.Sprintf("event is larger than %d bytes", maxWebhookBodySize)})
+			return
+		}
+
+		msgLog := util.Logger.With(zap.String("transport", "webhook"), zap.String("value", string(msg)))
+		// The trace context of the sender is propagated like the one of Kafka messages. Not using the context of the
+		// request, so a sender that disconnects doesn't cancel the handler halfway through its changes.
+		ctx := tracing.ExtractHttpHeaders(context.Background(), c.Request.Header)
+		result := Dispatch(ctx, registry, msg, msgLog)
+
+		resp := WebhookResponse{
+			Status: result.Status,
+			Reason: result.Reason,
+		}
+		if result.Event != nil {
+			resp.Type = result.Event.Type
+			resp.MessageId = result.Event.MessageId
+		}
+
+		switch result.Status {
+		case StatusHandled:
+			c.IndentedJSON(http.StatusOK, resp)
+		case StatusSkipped:
+			if result.Reason == "no_handler" || result.Reason == "duplicate" {
+				c.IndentedJSON(http.StatusOK, resp)
+				return
+			}
+			c.IndentedJSON(http.StatusBadRequest, resp)
+		default:
+			resp.Error = result.Err.Error()
+			failedEvent, err := store.Save(result.Event, msg, "webhook", result.Err)
+			if err != nil {
+				msgLog.Error("Unable to store failed event", zap.Error(err))
+				c.IndentedJSON(http.StatusInternalServerError, resp)
+				return
+			}
+			metricMessagesDeadLettered.WithLabelValues(result.Event.Type).Inc()
+			resp.FailedEventId = failedEvent.ID
+			c.IndentedJSON(http.StatusInternalServerError, resp)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package event
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"go.dfds.cloud/aad-aws-sync/internal/event/model"
+	statestore "go.dfds.cloud/aad-aws-sync/internal/store"
+	"go.dfds.cloud/aad-aws-sync/internal/util"
+	"go.uber.org/zap"
+)
+
+func TestWebhookHandler(t *testing.T) {
+	util.Logger = zap.NewNop()
+	gin.SetMode(gin.TestMode)
+	statestore.SetDefault(statestore.NewMemoryStore())
+
+	var received model.HandlerContext
+	registry := NewRegistry()
+	registry.Register("capability-deleted", func(ctx context.Context, event model.HandlerContext) error {
+		received = event
+		return nil
+	})
+	registry.Register("member_left_capability", func(ctx context.Context, event model.HandlerContext) error {
+		return errors.New("user not found")
+	})
+	registry.Register("member_joined_capability", func(ctx context.Context, event model.HandlerContext) error {
+		return ctx.Err()
+	})
+
+	store, err := NewFailedEventStore(t.TempDir())
+	assert.NoError(t, err)
+
+	router := gin.New()
+	router.POST("/events", WebhookHandler(registry, store))
+
+	post := func(body string) (int, WebhookResponse) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/events", strings.NewReader(body)))
+
+		var resp WebhookResponse
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return w.Code, resp
+	}
+
+	msg := `{"type":"capability-deleted","messageId":"0001","data":{"capabilityId":"sandbox-xyz"}}`
+	code, resp := post(msg)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, StatusHandled, resp.Status)
+	assert.Equal(t, "capability-deleted", resp.Type)
+	assert.Equal(t, "0001", resp.MessageId)
+	assert.Equal(t, "capability-deleted", received.Event.Type)
+	assert.JSONEq(t, msg, string(received.Msg))
+
+	// Redelivered events are only handled once
+	received = model.HandlerContext{}
+	code, resp = post(msg)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, StatusSkipped, resp.Status)
+	assert.Equal(t, "duplicate", resp.Reason)
+	assert.Nil(t, received.Event)
+
+	code, resp = post(`{"type":"capability_created","messageId":"0002"}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, StatusSkipped, resp.Status)
+	assert.Equal(t, "no_handler", resp.Reason)
+
+	code, resp = post(`not json`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, "invalid_payload", resp.Reason)
+
+	code, resp = post(`{"messageId":"0003"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, "invalid_envelope", resp.Reason)
+
+	code, resp = post(`{"type":"member_left_capability","messageId":"0004"}`)
+	assert.Equal(t, http.StatusInternalServerError, code)
+	assert.Equal(t, StatusFailed, resp.Status)
+	assert.Equal(t, "user not found", resp.Error)
+	assert.NotEmpty(t, resp.FailedEventId)
+
+	failedEvents, err := store.List()
+	assert.NoError(t, err)
+	assert.Len(t, failedEvents, 1)
+	assert.Equal(t, resp.FailedEventId, failedEvents[0].ID)
+	assert.Equal(t, "0004", failedEvents[0].MessageId)
+
+	code, resp = post(`{"type":"capability-deleted","messageId":"0005","data":"` + strings.Repeat("x", maxWebhookBodySize) + `"}`)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, code)
+	assert.Equal(t, StatusSkipped, resp.Status)
+
+	// A sender that disconnects doesn't cancel the handler
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/events", strings.NewReader(`{"type":"member_joined_capability","messageId":"0006"}`)).WithContext(ctx))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
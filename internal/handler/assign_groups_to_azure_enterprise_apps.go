@@ -54,16 +54,17 @@ func AssignGroupsToAzureEnterpriseAppsHandler(ctx context.Context) error {
 		TenantId:             conf.Azure.TenantId,
 		ClientId:             conf.Azure.ClientId,
 		ClientSecret:         conf.Azure.ClientSecret,
+		Auth:                 conf.Azure.Auth,
 		InternalDomainSuffix: conf.Azure.InternalDomainSuffix,
 	})
 
-	groups, err := azClient.GetGroups(azure.AZURE_CAPABILITY_GROUP_PREFIX)
+	groups, err := azClient.GetGroups(ctx, azure.AZURE_CAPABILITY_GROUP_PREFIX)
 	if err != nil {
 		return err
 	}
 
 	for _, app := range apps {
-		appRoles, err := azClient.GetApplicationRoles(app.AppId)
+		appRoles, err := azClient.GetApplicationRoles(ctx, app.AppId)
 		if err != nil {
 			return err
 		}
@@ -73,7 +74,7 @@ func AssignGroupsToAzureEnterpriseAppsHandler(ctx context.Context) error {
 			return err
 		}
 
-		appAssignments, err := azClient.GetAssignmentsForApplication(app.ObjectId)
+		appAssignments, err := azClient.GetAssignmentsForApplication(ctx, app.ObjectId)
 		if err != nil {
 			return err
 		}
@@ -91,7 +92,7 @@ func AssignGroupsToAzureEnterpriseAppsHandler(ctx context.Context) error {
 			// If group is not already assigned to enterprise application, assign them.
 			if !appAssignments.ContainsGroup(group.DisplayName) {
 				util.Logger.Info(fmt.Sprintf("Group %s has not been assigned to application yet, assigning", group.DisplayName), zap.String("jobName", AzureAdToAwsName))
-				_, err := azClient.AssignGroupToApplication(app.ObjectId, group.ID, appRoleId)
+				err := AssignGroupToApplication(ctx, azClient, app.ObjectId, group.ID, appRoleId)
 				if err != nil {
 					return err
 				}
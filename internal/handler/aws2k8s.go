@@ -2,22 +2,19 @@ package handler
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"strings"
 	"time"
 
-	daws "github.com/aws/aws-sdk-go-v2/aws"
-	awsConfig "github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/organizations"
-	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"go.dfds.cloud/aad-aws-sync/internal/audit"
 	"go.dfds.cloud/aad-aws-sync/internal/aws"
 	"go.dfds.cloud/aad-aws-sync/internal/config"
 	"go.dfds.cloud/aad-aws-sync/internal/k8s"
 	"go.dfds.cloud/aad-aws-sync/internal/util"
 	"go.uber.org/zap"
 	"gopkg.in/yaml.v2"
+	"k8s.io/client-go/kubernetes"
 )
 
 const TIME_FORMAT = "2006-01-02 15:04:05.999999999 -0700 MST"
@@ -29,27 +26,9 @@ func Aws2K8sHandler(ctx context.Context) error {
 		return err
 	}
 
-	var cfg daws.Config
-
-	cfg, err = awsConfig.LoadDefaultConfig(context.TODO(), awsConfig.WithRegion(conf.Aws.SsoRegion), awsConfig.WithHTTPClient(aws.CreateHttpClientWithoutKeepAlive()))
+	cfg, err := LoadAwsConfig(ctx, conf, AwsToKubernetesName)
 	if err != nil {
-		return errors.New(fmt.Sprintf("unable to load SDK config, %v", err))
-	}
-
-	if conf.Aws.AssumableRoles.SsoManagementArn != "" {
-		stsClient := sts.NewFromConfig(cfg)
-		roleSessionName := fmt.Sprintf("aad-aws-sync-%s", AwsMappingName)
-
-		assumedRole, err := stsClient.AssumeRole(context.TODO(), &sts.AssumeRoleInput{RoleArn: &conf.Aws.AssumableRoles.SsoManagementArn, RoleSessionName: &roleSessionName})
-		if err != nil {
-			util.Logger.Info(fmt.Sprintf("unable to assume role %s, %v", conf.Aws.AssumableRoles.SsoManagementArn, err), zap.String("jobName", AwsToKubernetesName))
-			return err
-		}
-
-		cfg, err = awsConfig.LoadDefaultConfig(context.TODO(), awsConfig.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(*assumedRole.Credentials.AccessKeyId, *assumedRole.Credentials.SecretAccessKey, *assumedRole.Credentials.SessionToken)), awsConfig.WithRegion(conf.Aws.SsoRegion))
-		if err != nil {
-			return errors.New(fmt.Sprintf("unable to load SDK config, %v", err))
-		}
+		return err
 	}
 
 	orgClient := organizations.NewFromConfig(cfg)
@@ -80,7 +59,7 @@ func Aws2K8sHandler(ctx context.Context) error {
 	}
 
 	// Populate rolename rolearn from api+config
-	resp, err := aws.GetSsoRoles(ssoRoleMappings, conf.Aws.AssumableRoles.CapabilityAccountRoleName)
+	resp, err := aws.GetSsoRoles(ctx, ssoRoleMappings, conf.Aws.AssumableRoles.CapabilityAccountRoleName)
 	if err != nil {
 		return err
 	}
@@ -90,6 +69,8 @@ func Aws2K8sHandler(ctx context.Context) error {
 		return err
 	}
 
+	var mutations []audit.Mutation
+
 	// Loop through ConfigMap entries, check if an entry exists where the equivalent AWS role doesn't. If that's the case, remove the entry from aws-auth ConfigMap
 	for x := 0; x < len(amResp.Mappings); x++ {
 		if amResp.Mappings[x].ManagedByThis() {
@@ -106,6 +87,7 @@ func Aws2K8sHandler(ctx context.Context) error {
 
 			if !match {
 				util.Logger.Info(fmt.Sprintf("Role no longer found. Removing %s", amResp.Mappings[x].RoleARN), zap.String("jobName", AwsToKubernetesName))
+				mutations = append(mutations, roleMappingMutation(MutationAwsAuthRoleMappingRemoved, amResp.Mappings[x].RoleARN, amResp.Mappings[x], nil))
 				amResp.Mappings = removeArrayItem(amResp.Mappings, x)
 			}
 		}
@@ -120,44 +102,37 @@ func Aws2K8sHandler(ctx context.Context) error {
 		default:
 		}
 
-		mapping := amResp.GetMappingByArn(fmt.Sprintf("arn:aws:iam::%s:role/%s", acc.AccountId, acc.RoleName))
-		currentTime := time.Now()
-
-		// If no config-map entry for aws acc with role
-		if mapping == nil {
-			util.Logger.Info(fmt.Sprintf("No mapping for %s, creating.\n", acc.AccountAlias), zap.String("jobName", AwsToKubernetesName))
-			roleMapping := &k8s.RoleMapping{
-				RoleARN:     fmt.Sprintf("arn:aws:iam::%s:role/%s", acc.AccountId, acc.RoleName),
-				ManagedBy:   "aad-aws-sync",
-				LastUpdated: currentTime.Format(TIME_FORMAT),
-				CreatedAt:   currentTime.Format(TIME_FORMAT),
-				Username:    fmt.Sprintf("%s:sso-{{SessionName}}", acc.RootId),
-				Groups:      []string{"DFDS-ReadOnly", acc.RootId},
-			}
-			amResp.Mappings = append(amResp.Mappings, roleMapping)
-		} else {
-			configMismatch := false
+		if mutation := reconcileRoleMapping(amResp, acc); mutation != nil {
+			mutations = append(mutations, *mutation)
+		}
+	}
 
-			if mapping.Username != fmt.Sprintf("%s:sso-{{SessionName}}", acc.RootId) {
-				configMismatch = true
-			}
+	payload, err := yaml.Marshal(&amResp.Mappings)
+	if err != nil {
+		return err
+	}
 
-			if !mapping.ContainsGroup("DFDS-ReadOnly") {
-				configMismatch = true
-			}
+	amResp.ConfigMap.Data["mapRoles"] = string(payload)
 
-			if !mapping.ContainsGroup(acc.RootId) {
-				configMismatch = true
-			}
+	err = mutate(ctx, func() error { return k8s.UpdateAwsAuthMapRoles(k8sClient, amResp.ConfigMap) })
+	for _, mutation := range mutations {
+		RecordMutation(ctx, mutation, err)
+	}
 
-			if configMismatch {
-				util.Logger.Info(fmt.Sprintf("Config mismatch for %s detected, updating entry\n", acc.AccountAlias), zap.String("jobName", AwsToKubernetesName))
+	return err
+}
 
-				mapping.Username = fmt.Sprintf("%s:sso-{{SessionName}}", acc.RootId)
-				mapping.Groups = []string{"DFDS-ReadOnly", acc.RootId}
-				mapping.LastUpdated = currentTime.Format(TIME_FORMAT)
-			}
-		}
+// AddAwsAuthRoleMapping creates or corrects the aws-auth ConfigMap entry for the Capability access role of a single
+// AWS account.
+func AddAwsAuthRoleMapping(ctx context.Context, k8sClient kubernetes.Interface, acc aws.SsoRoleMapping) error {
+	amResp, err := k8s.LoadAwsAuthMapRoles(k8sClient)
+	if err != nil {
+		return err
+	}
+
+	mutation := reconcileRoleMapping(amResp, acc)
+	if mutation == nil {
+		return nil
 	}
 
 	payload, err := yaml.Marshal(&amResp.Mappings)
@@ -167,11 +142,72 @@ func Aws2K8sHandler(ctx context.Context) error {
 
 	amResp.ConfigMap.Data["mapRoles"] = string(payload)
 
-	err = k8s.UpdateAwsAuthMapRoles(k8sClient, amResp.ConfigMap)
-	if err != nil {
-		return err
+	err = mutate(ctx, func() error { return k8s.UpdateAwsAuthMapRoles(k8sClient, amResp.ConfigMap) })
+	RecordMutation(ctx, *mutation, err)
+
+	return err
+}
+
+// reconcileRoleMapping adds a mapping for the AWS account's Capability access role, or corrects the existing one.
+// Returns the change made to the mappings, or nil if there was none.
+func reconcileRoleMapping(amResp *k8s.LoadRoleMapResponse, acc aws.SsoRoleMapping) *audit.Mutation {
+	roleArn := fmt.Sprintf("arn:aws:iam::%s:role/%s", acc.AccountId, acc.RoleName)
+	mapping := amResp.GetMappingByArn(roleArn)
+	currentTime := time.Now()
+
+	// If no config-map entry for aws acc with role
+	if mapping == nil {
+		util.Logger.Info(fmt.Sprintf("No mapping for %s, creating.\n", acc.AccountAlias), zap.String("jobName", AwsToKubernetesName))
+		roleMapping := &k8s.RoleMapping{
+			RoleARN:     fmt.Sprintf("arn:aws:iam::%s:role/%s", acc.AccountId, acc.RoleName),
+			ManagedBy:   "aad-aws-sync",
+			LastUpdated: currentTime.Format(TIME_FORMAT),
+			CreatedAt:   currentTime.Format(TIME_FORMAT),
+			Username:    fmt.Sprintf("%s:sso-{{SessionName}}", acc.RootId),
+			Groups:      []string{"DFDS-ReadOnly", acc.RootId},
+		}
+		amResp.Mappings = append(amResp.Mappings, roleMapping)
+		mutation := roleMappingMutation(MutationAwsAuthRoleMappingChanged, roleArn, nil, roleMapping)
+		return &mutation
 	}
-	return nil
+
+	if roleMappingMatches(mapping, acc.RootId) {
+		return nil
+	}
+
+	util.Logger.Info(fmt.Sprintf("Config mismatch for %s detected, updating entry\n", acc.AccountAlias), zap.String("jobName", AwsToKubernetesName))
+	before := *mapping
+	mapping.Username = fmt.Sprintf("%s:sso-{{SessionName}}", acc.RootId)
+	mapping.Groups = []string{"DFDS-ReadOnly", acc.RootId}
+	mapping.LastUpdated = currentTime.Format(TIME_FORMAT)
+
+	mutation := roleMappingMutation(MutationAwsAuthRoleMappingChanged, roleArn, &before, mapping)
+	return &mutation
+}
+
+func roleMappingMutation(action string, roleArn string, before *k8s.RoleMapping, after *k8s.RoleMapping) audit.Mutation {
+	mutation := audit.Mutation{
+		System:    audit.SystemKubernetes,
+		Action:    action,
+		ObjectIds: map[string]string{"configMap": "kube-system/aws-auth", "roleArn": roleArn},
+	}
+	// Avoid typed nil pointers, which would show up as null in the audit record
+	if before != nil {
+		mutation.Before = before
+	}
+	if after != nil {
+		mutation.After = after
+	}
+
+	return mutation
+}
+
+// roleMappingMatches reports whether an aws-auth ConfigMap entry maps the Capability access role to the Capability's
+// username and groups.
+func roleMappingMatches(mapping *k8s.RoleMapping, rootId string) bool {
+	return mapping.Username == fmt.Sprintf("%s:sso-{{SessionName}}", rootId) &&
+		mapping.ContainsGroup("DFDS-ReadOnly") &&
+		mapping.ContainsGroup(rootId)
 }
 
 func removeArrayItem(s []*k8s.RoleMapping, i int) []*k8s.RoleMapping {
@@ -7,10 +7,15 @@ import (
 	daws "github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/identitystore"
 	"github.com/aws/aws-sdk-go-v2/service/ssoadmin"
 	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/joomcode/errorx"
+	"go.dfds.cloud/aad-aws-sync/internal/audit"
 	"go.dfds.cloud/aad-aws-sync/internal/aws"
 	dconfig "go.dfds.cloud/aad-aws-sync/internal/config"
+	"go.dfds.cloud/aad-aws-sync/internal/metrics"
+	"go.dfds.cloud/aad-aws-sync/internal/tracing"
 	"go.dfds.cloud/aad-aws-sync/internal/util"
 	"go.uber.org/zap"
 )
@@ -25,41 +30,24 @@ func AwsMappingHandler(ctx context.Context) error {
 		return err
 	}
 
-	var cfg daws.Config
-
-	cfg, err = config.LoadDefaultConfig(context.TODO(), config.WithRegion(conf.Aws.SsoRegion), config.WithHTTPClient(aws.CreateHttpClientWithoutKeepAlive()))
+	cfg, err := LoadAwsConfig(ctx, conf, AwsMappingName)
 	if err != nil {
-		return errors.New(fmt.Sprintf("unable to load SDK config, %v", err))
-	}
-
-	if conf.Aws.AssumableRoles.SsoManagementArn != "" {
-		stsClient := sts.NewFromConfig(cfg)
-		roleSessionName := fmt.Sprintf("aad-aws-sync-%s", AwsMappingName)
-
-		assumedRole, err := stsClient.AssumeRole(context.TODO(), &sts.AssumeRoleInput{RoleArn: &conf.Aws.AssumableRoles.SsoManagementArn, RoleSessionName: &roleSessionName})
-		if err != nil {
-			util.Logger.Debug(fmt.Sprintf("unable to assume role %s, %v", conf.Aws.AssumableRoles.SsoManagementArn, err))
-			return err
-		}
-
-		cfg, err = config.LoadDefaultConfig(context.TODO(), config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(*assumedRole.Credentials.AccessKeyId, *assumedRole.Credentials.SecretAccessKey, *assumedRole.Credentials.SessionToken)), config.WithRegion(conf.Aws.SsoRegion))
-		if err != nil {
-			return errors.New(fmt.Sprintf("unable to load SDK config, %v", err))
-		}
+		return err
 	}
 
 	ssoClient := ssoadmin.NewFromConfig(cfg)
 
-	manageSso, err := aws.InitManageSso(cfg, conf.Aws.IdentityStoreArn)
+	manageSso, err := aws.InitManageSso(ctx, cfg, conf.Aws.IdentityStoreArn)
 	if err != nil {
 		return err
 	}
 
 	// Capability PermissionSet
-	accountsWithMissingPermissionSet, err := manageSso.GetAccountsMissingCapabilityPermissionSet(ssoClient, conf.Aws.SsoInstanceArn, conf.Aws.CapabilityPermissionSetArn, CAPABILITY_GROUP_PREFIX, conf.Aws.AccountNamePrefix)
+	accountsWithMissingPermissionSet, err := manageSso.GetAccountsMissingCapabilityPermissionSet(ctx, ssoClient, conf.Aws.SsoInstanceArn, conf.Aws.CapabilityPermissionSetArn, CAPABILITY_GROUP_PREFIX, conf.Aws.AccountNamePrefix)
 	if err != nil {
 		return err
 	}
+	setDrift(AwsMappingName, audit.SystemAwsSso, DriftAccountsMissingPermissionSet, len(accountsWithMissingPermissionSet))
 
 	for _, resp := range accountsWithMissingPermissionSet {
 		select {
@@ -75,21 +63,26 @@ func AwsMappingHandler(ctx context.Context) error {
 		}
 
 		util.Logger.Info(fmt.Sprintf("Assigning Capability access to group %s for account %s\n", *resp.Group.DisplayName, *resp.Account.Name), zap.String("jobName", AwsMappingName))
-		_, err := ssoClient.CreateAccountAssignment(context.TODO(), &ssoadmin.CreateAccountAssignmentInput{
+		input := &ssoadmin.CreateAccountAssignmentInput{
 			InstanceArn:      &conf.Aws.SsoInstanceArn,
 			PermissionSetArn: &conf.Aws.CapabilityPermissionSetArn,
 			PrincipalId:      resp.Group.GroupId,
 			PrincipalType:    "GROUP",
 			TargetId:         resp.Account.Id,
 			TargetType:       "AWS_ACCOUNT",
+		}
+		err := mutate(ctx, func() error {
+			_, err := ssoClient.CreateAccountAssignment(ctx, input)
+			return err
 		})
+		RecordMutation(ctx, ssoAccountAssignmentMutation(input), err)
 		if err != nil {
 			return err
 		}
 	}
 
 	// CapabilityLog PermissionSet
-	err = addToSharedRole(manageSso, ssoClient, addToSharedRoleRequest{
+	err = addToSharedRole(ctx, manageSso, ssoClient, addToSharedRoleRequest{
 		Name:                "CapabilityLog",
 		AwsAccountNameAlias: conf.Aws.CapabilityLogsAwsAccountAlias,
 		PermissionSetArn:    conf.Aws.CapabilityLogsPermissionSetArn,
@@ -101,7 +94,7 @@ func AwsMappingHandler(ctx context.Context) error {
 	}
 
 	// Shared ECR pull PermissionSet
-	err = addToSharedRole(manageSso, ssoClient, addToSharedRoleRequest{
+	err = addToSharedRole(ctx, manageSso, ssoClient, addToSharedRoleRequest{
 		Name:                "SharedECRPull",
 		AwsAccountNameAlias: conf.Aws.SharedEcrPullAwsAccountAlias,
 		PermissionSetArn:    conf.Aws.SharedEcrPullPermissionSetArn,
@@ -115,13 +108,13 @@ func AwsMappingHandler(ctx context.Context) error {
 	return nil
 }
 
-func addToSharedRole(manageSso *aws.ManageSso, ssoClient *ssoadmin.Client, req addToSharedRoleRequest) error {
+func addToSharedRole(ctx context.Context, manageSso *aws.ManageSso, ssoClient *ssoadmin.Client, req addToSharedRoleRequest) error {
 	acc := manageSso.GetAccountByName(req.AwsAccountNameAlias)
 	if acc == nil {
 		return errors.New(fmt.Sprintf("Unable to find AWS account by alias %s", req.AwsAccountNameAlias))
 	}
 
-	resp, err := manageSso.GetGroupsNotAssignedToAccountWithPermissionSet(ssoClient, req.SsoInstanceArn, req.PermissionSetArn, *acc.Id, CAPABILITY_GROUP_PREFIX)
+	resp, err := manageSso.GetGroupsNotAssignedToAccountWithPermissionSet(ctx, ssoClient, req.SsoInstanceArn, req.PermissionSetArn, *acc.Id, CAPABILITY_GROUP_PREFIX)
 	if err != nil {
 		return err
 	}
@@ -146,14 +139,19 @@ func addToSharedRole(manageSso *aws.ManageSso, ssoClient *ssoadmin.Client, req a
 		}
 
 		util.Logger.Info(fmt.Sprintf("Assigning access to %s\n", *grp.DisplayName), zap.String("jobName", AwsMappingName), zap.String("permissionSet", req.Name))
-		_, err := ssoClient.CreateAccountAssignment(context.TODO(), &ssoadmin.CreateAccountAssignmentInput{
+		input := &ssoadmin.CreateAccountAssignmentInput{
 			InstanceArn:      &req.SsoInstanceArn,
 			PermissionSetArn: &req.PermissionSetArn,
 			PrincipalId:      grp.GroupId,
 			PrincipalType:    "GROUP",
 			TargetId:         acc.Id,
 			TargetType:       "AWS_ACCOUNT",
+		}
+		err := mutate(req.ctx, func() error {
+			_, err := ssoClient.CreateAccountAssignment(req.ctx, input)
+			return err
 		})
+		RecordMutation(req.ctx, ssoAccountAssignmentMutation(input), err)
 		if err != nil {
 			return err
 		}
@@ -162,6 +160,101 @@ func addToSharedRole(manageSso *aws.ManageSso, ssoClient *ssoadmin.Client, req a
 	return nil
 }
 
+// LoadAwsConfig loads the default AWS SDK config. If an SSO management role has been configured, the role is assumed
+// and the returned config uses its credentials.
+func LoadAwsConfig(ctx context.Context, conf dconfig.Config, jobName string) (daws.Config, error) {
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(conf.Aws.SsoRegion), config.WithHTTPClient(aws.CreateHttpClientWithoutKeepAlive()), config.WithAPIOptions(metrics.AwsApiOptions), config.WithAPIOptions(tracing.AwsApiOptions))
+	if err != nil {
+		return cfg, errors.New(fmt.Sprintf("unable to load SDK config, %v", err))
+	}
+
+	if conf.Aws.AssumableRoles.SsoManagementArn != "" {
+		stsClient := sts.NewFromConfig(cfg)
+		roleSessionName := fmt.Sprintf("aad-aws-sync-%s", jobName)
+
+		assumedRole, err := stsClient.AssumeRole(ctx, &sts.AssumeRoleInput{RoleArn: &conf.Aws.AssumableRoles.SsoManagementArn, RoleSessionName: &roleSessionName})
+		if err != nil {
+			util.Logger.Info(fmt.Sprintf("unable to assume role %s, %v", conf.Aws.AssumableRoles.SsoManagementArn, err), zap.String("jobName", jobName))
+			return cfg, err
+		}
+
+		cfg, err = config.LoadDefaultConfig(ctx, config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(*assumedRole.Credentials.AccessKeyId, *assumedRole.Credentials.SecretAccessKey, *assumedRole.Credentials.SessionToken)), config.WithRegion(conf.Aws.SsoRegion), config.WithAPIOptions(metrics.AwsApiOptions), config.WithAPIOptions(tracing.AwsApiOptions))
+		if err != nil {
+			return cfg, errors.New(fmt.Sprintf("unable to load SDK config, %v", err))
+		}
+	}
+
+	return cfg, nil
+}
+
+// AssignCapabilityPermissionSet assigns the Capability permission set to the SSO group of a Capability in the given
+// AWS account, and waits for the assignment to be provisioned. Nothing is done if the assignment already exists.
+func AssignCapabilityPermissionSet(ctx context.Context, ssoClient *ssoadmin.Client, identityStoreClient *identitystore.Client, conf dconfig.Config, rootId string, accountId string) error {
+	return AssignGroupPermissionSet(ctx, ssoClient, identityStoreClient, conf, rootId, conf.Aws.CapabilityPermissionSetArn, accountId)
+}
+
+// AssignGroupPermissionSet assigns a permission set to the SSO group of a Capability in the given AWS account, and
+// waits for the assignment to be provisioned. Nothing is done if the assignment already exists.
+func AssignGroupPermissionSet(ctx context.Context, ssoClient *ssoadmin.Client, identityStoreClient *identitystore.Client, conf dconfig.Config, rootId string, permissionSetArn string, accountId string) error {
+	groupName := fmt.Sprintf("%s %s", CAPABILITY_GROUP_PREFIX, rootId)
+	group, err := aws.GetGroupByDisplayName(ctx, identityStoreClient, conf.Aws.IdentityStoreArn, groupName)
+	if err != nil {
+		return err
+	}
+	if group == nil {
+		return SsoGroupNotFound.New(fmt.Sprintf("SSO group %s not found", groupName))
+	}
+
+	assignments, err := aws.GetAssignedForPermissionSetInAccount(ctx, ssoClient, conf.Aws.SsoInstanceArn, permissionSetArn, accountId)
+	if err != nil {
+		return err
+	}
+
+	for _, assignment := range assignments {
+		if assignment.PrincipalType == "GROUP" && *assignment.PrincipalId == *group.GroupId {
+			return nil
+		}
+	}
+
+	util.Logger.Info(fmt.Sprintf("Assigning permission set %s to group %s for account %s", permissionSetArn, groupName, accountId), zap.String("jobName", AwsMappingName))
+	input := &ssoadmin.CreateAccountAssignmentInput{
+		InstanceArn:      &conf.Aws.SsoInstanceArn,
+		PermissionSetArn: &permissionSetArn,
+		PrincipalId:      group.GroupId,
+		PrincipalType:    "GROUP",
+		TargetId:         &accountId,
+		TargetType:       "AWS_ACCOUNT",
+	}
+	err = mutate(ctx, func() error {
+		resp, err := ssoClient.CreateAccountAssignment(ctx, input)
+		if err != nil {
+			return err
+		}
+		return aws.WaitForAccountAssignmentCreation(ctx, ssoClient, conf.Aws.SsoInstanceArn, *resp.AccountAssignmentCreationStatus.RequestId)
+	})
+	RecordMutation(ctx, ssoAccountAssignmentMutation(input), err)
+
+	return err
+}
+
+func ssoAccountAssignmentMutation(input *ssoadmin.CreateAccountAssignmentInput) audit.Mutation {
+	return audit.Mutation{
+		System: audit.SystemAwsSso,
+		Action: MutationSsoAccountAssignmentCreated,
+		ObjectIds: map[string]string{
+			"permissionSetArn": daws.ToString(input.PermissionSetArn),
+			"principalId":      daws.ToString(input.PrincipalId),
+			"accountId":        daws.ToString(input.TargetId),
+		},
+		After: input,
+	}
+}
+
+var (
+	AwsMappingError  = errorx.NewNamespace("awsMapping")
+	SsoGroupNotFound = AwsMappingError.NewType("sso_group_not_found")
+)
+
 type addToSharedRoleRequest struct {
 	Name                string
 	AwsAccountNameAlias string
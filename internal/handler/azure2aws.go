@@ -3,6 +3,7 @@ package handler
 import (
 	"context"
 	"fmt"
+	"go.dfds.cloud/aad-aws-sync/internal/audit"
 	"go.dfds.cloud/aad-aws-sync/internal/azure"
 	"go.dfds.cloud/aad-aws-sync/internal/capsvc"
 	"go.dfds.cloud/aad-aws-sync/internal/config"
@@ -22,6 +23,7 @@ func Azure2AwsHandler(ctx context.Context) error {
 		TenantId:     conf.Azure.TenantId,
 		ClientId:     conf.Azure.ClientId,
 		ClientSecret: conf.Azure.ClientSecret,
+		Auth:         conf.Azure.Auth,
 	})
 
 	capabilitiesByRootId := make(map[string]*capsvc.GetCapabilitiesResponseContextCapability)
@@ -30,10 +32,11 @@ func Azure2AwsHandler(ctx context.Context) error {
 		TenantId:     conf.Azure.TenantId,
 		ClientId:     conf.CapSvc.ClientId,
 		ClientSecret: conf.CapSvc.ClientSecret,
+		Auth:         conf.CapSvc.Auth,
 		Scope:        conf.CapSvc.TokenScope,
 	})
 
-	capabilities, err := ssuClient.GetCapabilities()
+	capabilities, err := ssuClient.GetCapabilities(ctx)
 	if err != nil {
 		return err
 	}
@@ -45,7 +48,7 @@ func Azure2AwsHandler(ctx context.Context) error {
 		}
 	}
 
-	appRoles, err := azClient.GetApplicationRoles(conf.Azure.ApplicationId)
+	appRoles, err := azClient.GetApplicationRoles(ctx, conf.Azure.ApplicationId)
 	if err != nil {
 		return err
 	}
@@ -55,12 +58,12 @@ func Azure2AwsHandler(ctx context.Context) error {
 		return err
 	}
 
-	appAssignments, err := azClient.GetAssignmentsForApplication(conf.Azure.ApplicationObjectId)
+	appAssignments, err := azClient.GetAssignmentsForApplication(ctx, conf.Azure.ApplicationObjectId)
 	if err != nil {
 		return err
 	}
 
-	groups, err := azClient.GetGroups(azure.AZURE_CAPABILITY_GROUP_PREFIX)
+	groups, err := azClient.GetGroups(ctx, azure.AZURE_CAPABILITY_GROUP_PREFIX)
 	if err != nil {
 		return err
 	}
@@ -83,7 +86,7 @@ func Azure2AwsHandler(ctx context.Context) error {
 		// If group is not already assigned to enterprise application, assign them.
 		if !appAssignments.ContainsGroup(group.DisplayName) {
 			util.Logger.Info(fmt.Sprintf("Group %s has not been assigned to application yet, assigning", group.DisplayName), zap.String("jobName", AzureAdToAwsName))
-			_, err := azClient.AssignGroupToApplication(conf.Azure.ApplicationObjectId, group.ID, appRoleId)
+			err := AssignGroupToApplication(ctx, azClient, conf.Azure.ApplicationObjectId, group.ID, appRoleId)
 			if err != nil {
 				return err
 			}
@@ -92,3 +95,25 @@ func Azure2AwsHandler(ctx context.Context) error {
 
 	return nil
 }
+
+// AssignGroupToApplication assigns an AAD group to an enterprise application with the given app role.
+func AssignGroupToApplication(ctx context.Context, azClient *azure.Client, appObjectId string, groupId string, appRoleId string) error {
+	var assignment *azure.AssignGroupToApplicationResponse
+	err := mutate(ctx, func() error {
+		var err error
+		assignment, err = azClient.AssignGroupToApplication(ctx, appObjectId, groupId, appRoleId)
+		return err
+	})
+	mutation := audit.Mutation{
+		System:    audit.SystemAzureAd,
+		Action:    MutationAppAssignmentCreated,
+		ObjectIds: map[string]string{"applicationObjectId": appObjectId, "groupId": groupId, "appRoleId": appRoleId},
+	}
+	if assignment != nil {
+		mutation.ObjectIds["assignmentId"] = assignment.ID
+		mutation.After = assignment
+	}
+	RecordMutation(ctx, mutation, err)
+
+	return err
+}
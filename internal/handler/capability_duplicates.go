@@ -0,0 +1,311 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/identitystore"
+	"go.dfds.cloud/aad-aws-sync/internal/audit"
+	"go.dfds.cloud/aad-aws-sync/internal/aws"
+	"go.dfds.cloud/aad-aws-sync/internal/azure"
+	"go.dfds.cloud/aad-aws-sync/internal/capsvc"
+	"go.dfds.cloud/aad-aws-sync/internal/config"
+	"go.dfds.cloud/aad-aws-sync/internal/store"
+	"go.dfds.cloud/aad-aws-sync/internal/util"
+	"go.uber.org/zap"
+)
+
+// DuplicateGroupsReport is what was done about the duplicated AAD groups of Capabilities in a run of capSvc2Aad.
+type DuplicateGroupsReport struct {
+	CreatedAt time.Time `json:"createdAt"`
+	// ReportOnly is set if the duplicates were only reported, see config.Handler.Capsvc2Aad.ReportDuplicatesOnly
+	ReportOnly   bool                         `json:"reportOnly"`
+	Capabilities []*CapabilityDuplicateGroups `json:"capabilities"`
+}
+
+// CapabilityDuplicateGroups are the duplicated AAD groups of a Capability, and the group kept of them.
+type CapabilityDuplicateGroups struct {
+	CapabilityRootId string            `json:"capabilityRootId"`
+	Survivor         *DuplicateGroup   `json:"survivor"`
+	Duplicates       []*DuplicateGroup `json:"duplicates"`
+}
+
+// DuplicateGroup is a duplicated AAD group of a Capability.
+type DuplicateGroup struct {
+	ID              string    `json:"id"`
+	DisplayName     string    `json:"displayName"`
+	CreatedDateTime time.Time `json:"createdDateTime"`
+	Bound           bool      `json:"bound"`
+	// IdentityStoreGroupId is the group the AAD group was provisioned as in the AWS Identity Store
+	IdentityStoreGroupId string `json:"identityStoreGroupId,omitempty"`
+	// MergedMembers are the members only the duplicate had, added to the survivor
+	MergedMembers []*azure.Member `json:"mergedMembers,omitempty"`
+	// MovedAppAssignments are the app roles the duplicate was assigned to, assigned to the survivor
+	MovedAppAssignments []*azure.GetAssignmentsForApplicationResponseAssignment `json:"movedAppAssignments,omitempty"`
+	// Kept explains why the duplicate wasn't removed, if it wasn't
+	Kept    string `json:"kept,omitempty"`
+	Removed bool   `json:"removed"`
+
+	members     []*azure.Member
+	assignments []*azure.GetAssignmentsForApplicationResponseAssignment
+}
+
+// IdentityStoreGroups returns the IDs of the AWS Identity Store groups AAD groups were provisioned as, by the ID of
+// the AAD group. Returns nil if the Identity Store can't be checked, as it isn't configured.
+type IdentityStoreGroups func(ctx context.Context) (map[string]string, error)
+
+// AwsIdentityStoreGroups looks up the Identity Store groups provisioned from AAD by their external ID, which Entra ID
+// provisioning sets to the object ID of the AAD group. The groups are only read once.
+func AwsIdentityStoreGroups(conf config.Config) IdentityStoreGroups {
+	var byExternalId map[string]string
+	return func(ctx context.Context) (map[string]string, error) {
+		if conf.Aws.IdentityStoreArn == "" || byExternalId != nil {
+			return byExternalId, nil
+		}
+
+		cfg, err := LoadAwsConfig(ctx, conf, CapabilityServiceToAzureAdName)
+		if err != nil {
+			return nil, err
+		}
+
+		groups, err := aws.GetGroups(ctx, identitystore.NewFromConfig(cfg), conf.Aws.IdentityStoreArn)
+		if err != nil {
+			return nil, err
+		}
+
+		byExternalId = map[string]string{}
+		for _, group := range groups {
+			for _, externalId := range group.ExternalIds {
+				if externalId.Id != nil && group.GroupId != nil {
+					byExternalId[*externalId.Id] = *group.GroupId
+				}
+			}
+		}
+
+		return byExternalId, nil
+	}
+}
+
+// findDuplicateGroupsAndEliminate removes the duplicated AAD groups of Capabilities. The members only a duplicate had
+// are added to the group that is kept, and before it is removed, it is replaced by that group in its app assignments.
+// Duplicates that were provisioned to the AWS Identity Store are kept, as removing them would remove the account
+// assignments of their Identity Store group; their stale members are removed when the members of the Capability are
+// reconciled. With reportOnly, duplicates are only reported.
+//
+// A report of the duplicates is saved to the state store, unless in a dry run.
+func findDuplicateGroupsAndEliminate(ctx context.Context, client *azure.Client, aUnitId string, groups *azure.GetAdministrativeUnitMembersResponse, capabilities []*capsvc.GetCapabilitiesResponseContextCapability, lookupIdentityStoreGroups IdentityStoreGroups, reportOnly bool) error {
+	report := &DuplicateGroupsReport{CreatedAt: time.Now(), ReportOnly: reportOnly, Capabilities: []*CapabilityDuplicateGroups{}}
+
+	var provisioned map[string]string
+	for _, capability := range capabilities {
+		matches := CapabilityGroupsOf(groups.Value, capability.RootID)
+		if len(matches) < 2 {
+			continue
+		}
+		util.Logger.Info(fmt.Sprintf("Duplicate groups found for Capability %s", capability.RootID), zap.String("jobName", CapabilityServiceToAzureAdName))
+
+		// The Identity Store is only read if there are duplicates
+		if provisioned == nil {
+			var err error
+			provisioned, err = lookupIdentityStoreGroups(ctx)
+			if err != nil {
+				return err
+			}
+			if provisioned == nil {
+				util.Logger.Warn("The AWS Identity Store isn't configured, keeping duplicate groups", zap.String("jobName", CapabilityServiceToAzureAdName))
+				provisioned = map[string]string{}
+				reportOnly = true
+				report.ReportOnly = true
+			}
+		}
+
+		duplicates := make([]*DuplicateGroup, 0, len(matches))
+		for _, match := range matches {
+			group, err := client.GetGroupWithMembers(ctx, match.ID, match.DisplayName)
+			if err != nil {
+				return err
+			}
+			assignments, err := client.GetGroupAppRoleAssignments(ctx, match.ID)
+			if err != nil {
+				return err
+			}
+			duplicates = append(duplicates, &DuplicateGroup{
+				ID:                   match.ID,
+				DisplayName:          match.DisplayName,
+				CreatedDateTime:      match.CreatedDateTime,
+				Bound:                match.CapabilityRootId != "",
+				IdentityStoreGroupId: provisioned[match.ID],
+				members:              group.Members,
+				assignments:          assignments,
+			})
+		}
+
+		capabilityReport := planDuplicateGroups(capability.RootID, duplicates)
+		report.Capabilities = append(report.Capabilities, capabilityReport)
+		if reportOnly {
+			continue
+		}
+
+		if err := eliminateDuplicateGroups(ctx, client, aUnitId, capabilityReport); err != nil {
+			return err
+		}
+	}
+
+	if len(report.Capabilities) == 0 || IsDryRun(ctx) {
+		return nil
+	}
+
+	return store.Default().Put(store.BucketDuplicateGroups, store.TimeKey(report.CreatedAt), report)
+}
+
+// planDuplicateGroups chooses the group of a Capability that is kept of its duplicates, ranked like CapabilityGroupOf
+// does. It works out the members and app assignments to move to it from the other groups, and which of them can be
+// removed.
+func planDuplicateGroups(rootId string, duplicates []*DuplicateGroup) *CapabilityDuplicateGroups {
+	rank := func(duplicate *DuplicateGroup) capabilityGroupRank {
+		return capabilityGroupRank{provisioned: duplicate.IdentityStoreGroupId != "", bound: duplicate.Bound, created: duplicate.CreatedDateTime}
+	}
+	sorted := append([]*DuplicateGroup{}, duplicates...)
+	sort.SliceStable(sorted, func(i, j int) bool { return rank(sorted[i]).keptOver(rank(sorted[j])) })
+
+	survivor := sorted[0]
+	plan := &CapabilityDuplicateGroups{CapabilityRootId: rootId, Survivor: survivor, Duplicates: sorted[1:]}
+
+	members := map[string]bool{}
+	for _, member := range survivor.members {
+		members[member.ID] = true
+	}
+	assignments := map[string]bool{}
+	for _, assignment := range survivor.assignments {
+		assignments[assignment.ResourceID+"/"+assignment.AppRoleID] = true
+	}
+
+	for _, duplicate := range plan.Duplicates {
+		for _, member := range duplicate.members {
+			if !members[member.ID] {
+				members[member.ID] = true
+				duplicate.MergedMembers = append(duplicate.MergedMembers, member)
+			}
+		}
+		if duplicate.IdentityStoreGroupId != "" {
+			duplicate.Kept = fmt.Sprintf("provisioned to the AWS Identity Store as group %s", duplicate.IdentityStoreGroupId)
+			continue
+		}
+
+		for _, assignment := range duplicate.assignments {
+			key := assignment.ResourceID + "/" + assignment.AppRoleID
+			if !assignments[key] {
+				assignments[key] = true
+				duplicate.MovedAppAssignments = append(duplicate.MovedAppAssignments, assignment)
+			}
+		}
+	}
+
+	return plan
+}
+
+// eliminateDuplicateGroups moves the members and app assignments of the duplicates of a Capability to the group that
+// is kept, and removes the duplicates, as planned by planDuplicateGroups. Duplicates that are kept only have their
+// members merged.
+func eliminateDuplicateGroups(ctx context.Context, client *azure.Client, aUnitId string, plan *CapabilityDuplicateGroups) error {
+	survivor := plan.Survivor
+	for _, duplicate := range plan.Duplicates {
+		if len(duplicate.MergedMembers) > 0 {
+			userIds := make([]string, 0, len(duplicate.MergedMembers))
+			for _, member := range duplicate.MergedMembers {
+				userIds = append(userIds, member.ID)
+			}
+			var addErrs map[string]error
+			err := mutate(ctx, func() (err error) {
+				addErrs, err = client.AddGroupMembers(ctx, survivor.ID, userIds)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			for _, member := range duplicate.MergedMembers {
+				RecordMutation(ctx, MembershipMutation(audit.SystemAzureAd, MutationAadGroupMemberAdded, map[string]string{"groupId": survivor.ID, "userId": member.ID, "userPrincipalName": member.UserPrincipalName, "duplicateGroupId": duplicate.ID}, true), addErrs[member.ID])
+			}
+			// Members would be lost with the duplicate
+			if len(addErrs) > 0 && duplicate.Kept == "" {
+				duplicate.Kept = fmt.Sprintf("%d of its members couldn't be added to group %s", len(addErrs), survivor.ID)
+			}
+		}
+		if duplicate.Kept != "" {
+			util.Logger.Warn(fmt.Sprintf("Keeping duplicate group %s (%s) of Capability %s, %s", duplicate.ID, duplicate.DisplayName, plan.CapabilityRootId, duplicate.Kept), zap.String("jobName", CapabilityServiceToAzureAdName))
+			continue
+		}
+
+		for _, assignment := range duplicate.MovedAppAssignments {
+			if err := AssignGroupToApplication(ctx, client, assignment.ResourceID, survivor.ID, assignment.AppRoleID); err != nil {
+				return err
+			}
+		}
+
+		util.Logger.Info(fmt.Sprintf("Removing duplicate group %s (%s) of Capability %s, keeping %s", duplicate.ID, duplicate.DisplayName, plan.CapabilityRootId, survivor.ID), zap.String("jobName", CapabilityServiceToAzureAdName))
+		err := mutate(ctx, func() error { return client.DeleteAdministrativeUnitGroup(ctx, aUnitId, duplicate.ID) })
+		RecordMutation(ctx, audit.Mutation{
+			System:    audit.SystemAzureAd,
+			Action:    MutationAadGroupDeleted,
+			ObjectIds: map[string]string{"administrativeUnitId": aUnitId, "groupId": duplicate.ID, "survivorGroupId": survivor.ID},
+			Before:    duplicate,
+		}, err)
+		if err != nil {
+			return err
+		}
+		duplicate.Removed = !IsDryRun(ctx)
+	}
+
+	return nil
+}
+
+// removedDuplicateGroups returns the IDs of the groups removed as duplicates of the group of a Capability, see
+// eliminateDuplicateGroups.
+func removedDuplicateGroups(st store.Store) (map[string]bool, error) {
+	reports, err := LoadDuplicateGroupsReports(st, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	removed := map[string]bool{}
+	for _, report := range reports {
+		for _, capability := range report.Capabilities {
+			for _, duplicate := range capability.Duplicates {
+				if duplicate.Removed {
+					removed[duplicate.ID] = true
+				}
+			}
+		}
+	}
+
+	return removed, nil
+}
+
+// LoadDuplicateGroupsReports returns the latest reports of duplicated Capability groups, newest first.
+func LoadDuplicateGroupsReports(st store.Store, limit int) ([]*DuplicateGroupsReport, error) {
+	var reports []*DuplicateGroupsReport
+	err := st.List(store.BucketDuplicateGroups, "", func(key string, value []byte) error {
+		var report DuplicateGroupsReport
+		if err := json.Unmarshal(value, &report); err != nil {
+			return err
+		}
+		reports = append(reports, &report)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Keys sort chronologically
+	for i, j := 0, len(reports)-1; i < j; i, j = i+1, j-1 {
+		reports[i], reports[j] = reports[j], reports[i]
+	}
+	if limit > 0 && len(reports) > limit {
+		reports = reports[:limit]
+	}
+
+	return reports, nil
+}
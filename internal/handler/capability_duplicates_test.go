@@ -0,0 +1,101 @@
+package handler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.dfds.cloud/aad-aws-sync/internal/azure"
+	"go.dfds.cloud/aad-aws-sync/internal/store"
+)
+
+func TestPlanDuplicateGroups(t *testing.T) {
+	created := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	one := &azure.Member{ID: "1", UserPrincipalName: "one@dfds.com"}
+	two := &azure.Member{ID: "2", UserPrincipalName: "two@dfds.com"}
+	awsApp := &azure.GetAssignmentsForApplicationResponseAssignment{ResourceID: "aws", AppRoleID: "user"}
+	otherApp := &azure.GetAssignmentsForApplicationResponseAssignment{ResourceID: "other", AppRoleID: "user"}
+
+	oldest := &DuplicateGroup{ID: "oldest", CreatedDateTime: created, members: []*azure.Member{one}, assignments: []*azure.GetAssignmentsForApplicationResponseAssignment{awsApp}}
+	newer := &DuplicateGroup{ID: "newer", CreatedDateTime: created.Add(time.Hour), members: []*azure.Member{one, two}, assignments: []*azure.GetAssignmentsForApplicationResponseAssignment{awsApp, otherApp}}
+
+	// The oldest group is kept, and gets the members and app assignments only the newer one had
+	plan := planDuplicateGroups("sandbox-abcde", []*DuplicateGroup{newer, oldest})
+	assert.Equal(t, "oldest", plan.Survivor.ID)
+	assert.Len(t, plan.Duplicates, 1)
+	assert.Equal(t, []*azure.Member{two}, plan.Duplicates[0].MergedMembers)
+	assert.Equal(t, []*azure.GetAssignmentsForApplicationResponseAssignment{otherApp}, plan.Duplicates[0].MovedAppAssignments)
+	assert.Empty(t, plan.Duplicates[0].Kept)
+}
+
+func TestPlanDuplicateGroupsSurvivor(t *testing.T) {
+	created := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	newGroup := func(id string, age time.Duration) *DuplicateGroup {
+		return &DuplicateGroup{ID: id, CreatedDateTime: created.Add(-age)}
+	}
+
+	// A group provisioned to the AWS Identity Store is kept over older groups
+	oldest := newGroup("oldest", 2*time.Hour)
+	provisioned := newGroup("provisioned", time.Hour)
+	provisioned.IdentityStoreGroupId = "aws-group"
+	plan := planDuplicateGroups("sandbox-abcde", []*DuplicateGroup{oldest, provisioned})
+	assert.Equal(t, "provisioned", plan.Survivor.ID)
+
+	// A group provisioned to the AWS Identity Store is kept over a newer bound group, as AWS access is granted through it
+	bound := newGroup("bound", 0)
+	bound.Bound = true
+	plan = planDuplicateGroups("sandbox-abcde", []*DuplicateGroup{newGroup("oldest", 2*time.Hour), bound, provisioned})
+	assert.Equal(t, "provisioned", plan.Survivor.ID)
+	assert.Equal(t, "bound", plan.Duplicates[0].ID)
+	assert.Equal(t, "oldest", plan.Duplicates[1].ID)
+
+	// Without provisioned groups, the bound group is kept over older groups
+	plan = planDuplicateGroups("sandbox-abcde", []*DuplicateGroup{newGroup("oldest", 2*time.Hour), bound})
+	assert.Equal(t, "bound", plan.Survivor.ID)
+}
+
+func TestPlanDuplicateGroupsKept(t *testing.T) {
+	created := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	one := &azure.Member{ID: "1", UserPrincipalName: "one@dfds.com"}
+	two := &azure.Member{ID: "2", UserPrincipalName: "two@dfds.com"}
+	awsApp := &azure.GetAssignmentsForApplicationResponseAssignment{ResourceID: "aws", AppRoleID: "user"}
+
+	survivor := &DuplicateGroup{ID: "survivor", CreatedDateTime: created, IdentityStoreGroupId: "aws-group", members: []*azure.Member{one}}
+	provisioned := &DuplicateGroup{ID: "provisioned", CreatedDateTime: created.Add(time.Hour), IdentityStoreGroupId: "other-aws-group", members: []*azure.Member{one, two}, assignments: []*azure.GetAssignmentsForApplicationResponseAssignment{awsApp}}
+
+	// A duplicate provisioned to the AWS Identity Store is kept, but its members are still merged
+	plan := planDuplicateGroups("sandbox-abcde", []*DuplicateGroup{provisioned, survivor})
+	assert.Equal(t, "survivor", plan.Survivor.ID)
+	assert.Contains(t, plan.Duplicates[0].Kept, "other-aws-group")
+	assert.Equal(t, []*azure.Member{two}, plan.Duplicates[0].MergedMembers)
+	assert.Empty(t, plan.Duplicates[0].MovedAppAssignments)
+}
+
+func TestLoadDuplicateGroupsReports(t *testing.T) {
+	st := store.NewMemoryStore()
+	created := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		report := DuplicateGroupsReport{CreatedAt: created.Add(time.Duration(i) * time.Hour)}
+		assert.NoError(t, st.Put(store.BucketDuplicateGroups, store.TimeKey(report.CreatedAt), report))
+	}
+
+	reports, err := LoadDuplicateGroupsReports(st, 2)
+	assert.NoError(t, err)
+	assert.Len(t, reports, 2)
+	assert.Equal(t, created.Add(2*time.Hour), reports[0].CreatedAt)
+	assert.Equal(t, created.Add(time.Hour), reports[1].CreatedAt)
+}
+
+func TestRemovedDuplicateGroups(t *testing.T) {
+	st := store.NewMemoryStore()
+	report := DuplicateGroupsReport{CreatedAt: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC), Capabilities: []*CapabilityDuplicateGroups{{
+		CapabilityRootId: "sandbox-abcde",
+		Survivor:         &DuplicateGroup{ID: "survivor"},
+		Duplicates:       []*DuplicateGroup{{ID: "removed", Removed: true}, {ID: "kept", Kept: "provisioned to the AWS Identity Store as group aws-group"}},
+	}}}
+	assert.NoError(t, st.Put(store.BucketDuplicateGroups, store.TimeKey(report.CreatedAt), report))
+
+	removed, err := removedDuplicateGroups(st)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]bool{"removed": true}, removed)
+}
@@ -9,11 +9,13 @@ import (
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.dfds.cloud/aad-aws-sync/internal/audit"
 	"go.dfds.cloud/aad-aws-sync/internal/azure"
 	"go.dfds.cloud/aad-aws-sync/internal/capsvc"
 	"go.dfds.cloud/aad-aws-sync/internal/config"
 	"go.dfds.cloud/aad-aws-sync/internal/ssu_exchange"
 	"go.dfds.cloud/aad-aws-sync/internal/ssu_exchange/direct"
+	"go.dfds.cloud/aad-aws-sync/internal/store"
 	"go.dfds.cloud/aad-aws-sync/internal/util"
 	"go.uber.org/zap"
 	"golang.org/x/sync/semaphore"
@@ -43,6 +45,12 @@ func NewAlias(displayName string, emailAliasValue string, addCapabilityMembers b
 	}
 }
 
+// GroupDisplayName returns the name of the distribution group backing the alias for the given Capability, without
+// the CI_SSU_Ex prefix.
+func (a Alias) GroupDisplayName(rootId string) string {
+	return fmt.Sprintf("%s %s", rootId, a.DisplayName)
+}
+
 var metricTotalEmailAliasCount = promauto.NewGauge(prometheus.GaugeOpts{
 	Name:      "exchange_email_aliases_count",
 	Help:      "Current email aliases",
@@ -92,6 +100,7 @@ func CapabilityEmailAliasHandler(ctx context.Context) error {
 		TenantId:     conf.Azure.TenantId,
 		ClientId:     conf.CapSvc.ClientId,
 		ClientSecret: conf.CapSvc.ClientSecret,
+		Auth:         conf.CapSvc.Auth,
 		Scope:        conf.CapSvc.TokenScope,
 	})
 
@@ -107,6 +116,7 @@ func CapabilityEmailAliasHandler(ctx context.Context) error {
 		TenantId:     conf.Azure.TenantId,
 		ClientId:     conf.Exchange.ClientId,
 		ClientSecret: conf.Exchange.ClientSecret,
+		Auth:         conf.Exchange.Auth,
 		BaseUrl:      conf.Exchange.BaseUrl,
 		ManagedBy:    conf.Exchange.ManagedBy,
 		EmailSuffix:  conf.Exchange.EmailSuffix,
@@ -116,6 +126,7 @@ func CapabilityEmailAliasHandler(ctx context.Context) error {
 		TenantId:             conf.Azure.TenantId,
 		ClientId:             conf.Azure.ClientId,
 		ClientSecret:         conf.Azure.ClientSecret,
+		Auth:                 conf.Azure.Auth,
 		InternalDomainSuffix: conf.Azure.InternalDomainSuffix,
 	})
 
@@ -128,7 +139,7 @@ func CapabilityEmailAliasHandler(ctx context.Context) error {
 		Config:               conf,
 	}
 
-	capabilities, err := handler.CapSvcClient.GetCapabilities()
+	capabilities, err := handler.CapSvcClient.GetCapabilities(ctx)
 	if err != nil {
 		return err
 	}
@@ -137,8 +148,6 @@ func CapabilityEmailAliasHandler(ctx context.Context) error {
 
 	// Get aliases from Exchange
 	aliases, err := ssuClient.GetAliases(ctx)
-	var aliasesByDisplayName map[string]ssu_exchange.GetAliasesResponse = make(map[string]ssu_exchange.GetAliasesResponse)
-	var aliasesByEmail map[string]ssu_exchange.GetAliasesResponse = make(map[string]ssu_exchange.GetAliasesResponse)
 	if err != nil {
 		return err
 	}
@@ -148,28 +157,28 @@ func CapabilityEmailAliasHandler(ctx context.Context) error {
 	}
 
 	metricTotalEmailAliasCount.Set(float64(len(aliases)))
-	// Put aliases in map
-	for _, alias := range aliases {
-		aliasesByDisplayName[alias.Identity] = alias
-		aliasesByEmail[alias.WindowsEmailAddress] = alias
-	}
-
-	handlerState := &state{
-		EmailAliasesByDisplayName:               aliasesByDisplayName,
-		EmailAliasesByEmail:                     aliasesByEmail,
-		EmailAliasesWithoutCapabilities:         map[string]ssu_exchange.GetAliasesResponse{},
-		DistributionsGroupsInAzureByDisplayName: map[string]*azure.Group{},
-		MissingAliases:                          []*missingAliasContainer{},
-	}
-	handler.State = handlerState
+	handler.State = newEmailAliasState(aliases)
 
 	// Get corresponding groups in Azure for aliases
-	azureGroupsResp, err := azClient.GetGroups("CI_SSU_Ex")
-	if err != nil {
-		return err
-	}
+	if conf.Azure.DeltaSync {
+		groups, err := azure.NewGroupCache(azClient, store.Default(), "CI_SSU_Ex").Groups(ctx)
+		if err != nil {
+			return err
+		}
+		for _, group := range groups {
+			handler.State.DistributionsGroupsInAzureByDisplayName[group.DisplayName] = group
+		}
+	} else {
+		azureGroupsResp, err := azClient.GetGroups(ctx, "CI_SSU_Ex")
+		if err != nil {
+			return err
+		}
 
-	handler.PopulateGroupsWithMembers(ctx, azureGroupsResp)
+		err = handler.PopulateGroupsWithMembers(ctx, azureGroupsResp)
+		if err != nil {
+			return err
+		}
+	}
 
 	//
 	// SETUP END
@@ -192,6 +201,24 @@ func CapabilityEmailAliasHandler(ctx context.Context) error {
 	return nil
 }
 
+// newEmailAliasState indexes the email aliases in Exchange Online by display name and email address.
+func newEmailAliasState(aliases []ssu_exchange.GetAliasesResponse) *state {
+	handlerState := &state{
+		EmailAliasesByDisplayName:               map[string]ssu_exchange.GetAliasesResponse{},
+		EmailAliasesByEmail:                     map[string]ssu_exchange.GetAliasesResponse{},
+		EmailAliasesWithoutCapabilities:         map[string]ssu_exchange.GetAliasesResponse{},
+		DistributionsGroupsInAzureByDisplayName: map[string]*azure.Group{},
+		MissingAliases:                          []*missingAliasContainer{},
+	}
+
+	for _, alias := range aliases {
+		handlerState.EmailAliasesByDisplayName[alias.Identity] = alias
+		handlerState.EmailAliasesByEmail[alias.WindowsEmailAddress] = alias
+	}
+
+	return handlerState
+}
+
 type capabilityEmailAliasHandler struct {
 	CapSvcClient         *capsvc.Client
 	ExchangeOnlineClient ssu_exchange.IClient
@@ -217,15 +244,11 @@ func (c *capabilityEmailAliasHandler) ReconcileMainAlias(ctx context.Context) er
 
 			newMembers := []capsvc.GetCapabilitiesResponseContextCapabilityMember{}
 			for _, member := range capaWithCcMembers.Members {
-				if c.AzClient.IsUserExternal(member.Email) {
-					resp, err := c.AzClient.GetUserViaEmail(member.Email)
-					if err != nil {
-						return err
-					}
-					newMembers = append(newMembers, capsvc.GetCapabilitiesResponseContextCapabilityMember{Email: resp.UserPrincipalName})
-				} else {
-					newMembers = append(newMembers, member)
+				upn, err := ResolveExchangeMember(ctx, c.AzClient, member.Email)
+				if err != nil {
+					return err
 				}
+				newMembers = append(newMembers, capsvc.GetCapabilitiesResponseContextCapabilityMember{Email: upn})
 			}
 			capaWithCcMembers.Members = newMembers
 
@@ -237,9 +260,12 @@ func (c *capabilityEmailAliasHandler) ReconcileMainAlias(ctx context.Context) er
 			for _, capabilityMember := range capaWithCcMembers.Members {
 				if !dstGroup.HasMember(capabilityMember.Email) {
 					c.Logger.Info(fmt.Sprintf("%s missing from exchange alias %s, adding", capabilityMember.Email, capa.RootID))
-					err := c.ExchangeOnlineClient.AddDistributionGroupMember(ctx, fmt.Sprintf("%s %s", capa.RootID, MainAlias.DisplayName), capabilityMember.Email)
+					err := mutate(ctx, func() error {
+						return c.ExchangeOnlineClient.AddDistributionGroupMember(ctx, MainAlias.GroupDisplayName(capa.RootID), capabilityMember.Email)
+					})
+					RecordMutation(ctx, emailAliasMutation(MutationEmailAliasMemberAdded, MainAlias.GroupDisplayName(capa.RootID), capabilityMember.Email), err)
 					if err != nil {
-						if strings.Contains(err.Error(), "status code: 404") {
+						if IsExchangeNotFound(err) {
 							c.Logger.Info(fmt.Sprintf("user %s not found, unable to add", capabilityMember.Email))
 							continue
 						}
@@ -251,7 +277,10 @@ func (c *capabilityEmailAliasHandler) ReconcileMainAlias(ctx context.Context) er
 			for _, azGrpMember := range dstGroup.Members {
 				if !capaWithCcMembers.HasMember(azGrpMember.UserPrincipalName) {
 					c.Logger.Info(fmt.Sprintf("exchange alias %s contains stale member %s, removing", capa.RootID, azGrpMember.UserPrincipalName))
-					err := c.ExchangeOnlineClient.RemoveDistributionGroupMember(ctx, fmt.Sprintf("%s %s", capa.RootID, MainAlias.DisplayName), azGrpMember.UserPrincipalName)
+					err := mutate(ctx, func() error {
+						return c.ExchangeOnlineClient.RemoveDistributionGroupMember(ctx, MainAlias.GroupDisplayName(capa.RootID), azGrpMember.UserPrincipalName)
+					})
+					RecordMutation(ctx, emailAliasMutation(MutationEmailAliasMemberRemoved, MainAlias.GroupDisplayName(capa.RootID), azGrpMember.UserPrincipalName), err)
 					if err != nil {
 						return err
 					}
@@ -261,9 +290,12 @@ func (c *capabilityEmailAliasHandler) ReconcileMainAlias(ctx context.Context) er
 			if c.State.EmailAliasesByDisplayName[displayName].RequireSenderAuthenticationEnabled {
 				c.Logger.Info(fmt.Sprintf("Misconfigured RequireSenderAuthenticationEnabled for %s, correcting", displayName))
 				requireSenderAuthenticationEnabled := false
-				err := c.ExchangeOnlineClient.UpdateAlias(ctx, displayName, direct.CmdletInputParameters{
-					RequireSenderAuthenticationEnabled: &requireSenderAuthenticationEnabled,
+				err := mutate(ctx, func() error {
+					return c.ExchangeOnlineClient.UpdateAlias(ctx, displayName, direct.CmdletInputParameters{
+						RequireSenderAuthenticationEnabled: &requireSenderAuthenticationEnabled,
+					})
 				})
+				RecordMutation(ctx, requireSenderAuthenticationMutation(displayName), err)
 				if err != nil {
 					return err
 				}
@@ -272,7 +304,12 @@ func (c *capabilityEmailAliasHandler) ReconcileMainAlias(ctx context.Context) er
 		} else {
 			// Create alias, add members
 			members := memberStringBuilder(capa.Members)
-			err := c.ExchangeOnlineClient.CreateAlias(ctx, capa.RootID, fmt.Sprintf("%s %s", capa.RootID, MainAlias.DisplayName), members)
+			err := mutate(ctx, func() error {
+				return c.ExchangeOnlineClient.CreateAlias(ctx, capa.RootID, fmt.Sprintf("%s %s", capa.RootID, MainAlias.DisplayName), members)
+			})
+			mutation := emailAliasMutation(MutationEmailAliasCreated, MainAlias.GroupDisplayName(capa.RootID), "")
+			mutation.After = map[string]any{"members": members}
+			RecordMutation(ctx, mutation, err)
 			if err != nil {
 				return err
 			}
@@ -296,7 +333,12 @@ func (c *capabilityEmailAliasHandler) ReconcileSubAliases(ctx context.Context) e
 				} else {
 					members = append(members, c.Config.Exchange.CcEmail)
 				}
-				err := c.ExchangeOnlineClient.CreateAlias(ctx, fmt.Sprintf("%s.%s", subAlias.EmailAliasValue, capa.RootID), fmt.Sprintf("%s %s", capa.RootID, subAlias.DisplayName), members)
+				err := mutate(ctx, func() error {
+					return c.ExchangeOnlineClient.CreateAlias(ctx, fmt.Sprintf("%s.%s", subAlias.EmailAliasValue, capa.RootID), fmt.Sprintf("%s %s", capa.RootID, subAlias.DisplayName), members)
+				})
+				mutation := emailAliasMutation(MutationEmailAliasCreated, subAlias.GroupDisplayName(capa.RootID), "")
+				mutation.After = map[string]any{"members": members}
+				RecordMutation(ctx, mutation, err)
 				if err != nil {
 					return err
 				}
@@ -305,9 +347,12 @@ func (c *capabilityEmailAliasHandler) ReconcileSubAliases(ctx context.Context) e
 				if c.State.EmailAliasesByDisplayName[displayName].RequireSenderAuthenticationEnabled {
 					c.Logger.Info(fmt.Sprintf("Misconfigured RequireSenderAuthenticationEnabled for %s, correcting", displayName))
 					requireSenderAuthenticationEnabled := false
-					err := c.ExchangeOnlineClient.UpdateAlias(ctx, displayName, direct.CmdletInputParameters{
-						RequireSenderAuthenticationEnabled: &requireSenderAuthenticationEnabled,
+					err := mutate(ctx, func() error {
+						return c.ExchangeOnlineClient.UpdateAlias(ctx, displayName, direct.CmdletInputParameters{
+							RequireSenderAuthenticationEnabled: &requireSenderAuthenticationEnabled,
+						})
 					})
+					RecordMutation(ctx, requireSenderAuthenticationMutation(displayName), err)
 					if err != nil {
 						return err
 					}
@@ -319,45 +364,42 @@ func (c *capabilityEmailAliasHandler) ReconcileSubAliases(ctx context.Context) e
 	return nil
 }
 
-func (c *capabilityEmailAliasHandler) PopulateGroupsWithMembers(ctx context.Context, groups *azure.GroupsListResponse) {
+// PopulateGroupsWithMembers reads the members of the distribution groups in Azure. It fails if the members of any
+// group can't be read, as the group would otherwise look like it has no members.
+func (c *capabilityEmailAliasHandler) PopulateGroupsWithMembers(ctx context.Context, groups *azure.GroupsListResponse) error {
 	var waitGroup sync.WaitGroup
 	sem := semaphore.NewWeighted(50)
 	var lock *sync.Mutex = &sync.Mutex{}
+	var membersErr error
 
 	for _, grp := range groups.Value {
+		if err := sem.Acquire(ctx, 1); err != nil {
+			waitGroup.Wait()
+			return err
+		}
 		waitGroup.Add(1)
 
 		grp := grp
 		go func() {
-			sem.Acquire(ctx, 1)
 			defer sem.Release(1)
 			defer waitGroup.Done()
 
-			group := &azure.Group{
-				DisplayName: grp.DisplayName,
-				Members:     []*azure.Member{},
-				ID:          grp.ID,
-			}
-			groupMembers, err := c.AzClient.GetGroupMembers(grp.ID)
-			if err != nil {
-				c.Logger.Error(fmt.Sprintf("GetGroupMembers failed: %v", err), zap.Error(err))
-			}
-
-			for _, groupMember := range groupMembers.Value {
-				group.Members = append(group.Members, &azure.Member{
-					ID:                groupMember.ID,
-					DisplayName:       groupMember.DisplayName,
-					UserPrincipalName: groupMember.UserPrincipalName,
-				})
-			}
+			group, err := c.AzClient.GetGroupWithMembers(ctx, grp.ID, grp.DisplayName)
 
 			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				c.Logger.Error(fmt.Sprintf("GetGroupWithMembers failed: %v", err), zap.Error(err))
+				membersErr = err
+				return
+			}
 			c.State.DistributionsGroupsInAzureByDisplayName[group.DisplayName] = group
-			lock.Unlock()
 		}()
 	}
 
 	waitGroup.Wait()
+
+	return membersErr
 }
 
 func (c *capabilityEmailAliasHandler) EmailAliasExists(value string) bool {
@@ -370,6 +412,80 @@ func (c *capabilityEmailAliasHandler) AliasDisplayNameExists(value string) bool
 	return ok
 }
 
+// ResolveExchangeMember returns the address a Capability member is known by in Exchange Online. External users are
+// looked up in AAD, since the UPN of their guest account differs from their email address.
+func ResolveExchangeMember(ctx context.Context, azClient *azure.Client, email string) (string, error) {
+	if !azClient.IsUserExternal(email) {
+		return email, nil
+	}
+
+	resp, err := azClient.GetUserViaEmail(ctx, email)
+	if err != nil {
+		return "", err
+	}
+
+	return resp.UserPrincipalName, nil
+}
+
+// AddMainAliasMember adds a Capability member to the main email alias of the Capability. member is the address the
+// Capability member is known by in Exchange Online, see ResolveExchangeMember.
+func AddMainAliasMember(ctx context.Context, exchangeClient ssu_exchange.IClient, rootId string, member string) error {
+	err := mutate(ctx, func() error {
+		return exchangeClient.AddDistributionGroupMember(ctx, MainAlias.GroupDisplayName(rootId), member)
+	})
+	RecordMutation(ctx, emailAliasMutation(MutationEmailAliasMemberAdded, MainAlias.GroupDisplayName(rootId), member), err)
+
+	return err
+}
+
+// RemoveMainAliasMember removes a Capability member from the main email alias of the Capability. member is the address the
+// Capability member is known by in Exchange Online, see ResolveExchangeMember.
+func RemoveMainAliasMember(ctx context.Context, exchangeClient ssu_exchange.IClient, rootId string, member string) error {
+	err := mutate(ctx, func() error {
+		return exchangeClient.RemoveDistributionGroupMember(ctx, MainAlias.GroupDisplayName(rootId), member)
+	})
+	RecordMutation(ctx, emailAliasMutation(MutationEmailAliasMemberRemoved, MainAlias.GroupDisplayName(rootId), member), err)
+
+	return err
+}
+
+// RemoveAlias removes an email alias of a Capability.
+func RemoveAlias(ctx context.Context, exchangeClient ssu_exchange.IClient, aliasName string) error {
+	err := mutate(ctx, func() error { return exchangeClient.RemoveAlias(ctx, aliasName) })
+	RecordMutation(ctx, emailAliasMutation(MutationEmailAliasRemoved, aliasName, ""), err)
+
+	return err
+}
+
+func emailAliasMutation(action string, aliasName string, member string) audit.Mutation {
+	mutation := audit.Mutation{
+		System:    audit.SystemExchange,
+		Action:    action,
+		ObjectIds: map[string]string{"alias": aliasName},
+	}
+	if member != "" {
+		mutation.ObjectIds["member"] = member
+		added := action == MutationEmailAliasMemberAdded
+		mutation.Before = Membership{Member: !added}
+		mutation.After = Membership{Member: added}
+	}
+
+	return mutation
+}
+
+func requireSenderAuthenticationMutation(displayName string) audit.Mutation {
+	mutation := emailAliasMutation(MutationEmailAliasUpdated, displayName, "")
+	mutation.Before = map[string]any{"requireSenderAuthenticationEnabled": true}
+	mutation.After = map[string]any{"requireSenderAuthenticationEnabled": false}
+
+	return mutation
+}
+
+// IsExchangeNotFound reports whether an error returned by the Exchange Online client was caused by a 404 response.
+func IsExchangeNotFound(err error) bool {
+	return strings.Contains(err.Error(), "status code: 404")
+}
+
 func memberStringBuilder(data []capsvc.GetCapabilitiesResponseContextCapabilityMember) []string {
 	members := []string{}
 	for _, member := range data {
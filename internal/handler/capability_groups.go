@@ -0,0 +1,292 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/joomcode/errorx"
+	"go.dfds.cloud/aad-aws-sync/internal/audit"
+	"go.dfds.cloud/aad-aws-sync/internal/azure"
+	"go.dfds.cloud/aad-aws-sync/internal/capsvc"
+	"go.dfds.cloud/aad-aws-sync/internal/config"
+	"go.dfds.cloud/aad-aws-sync/internal/store"
+	"go.dfds.cloud/aad-aws-sync/internal/util"
+	"go.uber.org/zap"
+)
+
+// CapabilityGroupsOf returns the groups of the administrative unit that belong to the Capability with the given root
+// ID: the groups bound to the Capability by its ID first, then the groups not bound to any Capability with the
+// display name of its group. More than one group means the group is duplicated.
+func CapabilityGroupsOf(units []azure.GetAdministrativeUnitMembersResponseUnit, rootId string) []azure.GetAdministrativeUnitMembersResponseUnit {
+	displayName := azure.GenerateAzureGroupDisplayName(rootId)
+
+	var bound, named []azure.GetAdministrativeUnitMembersResponseUnit
+	for _, unit := range units {
+		switch {
+		case unit.CapabilityRootId == rootId:
+			bound = append(bound, unit)
+		case unit.CapabilityRootId == "" && unit.DisplayName == displayName:
+			named = append(named, unit)
+		}
+	}
+
+	return append(bound, named...)
+}
+
+// capabilityGroupRank is what decides which of the duplicated groups of a Capability is kept.
+type capabilityGroupRank struct {
+	provisioned bool
+	bound       bool
+	created     time.Time
+}
+
+// keptOver reports whether the group ranked r is kept over the group ranked other: the group provisioned to the AWS
+// Identity Store first, as AWS access is granted through its Identity Store group, then the group bound to the
+// Capability, then the oldest group.
+func (r capabilityGroupRank) keptOver(other capabilityGroupRank) bool {
+	if r.provisioned != other.provisioned {
+		return r.provisioned
+	}
+	if r.bound != other.bound {
+		return r.bound
+	}
+	return r.created.Before(other.created)
+}
+
+// CapabilityGroupOf returns the group of the Capability with the given root ID that is kept of its groups in the
+// administrative unit, see CapabilityGroupsOf, and the other groups, which are duplicates. The AWS Identity Store is
+// only looked up if the group is duplicated. Returns nil if the Capability has no group.
+func CapabilityGroupOf(ctx context.Context, units []azure.GetAdministrativeUnitMembersResponseUnit, rootId string, lookupIdentityStoreGroups IdentityStoreGroups) (*azure.GetAdministrativeUnitMembersResponseUnit, []azure.GetAdministrativeUnitMembersResponseUnit, error) {
+	groups := CapabilityGroupsOf(units, rootId)
+	if len(groups) == 0 {
+		return nil, nil, nil
+	}
+	if len(groups) == 1 {
+		return &groups[0], nil, nil
+	}
+
+	provisioned, err := lookupIdentityStoreGroups(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rank := func(unit azure.GetAdministrativeUnitMembersResponseUnit) capabilityGroupRank {
+		return capabilityGroupRank{provisioned: provisioned[unit.ID] != "", bound: unit.CapabilityRootId != "", created: unit.CreatedDateTime}
+	}
+	sort.SliceStable(groups, func(i, j int) bool { return rank(groups[i]).keptOver(rank(groups[j])) })
+
+	return &groups[0], groups[1:], nil
+}
+
+// CapabilityGroupNeedsBinding reports whether the group of a Capability isn't bound to it yet, or doesn't describe it,
+// see BindCapabilityGroup.
+func CapabilityGroupNeedsBinding(azureClient *azure.Client, unit azure.GetAdministrativeUnitMembersResponseUnit, capability *capsvc.GetCapabilitiesResponseContextCapability) bool {
+	if azureClient.BindsGroups() && unit.CapabilityRootId != capability.RootID {
+		return true
+	}
+
+	return unit.Description != azure.CapabilityGroupDescription(capability.Name)
+}
+
+// BindCapabilityGroup binds the AAD group with the given ID to the Capability, so it is found by the ID of the
+// Capability even if it is renamed, and describes the Capability in the description of the group.
+func BindCapabilityGroup(ctx context.Context, azureClient *azure.Client, groupId string, capability *capsvc.GetCapabilitiesResponseContextCapability) error {
+	err := mutate(ctx, func() error {
+		return azureClient.BindGroupToCapability(ctx, groupId, capability.RootID, capability.Name)
+	})
+	RecordMutation(ctx, audit.Mutation{
+		System:    audit.SystemAzureAd,
+		Action:    MutationAadGroupBound,
+		ObjectIds: map[string]string{"groupId": groupId, "capabilityRootId": capability.RootID},
+		After:     map[string]string{"description": azure.CapabilityGroupDescription(capability.Name)},
+	}, err)
+
+	return err
+}
+
+// RegisterCapabilityIdProperty registers the directory extension property AAD groups are bound to Capabilities with
+// on the app azure.applicationObjectId, unless it is registered already. Returns the name Graph gives the property,
+// to be configured as azure.capabilityIdProperty.
+func RegisterCapabilityIdProperty(ctx context.Context, conf config.Config, name string) (string, error) {
+	if conf.Azure.ApplicationObjectId == "" {
+		return "", fmt.Errorf("azure.applicationObjectId is required to register the property on the app")
+	}
+
+	azClient := azure.NewAzureClient(azure.Config{
+		TenantId:     conf.Azure.TenantId,
+		ClientId:     conf.Azure.ClientId,
+		ClientSecret: conf.Azure.ClientSecret,
+		Auth:         conf.Azure.Auth,
+	})
+	property, err := azClient.RegisterGroupExtensionProperty(ctx, conf.Azure.ApplicationObjectId, name)
+	if err != nil {
+		return "", err
+	}
+
+	return property.Name, nil
+}
+
+// reconcileAzureGroupOwners makes the direct members of the AAD group of a Capability its owners, and removes the
+// users that are no longer members as owners, see config.Handler.Capsvc2Aad.SetGroupOwners. Run after the members of
+// the group are reconciled, as the members are read again. Owners that aren't users are kept.
+func reconcileAzureGroupOwners(ctx context.Context, azureClient *azure.Client, groupId string) error {
+	if groupId == "" {
+		// A group planned by a dry run
+		return nil
+	}
+
+	members, err := azureClient.GetGroupMembers(ctx, groupId)
+	if err != nil {
+		return err
+	}
+	owners, err := azureClient.GetGroupOwners(ctx, groupId)
+	if err != nil {
+		return err
+	}
+
+	isOwner := map[string]bool{}
+	for _, owner := range owners {
+		isOwner[owner.ID] = true
+	}
+	isMember := map[string]bool{}
+	for _, member := range members.Value {
+		if !member.IsUser() {
+			continue
+		}
+		isMember[member.ID] = true
+		if isOwner[member.ID] {
+			continue
+		}
+
+		err := mutate(ctx, func() error { return azureClient.AddGroupOwner(ctx, groupId, member.ID) })
+		RecordMutation(ctx, MembershipMutation(audit.SystemAzureAd, MutationAadGroupOwnerAdded, map[string]string{"groupId": groupId, "userId": member.ID, "userPrincipalName": member.UserPrincipalName}, true), err)
+		if err != nil && !errorx.IsOfType(err, azure.AdUserNotFound) {
+			return err
+		}
+	}
+
+	for _, owner := range owners {
+		if !owner.IsUser() || isMember[owner.ID] {
+			continue
+		}
+
+		err := mutate(ctx, func() error { return azureClient.DeleteGroupOwner(ctx, groupId, owner.ID) })
+		RecordMutation(ctx, MembershipMutation(audit.SystemAzureAd, MutationAadGroupOwnerRemoved, map[string]string{"groupId": groupId, "userId": owner.ID, "userPrincipalName": owner.UserPrincipalName}, false), err)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// reportCapabilityGroupDrift reports the groups bound to a Capability that no longer exists, and the groups bound to
+// a Capability that were renamed. Neither is fixed automatically: the group of a deleted Capability is removed when
+// the deletion event is handled, and a renamed group keeps its members and app assignments.
+func reportCapabilityGroupDrift(units []azure.GetAdministrativeUnitMembersResponseUnit, capabilitiesByRootId map[string]*capsvc.GetCapabilitiesResponseContextCapability) {
+	orphaned := 0
+	renamed := 0
+	for _, unit := range units {
+		if unit.CapabilityRootId == "" {
+			continue
+		}
+
+		if _, ok := capabilitiesByRootId[unit.CapabilityRootId]; !ok {
+			orphaned++
+			util.Logger.Warn(fmt.Sprintf("Group %s (%s) is bound to Capability %s, which doesn't exist", unit.DisplayName, unit.ID, unit.CapabilityRootId), zap.String("jobName", CapabilityServiceToAzureAdName))
+			continue
+		}
+
+		if displayName := azure.GenerateAzureGroupDisplayName(unit.CapabilityRootId); unit.DisplayName != displayName {
+			renamed++
+			util.Logger.Warn(fmt.Sprintf("Group %s (%s) of Capability %s was renamed, expected %s", unit.DisplayName, unit.ID, unit.CapabilityRootId, displayName), zap.String("jobName", CapabilityServiceToAzureAdName))
+		}
+	}
+
+	setDrift(CapabilityServiceToAzureAdName, audit.SystemAzureAd, DriftOrphanedAadGroups, orphaned)
+	setDrift(CapabilityServiceToAzureAdName, audit.SystemAzureAd, DriftRenamedAadGroups, renamed)
+}
+
+// restorableCapabilityGroup chooses the deleted group of a Capability to restore, of its deleted groups, most recently
+// deleted first. Groups removed as duplicates of the group of the Capability are skipped, as restoring one would
+// duplicate the group again. Of the others, the group provisioned to the AWS Identity Store is preferred, as AWS access
+// is granted through its Identity Store group, then the most recently deleted group. The Identity Store is only
+// looked up if there's a choice. Returns nil if no group can be restored.
+func restorableCapabilityGroup(ctx context.Context, deleted []*azure.DeletedGroup, removedDuplicates map[string]bool, lookupIdentityStoreGroups IdentityStoreGroups) (*azure.DeletedGroup, error) {
+	var candidates []*azure.DeletedGroup
+	for _, group := range deleted {
+		if !removedDuplicates[group.ID] {
+			candidates = append(candidates, group)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+	if len(candidates) == 1 {
+		return candidates[0], nil
+	}
+
+	provisioned, err := lookupIdentityStoreGroups(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, group := range candidates {
+		if provisioned[group.ID] != "" {
+			return group, nil
+		}
+	}
+
+	return candidates[0], nil
+}
+
+// restoreCapabilityAzureGroup restores a deleted group of the Capability, chosen by restorableCapabilityGroup, adds it
+// back to the administrative unit and binds it to the Capability. Returns nil if the Capability has no deleted group
+// that can be restored.
+func restoreCapabilityAzureGroup(ctx context.Context, azureClient *azure.Client, aUnitId string, capability *capsvc.GetCapabilitiesResponseContextCapability, lookupIdentityStoreGroups IdentityStoreGroups) (*azure.Group, error) {
+	deleted, err := azureClient.GetDeletedCapabilityGroups(ctx, capability.RootID)
+	if err != nil {
+		return nil, err
+	}
+	if len(deleted) == 0 {
+		return nil, nil
+	}
+
+	removedDuplicates, err := removedDuplicateGroups(store.Default())
+	if err != nil {
+		return nil, err
+	}
+	group, err := restorableCapabilityGroup(ctx, deleted, removedDuplicates, lookupIdentityStoreGroups)
+	if err != nil || group == nil {
+		return nil, err
+	}
+
+	util.Logger.Info(fmt.Sprintf("Capability %s has a deleted group %s (%s), restoring", capability.RootID, group.DisplayName, group.ID), zap.String("jobName", CapabilityServiceToAzureAdName))
+	err = mutate(ctx, func() error { return azureClient.RestoreDeletedGroup(ctx, group.ID) })
+	RecordMutation(ctx, audit.Mutation{
+		System:    audit.SystemAzureAd,
+		Action:    MutationAadGroupRestored,
+		ObjectIds: map[string]string{"groupId": group.ID, "capabilityRootId": capability.RootID},
+		Before:    group,
+	}, err)
+	if err != nil {
+		return nil, err
+	}
+
+	if IsDryRun(ctx) {
+		// The members of a deleted group can't be read, so a dry run plans them as if the group had been created
+		return &azure.Group{ID: group.ID, DisplayName: group.DisplayName}, nil
+	}
+
+	if err := azureClient.AddAdministrativeUnitMember(ctx, aUnitId, group.ID); err != nil {
+		return nil, err
+	}
+	// A group restored by its display name isn't bound yet, and the Capability may have been renamed meanwhile
+	if err := BindCapabilityGroup(ctx, azureClient, group.ID, capability); err != nil {
+		return nil, err
+	}
+
+	// The group is restored with the members it had
+	return azureClient.GetGroupWithMembers(ctx, group.ID, group.DisplayName)
+}
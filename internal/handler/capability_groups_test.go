@@ -0,0 +1,155 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.dfds.cloud/aad-aws-sync/internal/azure"
+	"go.dfds.cloud/aad-aws-sync/internal/capsvc"
+	"go.dfds.cloud/aad-aws-sync/internal/jobs"
+	"go.dfds.cloud/aad-aws-sync/internal/util"
+	"go.uber.org/zap"
+)
+
+func TestCapabilityGroupsOf(t *testing.T) {
+	units := []azure.GetAdministrativeUnitMembersResponseUnit{
+		{ID: "named", DisplayName: "CI_SSU_Cap - sandbox-abcde"},
+		{ID: "renamed", DisplayName: "Sandbox", CapabilityRootId: "sandbox-abcde"},
+		{ID: "other", DisplayName: "CI_SSU_Cap - other-fghij", CapabilityRootId: "other-fghij"},
+		// Bound to another Capability, so not a group of sandbox-abcde despite its name
+		{ID: "taken", DisplayName: "CI_SSU_Cap - sandbox-abcde", CapabilityRootId: "other-fghij"},
+	}
+
+	// Groups bound to the Capability come first
+	groups := CapabilityGroupsOf(units, "sandbox-abcde")
+	assert.Len(t, groups, 2)
+	assert.Equal(t, "renamed", groups[0].ID)
+	assert.Equal(t, "named", groups[1].ID)
+
+	assert.Empty(t, CapabilityGroupsOf(units, "missing-klmno"))
+}
+
+func TestCapabilityGroupOf(t *testing.T) {
+	created := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	units := []azure.GetAdministrativeUnitMembersResponseUnit{
+		{ID: "bound", DisplayName: "CI_SSU_Cap - sandbox-abcde", CapabilityRootId: "sandbox-abcde", CreatedDateTime: created.Add(time.Hour)},
+		{ID: "oldest", DisplayName: "CI_SSU_Cap - sandbox-abcde", CreatedDateTime: created},
+		{ID: "provisioned", DisplayName: "CI_SSU_Cap - sandbox-abcde", CreatedDateTime: created.Add(2 * time.Hour)},
+		{ID: "single", DisplayName: "CI_SSU_Cap - single-fghij", CreatedDateTime: created},
+	}
+	lookups := 0
+	lookup := func(ctx context.Context) (map[string]string, error) {
+		lookups++
+		return map[string]string{"provisioned": "aws-group"}, nil
+	}
+
+	// The group provisioned to the AWS Identity Store is kept over bound and older groups
+	unit, duplicates, err := CapabilityGroupOf(context.Background(), units, "sandbox-abcde", lookup)
+	assert.NoError(t, err)
+	assert.Equal(t, "provisioned", unit.ID)
+	assert.Len(t, duplicates, 2)
+	assert.Equal(t, "bound", duplicates[0].ID)
+	assert.Equal(t, "oldest", duplicates[1].ID)
+
+	// Without the Identity Store, the bound group is kept
+	unit, _, err = CapabilityGroupOf(context.Background(), units, "sandbox-abcde", func(ctx context.Context) (map[string]string, error) { return nil, nil })
+	assert.NoError(t, err)
+	assert.Equal(t, "bound", unit.ID)
+
+	// The Identity Store is only looked up for duplicated groups
+	lookups = 0
+	unit, duplicates, err = CapabilityGroupOf(context.Background(), units, "single-fghij", lookup)
+	assert.NoError(t, err)
+	assert.Equal(t, "single", unit.ID)
+	assert.Empty(t, duplicates)
+	assert.Zero(t, lookups)
+
+	unit, _, err = CapabilityGroupOf(context.Background(), units, "missing-klmno", lookup)
+	assert.NoError(t, err)
+	assert.Nil(t, unit)
+
+	_, _, err = CapabilityGroupOf(context.Background(), units, "sandbox-abcde", func(ctx context.Context) (map[string]string, error) { return nil, errors.New("throttled") })
+	assert.Error(t, err)
+}
+
+func TestRestorableCapabilityGroup(t *testing.T) {
+	deleted := []*azure.DeletedGroup{{ID: "latest"}, {ID: "removed-duplicate"}, {ID: "provisioned"}}
+	removed := map[string]bool{"removed-duplicate": true}
+	lookups := 0
+	lookup := func(ctx context.Context) (map[string]string, error) {
+		lookups++
+		return map[string]string{"provisioned": "aws-group", "removed-duplicate": "other-aws-group"}, nil
+	}
+
+	// The group provisioned to the AWS Identity Store is restored over more recently deleted groups
+	group, err := restorableCapabilityGroup(context.Background(), deleted, removed, lookup)
+	assert.NoError(t, err)
+	assert.Equal(t, "provisioned", group.ID)
+
+	// Without the Identity Store, the most recently deleted group is restored
+	group, err = restorableCapabilityGroup(context.Background(), deleted, removed, func(ctx context.Context) (map[string]string, error) { return nil, nil })
+	assert.NoError(t, err)
+	assert.Equal(t, "latest", group.ID)
+
+	// Groups removed as duplicates aren't restored, and the Identity Store is only looked up if there's a choice
+	lookups = 0
+	group, err = restorableCapabilityGroup(context.Background(), deleted[:2], removed, lookup)
+	assert.NoError(t, err)
+	assert.Equal(t, "latest", group.ID)
+	assert.Zero(t, lookups)
+
+	group, err = restorableCapabilityGroup(context.Background(), deleted[1:2], removed, lookup)
+	assert.NoError(t, err)
+	assert.Nil(t, group)
+
+	_, err = restorableCapabilityGroup(context.Background(), deleted, removed, func(ctx context.Context) (map[string]string, error) { return nil, errors.New("throttled") })
+	assert.Error(t, err)
+}
+
+func TestCapabilityGroupNeedsBinding(t *testing.T) {
+	capability := &capsvc.GetCapabilitiesResponseContextCapability{RootID: "sandbox-abcde", Name: "Sandbox"}
+	described := azure.CapabilityGroupDescription("Sandbox")
+
+	binding := azure.NewAzureClient(azure.Config{CapabilityIdProperty: "extension_app_capabilityRootId"})
+	assert.True(t, CapabilityGroupNeedsBinding(binding, azure.GetAdministrativeUnitMembersResponseUnit{Description: described}, capability))
+	assert.True(t, CapabilityGroupNeedsBinding(binding, azure.GetAdministrativeUnitMembersResponseUnit{CapabilityRootId: "sandbox-abcde", Description: "[Automated] - aad-aws-sync"}, capability))
+	assert.False(t, CapabilityGroupNeedsBinding(binding, azure.GetAdministrativeUnitMembersResponseUnit{CapabilityRootId: "sandbox-abcde", Description: described}, capability))
+
+	// Without a capability ID property, groups are only described
+	byName := azure.NewAzureClient(azure.Config{})
+	assert.False(t, CapabilityGroupNeedsBinding(byName, azure.GetAdministrativeUnitMembersResponseUnit{Description: described}, capability))
+}
+
+func TestReconcileAzureGroupOwners(t *testing.T) {
+	util.Logger = zap.NewNop()
+	fake, azureClient := newFakeGraph(t, azure.Config{})
+	fake.responses["GET /v1.0/groups/group-1/members"] = fakeGraphResponse{body: `{"value":[
+		{"@odata.type":"#microsoft.graph.user","id":"user-a","userPrincipalName":"a@dfds.com"},
+		{"@odata.type":"#microsoft.graph.user","id":"user-b","userPrincipalName":"b@dfds.com"},
+		{"@odata.type":"#microsoft.graph.group","id":"nested"}
+	]}`}
+	fake.responses["GET /v1.0/groups/group-1/owners"] = fakeGraphResponse{body: `{"value":[
+		{"@odata.type":"#microsoft.graph.user","id":"user-a","userPrincipalName":"a@dfds.com"},
+		{"@odata.type":"#microsoft.graph.user","id":"user-left","userPrincipalName":"left@dfds.com"},
+		{"@odata.type":"#microsoft.graph.servicePrincipal","id":"app"}
+	]}`}
+	fake.responses["POST /v1.0/groups/group-1/owners/$ref"] = fakeGraphResponse{status: http.StatusNoContent}
+	fake.responses["DELETE /v1.0/groups/group-1/owners/user-left/$ref"] = fakeGraphResponse{status: http.StatusNoContent}
+
+	ctx, mutations := jobs.TrackMutations(context.Background())
+	assert.NoError(t, reconcileAzureGroupOwners(ctx, azureClient, "group-1"))
+
+	// Members that aren't owners become owners, owners that left are removed, and the app stays an owner
+	assert.Equal(t, 1, fake.count("POST /v1.0/groups/group-1/owners/$ref"))
+	assert.Equal(t, 1, fake.count("DELETE /v1.0/groups/group-1/owners/user-left/$ref"))
+	assert.Zero(t, fake.count("DELETE /v1.0/groups/group-1/owners/app/$ref"))
+	assert.Equal(t, 1, mutations()[MutationAadGroupOwnerAdded])
+	assert.Equal(t, 1, mutations()[MutationAadGroupOwnerRemoved])
+
+	// A group planned by a dry run has no owners to reconcile
+	assert.NoError(t, reconcileAzureGroupOwners(ctx, azureClient, ""))
+}
@@ -0,0 +1,528 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	daws "github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/identitystore"
+	identityTypes "github.com/aws/aws-sdk-go-v2/service/identitystore/types"
+	"github.com/aws/aws-sdk-go-v2/service/organizations"
+	"github.com/aws/aws-sdk-go-v2/service/ssoadmin"
+	"github.com/joomcode/errorx"
+	"go.dfds.cloud/aad-aws-sync/internal/aws"
+	"go.dfds.cloud/aad-aws-sync/internal/azure"
+	"go.dfds.cloud/aad-aws-sync/internal/capsvc"
+	"go.dfds.cloud/aad-aws-sync/internal/config"
+	"go.dfds.cloud/aad-aws-sync/internal/k8s"
+	"go.dfds.cloud/aad-aws-sync/internal/ssu_exchange"
+	"go.dfds.cloud/aad-aws-sync/internal/store"
+)
+
+const CapabilityStatusName = "capabilityStatus"
+
+// Systems a Capability lives in, as reported by the Capability status.
+const (
+	StatusSystemCapabilityService = "capabilityService"
+	StatusSystemAadGroup          = "aadGroup"
+	StatusSystemAppAssignment     = "appAssignment"
+	StatusSystemIdentityStore     = "identityStore"
+	StatusSystemSsoAssignment     = "ssoAssignment"
+	StatusSystemAwsAuth           = "awsAuth"
+	StatusSystemExchange          = "exchange"
+)
+
+// CapabilityStatus is the state of a Capability across all systems it lives in, with every discrepancy between them.
+type CapabilityStatus struct {
+	RootId             string                  `json:"rootId"`
+	InSync             bool                    `json:"inSync"`
+	CapabilityService  CapabilityServiceStatus `json:"capabilityService"`
+	AadGroup           *GroupStatus            `json:"aadGroup,omitempty"`
+	AppAssignments     []AppAssignmentStatus   `json:"appAssignments"`
+	IdentityStoreGroup *GroupStatus            `json:"identityStoreGroup,omitempty"`
+	SsoAssignments     []SsoAssignmentStatus   `json:"ssoAssignments"`
+	AwsAuthMapping     *k8s.RoleMapping        `json:"awsAuthMapping,omitempty"`
+	EmailAliases       []EmailAliasStatus      `json:"emailAliases"`
+	// UnresolvedMembers are the external members of the Capability not found in AAD
+	UnresolvedMembers []UnresolvedMember `json:"unresolvedMembers"`
+	Discrepancies     []Discrepancy      `json:"discrepancies"`
+	// Errors lists the systems that could not be read, and which therefore may have discrepancies not reported.
+	Errors []Discrepancy `json:"errors"`
+}
+
+type CapabilityServiceStatus struct {
+	Members  []string                                 `json:"members"`
+	Contexts []*capsvc.GetCapabilitiesResponseContext `json:"contexts"`
+}
+
+type GroupStatus struct {
+	ID          string   `json:"id"`
+	DisplayName string   `json:"displayName"`
+	Members     []string `json:"members"`
+	// InheritedMembers are the members of groups nested in the group, see azure.Config.TransitiveMembers
+	InheritedMembers []string `json:"inheritedMembers,omitempty"`
+}
+
+type AppAssignmentStatus struct {
+	AppId    string `json:"appId"`
+	Assigned bool   `json:"assigned"`
+}
+
+type SsoAssignmentStatus struct {
+	Name             string `json:"name"`
+	AccountId        string `json:"accountId"`
+	PermissionSetArn string `json:"permissionSetArn"`
+	Assigned         bool   `json:"assigned"`
+}
+
+type EmailAliasStatus struct {
+	DisplayName string   `json:"displayName"`
+	Email       string   `json:"email,omitempty"`
+	Exists      bool     `json:"exists"`
+	Members     []string `json:"members,omitempty"`
+}
+
+// Discrepancy is a single difference between the expected and the actual state of a Capability in a system.
+type Discrepancy struct {
+	System  string `json:"system"`
+	Message string `json:"message"`
+}
+
+func (s *CapabilityStatus) addDiscrepancy(system string, format string, args ...any) {
+	s.Discrepancies = append(s.Discrepancies, Discrepancy{System: system, Message: fmt.Sprintf(format, args...)})
+}
+
+func (s *CapabilityStatus) addError(system string, err error) {
+	s.Errors = append(s.Errors, Discrepancy{System: system, Message: err.Error()})
+}
+
+// diffMembers reports members missing from a group, and stale members in it. Members are compared case-insensitively.
+func (s *CapabilityStatus) diffMembers(system string, groupName string, expected []string, actual []string) {
+	expectedSet := map[string]bool{}
+	for _, member := range expected {
+		expectedSet[strings.ToLower(member)] = true
+	}
+	actualSet := map[string]bool{}
+	for _, member := range actual {
+		actualSet[strings.ToLower(member)] = true
+	}
+
+	for _, member := range sortedKeys(expectedSet) {
+		if !actualSet[member] {
+			s.addDiscrepancy(system, "%s is missing member %s", groupName, member)
+		}
+	}
+	for _, member := range sortedKeys(actualSet) {
+		if !expectedSet[member] {
+			s.addDiscrepancy(system, "%s contains stale member %s", groupName, member)
+		}
+	}
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// GetCapabilityStatus reads the state of a Capability in every system it lives in, without changing anything, and
+// reports every discrepancy. A system that can't be read is reported as an error, and the remaining systems are
+// still checked.
+func GetCapabilityStatus(ctx context.Context, rootId string) (*CapabilityStatus, error) {
+	conf, err := config.LoadConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	capSvcClient := capsvc.NewCapSvcClient(capsvc.Config{
+		Host:         conf.CapSvc.Host,
+		TenantId:     conf.Azure.TenantId,
+		ClientId:     conf.CapSvc.ClientId,
+		ClientSecret: conf.CapSvc.ClientSecret,
+		Auth:         conf.CapSvc.Auth,
+		Scope:        conf.CapSvc.TokenScope,
+	})
+
+	capability, err := getCapabilityByRootId(ctx, capSvcClient, rootId)
+	if err != nil {
+		return nil, err
+	}
+
+	azClient := azure.NewAzureClient(azure.Config{
+		TenantId:             conf.Azure.TenantId,
+		ClientId:             conf.Azure.ClientId,
+		ClientSecret:         conf.Azure.ClientSecret,
+		Auth:                 conf.Azure.Auth,
+		InternalDomainSuffix: conf.Azure.InternalDomainSuffix,
+		TransitiveMembers:    conf.Azure.TransitiveMembers,
+		CapabilityIdProperty: conf.Azure.CapabilityIdProperty,
+	})
+
+	status := &CapabilityStatus{
+		RootId: rootId,
+		CapabilityService: CapabilityServiceStatus{
+			Members:  memberStringBuilder(capability.Members),
+			Contexts: capability.Contexts,
+		},
+		AppAssignments:    []AppAssignmentStatus{},
+		SsoAssignments:    []SsoAssignmentStatus{},
+		EmailAliases:      []EmailAliasStatus{},
+		UnresolvedMembers: []UnresolvedMember{},
+		Discrepancies:     []Discrepancy{},
+		Errors:            []Discrepancy{},
+	}
+
+	// Members are known by their UPN in AAD and AWS, which differs from their email address for external users
+	expectedUpns := []string{}
+	for _, member := range capability.Members {
+		upn, err := ResolveExchangeMember(ctx, azClient, member.Email)
+		if errorx.IsOfType(err, azure.AdUserNotFound) {
+			status.addUnresolvedMember(store.Default(), member.Email)
+			continue
+		}
+		if err != nil {
+			status.addError(StatusSystemAadGroup, err)
+			continue
+		}
+		expectedUpns = append(expectedUpns, upn)
+	}
+
+	status.checkAadGroup(ctx, azClient, conf, capability, expectedUpns)
+	if status.AadGroup != nil {
+		status.checkAppAssignments(ctx, azClient, conf, capability)
+	}
+
+	// Capabilities only live in AWS once they have an AWS account
+	capaContext, contextErr := capability.GetContext()
+	if contextErr != nil {
+		if len(capability.Contexts) > 0 {
+			status.addDiscrepancy(StatusSystemCapabilityService, "%s", contextErr.Error())
+		}
+	} else {
+		cfg, err := LoadAwsConfig(ctx, conf, CapabilityStatusName)
+		if err != nil {
+			status.addError(StatusSystemIdentityStore, err)
+		} else {
+			status.checkAws(ctx, cfg, conf, capability, capaContext.AwsAccountID, expectedUpns)
+		}
+	}
+
+	status.checkEmailAliases(ctx, azClient, conf, capability)
+
+	status.InSync = len(status.Discrepancies) == 0 && len(status.Errors) == 0
+
+	return status, nil
+}
+
+// addUnresolvedMember reports a Capability member not found in AAD, with the B2B invitation sent to them, if any. The
+// invitation is reported as unknown if st is unavailable.
+func (s *CapabilityStatus) addUnresolvedMember(st store.Store, email string) {
+	invitation, err := LoadGuestInvitation(st, email)
+	unknown := errorx.IsOfType(err, store.Unavailable)
+	if err != nil && !unknown {
+		s.addError(StatusSystemAadGroup, err)
+	}
+	s.UnresolvedMembers = append(s.UnresolvedMembers, UnresolvedMember{Email: email, Invitation: invitation, InvitationUnknown: unknown})
+
+	if invitation != nil {
+		s.addDiscrepancy(StatusSystemAadGroup, "member %s is not in AAD, invited as guest at %s", email, invitation.InvitedAt.Format(time.RFC3339))
+		return
+	}
+	s.addDiscrepancy(StatusSystemAadGroup, "member %s is not in AAD", email)
+}
+
+// checkAadGroup compares the members of the AAD group of the Capability with the members of the Capability. The group
+// is the one kept of its groups, see CapabilityGroupOf, and the others are reported as duplicates.
+func (s *CapabilityStatus) checkAadGroup(ctx context.Context, azClient *azure.Client, conf config.Config, capability *capsvc.GetCapabilitiesResponseContextCapability, expectedUpns []string) {
+	groupName := azure.GenerateAzureGroupDisplayName(capability.RootID)
+	groups, err := getCapabilityAzureGroups(ctx, azClient, conf, capability)
+	if err != nil {
+		s.addError(StatusSystemAadGroup, err)
+		return
+	}
+	if groups.kept == nil {
+		s.addDiscrepancy(StatusSystemAadGroup, "AAD group %s does not exist", groupName)
+		return
+	}
+	if groups.kept.CapabilityRootId != "" && groups.kept.DisplayName != groupName {
+		s.addDiscrepancy(StatusSystemAadGroup, "AAD group %s of the Capability was renamed, expected %s", groups.kept.DisplayName, groupName)
+		groupName = groups.kept.DisplayName
+	}
+	for _, duplicate := range groups.duplicates {
+		s.addDiscrepancy(StatusSystemAadGroup, "AAD group %s (%s) duplicates group %s", duplicate.DisplayName, duplicate.ID, groups.kept.ID)
+	}
+
+	group, err := azClient.GetGroupWithMembers(ctx, groups.kept.ID, groups.kept.DisplayName)
+	if err != nil {
+		s.addError(StatusSystemAadGroup, err)
+		return
+	}
+
+	s.AadGroup = newGroupStatus(group)
+	s.diffMembers(StatusSystemAadGroup, fmt.Sprintf("AAD group %s", groupName), expectedUpns, append(s.AadGroup.Members, s.AadGroup.InheritedMembers...))
+}
+
+// checkAppAssignments checks that the AAD group of the Capability is assigned to the enterprise applications it
+// should be assigned to.
+func (s *CapabilityStatus) checkAppAssignments(ctx context.Context, azClient *azure.Client, conf config.Config, capability *capsvc.GetCapabilitiesResponseContextCapability) {
+	apps, err := capabilityEnterpriseApps(conf, capability)
+	if err != nil {
+		s.addError(StatusSystemAppAssignment, err)
+		return
+	}
+
+	for _, app := range apps {
+		appAssignments, err := azClient.GetAssignmentsForApplication(ctx, app.ObjectId)
+		if err != nil {
+			s.addError(StatusSystemAppAssignment, err)
+			continue
+		}
+
+		assigned := appAssignments.ContainsGroup(s.AadGroup.DisplayName)
+		s.AppAssignments = append(s.AppAssignments, AppAssignmentStatus{AppId: app.AppId, Assigned: assigned})
+		if !assigned {
+			s.addDiscrepancy(StatusSystemAppAssignment, "AAD group %s is not assigned to enterprise application %s", s.AadGroup.DisplayName, app.AppId)
+		}
+	}
+}
+
+// checkAws checks the Identity Store group of the Capability, its SSO assignments and its aws-auth mapping.
+func (s *CapabilityStatus) checkAws(ctx context.Context, cfg daws.Config, conf config.Config, capability *capsvc.GetCapabilitiesResponseContextCapability, accountId string, expectedUpns []string) {
+	identityStoreClient := identitystore.NewFromConfig(cfg)
+	ssoClient := ssoadmin.NewFromConfig(cfg)
+
+	groupName := fmt.Sprintf("%s %s", CAPABILITY_GROUP_PREFIX, capability.RootID)
+	group, err := aws.GetGroupByDisplayName(ctx, identityStoreClient, conf.Aws.IdentityStoreArn, groupName)
+	if err != nil {
+		s.addError(StatusSystemIdentityStore, err)
+	} else if group == nil {
+		s.addDiscrepancy(StatusSystemIdentityStore, "group %s is not provisioned to the AWS Identity Store", groupName)
+	} else {
+		s.IdentityStoreGroup, err = getIdentityStoreGroupStatus(ctx, identityStoreClient, conf.Aws.IdentityStoreArn, group)
+		if err != nil {
+			s.addError(StatusSystemIdentityStore, err)
+		} else {
+			s.diffMembers(StatusSystemIdentityStore, fmt.Sprintf("Identity Store group %s", groupName), expectedUpns, s.IdentityStoreGroup.Members)
+		}
+	}
+
+	assignments := []SsoAssignmentStatus{
+		{Name: "Capability", AccountId: accountId, PermissionSetArn: conf.Aws.CapabilityPermissionSetArn},
+	}
+	if manageSso, err := aws.InitManageSso(ctx, cfg, conf.Aws.IdentityStoreArn); err != nil {
+		s.addError(StatusSystemSsoAssignment, err)
+	} else {
+		for _, sharedRole := range capabilitySharedRoles(conf) {
+			acc := manageSso.GetAccountByName(sharedRole.AwsAccountNameAlias)
+			if acc == nil {
+				s.addError(StatusSystemSsoAssignment, fmt.Errorf("unable to find AWS account by alias %s", sharedRole.AwsAccountNameAlias))
+				continue
+			}
+			assignments = append(assignments, SsoAssignmentStatus{Name: sharedRole.Name, AccountId: *acc.Id, PermissionSetArn: sharedRole.PermissionSetArn})
+		}
+	}
+
+	for _, assignment := range assignments {
+		if group != nil {
+			accountAssignments, err := aws.GetAssignedForPermissionSetInAccount(ctx, ssoClient, conf.Aws.SsoInstanceArn, assignment.PermissionSetArn, assignment.AccountId)
+			if err != nil {
+				s.addError(StatusSystemSsoAssignment, err)
+				continue
+			}
+			for _, accountAssignment := range accountAssignments {
+				if accountAssignment.PrincipalType == "GROUP" && *accountAssignment.PrincipalId == *group.GroupId {
+					assignment.Assigned = true
+				}
+			}
+		}
+
+		s.SsoAssignments = append(s.SsoAssignments, assignment)
+		if !assignment.Assigned {
+			s.addDiscrepancy(StatusSystemSsoAssignment, "group %s is not assigned permission set %s in AWS account %s", groupName, assignment.PermissionSetArn, assignment.AccountId)
+		}
+	}
+
+	s.checkAwsAuthMapping(ctx, cfg, conf, capability.RootID, accountId)
+}
+
+// getIdentityStoreGroupStatus returns an Identity Store group with the user names of its members.
+func getIdentityStoreGroupStatus(ctx context.Context, client *identitystore.Client, identityStoreArn string, group *identityTypes.Group) (*GroupStatus, error) {
+	memberships, err := aws.GetGroupMemberships(ctx, client, identityStoreArn, group.GroupId)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &GroupStatus{ID: *group.GroupId, DisplayName: *group.DisplayName, Members: []string{}}
+	for _, membership := range memberships {
+		userId, ok := membership.MemberId.(*identityTypes.MemberIdMemberUserId)
+		if !ok {
+			continue
+		}
+
+		user, err := client.DescribeUser(ctx, &identitystore.DescribeUserInput{IdentityStoreId: &identityStoreArn, UserId: &userId.Value})
+		if err != nil {
+			return nil, err
+		}
+		status.Members = append(status.Members, *user.UserName)
+	}
+
+	return status, nil
+}
+
+// checkAwsAuthMapping checks the aws-auth ConfigMap entry for the Capability access role of the AWS account.
+func (s *CapabilityStatus) checkAwsAuthMapping(ctx context.Context, cfg daws.Config, conf config.Config, rootId string, accountId string) {
+	orgClient := organizations.NewFromConfig(cfg)
+	account, err := orgClient.DescribeAccount(ctx, &organizations.DescribeAccountInput{AccountId: &accountId})
+	if err != nil {
+		s.addError(StatusSystemAwsAuth, err)
+		return
+	}
+
+	roles, err := aws.GetSsoRoles(ctx, []aws.SsoRoleMapping{
+		{
+			AccountAlias: *account.Account.Name,
+			AccountId:    accountId,
+			RootId:       rootId,
+		},
+	}, conf.Aws.AssumableRoles.CapabilityAccountRoleName)
+	if err != nil {
+		s.addError(StatusSystemAwsAuth, err)
+		return
+	}
+
+	role, ok := roles[*account.Account.Name]
+	if !ok {
+		s.addDiscrepancy(StatusSystemAwsAuth, "SSO role for Capability access not found in AWS account %s", accountId)
+		return
+	}
+
+	k8sClient, err := k8s.GetK8sClient()
+	if err != nil {
+		s.addError(StatusSystemAwsAuth, err)
+		return
+	}
+
+	amResp, err := k8s.LoadAwsAuthMapRoles(k8sClient)
+	if err != nil {
+		s.addError(StatusSystemAwsAuth, err)
+		return
+	}
+
+	roleArn := fmt.Sprintf("arn:aws:iam::%s:role/%s", accountId, role.RoleName)
+	s.AwsAuthMapping = amResp.GetMappingByArn(roleArn)
+	if s.AwsAuthMapping == nil {
+		s.addDiscrepancy(StatusSystemAwsAuth, "aws-auth has no entry for role %s", roleArn)
+		return
+	}
+	if !roleMappingMatches(s.AwsAuthMapping, rootId) {
+		s.addDiscrepancy(StatusSystemAwsAuth, "aws-auth entry for role %s does not map to the username and groups of the Capability", roleArn)
+	}
+}
+
+// checkEmailAliases checks that the email aliases of the Capability exist and are configured correctly, and compares
+// the members of its main alias with the members of the Capability.
+func (s *CapabilityStatus) checkEmailAliases(ctx context.Context, azClient *azure.Client, conf config.Config, capability *capsvc.GetCapabilitiesResponseContextCapability) {
+	ssuClient := ssu_exchange.NewSsuExchangeClientO365UnofficialApi(ssu_exchange.Config{
+		TenantId:     conf.Azure.TenantId,
+		ClientId:     conf.Exchange.ClientId,
+		ClientSecret: conf.Exchange.ClientSecret,
+		Auth:         conf.Exchange.Auth,
+		BaseUrl:      conf.Exchange.BaseUrl,
+		ManagedBy:    conf.Exchange.ManagedBy,
+		EmailSuffix:  conf.Exchange.EmailSuffix,
+	})
+
+	aliases, err := ssuClient.GetAliases(ctx)
+	if err != nil {
+		s.addError(StatusSystemExchange, err)
+		return
+	}
+	aliasState := newEmailAliasState(aliases)
+
+	for _, alias := range append([]Alias{MainAlias}, SubAliases...) {
+		displayName := ssu_exchange.GenerateExchangeDistributionGroupDisplayName(alias.GroupDisplayName(capability.RootID))
+		aliasStatus := EmailAliasStatus{DisplayName: displayName}
+
+		existing, exists := aliasState.EmailAliasesByDisplayName[displayName]
+		if !exists {
+			s.EmailAliases = append(s.EmailAliases, aliasStatus)
+			s.addDiscrepancy(StatusSystemExchange, "email alias %s does not exist", displayName)
+			continue
+		}
+		aliasStatus.Exists = true
+		aliasStatus.Email = existing.WindowsEmailAddress
+
+		if existing.RequireSenderAuthenticationEnabled {
+			s.addDiscrepancy(StatusSystemExchange, "email alias %s only accepts mail from authenticated senders", displayName)
+		}
+
+		if alias == MainAlias {
+			group, err := getAzureGroupWithMembers(ctx, azClient, displayName)
+			if err != nil {
+				s.addError(StatusSystemExchange, err)
+			} else if group == nil {
+				s.addDiscrepancy(StatusSystemExchange, "email alias %s exists in Exchange Online, but its group doesn't exist in AAD", displayName)
+			} else {
+				aliasStatus.Members = newGroupStatus(group).Members
+				s.diffMembers(StatusSystemExchange, fmt.Sprintf("email alias %s", displayName), s.expectedMainAliasMembers(ctx, azClient, conf), aliasStatus.Members)
+			}
+		}
+
+		s.EmailAliases = append(s.EmailAliases, aliasStatus)
+	}
+}
+
+// expectedMainAliasMembers returns the addresses the main email alias of the Capability should contain, i.e. the
+// Capability members and the CC address.
+func (s *CapabilityStatus) expectedMainAliasMembers(ctx context.Context, azClient *azure.Client, conf config.Config) []string {
+	members := []string{}
+	for _, email := range append(s.CapabilityService.Members, conf.Exchange.CcEmail) {
+		upn, err := ResolveExchangeMember(ctx, azClient, email)
+		if errorx.IsOfType(err, azure.AdUserNotFound) {
+			// Reported as unresolved member already
+			continue
+		}
+		if err != nil {
+			s.addError(StatusSystemExchange, err)
+			continue
+		}
+		members = append(members, upn)
+	}
+
+	return members
+}
+
+func newGroupStatus(group *azure.Group) *GroupStatus {
+	status := &GroupStatus{ID: group.ID, DisplayName: group.DisplayName, Members: []string{}}
+	for _, member := range group.Members {
+		status.Members = append(status.Members, member.UserPrincipalName)
+	}
+	for _, member := range group.InheritedMembers {
+		status.InheritedMembers = append(status.InheritedMembers, member.UserPrincipalName)
+	}
+
+	return status
+}
+
+// capabilitySharedRoles returns the shared permission sets every Capability is assigned in a shared AWS account.
+func capabilitySharedRoles(conf config.Config) []addToSharedRoleRequest {
+	return []addToSharedRoleRequest{
+		{
+			Name:                "CapabilityLog",
+			AwsAccountNameAlias: conf.Aws.CapabilityLogsAwsAccountAlias,
+			PermissionSetArn:    conf.Aws.CapabilityLogsPermissionSetArn,
+		},
+		{
+			Name:                "SharedECRPull",
+			AwsAccountNameAlias: conf.Aws.SharedEcrPullAwsAccountAlias,
+			PermissionSetArn:    conf.Aws.SharedEcrPullPermissionSetArn,
+		},
+	}
+}
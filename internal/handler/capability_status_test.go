@@ -0,0 +1,46 @@
+package handler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.dfds.cloud/aad-aws-sync/internal/store"
+)
+
+func TestCapabilityStatus_DiffMembers(t *testing.T) {
+	status := &CapabilityStatus{Discrepancies: []Discrepancy{}}
+
+	status.diffMembers(StatusSystemAadGroup, "AAD group CI_SSU_Cap - sandbox-abcde",
+		[]string{"alice@example.com", "Bob@example.com", "carol@example.com"},
+		[]string{"bob@example.com", "carol@example.com", "dave@example.com"})
+
+	assert.Equal(t, []Discrepancy{
+		{System: StatusSystemAadGroup, Message: "AAD group CI_SSU_Cap - sandbox-abcde is missing member alice@example.com"},
+		{System: StatusSystemAadGroup, Message: "AAD group CI_SSU_Cap - sandbox-abcde contains stale member dave@example.com"},
+	}, status.Discrepancies)
+}
+
+func TestCapabilityStatus_AddUnresolvedMember(t *testing.T) {
+	st := store.NewMemoryStore()
+	invitedAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	assert.NoError(t, st.Put(store.BucketGuestInvitations, "invited@example.com", GuestInvitation{Email: "invited@example.com", InvitedAt: invitedAt}))
+
+	status := &CapabilityStatus{Discrepancies: []Discrepancy{}, Errors: []Discrepancy{}}
+	status.addUnresolvedMember(st, "invited@example.com")
+	status.addUnresolvedMember(st, "unknown@example.com")
+	// A standby can't see the invitations, which doesn't mean AAD could not be read
+	status.addUnresolvedMember(store.NewUnavailableStore("standby"), "standby@example.com")
+
+	assert.Len(t, status.UnresolvedMembers, 3)
+	assert.NotNil(t, status.UnresolvedMembers[0].Invitation)
+	assert.Nil(t, status.UnresolvedMembers[1].Invitation)
+	assert.False(t, status.UnresolvedMembers[1].InvitationUnknown)
+	assert.True(t, status.UnresolvedMembers[2].InvitationUnknown)
+	assert.Empty(t, status.Errors)
+	assert.Equal(t, []Discrepancy{
+		{System: StatusSystemAadGroup, Message: "member invited@example.com is not in AAD, invited as guest at 2024-01-02T03:04:05Z"},
+		{System: StatusSystemAadGroup, Message: "member unknown@example.com is not in AAD"},
+		{System: StatusSystemAadGroup, Message: "member standby@example.com is not in AAD"},
+	}, status.Discrepancies)
+}
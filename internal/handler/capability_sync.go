@@ -0,0 +1,500 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	daws "github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/identitystore"
+	"github.com/aws/aws-sdk-go-v2/service/organizations"
+	"github.com/aws/aws-sdk-go-v2/service/ssoadmin"
+	"github.com/google/uuid"
+	"github.com/joomcode/errorx"
+	"go.dfds.cloud/aad-aws-sync/internal/audit"
+	"go.dfds.cloud/aad-aws-sync/internal/aws"
+	"go.dfds.cloud/aad-aws-sync/internal/azure"
+	"go.dfds.cloud/aad-aws-sync/internal/capsvc"
+	"go.dfds.cloud/aad-aws-sync/internal/config"
+	"go.dfds.cloud/aad-aws-sync/internal/jobs"
+	"go.dfds.cloud/aad-aws-sync/internal/k8s"
+	"go.dfds.cloud/aad-aws-sync/internal/ssu_exchange"
+	"go.dfds.cloud/aad-aws-sync/internal/store"
+	"go.dfds.cloud/aad-aws-sync/internal/util"
+	"go.uber.org/zap"
+)
+
+const CapabilitySyncName = "capabilitySync"
+
+// Steps of a Capability sync, in the order they are run.
+const (
+	SyncStepAadGroup         = "aadGroup"
+	SyncStepAppAssignment    = "appAssignment"
+	SyncStepSsoPermissionSet = "ssoPermissionSet"
+	SyncStepSharedRoles      = "sharedRoles"
+	SyncStepAwsAuthMapping   = "awsAuthMapping"
+	SyncStepEmailAliases     = "emailAliases"
+)
+
+const (
+	SyncStepStatusOk      = "ok"
+	SyncStepStatusSkipped = "skipped"
+	SyncStepStatusFailed  = "failed"
+)
+
+// CapabilitySyncResult is the outcome of syncing a single Capability.
+type CapabilitySyncResult struct {
+	RootId string `json:"rootId"`
+	// RunId identifies the sync in the audit log
+	RunId string           `json:"runId"`
+	Steps []SyncStepResult `json:"steps"`
+}
+
+// SyncStepResult is the outcome of a single step of a Capability sync.
+type SyncStepResult struct {
+	Step      string         `json:"step"`
+	Status    string         `json:"status"`
+	Message   string         `json:"message,omitempty"`
+	Mutations map[string]int `json:"mutations"`
+}
+
+// Failed reports whether any step of the sync failed.
+func (r *CapabilitySyncResult) Failed() bool {
+	for _, step := range r.Steps {
+		if step.Status == SyncStepStatusFailed {
+			return true
+		}
+	}
+
+	return false
+}
+
+// run runs a step and records its result. Steps return a SyncStepSkipped error if there is nothing for them to do.
+// Returns true if the step succeeded.
+func (r *CapabilitySyncResult) run(ctx context.Context, step string, f func(ctx context.Context) error) bool {
+	ctx, mutations := jobs.TrackMutations(ctx)
+	err := f(ctx)
+
+	result := SyncStepResult{Step: step, Status: SyncStepStatusOk, Mutations: mutations()}
+	switch {
+	case err == nil:
+	case errorx.IsOfType(err, SyncStepSkipped):
+		result.Status = SyncStepStatusSkipped
+		result.Message = errorx.Cast(err).Message()
+	default:
+		result.Status = SyncStepStatusFailed
+		result.Message = err.Error()
+		util.Logger.Info(fmt.Sprintf("Capability %s sync step %s failed", r.RootId, step), zap.String("jobName", CapabilitySyncName), zap.Error(err))
+	}
+	r.Steps = append(r.Steps, result)
+
+	return result.Status == SyncStepStatusOk
+}
+
+// skip records a step that is not run because a step it depends on did not succeed.
+func (r *CapabilitySyncResult) skip(step string, dependency string) {
+	r.Steps = append(r.Steps, SyncStepResult{
+		Step:      step,
+		Status:    SyncStepStatusSkipped,
+		Message:   fmt.Sprintf("skipped since step %s did not succeed", dependency),
+		Mutations: map[string]int{},
+	})
+}
+
+// SyncCapability runs the whole pipeline for a single Capability, instead of waiting for the scheduled jobs to get
+// to it. A failing step doesn't stop the sync, but steps depending on it are skipped.
+func SyncCapability(ctx context.Context, rootId string) (*CapabilitySyncResult, error) {
+	conf, err := config.LoadConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	capSvcClient := capsvc.NewCapSvcClient(capsvc.Config{
+		Host:         conf.CapSvc.Host,
+		TenantId:     conf.Azure.TenantId,
+		ClientId:     conf.CapSvc.ClientId,
+		ClientSecret: conf.CapSvc.ClientSecret,
+		Auth:         conf.CapSvc.Auth,
+		Scope:        conf.CapSvc.TokenScope,
+	})
+
+	capability, err := getCapabilityByRootId(ctx, capSvcClient, rootId)
+	if err != nil {
+		return nil, err
+	}
+
+	azClient := azure.NewAzureClient(azure.Config{
+		TenantId:             conf.Azure.TenantId,
+		ClientId:             conf.Azure.ClientId,
+		ClientSecret:         conf.Azure.ClientSecret,
+		Auth:                 conf.Azure.Auth,
+		InternalDomainSuffix: conf.Azure.InternalDomainSuffix,
+		TransitiveMembers:    conf.Azure.TransitiveMembers,
+		CapabilityIdProperty: conf.Azure.CapabilityIdProperty,
+	})
+
+	util.Logger.Info(fmt.Sprintf("Syncing Capability %s", rootId), zap.String("jobName", CapabilitySyncName))
+	result := &CapabilitySyncResult{RootId: rootId, RunId: uuid.NewString()}
+	actorKind := audit.ActorKindApi
+	if audit.ActorFromContext(ctx).Kind == audit.ActorKindCli {
+		actorKind = audit.ActorKindCli
+	}
+	ctx = audit.WithActor(ctx, audit.Actor{Kind: actorKind, Name: CapabilitySyncName, RunId: result.RunId})
+
+	var azureGroup *azure.Group
+	if result.run(ctx, SyncStepAadGroup, func(ctx context.Context) error {
+		azureGroup, err = syncAzureGroup(ctx, azClient, conf, capability)
+		return err
+	}) {
+		result.run(ctx, SyncStepAppAssignment, func(ctx context.Context) error {
+			return syncAppAssignments(ctx, azClient, conf, capability, azureGroup)
+		})
+	} else {
+		result.skip(SyncStepAppAssignment, SyncStepAadGroup)
+	}
+
+	cfg, awsConfigErr := LoadAwsConfig(ctx, conf, CapabilitySyncName)
+	var account *aws.SsoRoleMapping
+	permissionSetAssigned := result.run(ctx, SyncStepSsoPermissionSet, func(ctx context.Context) error {
+		if awsConfigErr != nil {
+			return awsConfigErr
+		}
+		account, err = syncCapabilityPermissionSet(ctx, cfg, conf, capability)
+		return err
+	})
+
+	result.run(ctx, SyncStepSharedRoles, func(ctx context.Context) error {
+		if awsConfigErr != nil {
+			return awsConfigErr
+		}
+		return syncSharedRoles(ctx, cfg, conf, rootId)
+	})
+
+	if permissionSetAssigned {
+		result.run(ctx, SyncStepAwsAuthMapping, func(ctx context.Context) error {
+			return syncAwsAuthMapping(ctx, conf, *account)
+		})
+	} else {
+		result.skip(SyncStepAwsAuthMapping, SyncStepSsoPermissionSet)
+	}
+
+	result.run(ctx, SyncStepEmailAliases, func(ctx context.Context) error {
+		return syncEmailAliases(ctx, azClient, capSvcClient, conf, capability)
+	})
+
+	return result, nil
+}
+
+// getCapabilityByRootId looks up a single Capability in Capability-Service.
+func getCapabilityByRootId(ctx context.Context, client *capsvc.Client, rootId string) (*capsvc.GetCapabilitiesResponseContextCapability, error) {
+	capabilities, err := client.GetCapabilities(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, capability := range capabilities {
+		if capability.RootID == rootId {
+			return capability, nil
+		}
+	}
+
+	return nil, CapabilityNotFound.New(fmt.Sprintf("Capability %s not found in Capability-Service", rootId))
+}
+
+// getAzureGroupWithMembers returns the AAD group with the given display name and its members, or nil if no such
+// group exists.
+func getAzureGroupWithMembers(ctx context.Context, azClient *azure.Client, displayName string) (*azure.Group, error) {
+	groupsResp, err := azClient.GetGroups(ctx, displayName)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, grp := range groupsResp.Value {
+		if grp.DisplayName != displayName {
+			continue
+		}
+
+		return azClient.GetGroupWithMembers(ctx, grp.ID, grp.DisplayName)
+	}
+
+	return nil, nil
+}
+
+// capabilityAzureGroups are the groups of a Capability in the self service administrative unit.
+type capabilityAzureGroups struct {
+	aUnitId string
+	// kept is the group of the Capability kept of its groups, see CapabilityGroupOf, or nil if it has none
+	kept       *azure.GetAdministrativeUnitMembersResponseUnit
+	duplicates []azure.GetAdministrativeUnitMembersResponseUnit
+}
+
+// getCapabilityAzureGroups returns the groups of the Capability in the self service administrative unit.
+func getCapabilityAzureGroups(ctx context.Context, azClient *azure.Client, conf config.Config, capability *capsvc.GetCapabilitiesResponseContextCapability) (*capabilityAzureGroups, error) {
+	aUnits, err := azClient.GetAdministrativeUnits(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	aUnit := aUnits.GetUnit("Team - Cloud Engineering - Self service")
+	if aUnit == nil {
+		return nil, errors.New("unable to find administrative unit")
+	}
+
+	aUnitMembers, err := azClient.GetAdministrativeUnitMembers(ctx, aUnit.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	kept, duplicates, err := CapabilityGroupOf(ctx, aUnitMembers.Value, capability.RootID, AwsIdentityStoreGroups(conf))
+	if err != nil {
+		return nil, err
+	}
+
+	return &capabilityAzureGroups{aUnitId: aUnit.ID, kept: kept, duplicates: duplicates}, nil
+}
+
+// syncAzureGroup creates the AAD group of the Capability if it doesn't exist, binds it to the Capability, and
+// reconciles its members, and its owners if configured. External members not found in AAD are invited as guests if
+// configured. Stale members are removed from the duplicates of the group too.
+func syncAzureGroup(ctx context.Context, azClient *azure.Client, conf config.Config, capability *capsvc.GetCapabilitiesResponseContextCapability) (*azure.Group, error) {
+	groups, err := getCapabilityAzureGroups(ctx, azClient, conf, capability)
+	if err != nil {
+		return nil, err
+	}
+
+	var azureGroup *azure.Group
+	if groups.kept == nil {
+		util.Logger.Info(fmt.Sprintf("Capability %s doesn't exist in Azure, creating.", capability.RootID), zap.String("jobName", CapabilitySyncName))
+		azureGroup, err = CreateCapabilityAzureGroup(ctx, azClient, groups.aUnitId, capability, AwsIdentityStoreGroups(conf))
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		if CapabilityGroupNeedsBinding(azClient, *groups.kept, capability) {
+			err = BindCapabilityGroup(ctx, azClient, groups.kept.ID, capability)
+			if err != nil {
+				return nil, err
+			}
+		}
+		azureGroup, err = azClient.GetGroupWithMembers(ctx, groups.kept.ID, groups.kept.DisplayName)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	unresolved, err := reconcileAzureGroupMembers(ctx, azClient, azureGroup, capability)
+	if err != nil {
+		return nil, err
+	}
+	if conf.Handler.Capsvc2Aad.InviteGuests {
+		_, err = inviteUnresolvedMembers(ctx, azClient, store.Default(), conf.Handler.Capsvc2Aad.InviteRedirectUrl, azureGroup, capability, unresolved)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if conf.Handler.Capsvc2Aad.SetGroupOwners {
+		if err := reconcileAzureGroupOwners(ctx, azClient, azureGroup.ID); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, duplicate := range groups.duplicates {
+		group, err := azClient.GetGroupWithMembers(ctx, duplicate.ID, duplicate.DisplayName)
+		if err != nil {
+			return nil, err
+		}
+		if err := removeAzureGroupMembers(ctx, azClient, group, capability); err != nil {
+			return nil, err
+		}
+	}
+
+	return azureGroup, nil
+}
+
+// syncAppAssignments assigns the AAD group of the Capability to the AWS enterprise application if the Capability has
+// an AWS account, and to the enterprise applications all Capability groups are assigned to.
+func syncAppAssignments(ctx context.Context, azClient *azure.Client, conf config.Config, capability *capsvc.GetCapabilitiesResponseContextCapability, azureGroup *azure.Group) error {
+	apps, err := capabilityEnterpriseApps(conf, capability)
+	if err != nil {
+		return err
+	}
+
+	if len(apps) == 0 {
+		return SyncStepSkipped.New("Capability has no AWS account and no enterprise app mappings are configured")
+	}
+
+	for _, app := range apps {
+		appRoles, err := azClient.GetApplicationRoles(ctx, app.AppId)
+		if err != nil {
+			return err
+		}
+
+		appRoleId, err := appRoles.GetRoleId("User")
+		if err != nil {
+			return err
+		}
+
+		appAssignments, err := azClient.GetAssignmentsForApplication(ctx, app.ObjectId)
+		if err != nil {
+			return err
+		}
+
+		if !appAssignments.ContainsGroup(azureGroup.DisplayName) {
+			util.Logger.Info(fmt.Sprintf("Group %s has not been assigned to application %s yet, assigning", azureGroup.DisplayName, app.AppId), zap.String("jobName", CapabilitySyncName))
+			err := AssignGroupToApplication(ctx, azClient, app.ObjectId, azureGroup.ID, appRoleId)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// capabilityEnterpriseApps returns the enterprise applications the AAD group of a Capability should be assigned to.
+func capabilityEnterpriseApps(conf config.Config, capability *capsvc.GetCapabilitiesResponseContextCapability) ([]EnterpriseAppData, error) {
+	apps := []EnterpriseAppData{}
+	if _, err := capability.GetContext(); err == nil {
+		apps = append(apps, EnterpriseAppData{AppId: conf.Azure.ApplicationId, ObjectId: conf.Azure.ApplicationObjectId})
+	}
+
+	if conf.Handler.AssignGroups2AzureEnterpriseApps.DataFilePath != "" {
+		mappedApps, err := loadEnterpriseAppMappings(conf.Handler.AssignGroups2AzureEnterpriseApps.DataFilePath)
+		if err != nil {
+			return nil, err
+		}
+		apps = append(apps, mappedApps...)
+	}
+
+	return apps, nil
+}
+
+// syncCapabilityPermissionSet assigns the Capability permission set to the SSO group of the Capability in its AWS
+// account. Returns the AWS account of the Capability.
+func syncCapabilityPermissionSet(ctx context.Context, cfg daws.Config, conf config.Config, capability *capsvc.GetCapabilitiesResponseContextCapability) (*aws.SsoRoleMapping, error) {
+	capaContext, err := capability.GetContext()
+	if err != nil {
+		return nil, SyncStepSkipped.New(err.Error())
+	}
+	accountId := capaContext.AwsAccountID
+
+	orgClient := organizations.NewFromConfig(cfg)
+	account, err := orgClient.DescribeAccount(ctx, &organizations.DescribeAccountInput{AccountId: &accountId})
+	if err != nil {
+		return nil, err
+	}
+
+	err = AssignCapabilityPermissionSet(ctx, ssoadmin.NewFromConfig(cfg), identitystore.NewFromConfig(cfg), conf, capability.RootID, accountId)
+	if err != nil {
+		if errorx.IsOfType(err, SsoGroupNotFound) {
+			return nil, SyncStepSkipped.New("group is not yet provisioned to AWS")
+		}
+		return nil, err
+	}
+
+	return &aws.SsoRoleMapping{
+		AccountAlias: *account.Account.Name,
+		AccountId:    accountId,
+		RootId:       capability.RootID,
+	}, nil
+}
+
+// syncAwsAuthMapping adds the Capability access role of the AWS account to the aws-auth ConfigMap.
+func syncAwsAuthMapping(ctx context.Context, conf config.Config, account aws.SsoRoleMapping) error {
+	roles, err := aws.GetSsoRoles(ctx, []aws.SsoRoleMapping{account}, conf.Aws.AssumableRoles.CapabilityAccountRoleName)
+	if err != nil {
+		return err
+	}
+
+	role, ok := roles[account.AccountAlias]
+	if !ok {
+		return SyncStepSkipped.New(fmt.Sprintf("SSO role for Capability access not yet provisioned in AWS account %s", account.AccountId))
+	}
+
+	k8sClient, err := k8s.GetK8sClient()
+	if err != nil {
+		return err
+	}
+
+	return AddAwsAuthRoleMapping(ctx, k8sClient, role)
+}
+
+// syncSharedRoles assigns the shared permission sets, e.g. for reading Capability logs, to the SSO group of the
+// Capability.
+func syncSharedRoles(ctx context.Context, cfg daws.Config, conf config.Config, rootId string) error {
+	manageSso, err := aws.InitManageSso(ctx, cfg, conf.Aws.IdentityStoreArn)
+	if err != nil {
+		return err
+	}
+
+	ssoClient := ssoadmin.NewFromConfig(cfg)
+	identityStoreClient := identitystore.NewFromConfig(cfg)
+
+	for _, sharedRole := range capabilitySharedRoles(conf) {
+		acc := manageSso.GetAccountByName(sharedRole.AwsAccountNameAlias)
+		if acc == nil {
+			return errors.New(fmt.Sprintf("Unable to find AWS account by alias %s", sharedRole.AwsAccountNameAlias))
+		}
+
+		err = AssignGroupPermissionSet(ctx, ssoClient, identityStoreClient, conf, rootId, sharedRole.PermissionSetArn, *acc.Id)
+		if err != nil {
+			if errorx.IsOfType(err, SsoGroupNotFound) {
+				return SyncStepSkipped.New("group is not yet provisioned to AWS")
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+// syncEmailAliases creates the email aliases of the Capability if they don't exist, and reconciles the members of
+// its main alias.
+func syncEmailAliases(ctx context.Context, azClient *azure.Client, capSvcClient *capsvc.Client, conf config.Config, capability *capsvc.GetCapabilitiesResponseContextCapability) error {
+	ssuClient := ssu_exchange.NewSsuExchangeClientO365UnofficialApi(ssu_exchange.Config{
+		TenantId:     conf.Azure.TenantId,
+		ClientId:     conf.Exchange.ClientId,
+		ClientSecret: conf.Exchange.ClientSecret,
+		Auth:         conf.Exchange.Auth,
+		BaseUrl:      conf.Exchange.BaseUrl,
+		ManagedBy:    conf.Exchange.ManagedBy,
+		EmailSuffix:  conf.Exchange.EmailSuffix,
+	})
+
+	aliases, err := ssuClient.GetAliases(ctx)
+	if err != nil {
+		return err
+	}
+
+	handler := &capabilityEmailAliasHandler{
+		CapSvcClient:         capSvcClient,
+		ExchangeOnlineClient: ssuClient,
+		AzClient:             azClient,
+		Cache:                &capabilityEmailAliasHandlerCache{Capabilities: []*capsvc.GetCapabilitiesResponseContextCapability{capability}},
+		State:                newEmailAliasState(aliases),
+		Logger:               util.Logger.With(zap.String("job", CapabilitySyncName)),
+		Config:               conf,
+	}
+
+	azureGroupsResp, err := azClient.GetGroups(ctx, ssu_exchange.GenerateExchangeDistributionGroupDisplayName(capability.RootID))
+	if err != nil {
+		return err
+	}
+	err = handler.PopulateGroupsWithMembers(ctx, azureGroupsResp)
+	if err != nil {
+		return err
+	}
+
+	err = handler.ReconcileMainAlias(ctx)
+	if err != nil {
+		return err
+	}
+
+	return handler.ReconcileSubAliases(ctx)
+}
+
+var (
+	CapabilitySyncError = errorx.NewNamespace("capabilitySync")
+	CapabilityNotFound  = CapabilitySyncError.NewType("capability_not_found")
+	SyncStepSkipped     = CapabilitySyncError.NewType("step_skipped")
+)
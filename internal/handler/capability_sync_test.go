@@ -0,0 +1,39 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.dfds.cloud/aad-aws-sync/internal/jobs"
+	"go.dfds.cloud/aad-aws-sync/internal/util"
+	"go.uber.org/zap"
+)
+
+func TestCapabilitySyncResult(t *testing.T) {
+	util.Logger = zap.NewNop()
+	result := &CapabilitySyncResult{RootId: "sandbox-abcde"}
+
+	assert.True(t, result.run(context.Background(), SyncStepAadGroup, func(ctx context.Context) error {
+		jobs.CountMutation(ctx, MutationAadGroupCreated)
+		return nil
+	}))
+	assert.False(t, result.run(context.Background(), SyncStepSsoPermissionSet, func(ctx context.Context) error {
+		return SyncStepSkipped.New("group is not yet provisioned to AWS")
+	}))
+	result.skip(SyncStepAwsAuthMapping, SyncStepSsoPermissionSet)
+	assert.False(t, result.Failed())
+
+	assert.False(t, result.run(context.Background(), SyncStepEmailAliases, func(ctx context.Context) error {
+		return errors.New("boom")
+	}))
+	assert.True(t, result.Failed())
+
+	assert.Equal(t, []SyncStepResult{
+		{Step: SyncStepAadGroup, Status: SyncStepStatusOk, Mutations: map[string]int{MutationAadGroupCreated: 1}},
+		{Step: SyncStepSsoPermissionSet, Status: SyncStepStatusSkipped, Message: "group is not yet provisioned to AWS", Mutations: map[string]int{}},
+		{Step: SyncStepAwsAuthMapping, Status: SyncStepStatusSkipped, Message: "skipped since step ssoPermissionSet did not succeed", Mutations: map[string]int{}},
+		{Step: SyncStepEmailAliases, Status: SyncStepStatusFailed, Message: "boom", Mutations: map[string]int{}},
+	}, result.Steps)
+}
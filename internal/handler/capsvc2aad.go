@@ -7,9 +7,11 @@ import (
 	"sync"
 
 	"github.com/joomcode/errorx"
+	"go.dfds.cloud/aad-aws-sync/internal/audit"
 	"go.dfds.cloud/aad-aws-sync/internal/azure"
 	"go.dfds.cloud/aad-aws-sync/internal/capsvc"
 	"go.dfds.cloud/aad-aws-sync/internal/config"
+	"go.dfds.cloud/aad-aws-sync/internal/store"
 	"go.dfds.cloud/aad-aws-sync/internal/util"
 	"go.uber.org/zap"
 	"golang.org/x/sync/semaphore"
@@ -24,29 +26,35 @@ func Capsvc2AadHandler(ctx context.Context) error {
 		return err
 	}
 
-	groupsInAzure := make(map[string]*azure.Group)
 	capabilitiesByRootId := make(map[string]*capsvc.GetCapabilitiesResponseContextCapability)
 	client := capsvc.NewCapSvcClient(capsvc.Config{
 		Host:         conf.CapSvc.Host,
 		TenantId:     conf.Azure.TenantId,
 		ClientId:     conf.CapSvc.ClientId,
 		ClientSecret: conf.CapSvc.ClientSecret,
+		Auth:         conf.CapSvc.Auth,
 		Scope:        conf.CapSvc.TokenScope,
 	})
 
-	capabilities, err := client.GetCapabilities()
+	capabilities, err := client.GetCapabilities(ctx)
 	if err != nil {
 		return err
 	}
+	if err := capsvc.SaveSnapshot(store.Default(), capabilities); err != nil {
+		util.Logger.Warn("Unable to save Capability-Service snapshot to state store", zap.Error(err))
+	}
 
 	azureClient := azure.NewAzureClient(azure.Config{
 		TenantId:             conf.Azure.TenantId,
 		ClientId:             conf.Azure.ClientId,
 		ClientSecret:         conf.Azure.ClientSecret,
+		Auth:                 conf.Azure.Auth,
 		InternalDomainSuffix: conf.Azure.InternalDomainSuffix,
+		TransitiveMembers:    conf.Azure.TransitiveMembers,
+		CapabilityIdProperty: conf.Azure.CapabilityIdProperty,
 	})
 
-	aUnits, err := azureClient.GetAdministrativeUnits()
+	aUnits, err := azureClient.GetAdministrativeUnits(ctx)
 	if err != nil {
 		return err
 	}
@@ -56,17 +64,18 @@ func Capsvc2AadHandler(ctx context.Context) error {
 		return errors.New("unable to find administrative unit")
 	}
 
-	aUnitMembers, err := azureClient.GetAdministrativeUnitMembers(aUnit.ID)
+	aUnitMembers, err := azureClient.GetAdministrativeUnitMembers(ctx, aUnit.ID)
 	if err != nil {
 		return err
 	}
 
-	err = findDuplicateGroupsAndEliminate(azureClient, aUnit.ID, aUnitMembers, capabilities)
+	identityStoreGroups := AwsIdentityStoreGroups(conf)
+	err = findDuplicateGroupsAndEliminate(ctx, azureClient, aUnit.ID, aUnitMembers, capabilities, identityStoreGroups, conf.Handler.Capsvc2Aad.ReportDuplicatesOnly)
 	if err != nil {
 		return err
 	}
 
-	aUnitMembers, err = azureClient.GetAdministrativeUnitMembers(aUnit.ID)
+	aUnitMembers, err = azureClient.GetAdministrativeUnitMembers(ctx, aUnit.ID)
 	if err != nil {
 		return err
 	}
@@ -74,54 +83,33 @@ func Capsvc2AadHandler(ctx context.Context) error {
 	for _, capability := range capabilities {
 		capabilitiesByRootId[capability.RootID] = capability
 	}
+	reportCapabilityGroupDrift(aUnitMembers.Value, capabilitiesByRootId)
 
-	{
-		ctx := context.Background()
-		var waitGroup sync.WaitGroup
-		sem := semaphore.NewWeighted(50)
-		var lock *sync.Mutex = &sync.Mutex{}
-		for _, member := range aUnitMembers.Value {
-			select {
-			case <-ctx.Done():
-				util.Logger.Info("Job cancelled", zap.String("jobName", CapabilityServiceToAzureAdName))
-				return nil
-			default:
-				waitGroup.Add(1)
-				member := member
-				go func() error {
-					sem.Acquire(ctx, 1)
-					defer sem.Release(1)
-					defer waitGroup.Done()
-
-					group := &azure.Group{
-						DisplayName: member.DisplayName,
-						ID:          member.ID,
-						Members:     []*azure.Member{},
-					}
-					groupMembers, err := azureClient.GetGroupMembers(member.ID)
-					if err != nil {
-						return err
-					}
-
-					for _, groupMember := range groupMembers.Value {
-						group.Members = append(group.Members, &azure.Member{
-							ID:                groupMember.ID,
-							DisplayName:       groupMember.DisplayName,
-							UserPrincipalName: groupMember.UserPrincipalName,
-						})
-					}
-
-					lock.Lock()
-					groupsInAzure[group.DisplayName] = group
-					lock.Unlock()
-					return nil
-				}()
-			}
+	groupsInAzure, err := getAdministrativeUnitGroups(ctx, azureClient, store.Default(), conf.Azure.DeltaSync, aUnitMembers.Value)
+	if ctx.Err() != nil {
+		util.Logger.Info("Job cancelled", zap.String("jobName", CapabilityServiceToAzureAdName))
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	capabilitiesWithoutGroup := 0
+	for rootId := range capabilitiesByRootId {
+		if len(CapabilityGroupsOf(aUnitMembers.Value, rootId)) == 0 {
+			capabilitiesWithoutGroup++
 		}
+	}
+	setDrift(CapabilityServiceToAzureAdName, audit.SystemAzureAd, DriftCapabilitiesWithoutAadGroup, capabilitiesWithoutGroup)
 
-		waitGroup.Wait()
+	if conf.Handler.Capsvc2Aad.InviteGuests {
+		// Before inviting anyone, so members whose guest user was deleted are invited again
+		if err := trackGuestInvitations(ctx, azureClient, store.Default()); err != nil {
+			return err
+		}
 	}
 
+	membersNotInAad := 0
 	for rootId, capability := range capabilitiesByRootId {
 		select {
 		case <-ctx.Done():
@@ -129,135 +117,367 @@ func Capsvc2AadHandler(ctx context.Context) error {
 			return nil
 		default:
 		}
-		azureGroupName := fmt.Sprintf("%s %s", CAPABILITY_GROUP_PREFIX, rootId)
 		var azureGroup *azure.Group
 
 		// Check if Capability has a group in Azure AD, if it doesn't create it
-		if resp, ok := groupsInAzure[azureGroupName]; !ok {
+		unit, duplicates, err := CapabilityGroupOf(ctx, aUnitMembers.Value, rootId, identityStoreGroups)
+		if err != nil {
+			return err
+		}
+		if unit == nil {
 			util.Logger.Info(fmt.Sprintf("Capability %s doesn't exist in Azure, creating.\n", rootId), zap.String("jobName", CapabilityServiceToAzureAdName))
-			createGroupRequest := azure.CreateAdministrativeUnitGroupRequest{
-				OdataType:       "#Microsoft.Graph.Group",
-				Description:     "[Automated] - aad-aws-sync",
-				DisplayName:     azure.GenerateAzureGroupDisplayName(rootId),
-				MailNickname:    azure.GenerateAzureGroupMailPrefix(rootId),
-				GroupTypes:      []interface{}{},
-				MailEnabled:     false,
-				SecurityEnabled: true,
-
-				ParentAdministrativeUnitId: aUnit.ID,
+			azureGroup, err = CreateCapabilityAzureGroup(ctx, azureClient, aUnit.ID, capability, identityStoreGroups)
+			if err != nil {
+				return err
+			}
+		} else {
+			azureGroup = groupsInAzure[unit.ID]
+			if CapabilityGroupNeedsBinding(azureClient, *unit, capability) {
+				if err := BindCapabilityGroup(ctx, azureClient, unit.ID, capability); err != nil {
+					return err
+				}
 			}
-			resp, err := azureClient.CreateAdministrativeUnitGroup(ctx, createGroupRequest)
+		}
+
+		unresolved, err := reconcileAzureGroupMembers(ctx, azureClient, azureGroup, capability)
+		if err != nil {
+			return err
+		}
+		if conf.Handler.Capsvc2Aad.InviteGuests {
+			unresolved, err = inviteUnresolvedMembers(ctx, azureClient, store.Default(), conf.Handler.Capsvc2Aad.InviteRedirectUrl, azureGroup, capability, unresolved)
 			if err != nil {
 				return err
 			}
+		}
+		membersNotInAad += len(unresolved)
+		if conf.Handler.Capsvc2Aad.SetGroupOwners {
+			if err := reconcileAzureGroupOwners(ctx, azureClient, azureGroup.ID); err != nil {
+				return err
+			}
+		}
 
-			azureGroup = &azure.Group{ID: resp.ID, DisplayName: resp.DisplayName}
-		} else {
-			azureGroup = resp
+		// Duplicates that weren't removed still grant access, e.g. through their Identity Store group
+		for _, duplicate := range duplicates {
+			if err := removeAzureGroupMembers(ctx, azureClient, groupsInAzure[duplicate.ID], capability); err != nil {
+				return err
+			}
 		}
+	}
+	setDrift(CapabilityServiceToAzureAdName, audit.SystemAzureAd, DriftCapabilityMembersNotInAad, membersNotInAad)
 
-		// Add missing members in Azure AD group
-		if azureGroup != nil {
-			for _, capMember := range capability.Members {
-				select {
-				case <-ctx.Done():
-					util.Logger.Info("Job cancelled", zap.String("jobName", CapabilityServiceToAzureAdName))
-					return nil
-				default:
-				}
+	return nil
+}
 
-				upn := capMember.Email
-				// treat user as external, look up UPN manually
-				if azureClient.IsUserExternal(upn) {
-					resp, err := azureClient.GetUserViaEmail(capMember.Email)
-					if err != nil {
-						return err
-					}
-					upn = resp.UserPrincipalName
-				}
+// CreateCapabilityAzureGroup creates the AAD group of a Capability in the self service administrative unit, and binds
+// it to the Capability. If the group of the Capability was deleted recently, it is restored instead, so it keeps its
+// object ID, and with it the Identity Store group and account assignments it was provisioned to AWS with, see
+// restoreCapabilityAzureGroup.
+func CreateCapabilityAzureGroup(ctx context.Context, azureClient *azure.Client, aUnitId string, capability *capsvc.GetCapabilitiesResponseContextCapability, lookupIdentityStoreGroups IdentityStoreGroups) (*azure.Group, error) {
+	restored, err := restoreCapabilityAzureGroup(ctx, azureClient, aUnitId, capability, lookupIdentityStoreGroups)
+	if err != nil || restored != nil {
+		return restored, err
+	}
+
+	createGroupRequest := azure.CreateAdministrativeUnitGroupRequest{
+		OdataType:       "#Microsoft.Graph.Group",
+		Description:     azure.CapabilityGroupDescription(capability.Name),
+		DisplayName:     azure.GenerateAzureGroupDisplayName(capability.RootID),
+		MailNickname:    azure.GenerateAzureGroupMailPrefix(capability.RootID),
+		GroupTypes:      []interface{}{},
+		MailEnabled:     false,
+		SecurityEnabled: true,
 
-				if !azureGroup.HasMember(upn) {
-					util.Logger.Debug(fmt.Sprintf("Azure group %s missing member %s, adding.\n", azureGroup.DisplayName, upn), zap.String("jobName", CapabilityServiceToAzureAdName))
-
-					err = azureClient.AddGroupMember(azureGroup.ID, upn)
-					if err != nil {
-						if errorx.IsOfType(err, azure.AdUserNotFound) {
-							util.Logger.Debug(err.Error(), zap.String("jobName", CapabilityServiceToAzureAdName))
-							continue
-						}
-						if errorx.IsOfType(err, azure.HttpError403) {
-							util.Logger.Debug(err.Error(), zap.String("jobName", CapabilityServiceToAzureAdName))
-							continue
-						}
-
-						return err
-					}
+		ParentAdministrativeUnitId: aUnitId,
+	}
+	var resp *azure.CreateAdministrativeUnitGroupResponse
+	err = mutate(ctx, func() (err error) {
+		resp, err = azureClient.CreateAdministrativeUnitGroup(ctx, createGroupRequest)
+		return err
+	})
+	mutation := audit.Mutation{
+		System:    audit.SystemAzureAd,
+		Action:    MutationAadGroupCreated,
+		ObjectIds: map[string]string{"administrativeUnitId": aUnitId, "displayName": createGroupRequest.DisplayName},
+	}
+	if resp != nil {
+		mutation.ObjectIds["groupId"] = resp.ID
+		mutation.After = resp
+	}
+	RecordMutation(ctx, mutation, err)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp == nil {
+		// A dry run plans the members of the group as if it had been created
+		return &azure.Group{DisplayName: createGroupRequest.DisplayName}, nil
+	}
+
+	// Graph only accepts extension properties of groups once they exist. A group that fails to be bound is bound by
+	// its display name in the next run.
+	if azureClient.BindsGroups() {
+		if err := BindCapabilityGroup(ctx, azureClient, resp.ID, capability); err != nil {
+			return nil, err
+		}
+	}
+
+	return &azure.Group{ID: resp.ID, DisplayName: resp.DisplayName}, nil
+}
+
+// reconcileAzureGroupMembers adds Capability members missing from the AAD group of the Capability, and removes
+// members that are no longer part of the Capability. Users are looked up, added and removed in batches. Returns the
+// Capability members not found in AAD.
+func reconcileAzureGroupMembers(ctx context.Context, azureClient *azure.Client, azureGroup *azure.Group, capability *capsvc.GetCapabilitiesResponseContextCapability) ([]string, error) {
+	unresolved, err := addAzureGroupMembers(ctx, azureClient, azureGroup, capability)
+	if err != nil {
+		return unresolved, err
+	}
+
+	return unresolved, removeAzureGroupMembers(ctx, azureClient, azureGroup, capability)
+}
+
+// addAzureGroupMembers adds Capability members missing from the AAD group of the Capability. Returns the Capability
+// members not found in AAD, by email address for external members and by UPN otherwise.
+func addAzureGroupMembers(ctx context.Context, azureClient *azure.Client, azureGroup *azure.Group, capability *capsvc.GetCapabilitiesResponseContextCapability) ([]string, error) {
+	if ctx.Err() != nil {
+		util.Logger.Info("Job cancelled", zap.String("jobName", CapabilityServiceToAzureAdName))
+		return nil, nil
+	}
+
+	// treat users as external, look up their UPN manually
+	var externalEmails []string
+	for _, capMember := range capability.Members {
+		if azureClient.IsUserExternal(capMember.Email) {
+			externalEmails = append(externalEmails, capMember.Email)
+		}
+	}
+	externalUsers, err := azureClient.GetUsersViaEmail(ctx, externalEmails)
+	if err != nil {
+		return nil, err
+	}
+
+	var unresolved []string
+	userIds := map[string]string{}
+	var missingUpns []string
+	var internalUpns []string
+	for _, capMember := range capability.Members {
+		upn := capMember.Email
+		if azureClient.IsUserExternal(upn) {
+			result := externalUsers[capMember.Email]
+			if result.Err != nil {
+				if errorx.IsOfType(result.Err, azure.AdUserNotFound) {
+					util.Logger.Debug(result.Err.Error(), zap.String("jobName", CapabilityServiceToAzureAdName))
+					unresolved = append(unresolved, capMember.Email)
+					continue
 				}
+				if errorx.IsOfType(result.Err, azure.HttpError403) {
+					util.Logger.Debug(result.Err.Error(), zap.String("jobName", CapabilityServiceToAzureAdName))
+					continue
+				}
+				return unresolved, result.Err
 			}
+			upn = result.User.UserPrincipalName
+			userIds[upn] = result.User.ID
+		}
 
-			//Delete members no longer in capability from Azure AD Group
-			for _, member := range azureGroup.Members {
-				select {
-				case <-ctx.Done():
-					util.Logger.Info("Job cancelled", zap.String("jobName", CapabilityServiceToAzureAdName))
-					return nil
-				default:
-				}
+		// Members of nested groups are members of the Capability group as well, see azure.Config.TransitiveMembers
+		if azureGroup.HasTransitiveMember(upn) || containsString(missingUpns, upn) {
+			continue
+		}
+		util.Logger.Debug(fmt.Sprintf("Azure group %s missing member %s, adding.\n", azureGroup.DisplayName, upn), zap.String("jobName", CapabilityServiceToAzureAdName))
+		missingUpns = append(missingUpns, upn)
+		if _, ok := userIds[upn]; !ok {
+			internalUpns = append(internalUpns, upn)
+		}
+	}
+	if len(missingUpns) == 0 {
+		return unresolved, nil
+	}
 
-				upn := member.UserPrincipalName
-				// treat user as external, look up UPN manually
-				if azureClient.IsUserExternal(upn) {
-					resp, err := azureClient.GetUserViaUPN(member.UserPrincipalName)
-					if err != nil {
-						return err
-					}
-					upn = resp.Mail
-				}
+	// Members are added by object ID
+	errs := map[string]error{}
+	internalUsers, err := azureClient.GetUsersViaUPN(ctx, internalUpns)
+	if err != nil {
+		return unresolved, err
+	}
+	for upn, result := range internalUsers {
+		if result.Err != nil {
+			errs[upn] = result.Err
+			continue
+		}
+		userIds[upn] = result.User.ID
+	}
 
-				if !capability.HasMember(upn) {
-					util.Logger.Debug(fmt.Sprintf("Azure group %s contains stale member %s, removing.\n", azureGroup.DisplayName, upn), zap.String("jobName", CapabilityServiceToAzureAdName))
-					err = azureClient.DeleteGroupMember(azureGroup.ID, member.ID)
-					if err != nil {
-						return err
-					}
-				}
+	var idsToAdd []string
+	for _, upn := range missingUpns {
+		if _, failed := errs[upn]; !failed {
+			idsToAdd = append(idsToAdd, userIds[upn])
+		}
+	}
+
+	var addErrs map[string]error
+	err = mutate(ctx, func() (err error) {
+		addErrs, err = azureClient.AddGroupMembers(ctx, azureGroup.ID, idsToAdd)
+		return err
+	})
+	if err != nil {
+		return unresolved, err
+	}
+
+	for _, upn := range missingUpns {
+		err, failed := errs[upn]
+		if !failed {
+			err = addErrs[userIds[upn]]
+		}
+		RecordMutation(ctx, MembershipMutation(audit.SystemAzureAd, MutationAadGroupMemberAdded, map[string]string{"groupId": azureGroup.ID, "userPrincipalName": upn}, true), err)
+		if err != nil {
+			if errorx.IsOfType(err, azure.AdUserNotFound) {
+				util.Logger.Debug(err.Error(), zap.String("jobName", CapabilityServiceToAzureAdName))
+				unresolved = append(unresolved, upn)
+				continue
+			}
+			if errorx.IsOfType(err, azure.HttpError403) {
+				util.Logger.Debug(err.Error(), zap.String("jobName", CapabilityServiceToAzureAdName))
+				continue
 			}
 
+			return unresolved, err
 		}
 	}
-	return nil
+
+	return unresolved, nil
 }
 
-func findDuplicateGroupsAndEliminate(client *azure.Client, aUnitId string, groups *azure.GetAdministrativeUnitMembersResponse, capabilities []*capsvc.GetCapabilitiesResponseContextCapability) error {
-	for _, capability := range capabilities {
-		groupName := azure.GenerateAzureGroupDisplayName(capability.RootID)
-		var matches []azure.GetAdministrativeUnitMembersResponseUnit
-		for _, group := range groups.Value {
-			if group.DisplayName == groupName {
-				matches = append(matches, group)
-			}
+// removeAzureGroupMembers removes the members of the AAD group of the Capability that are no longer part of the
+// Capability.
+func removeAzureGroupMembers(ctx context.Context, azureClient *azure.Client, azureGroup *azure.Group, capability *capsvc.GetCapabilitiesResponseContextCapability) error {
+	if ctx.Err() != nil {
+		util.Logger.Info("Job cancelled", zap.String("jobName", CapabilityServiceToAzureAdName))
+		return nil
+	}
+
+	// treat users as external, look up their e-mail address manually
+	var externalUpns []string
+	for _, member := range azureGroup.Members {
+		if azureClient.IsUserExternal(member.UserPrincipalName) {
+			externalUpns = append(externalUpns, member.UserPrincipalName)
 		}
-		if len(matches) > 1 {
-			util.Logger.Info(fmt.Sprintf("Duplicate groups found for Capability %s, eliminating excess", capability.RootID), zap.String("jobName", CapabilityServiceToAzureAdName))
-			oldest := matches[0]
-			oldestIndex := 0
-			for i, group := range matches {
-				if group.CreatedDateTime.Before(oldest.CreatedDateTime) {
-					oldest = group
-					oldestIndex = i
-				}
-				util.Logger.Debug(fmt.Sprintf("%s (%s) - %s", group.CreatedDateTime, group.ID, group.DisplayName), zap.String("jobName", CapabilityServiceToAzureAdName))
+	}
+	externalUsers, err := azureClient.GetUsersViaUPN(ctx, externalUpns)
+	if err != nil {
+		return err
+	}
+
+	var staleMembers []*azure.Member
+	var staleIds []string
+	for _, member := range azureGroup.Members {
+		upn := member.UserPrincipalName
+		if azureClient.IsUserExternal(upn) {
+			result := externalUsers[member.UserPrincipalName]
+			if errorx.IsOfType(result.Err, azure.AdUserNotFound) {
+				// Deleted since the members of the group were read
+				util.Logger.Debug(result.Err.Error(), zap.String("jobName", CapabilityServiceToAzureAdName))
+				continue
 			}
-			groupsWithoutOldest := append(matches[:oldestIndex], matches[oldestIndex+1:]...)
-			util.Logger.Debug(fmt.Sprintf("Oldest is %s - %s", oldest.ID, oldest.CreatedDateTime), zap.String("jobName", CapabilityServiceToAzureAdName))
-			for _, group := range groupsWithoutOldest {
-				util.Logger.Info(fmt.Sprintf("Removing group %s (%s)", group.ID, group.DisplayName), zap.String("jobName", CapabilityServiceToAzureAdName))
-				err := client.DeleteAdministrativeUnitGroup(aUnitId, group.ID)
-				if err != nil {
-					return err
-				}
+			if result.Err != nil {
+				return result.Err
 			}
+			upn = result.User.Mail
+		}
+
+		if !capability.HasMember(upn) {
+			util.Logger.Debug(fmt.Sprintf("Azure group %s contains stale member %s, removing.\n", azureGroup.DisplayName, upn), zap.String("jobName", CapabilityServiceToAzureAdName))
+			staleMembers = append(staleMembers, member)
+			staleIds = append(staleIds, member.ID)
 		}
 	}
-	return nil
+	if len(staleMembers) == 0 {
+		return nil
+	}
+
+	var deleteErrs map[string]error
+	err = mutate(ctx, func() (err error) {
+		deleteErrs, err = azureClient.DeleteGroupMembers(ctx, azureGroup.ID, staleIds)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	var firstErr error
+	for _, member := range staleMembers {
+		err := deleteErrs[member.ID]
+		RecordMutation(ctx, MembershipMutation(audit.SystemAzureAd, MutationAadGroupMemberRemoved, map[string]string{"groupId": azureGroup.ID, "userId": member.ID, "userPrincipalName": member.UserPrincipalName}, false), err)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getAdministrativeUnitGroups returns the groups of an administrative unit with their members, by ID. With deltaSync,
+// the Capability groups are read from the GroupCache in st, and only groups missing from it are read from Graph.
+func getAdministrativeUnitGroups(ctx context.Context, azureClient *azure.Client, st store.Store, deltaSync bool, units []azure.GetAdministrativeUnitMembersResponseUnit) (map[string]*azure.Group, error) {
+	cachedGroups := map[string]*azure.Group{}
+	if deltaSync {
+		var err error
+		cachedGroups, err = azure.NewGroupCache(azureClient, st, CAPABILITY_GROUP_PREFIX).Groups(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	groups := make(map[string]*azure.Group)
+	var waitGroup sync.WaitGroup
+	sem := semaphore.NewWeighted(50)
+	var lock sync.Mutex
+	var membersErr error
+	for _, unit := range units {
+		if group, ok := cachedGroups[unit.ID]; ok {
+			lock.Lock()
+			groups[unit.ID] = group
+			lock.Unlock()
+			continue
+		}
+
+		if err := sem.Acquire(ctx, 1); err != nil {
+			waitGroup.Wait()
+			return nil, err
+		}
+		waitGroup.Add(1)
+		unit := unit
+		go func() {
+			defer sem.Release(1)
+			defer waitGroup.Done()
+
+			group, err := azureClient.GetGroupWithMembers(ctx, unit.ID, unit.DisplayName)
+
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				membersErr = err
+				return
+			}
+			groups[unit.ID] = group
+		}()
+	}
+
+	waitGroup.Wait()
+	// A group whose members couldn't be read would otherwise look like it doesn't exist, and be created again
+	if membersErr != nil {
+		return nil, membersErr
+	}
+
+	return groups, nil
 }
@@ -0,0 +1,408 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/joomcode/errorx"
+	"github.com/stretchr/testify/assert"
+	"go.dfds.cloud/aad-aws-sync/internal/azure"
+	"go.dfds.cloud/aad-aws-sync/internal/capsvc"
+	"go.dfds.cloud/aad-aws-sync/internal/jobs"
+	"go.dfds.cloud/aad-aws-sync/internal/store"
+	"go.dfds.cloud/aad-aws-sync/internal/util"
+	"go.uber.org/zap"
+)
+
+// fakeGraphResponse is a canned response of fakeGraph. A zero status means 200.
+type fakeGraphResponse struct {
+	status int
+	body   string
+}
+
+// fakeGraph serves canned responses to Graph requests, keyed by method and path, followed by the $deltatoken of delta
+// queries. Requests of a $batch request are answered by batch. Other requests are answered with 404.
+type fakeGraph struct {
+	t         *testing.T
+	url       string
+	mu        sync.Mutex
+	responses map[string]fakeGraphResponse
+	batch     func(req azure.BatchRequest) azure.BatchResponse
+	// requests are the requests received, keyed like responses, including the requests of $batch requests
+	requests []string
+}
+
+func newFakeGraph(t *testing.T, conf azure.Config) (*fakeGraph, *azure.Client) {
+	fake := &fakeGraph{t: t, responses: map[string]fakeGraphResponse{}}
+	server := httptest.NewServer(http.HandlerFunc(fake.handler))
+	t.Cleanup(server.Close)
+	fake.url = server.URL
+
+	return fake, azure.NewAzureClientForUrl(conf, server.URL)
+}
+
+func (f *fakeGraph) handler(w http.ResponseWriter, r *http.Request) {
+	key := r.Method + " " + r.URL.Path
+	if token := r.URL.Query().Get("$deltatoken"); token != "" {
+		key += "?$deltatoken=" + token
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, key)
+
+	if key == "POST /v1.0/$batch" && f.batch != nil {
+		var payload struct {
+			Requests []azure.BatchRequest `json:"requests"`
+		}
+		assert.NoError(f.t, json.NewDecoder(r.Body).Decode(&payload))
+		responses := []azure.BatchResponse{}
+		for _, req := range payload.Requests {
+			f.requests = append(f.requests, "batch "+req.Method+" "+req.URL)
+			resp := f.batch(req)
+			resp.ID = req.ID
+			responses = append(responses, resp)
+		}
+		assert.NoError(f.t, json.NewEncoder(w).Encode(map[string]any{"responses": responses}))
+		return
+	}
+
+	resp, ok := f.responses[key]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"error":{"code":"Request_ResourceNotFound"}}`)
+		return
+	}
+	if resp.status != 0 {
+		w.WriteHeader(resp.status)
+	}
+	fmt.Fprint(w, resp.body)
+}
+
+// count returns how often the fake received the request with the given key.
+func (f *fakeGraph) count(key string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	count := 0
+	for _, req := range f.requests {
+		if req == key {
+			count++
+		}
+	}
+
+	return count
+}
+
+func groupMemberNames(group *azure.Group) []string {
+	names := []string{}
+	for _, member := range group.Members {
+		names = append(names, member.UserPrincipalName)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func TestGetAdministrativeUnitGroups(t *testing.T) {
+	util.Logger = zap.NewNop()
+	fake, azureClient := newFakeGraph(t, azure.Config{})
+	deltaLink := func(path string, token string) string {
+		return fmt.Sprintf(`{"@odata.deltaLink":"%s/v1.0/%s?$deltatoken=%s","value":[]}`, fake.url, path, token)
+	}
+	fake.responses = map[string]fakeGraphResponse{
+		"GET /v1.0/groups/delta?$deltatoken=latest": {body: deltaLink("groups/delta", "g1")},
+		"GET /v1.0/users/delta?$deltatoken=latest":  {body: deltaLink("users/delta", "u1")},
+		"GET /v1.0/groups":                          {body: `{"value":[{"id":"group-1","displayName":"CI_SSU_Cap - one"}]}`},
+		"GET /v1.0/groups/group-1/members":          {body: `{"value":[{"@odata.type":"#microsoft.graph.user","id":"user-1","userPrincipalName":"one@dfds.com"}]}`},
+		"GET /v1.0/groups/group-2/members":          {body: `{"value":[{"@odata.type":"#microsoft.graph.user","id":"user-2","userPrincipalName":"two@dfds.com"}]}`},
+		"GET /v1.0/groups/delta?$deltatoken=g1": {body: fmt.Sprintf(`{"@odata.deltaLink":"%s/v1.0/groups/delta?$deltatoken=g2","value":[
+			{"id":"group-1","members@delta":[{"@odata.type":"#microsoft.graph.user","id":"user-3"}]}
+		]}`, fake.url)},
+		"GET /v1.0/users/delta?$deltatoken=u1": {body: fmt.Sprintf(`{"@odata.deltaLink":"%s/v1.0/users/delta?$deltatoken=u2","value":[
+			{"id":"user-3","displayName":"Three","userPrincipalName":"three@dfds.com"}
+		]}`, fake.url)},
+	}
+	// group-2 doesn't match the prefix of the cache, e.g. because it was renamed
+	units := []azure.GetAdministrativeUnitMembersResponseUnit{
+		{ID: "group-1", DisplayName: "CI_SSU_Cap - one"},
+		{ID: "group-2", DisplayName: "Renamed"},
+	}
+	st := store.NewMemoryStore()
+
+	// Without delta sync, every group is read from Graph
+	groups, err := getAdministrativeUnitGroups(context.Background(), azureClient, st, false, units)
+	assert.NoError(t, err)
+	assert.Len(t, groups, 2)
+	assert.Equal(t, []string{"one@dfds.com"}, groupMemberNames(groups["group-1"]))
+	assert.Equal(t, []string{"two@dfds.com"}, groupMemberNames(groups["group-2"]))
+	assert.Zero(t, fake.count("GET /v1.0/groups/delta?$deltatoken=latest"))
+
+	// The first delta sync reads the groups of the cache, and the other groups from Graph
+	groups, err = getAdministrativeUnitGroups(context.Background(), azureClient, st, true, units)
+	assert.NoError(t, err)
+	assert.Len(t, groups, 2)
+	assert.Equal(t, []string{"one@dfds.com"}, groupMemberNames(groups["group-1"]))
+	assert.Equal(t, []string{"two@dfds.com"}, groupMemberNames(groups["group-2"]))
+	assert.Equal(t, 2, fake.count("GET /v1.0/groups/group-1/members"))
+	assert.Equal(t, 2, fake.count("GET /v1.0/groups/group-2/members"))
+
+	// Later delta syncs apply the changes to the cached groups without reading their members
+	groups, err = getAdministrativeUnitGroups(context.Background(), azureClient, st, true, units)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"one@dfds.com", "three@dfds.com"}, groupMemberNames(groups["group-1"]))
+	assert.Equal(t, []string{"two@dfds.com"}, groupMemberNames(groups["group-2"]))
+	assert.Equal(t, 2, fake.count("GET /v1.0/groups/group-1/members"))
+	assert.Equal(t, 3, fake.count("GET /v1.0/groups/group-2/members"))
+	assert.Equal(t, 1, fake.count("GET /v1.0/groups/delta?$deltatoken=latest"))
+
+	// A group whose members can't be read fails the sync, rather than looking like it doesn't exist
+	delete(fake.responses, "GET /v1.0/groups/group-2/members")
+	_, err = getAdministrativeUnitGroups(context.Background(), azureClient, st, false, units)
+	assert.Error(t, err)
+}
+
+// fakeDirectory answers the batched requests of reconcileAzureGroupMembers: user lookups by UPN and e-mail address,
+// and adding and removing members of groups.
+func fakeDirectory(req azure.BatchRequest) azure.BatchResponse {
+	ok := func(body string) azure.BatchResponse {
+		return azure.BatchResponse{Status: http.StatusOK, Body: json.RawMessage(body)}
+	}
+	status := func(status int) azure.BatchResponse {
+		return azure.BatchResponse{Status: status, Body: json.RawMessage(`{}`)}
+	}
+
+	switch {
+	case req.Method == http.MethodGet && strings.HasPrefix(req.URL, "/users?"):
+		query, _ := url.ParseQuery(strings.TrimPrefix(req.URL, "/users?"))
+		switch query.Get("$filter") {
+		case "mail eq 'ext@partner.com'":
+			return ok(`{"value":[{"id":"user-ext","userPrincipalName":"ext_partner.com#EXT#@dfds.onmicrosoft.com"}]}`)
+		case "mail eq 'blocked@partner.com'":
+			return status(http.StatusForbidden)
+		}
+		return ok(`{"value":[]}`)
+	case req.Method == http.MethodGet:
+		upn, _ := url.PathUnescape(strings.TrimPrefix(req.URL, "/users/"))
+		switch upn {
+		case "a@dfds.com", "b@dfds.com", "c@dfds.com":
+			return ok(fmt.Sprintf(`{"id":"user-%s","userPrincipalName":%q}`, upn[:1], upn))
+		case "ext_partner.com#EXT#@dfds.onmicrosoft.com":
+			return ok(`{"id":"user-ext","userPrincipalName":"ext_partner.com#EXT#@dfds.onmicrosoft.com","mail":"ext@partner.com"}`)
+		case "forbidden@dfds.com":
+			return status(http.StatusForbidden)
+		}
+		return status(http.StatusNotFound)
+	case req.Method == http.MethodPost:
+		if req.URL != "/groups/group-1/members/$ref" {
+			return status(http.StatusNotFound)
+		}
+		body := req.Body.(map[string]any)["@odata.id"].(string)
+		switch {
+		case strings.HasSuffix(body, "/user-a"):
+			// Already a member
+			return status(http.StatusBadRequest)
+		case strings.HasSuffix(body, "/user-c"):
+			// Deleted since it was looked up
+			return status(http.StatusNotFound)
+		}
+		return status(http.StatusNoContent)
+	case req.Method == http.MethodDelete:
+		switch req.URL {
+		case "/groups/group-1/members/broken/$ref":
+			return status(http.StatusInternalServerError)
+		case "/groups/group-1/members/gone/$ref":
+			return status(http.StatusNotFound)
+		}
+		return status(http.StatusNoContent)
+	}
+
+	return status(http.StatusNotImplemented)
+}
+
+func testCapability(emails ...string) *capsvc.GetCapabilitiesResponseContextCapability {
+	capability := &capsvc.GetCapabilitiesResponseContextCapability{RootID: "sandbox-abcde"}
+	for _, email := range emails {
+		capability.Members = append(capability.Members, capsvc.GetCapabilitiesResponseContextCapabilityMember{Email: email})
+	}
+
+	return capability
+}
+
+func TestAddAzureGroupMembers(t *testing.T) {
+	util.Logger = zap.NewNop()
+
+	tests := []struct {
+		name         string
+		groupId      string
+		groupMembers []*azure.Member
+		members      []string
+		// bindStatus is the response to adding all missing members with a single update
+		bindStatus     int
+		wantUnresolved []string
+		wantAdded      int
+		wantErr        *errorx.Type
+		wantRequests   map[string]int
+	}{
+		{
+			name:         "internal and external members",
+			groupMembers: []*azure.Member{{ID: "user-a", UserPrincipalName: "a@dfds.com"}},
+			members:      []string{"a@dfds.com", "b@dfds.com", "ext@partner.com"},
+			bindStatus:   http.StatusNoContent,
+			wantAdded:    2,
+			wantRequests: map[string]int{
+				"batch GET /users/b@dfds.com":             1,
+				"PATCH /v1.0/groups/group-1":              1,
+				"batch GET /users/a@dfds.com":             0,
+				"POST /v1.0/$batch":                       2,
+				"GET /v1.0/groups/group-1":                0,
+				"batch POST /groups/group-1/members/$ref": 0,
+			},
+		},
+		{
+			name:           "not found and forbidden members",
+			members:        []string{"missing@dfds.com", "forbidden@dfds.com", "nobody@partner.com", "blocked@partner.com", "b@dfds.com"},
+			bindStatus:     http.StatusNoContent,
+			wantUnresolved: []string{"nobody@partner.com", "missing@dfds.com"},
+			wantAdded:      1,
+		},
+		{
+			name:           "rejected update falls back to adding members one by one",
+			members:        []string{"a@dfds.com", "b@dfds.com", "c@dfds.com"},
+			bindStatus:     http.StatusBadRequest,
+			wantUnresolved: []string{"c@dfds.com"},
+			wantAdded:      2,
+			wantRequests: map[string]int{
+				"batch POST /groups/group-1/members/$ref": 3,
+				"GET /v1.0/groups/group-1":                1,
+			},
+		},
+		{
+			name:       "duplicate members",
+			members:    []string{"b@dfds.com", "b@dfds.com", "ext@partner.com", "ext@partner.com"},
+			bindStatus: http.StatusNoContent,
+			wantAdded:  2,
+			wantRequests: map[string]int{
+				"batch GET /users/b@dfds.com": 1,
+			},
+		},
+		{
+			name:    "missing group",
+			groupId: "gone",
+			members: []string{"b@dfds.com"},
+			wantErr: azure.GroupNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, azureClient := newFakeGraph(t, azure.Config{InternalDomainSuffix: "@dfds.com"})
+			fake.batch = fakeDirectory
+			fake.responses["GET /v1.0/groups/group-1"] = fakeGraphResponse{body: `{"id":"group-1"}`}
+			if tt.bindStatus != 0 {
+				fake.responses["PATCH /v1.0/groups/group-1"] = fakeGraphResponse{status: tt.bindStatus}
+			}
+			groupId := tt.groupId
+			if groupId == "" {
+				groupId = "group-1"
+			}
+			group := &azure.Group{ID: groupId, DisplayName: "CI_SSU_Cap - sandbox", Members: tt.groupMembers}
+
+			ctx, mutations := jobs.TrackMutations(context.Background())
+			unresolved, err := addAzureGroupMembers(ctx, azureClient, group, testCapability(tt.members...))
+			if tt.wantErr != nil {
+				assert.True(t, errorx.IsOfType(err, tt.wantErr), err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantUnresolved, unresolved)
+			assert.Equal(t, tt.wantAdded, mutations()[MutationAadGroupMemberAdded])
+			for key, count := range tt.wantRequests {
+				assert.Equal(t, count, fake.count(key), key)
+			}
+		})
+	}
+}
+
+func TestRemoveAzureGroupMembers(t *testing.T) {
+	util.Logger = zap.NewNop()
+
+	tests := []struct {
+		name         string
+		groupMembers []*azure.Member
+		members      []string
+		wantRemoved  []string
+		// wantCounted is the number of members removed successfully
+		wantCounted int
+		wantErr     *errorx.Type
+	}{
+		{
+			name: "stale internal and external members",
+			groupMembers: []*azure.Member{
+				{ID: "user-a", UserPrincipalName: "a@dfds.com"},
+				{ID: "user-stale", UserPrincipalName: "stale@dfds.com"},
+				{ID: "user-ext", UserPrincipalName: "ext_partner.com#EXT#@dfds.onmicrosoft.com"},
+			},
+			members:     []string{"a@dfds.com"},
+			wantRemoved: []string{"user-ext", "user-stale"},
+			wantCounted: 2,
+		},
+		{
+			name: "external members are matched by e-mail address",
+			groupMembers: []*azure.Member{
+				{ID: "user-ext", UserPrincipalName: "ext_partner.com#EXT#@dfds.onmicrosoft.com"},
+			},
+			members: []string{"ext@partner.com"},
+		},
+		{
+			name: "partial delete failures",
+			groupMembers: []*azure.Member{
+				{ID: "broken", UserPrincipalName: "broken@dfds.com"},
+				{ID: "gone", UserPrincipalName: "gone@dfds.com"},
+				{ID: "user-stale", UserPrincipalName: "stale@dfds.com"},
+			},
+			// Members that are already gone count as removed
+			wantRemoved: []string{"broken", "gone", "user-stale"},
+			wantCounted: 2,
+			wantErr:     azure.HttpError,
+		},
+		{
+			name: "external member deleted since the group was read",
+			groupMembers: []*azure.Member{
+				{ID: "user-unknown", UserPrincipalName: "unknown_partner.com#EXT#@dfds.onmicrosoft.com"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, azureClient := newFakeGraph(t, azure.Config{InternalDomainSuffix: "@dfds.com"})
+			fake.batch = fakeDirectory
+			group := &azure.Group{ID: "group-1", DisplayName: "CI_SSU_Cap - sandbox", Members: tt.groupMembers}
+
+			ctx, mutations := jobs.TrackMutations(context.Background())
+			err := removeAzureGroupMembers(ctx, azureClient, group, testCapability(tt.members...))
+			if tt.wantErr != nil {
+				assert.True(t, errorx.IsOfType(err, tt.wantErr), err)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			var removed []string
+			for _, member := range tt.groupMembers {
+				if fake.count(fmt.Sprintf("batch DELETE /groups/group-1/members/%s/$ref", member.ID)) > 0 {
+					removed = append(removed, member.ID)
+				}
+			}
+			sort.Strings(removed)
+			assert.Equal(t, tt.wantRemoved, removed)
+			assert.Equal(t, tt.wantCounted, mutations()[MutationAadGroupMemberRemoved])
+		})
+	}
+}
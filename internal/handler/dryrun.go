@@ -0,0 +1,55 @@
+package handler
+
+import (
+	"context"
+	"sync"
+
+	"go.dfds.cloud/aad-aws-sync/internal/audit"
+)
+
+type dryRunCtxKey struct{}
+
+// Plan collects the changes a dry run would have made to downstream systems.
+type Plan struct {
+	mu        sync.Mutex
+	mutations []audit.Mutation
+}
+
+// Mutations returns the planned changes, in the order they were planned.
+func (p *Plan) Mutations() []audit.Mutation {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return append([]audit.Mutation{}, p.mutations...)
+}
+
+func (p *Plan) add(mutation audit.Mutation) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.mutations = append(p.mutations, mutation)
+}
+
+// WithDryRun returns a context in which handlers read from downstream systems as usual, but don't change them. The
+// changes they would have made are added to plan instead.
+func WithDryRun(ctx context.Context, plan *Plan) context.Context {
+	return context.WithValue(ctx, dryRunCtxKey{}, plan)
+}
+
+// IsDryRun returns true if ctx is a dry run, see WithDryRun.
+func IsDryRun(ctx context.Context) bool {
+	return planFromContext(ctx) != nil
+}
+
+func planFromContext(ctx context.Context) *Plan {
+	plan, _ := ctx.Value(dryRunCtxKey{}).(*Plan)
+	return plan
+}
+
+// mutate changes a downstream system by calling do, unless ctx is a dry run.
+func mutate(ctx context.Context, do func() error) error {
+	if IsDryRun(ctx) {
+		return nil
+	}
+
+	return do()
+}
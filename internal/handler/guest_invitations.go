@@ -0,0 +1,227 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/joomcode/errorx"
+	"go.dfds.cloud/aad-aws-sync/internal/audit"
+	"go.dfds.cloud/aad-aws-sync/internal/azure"
+	"go.dfds.cloud/aad-aws-sync/internal/capsvc"
+	"go.dfds.cloud/aad-aws-sync/internal/store"
+	"go.dfds.cloud/aad-aws-sync/internal/util"
+	"go.uber.org/zap"
+)
+
+// Statuses of a GuestInvitation.
+const (
+	GuestInvitationPending  = "pending"
+	GuestInvitationRedeemed = "redeemed"
+)
+
+// GuestInvitation is a B2B invitation sent to an external Capability member not found in AAD. Invitations are kept in
+// the state store by email address, so a member is only invited once. The state store is on a persistent volume, see
+// k8s/pvc.yml, so the invitations survive restarts.
+type GuestInvitation struct {
+	Email string `json:"email"`
+	// UserId is the object ID of the guest user created by the invitation
+	UserId string `json:"userId"`
+	// RootId is the Capability the member was first invited for
+	RootId     string     `json:"rootId"`
+	Status     string     `json:"status"`
+	InvitedAt  time.Time  `json:"invitedAt"`
+	RedeemedAt *time.Time `json:"redeemedAt,omitempty"`
+}
+
+// UnresolvedMember is a Capability member not found in AAD, with the B2B invitation sent to them, if any.
+type UnresolvedMember struct {
+	Email      string           `json:"email"`
+	Invitation *GuestInvitation `json:"invitation,omitempty"`
+	// InvitationUnknown is set if the invitations can't be read, e.g. on a standby, which doesn't have the state store
+	// open
+	InvitationUnknown bool `json:"invitationUnknown,omitempty"`
+}
+
+func guestInvitationKey(email string) string {
+	return strings.ToLower(email)
+}
+
+// LoadGuestInvitation returns the B2B invitation sent to the given email address, or nil if none was sent.
+func LoadGuestInvitation(st store.Store, email string) (*GuestInvitation, error) {
+	var invitation GuestInvitation
+	err := st.Get(store.BucketGuestInvitations, guestInvitationKey(email), &invitation)
+	if errorx.IsOfType(err, store.NotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &invitation, nil
+}
+
+// inviteUnresolvedMembers sends a B2B invitation to the external members of a Capability that weren't found in AAD,
+// unless they were invited before, and adds the guest users the invitations create to the group of the Capability.
+// An invitation that fails, e.g. because the domain of the member is blocked for B2B collaboration, is logged and
+// retried in the next run. Returns the members that are still unresolved.
+func inviteUnresolvedMembers(ctx context.Context, azureClient *azure.Client, st store.Store, redirectUrl string, azureGroup *azure.Group, capability *capsvc.GetCapabilitiesResponseContextCapability, unresolved []string) ([]string, error) {
+	var stillUnresolved []string
+	var invited []*GuestInvitation
+	for _, email := range unresolved {
+		if !azureClient.IsUserExternal(email) {
+			stillUnresolved = append(stillUnresolved, email)
+			continue
+		}
+
+		existing, err := LoadGuestInvitation(st, email)
+		if err != nil {
+			return unresolved, err
+		}
+		if existing != nil {
+			// The guest user may not be found by its email address yet, see trackGuestInvitations for deleted ones
+			stillUnresolved = append(stillUnresolved, email)
+			continue
+		}
+
+		var invitation *azure.Invitation
+		err = mutate(ctx, func() (err error) {
+			invitation, err = azureClient.InviteGuestUser(ctx, email, redirectUrl)
+			return err
+		})
+		mutation := audit.Mutation{
+			System:    audit.SystemAzureAd,
+			Action:    MutationAadGuestInvited,
+			ObjectIds: map[string]string{"email": email, "capabilityRootId": capability.RootID},
+		}
+		if invitation != nil {
+			mutation.ObjectIds["userId"] = invitation.InvitedUser.ID
+		}
+		RecordMutation(ctx, mutation, err)
+		if err != nil {
+			util.Logger.Info(fmt.Sprintf("Unable to invite %s as guest", email), zap.String("jobName", CapabilityServiceToAzureAdName), zap.Error(err))
+			stillUnresolved = append(stillUnresolved, email)
+			continue
+		}
+		if invitation == nil {
+			// A dry run plans the invitation, but can't add a guest user that doesn't exist
+			stillUnresolved = append(stillUnresolved, email)
+			continue
+		}
+
+		util.Logger.Info(fmt.Sprintf("Invited %s as guest for Capability %s", email, capability.RootID), zap.String("jobName", CapabilityServiceToAzureAdName))
+		guestInvitation := &GuestInvitation{
+			Email:     email,
+			UserId:    invitation.InvitedUser.ID,
+			RootId:    capability.RootID,
+			Status:    GuestInvitationPending,
+			InvitedAt: time.Now(),
+		}
+		if err := st.Put(store.BucketGuestInvitations, guestInvitationKey(email), guestInvitation); err != nil {
+			return unresolved, err
+		}
+		invited = append(invited, guestInvitation)
+	}
+
+	return stillUnresolved, addInvitedGuests(ctx, azureClient, azureGroup, invited)
+}
+
+// addInvitedGuests adds the guest users created by B2B invitations to the group of a Capability. Graph creates guest
+// users right away, so they don't have to redeem their invitation first.
+func addInvitedGuests(ctx context.Context, azureClient *azure.Client, azureGroup *azure.Group, invited []*GuestInvitation) error {
+	if len(invited) == 0 {
+		return nil
+	}
+
+	userIds := make([]string, 0, len(invited))
+	for _, invitation := range invited {
+		userIds = append(userIds, invitation.UserId)
+	}
+
+	var addErrs map[string]error
+	err := mutate(ctx, func() (err error) {
+		addErrs, err = azureClient.AddGroupMembers(ctx, azureGroup.ID, userIds)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, invitation := range invited {
+		err := addErrs[invitation.UserId]
+		RecordMutation(ctx, MembershipMutation(audit.SystemAzureAd, MutationAadGroupMemberAdded, map[string]string{"groupId": azureGroup.ID, "userId": invitation.UserId, "email": invitation.Email}, true), err)
+		if err != nil {
+			// The member is added by its email address in the next run
+			util.Logger.Info(fmt.Sprintf("Unable to add invited guest %s to group %s", invitation.Email, azureGroup.DisplayName), zap.String("jobName", CapabilityServiceToAzureAdName), zap.Error(err))
+		}
+	}
+
+	return nil
+}
+
+// trackGuestInvitations marks the pending B2B invitations whose guest users redeemed them as redeemed, and forgets
+// the invitations whose guest users were deleted, so the members are invited again. An invitation whose guest user
+// can't be read stays pending until the next run. The invitations are counted in the guest invitation metrics.
+func trackGuestInvitations(ctx context.Context, azureClient *azure.Client, st store.Store) error {
+	invitations := map[string]*GuestInvitation{}
+	err := st.List(store.BucketGuestInvitations, "", func(key string, value []byte) error {
+		var invitation GuestInvitation
+		if err := json.Unmarshal(value, &invitation); err != nil {
+			return err
+		}
+		invitations[key] = &invitation
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var userIds []string
+	for _, invitation := range invitations {
+		if invitation.Status == GuestInvitationPending {
+			userIds = append(userIds, invitation.UserId)
+		}
+	}
+	results, err := azureClient.GetGuestUsers(ctx, userIds)
+	if err != nil {
+		return err
+	}
+
+	counts := map[string]int{GuestInvitationPending: 0, GuestInvitationRedeemed: 0}
+	for key, invitation := range invitations {
+		result, ok := results[invitation.UserId]
+		switch {
+		case invitation.Status != GuestInvitationPending || !ok:
+		case errorx.IsOfType(result.Err, azure.AdUserNotFound):
+			util.Logger.Info(fmt.Sprintf("Guest user of %s was deleted, inviting again", invitation.Email), zap.String("jobName", CapabilityServiceToAzureAdName))
+			if !IsDryRun(ctx) {
+				if err := st.Delete(store.BucketGuestInvitations, key); err != nil {
+					return err
+				}
+			}
+			continue
+		case result.Err != nil:
+			// Checked again in the next run
+			util.Logger.Warn(fmt.Sprintf("Unable to check the guest invitation of %s", invitation.Email), zap.String("jobName", CapabilityServiceToAzureAdName), zap.Error(result.Err))
+		case result.User.ExternalUserState == azure.ExternalUserStateAccepted:
+			util.Logger.Info(fmt.Sprintf("%s redeemed their guest invitation", invitation.Email), zap.String("jobName", CapabilityServiceToAzureAdName))
+			redeemedAt := time.Now()
+			invitation.Status = GuestInvitationRedeemed
+			invitation.RedeemedAt = &redeemedAt
+			if !IsDryRun(ctx) {
+				if err := st.Put(store.BucketGuestInvitations, key, invitation); err != nil {
+					return err
+				}
+			}
+		}
+		counts[invitation.Status]++
+	}
+
+	for status, count := range counts {
+		metricGuestInvitations.WithLabelValues(status).Set(float64(count))
+	}
+
+	return nil
+}
@@ -0,0 +1,79 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.dfds.cloud/aad-aws-sync/internal/azure"
+	"go.dfds.cloud/aad-aws-sync/internal/capsvc"
+	"go.dfds.cloud/aad-aws-sync/internal/store"
+	"go.dfds.cloud/aad-aws-sync/internal/util"
+	"go.uber.org/zap"
+)
+
+func TestLoadGuestInvitation(t *testing.T) {
+	st := store.NewMemoryStore()
+	invitation := &GuestInvitation{Email: "Contractor@example.com", UserId: "guest-1", Status: GuestInvitationPending, InvitedAt: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)}
+	assert.NoError(t, st.Put(store.BucketGuestInvitations, guestInvitationKey(invitation.Email), invitation))
+
+	// Email addresses are compared case-insensitively
+	loaded, err := LoadGuestInvitation(st, "contractor@example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, invitation, loaded)
+
+	loaded, err = LoadGuestInvitation(st, "other@example.com")
+	assert.NoError(t, err)
+	assert.Nil(t, loaded)
+}
+
+func TestInviteUnresolvedMembers(t *testing.T) {
+	st := store.NewMemoryStore()
+	assert.NoError(t, st.Put(store.BucketGuestInvitations, guestInvitationKey("invited@example.com"), &GuestInvitation{Email: "invited@example.com", UserId: "guest-1", Status: GuestInvitationPending}))
+	azureClient := azure.NewAzureClient(azure.Config{InternalDomainSuffix: "@dfds.com"})
+	capability := &capsvc.GetCapabilitiesResponseContextCapability{RootID: "sandbox-abcde"}
+
+	// Internal users aren't invited, and external users are only invited once
+	unresolved, err := inviteUnresolvedMembers(context.Background(), azureClient, st, "https://myapps.microsoft.com", &azure.Group{ID: "group-1"}, capability, []string{"left@dfds.com", "invited@example.com"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"left@dfds.com", "invited@example.com"}, unresolved)
+}
+
+func TestTrackGuestInvitations(t *testing.T) {
+	util.Logger = zap.NewNop()
+	st := store.NewMemoryStore()
+	for _, invitation := range []*GuestInvitation{
+		{Email: "redeemed@example.com", UserId: "guest-redeemed", Status: GuestInvitationPending},
+		{Email: "deleted@example.com", UserId: "guest-deleted", Status: GuestInvitationPending},
+		{Email: "denied@example.com", UserId: "guest-denied", Status: GuestInvitationPending},
+	} {
+		assert.NoError(t, st.Put(store.BucketGuestInvitations, guestInvitationKey(invitation.Email), invitation))
+	}
+	fake, azureClient := newFakeGraph(t, azure.Config{})
+	fake.batch = func(req azure.BatchRequest) azure.BatchResponse {
+		switch {
+		case strings.HasPrefix(req.URL, "/users/guest-redeemed?"):
+			return azure.BatchResponse{Status: http.StatusOK, Body: json.RawMessage(`{"id":"guest-redeemed","externalUserState":"Accepted"}`)}
+		case strings.HasPrefix(req.URL, "/users/guest-denied?"):
+			return azure.BatchResponse{Status: http.StatusForbidden, Body: json.RawMessage(`{"error":{"code":"Authorization_RequestDenied"}}`)}
+		}
+		return azure.BatchResponse{Status: http.StatusNotFound, Body: json.RawMessage(`{"error":{"code":"Request_ResourceNotFound"}}`)}
+	}
+
+	// A guest user that can't be read doesn't keep the other invitations from being tracked
+	assert.NoError(t, trackGuestInvitations(context.Background(), azureClient, st))
+
+	redeemed, err := LoadGuestInvitation(st, "redeemed@example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, GuestInvitationRedeemed, redeemed.Status)
+	deleted, err := LoadGuestInvitation(st, "deleted@example.com")
+	assert.NoError(t, err)
+	assert.Nil(t, deleted)
+	denied, err := LoadGuestInvitation(st, "denied@example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, GuestInvitationPending, denied.Status)
+}
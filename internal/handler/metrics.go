@@ -0,0 +1,51 @@
+package handler
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.dfds.cloud/aad-aws-sync/internal/audit"
+	"go.dfds.cloud/aad-aws-sync/internal/metrics"
+)
+
+// Kinds of drift between Capability-Service and the downstream systems, as found by the last job run.
+const (
+	DriftCapabilitiesWithoutAadGroup = "capabilitiesWithoutAadGroup"
+	// DriftCapabilityMembersNotInAad counts the members of all Capabilities; the members of a single Capability are
+	// listed by its status, see GetCapabilityStatus
+	DriftCapabilityMembersNotInAad    = "capabilityMembersNotInAad"
+	DriftAccountsMissingPermissionSet = "accountsMissingCapabilityPermissionSet"
+	DriftOrphanedAadGroups            = "orphanedAadGroups"
+	DriftRenamedAadGroups             = "renamedAadGroups"
+)
+
+var metricMutations = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name:      "mutations_total",
+	Help:      "Changes made to downstream systems, by kind and result",
+	Namespace: "aad_aws_sync",
+}, []string{"handler", "system", "kind", "result"})
+
+var metricDrift = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name:      "drift_objects",
+	Help:      "Objects out of sync between Capability-Service and a downstream system, as found by the last job run",
+	Namespace: "aad_aws_sync",
+}, []string{"handler", "system", "kind"})
+
+var metricGuestInvitations = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name:      "guest_invitations",
+	Help:      "B2B invitations sent to Capability members not found in AAD, by whether they were redeemed",
+	Namespace: "aad_aws_sync",
+}, []string{"status"})
+
+func observeMutation(ctx context.Context, mutation audit.Mutation, err error) {
+	result := audit.ResultSucceeded
+	if err != nil {
+		result = audit.ResultFailed
+	}
+	metricMutations.WithLabelValues(metrics.HandlerFromContext(ctx), mutation.System, mutation.Action, result).Inc()
+}
+
+func setDrift(handler string, system string, kind string, count int) {
+	metricDrift.WithLabelValues(handler, system, kind).Set(float64(count))
+}
@@ -0,0 +1,68 @@
+package handler
+
+import (
+	"context"
+
+	"go.dfds.cloud/aad-aws-sync/internal/audit"
+	"go.dfds.cloud/aad-aws-sync/internal/jobs"
+)
+
+// Kinds of changes made to downstream systems, as counted per job run.
+const (
+	MutationAadGroupCreated             = "aadGroupCreated"
+	MutationAadGroupDeleted             = "aadGroupDeleted"
+	MutationAadGroupBound               = "aadGroupBound"
+	MutationAadGroupRestored            = "aadGroupRestored"
+	MutationAadGroupMemberAdded         = "aadGroupMemberAdded"
+	MutationAadGroupMemberRemoved       = "aadGroupMemberRemoved"
+	MutationAadGroupOwnerAdded          = "aadGroupOwnerAdded"
+	MutationAadGroupOwnerRemoved        = "aadGroupOwnerRemoved"
+	MutationAadGuestInvited             = "aadGuestInvited"
+	MutationAppAssignmentCreated        = "appAssignmentCreated"
+	MutationAppAssignmentRemoved        = "appAssignmentRemoved"
+	MutationSsoAccountAssignmentCreated = "ssoAccountAssignmentCreated"
+	MutationAwsAuthRoleMappingChanged   = "awsAuthRoleMappingChanged"
+	MutationAwsAuthRoleMappingRemoved   = "awsAuthRoleMappingRemoved"
+	MutationEmailAliasCreated           = "emailAliasCreated"
+	MutationEmailAliasUpdated           = "emailAliasUpdated"
+	MutationEmailAliasMemberAdded       = "emailAliasMemberAdded"
+	MutationEmailAliasMemberRemoved     = "emailAliasMemberRemoved"
+	MutationEmailAliasRemoved           = "emailAliasRemoved"
+	MutationScimGroupMemberAdded        = "scimGroupMemberAdded"
+	MutationScimGroupMemberRemoved      = "scimGroupMemberRemoved"
+)
+
+// Membership is the Before and After of mutations adding or removing a member or an owner: whether the principal was
+// one.
+type Membership struct {
+	Member bool `json:"member"`
+}
+
+// MembershipMutation returns a mutation adding the principal identified by objectIds as a member or an owner if added,
+// or removing it otherwise. action is one of the Mutation kinds above.
+func MembershipMutation(system string, action string, objectIds map[string]string, added bool) audit.Mutation {
+	return audit.Mutation{
+		System:    system,
+		Action:    action,
+		ObjectIds: objectIds,
+		Before:    Membership{Member: !added},
+		After:     Membership{Member: added},
+	}
+}
+
+// RecordMutation writes a change made to a downstream system to the audit log, attributed to the actor in ctx, records
+// it in the mutation metrics, and counts it for the job run in ctx if it succeeded. mutation.Action is one of the
+// Mutation kinds above. err is the error returned by the downstream system.
+//
+// In a dry run, see WithDryRun, the mutation is added to the plan and counted, but not audited.
+func RecordMutation(ctx context.Context, mutation audit.Mutation, err error) {
+	if plan := planFromContext(ctx); plan != nil {
+		plan.add(mutation)
+	} else {
+		audit.Log(ctx, mutation, err)
+		observeMutation(ctx, mutation, err)
+	}
+	if err == nil {
+		jobs.CountMutation(ctx, mutation.Action)
+	}
+}
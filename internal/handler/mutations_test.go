@@ -0,0 +1,134 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"go.dfds.cloud/aad-aws-sync/internal/audit"
+	"go.dfds.cloud/aad-aws-sync/internal/aws"
+	"go.dfds.cloud/aad-aws-sync/internal/jobs"
+	"go.dfds.cloud/aad-aws-sync/internal/k8s"
+	"go.dfds.cloud/aad-aws-sync/internal/store"
+	"go.dfds.cloud/aad-aws-sync/internal/util"
+	"go.uber.org/zap"
+)
+
+func listAuditRecords(t *testing.T, st store.Store) []audit.Record {
+	var records []audit.Record
+	assert.NoError(t, st.List(store.BucketAudit, "", func(key string, value []byte) error {
+		var record audit.Record
+		assert.NoError(t, json.Unmarshal(value, &record))
+		records = append(records, record)
+		return nil
+	}))
+
+	return records
+}
+
+func TestRecordMutation(t *testing.T) {
+	util.Logger = zap.NewNop()
+	defer audit.SetDefault(audit.Default())
+	st := store.NewMemoryStore()
+	audit.SetDefault(audit.NewStoreSink(st))
+
+	ctx, mutations := jobs.TrackMutations(context.Background())
+	ctx = audit.WithActor(ctx, audit.Actor{Kind: audit.ActorKindJob, Name: CapabilityServiceToAzureAdName, RunId: "run-1"})
+
+	RecordMutation(ctx, MembershipMutation(audit.SystemAzureAd, MutationAadGroupMemberAdded,
+		map[string]string{"groupId": "group-1", "userPrincipalName": "user@dfds.com"}, true), nil)
+	RecordMutation(ctx, MembershipMutation(audit.SystemAzureAd, MutationAadGroupMemberAdded,
+		map[string]string{"groupId": "group-1", "userPrincipalName": "missing@dfds.com"}, true), errors.New("user not found"))
+
+	// Only successful mutations are counted, but every attempt is audited
+	assert.Equal(t, map[string]int{MutationAadGroupMemberAdded: 1}, mutations())
+
+	records := listAuditRecords(t, st)
+	assert.Len(t, records, 2)
+	for _, record := range records {
+		assert.Equal(t, audit.Actor{Kind: audit.ActorKindJob, Name: CapabilityServiceToAzureAdName, RunId: "run-1"}, record.Actor)
+		assert.Equal(t, MutationAadGroupMemberAdded, record.Action)
+		assert.Equal(t, map[string]any{"member": false}, record.Before)
+		assert.Equal(t, map[string]any{"member": true}, record.After)
+	}
+	results := map[string]string{}
+	for _, record := range records {
+		results[record.ObjectIds["userPrincipalName"]] = record.Result
+	}
+	assert.Equal(t, map[string]string{"user@dfds.com": audit.ResultSucceeded, "missing@dfds.com": audit.ResultFailed}, results)
+
+	// Both are counted in the mutation metrics, by result
+	for _, result := range []string{audit.ResultSucceeded, audit.ResultFailed} {
+		var metric dto.Metric
+		assert.NoError(t, metricMutations.WithLabelValues(CapabilityServiceToAzureAdName, audit.SystemAzureAd, MutationAadGroupMemberAdded, result).Write(&metric))
+		assert.Equal(t, float64(1), metric.GetCounter().GetValue())
+	}
+}
+
+func TestRecordMutationDryRun(t *testing.T) {
+	util.Logger = zap.NewNop()
+	defer audit.SetDefault(audit.Default())
+	st := store.NewMemoryStore()
+	audit.SetDefault(audit.NewStoreSink(st))
+
+	plan := &Plan{}
+	ctx, mutations := jobs.TrackMutations(context.Background())
+	ctx = WithDryRun(ctx, plan)
+	assert.True(t, IsDryRun(ctx))
+	assert.False(t, IsDryRun(context.Background()))
+
+	called := false
+	err := mutate(ctx, func() error {
+		called = true
+		return errors.New("should not be called")
+	})
+	assert.NoError(t, err)
+	assert.False(t, called)
+
+	mutation := audit.Mutation{
+		System:    audit.SystemAzureAd,
+		Action:    MutationAadGroupMemberRemoved,
+		ObjectIds: map[string]string{"groupId": "group-1", "userId": "user-1"},
+	}
+	RecordMutation(ctx, mutation, err)
+
+	// Planned mutations are counted, but not audited
+	assert.Equal(t, []audit.Mutation{mutation}, plan.Mutations())
+	assert.Equal(t, map[string]int{MutationAadGroupMemberRemoved: 1}, mutations())
+	assert.Len(t, listAuditRecords(t, st), 0)
+
+	// Outside a dry run the change is made
+	assert.Error(t, mutate(context.Background(), func() error {
+		called = true
+		return errors.New("downstream error")
+	}))
+	assert.True(t, called)
+}
+
+func TestReconcileRoleMapping(t *testing.T) {
+	util.Logger = zap.NewNop()
+	acc := aws.SsoRoleMapping{AccountAlias: "dfds-sandbox-abcde", AccountId: "123456789012", RoleName: "CapabilityAccess", RootId: "sandbox-abcde"}
+	roleArn := "arn:aws:iam::123456789012:role/CapabilityAccess"
+	amResp := &k8s.LoadRoleMapResponse{}
+
+	// A missing mapping is added
+	mutation := reconcileRoleMapping(amResp, acc)
+	assert.NotNil(t, mutation)
+	assert.Equal(t, MutationAwsAuthRoleMappingChanged, mutation.Action)
+	assert.Equal(t, roleArn, mutation.ObjectIds["roleArn"])
+	assert.Nil(t, mutation.Before)
+	assert.Len(t, amResp.Mappings, 1)
+
+	// A matching mapping is left alone
+	assert.Nil(t, reconcileRoleMapping(amResp, acc))
+
+	// A mismatching mapping is corrected, keeping what it looked like before
+	amResp.Mappings[0].Groups = []string{"DFDS-ReadOnly"}
+	mutation = reconcileRoleMapping(amResp, acc)
+	assert.NotNil(t, mutation)
+	assert.Equal(t, []string{"DFDS-ReadOnly"}, mutation.Before.(*k8s.RoleMapping).Groups)
+	assert.Equal(t, []string{"DFDS-ReadOnly", "sandbox-abcde"}, mutation.After.(*k8s.RoleMapping).Groups)
+}
@@ -0,0 +1,18 @@
+// Package handlerctx carries the name of the job, event or API operation a context belongs to, so packages that only
+// need the name, like metrics, don't depend on the audit log.
+package handlerctx
+
+import "context"
+
+type nameCtxKey struct{}
+
+// WithName returns a context belonging to the job, event or API operation with the given name.
+func WithName(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, nameCtxKey{}, name)
+}
+
+// Name returns the name set with WithName, or an empty string if there is none.
+func Name(ctx context.Context) string {
+	name, _ := ctx.Value(nameCtxKey{}).(string)
+	return name
+}
@@ -0,0 +1,317 @@
+package httpclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/joomcode/errorx"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.dfds.cloud/aad-aws-sync/internal/metrics"
+	"go.dfds.cloud/aad-aws-sync/internal/tracing"
+)
+
+// maxErrorBodySize limits how much of the body of an unexpected response is kept in the error.
+const maxErrorBodySize = 64 * 1024
+
+var (
+	// PropertyStatusCode holds the status code of the response an error returned by CheckResponse was created from
+	PropertyStatusCode = errorx.RegisterProperty("statusCode")
+	// PropertyResponseBody holds the body of the response an error returned by CheckResponse was created from
+	PropertyResponseBody = errorx.RegisterProperty("responseBody")
+)
+
+var metricRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name:      "downstream_retries_total",
+	Help:      "Requests to downstream systems that were retried, by reason: throttled, server_error or connection",
+	Namespace: "aad_aws_sync",
+}, []string{"handler", "target", "reason"})
+
+// Config configures the timeouts and retries of the clients returned by New.
+type Config struct {
+	// Target labels the metrics and spans of the requests, see the metrics.Target constants
+	Target string
+	// Timeout bounds every attempt of a request, including reading the response body. 0 means no timeout.
+	Timeout time.Duration
+	// MaxRetries is the number of times a request is retried after the first attempt
+	MaxRetries int
+	// BaseBackoff is the backoff before the first retry. It doubles with every retry, up to MaxBackoff.
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+	// MaxRetryAfter is the longest Retry-After the client waits for. Responses asking for a longer wait are returned
+	// to the caller instead of being retried.
+	MaxRetryAfter time.Duration
+}
+
+// DefaultConfig returns the Config used by the clients of all downstream systems.
+func DefaultConfig(target string) Config {
+	return Config{
+		Target:        target,
+		Timeout:       30 * time.Second,
+		MaxRetries:    4,
+		BaseBackoff:   500 * time.Millisecond,
+		MaxBackoff:    30 * time.Second,
+		MaxRetryAfter: 2 * time.Minute,
+	}
+}
+
+// New returns an http.Client retrying requests to conf.Target as described by Transport, and recording every attempt
+// in metrics and client spans.
+func New(conf Config) *http.Client {
+	return &http.Client{Transport: NewTransport(conf, metrics.NewTransport(conf.Target, tracing.NewTransport(conf.Target, nil)))}
+}
+
+// Transport is an http.RoundTripper retrying requests with exponential backoff and jitter, honouring Retry-After.
+//
+// Requests rejected with 429 Too Many Requests, and requests that failed to connect, are retried regardless of their
+// method, since the downstream system didn't act on them. 5xx responses, including 503 Service Unavailable which
+// e.g. Graph also returns for requests it partially handled, and other connection errors are only retried for
+// idempotent methods and requests made with a context from WithRepeatable, so e.g. a group is never created twice.
+// Requests with a body that can't be replayed, see http.Request.GetBody, are never retried.
+type Transport struct {
+	conf Config
+	next http.RoundTripper
+}
+
+// NewTransport wraps next with the timeouts and retries of conf. If next is nil, http.DefaultTransport is used.
+func NewTransport(conf Config, next http.RoundTripper) *Transport {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	return &Transport{conf: conf, next: next}
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		attemptReq, cancel, err := t.newAttempt(req, attempt)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := t.next.RoundTrip(attemptReq)
+
+		reason := retryReason(req, resp, err)
+		delay, retry := t.retryDelay(attempt, resp)
+		if reason == "" || !retry || attempt >= t.conf.MaxRetries || !canReplay(req) {
+			if err != nil {
+				cancel()
+				return nil, err
+			}
+
+			resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+			return resp, nil
+		}
+
+		if resp != nil {
+			_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, maxErrorBodySize))
+			resp.Body.Close()
+		}
+		cancel()
+		metricRetries.WithLabelValues(metrics.HandlerFromContext(req.Context()), t.conf.Target, reason).Inc()
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// newAttempt returns a copy of req for the given attempt, bound by the timeout of the Transport, with its body
+// rewound.
+func (t *Transport) newAttempt(req *http.Request, attempt int) (*http.Request, context.CancelFunc, error) {
+	ctx, cancel := req.Context(), context.CancelFunc(func() {})
+	if t.conf.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, t.conf.Timeout)
+	}
+
+	attemptReq := req.Clone(ctx)
+	if attempt > 0 && req.Body != nil && req.Body != http.NoBody {
+		body, err := req.GetBody()
+		if err != nil {
+			cancel()
+			return nil, nil, err
+		}
+		attemptReq.Body = body
+	}
+
+	return attemptReq, cancel, nil
+}
+
+// retryDelay returns how long to wait before the next attempt, and false if the downstream system asked to wait for
+// longer than MaxRetryAfter.
+func (t *Transport) retryDelay(attempt int, resp *http.Response) (time.Duration, bool) {
+	if resp != nil {
+		if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+			return retryAfter, retryAfter <= t.conf.MaxRetryAfter
+		}
+	}
+
+	backoff := t.conf.BaseBackoff << attempt
+	if backoff > t.conf.MaxBackoff || backoff <= 0 {
+		backoff = t.conf.MaxBackoff
+	}
+
+	// Half of the backoff is jitter, so replicas and concurrent requests throttled at once don't retry in lockstep
+	return backoff/2 + jitter(backoff/2), true
+}
+
+// retryReason returns why the attempt of req should be retried, or an empty string if it shouldn't be.
+func retryReason(req *http.Request, resp *http.Response, err error) string {
+	if err != nil {
+		if req.Context().Err() != nil {
+			return ""
+		}
+		if isIdempotent(req) || isDialError(err) {
+			return "connection"
+		}
+		return ""
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return "throttled"
+	case resp.StatusCode >= 500 && isIdempotent(req):
+		return "server_error"
+	}
+
+	return ""
+}
+
+type repeatableCtxKey struct{}
+
+// WithRepeatable returns a context marking the requests made with it as safe to repeat, so they are retried like
+// those of idempotent methods, e.g. token requests, which are POSTs.
+func WithRepeatable(ctx context.Context) context.Context {
+	return context.WithValue(ctx, repeatableCtxKey{}, true)
+}
+
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+
+	repeatable, _ := req.Context().Value(repeatableCtxKey{}).(bool)
+	return repeatable
+}
+
+// isDialError returns true if err happened before the request was sent.
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+func canReplay(req *http.Request) bool {
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// parseRetryAfter parses a Retry-After header, which is either a number of seconds or an HTTP date.
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		delay := time.Until(date)
+		if delay < 0 {
+			delay = 0
+		}
+		return delay, true
+	}
+
+	return 0, false
+}
+
+var (
+	jitterMu   sync.Mutex
+	jitterRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+func jitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+
+	jitterMu.Lock()
+	defer jitterMu.Unlock()
+	return time.Duration(jitterRand.Int63n(int64(max)))
+}
+
+// cancelOnClose releases the timeout of an attempt once its response body has been read.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// CheckResponse returns nil if resp has one of the expected status codes, or any 2xx status code if none are given.
+// Otherwise, it reads and closes the body of resp, and returns an error of errType with the status code and the
+// response body as properties.
+func CheckResponse(resp *http.Response, errType *errorx.Type, expected ...int) error {
+	if len(expected) == 0 && resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	for _, statusCode := range expected {
+		if resp.StatusCode == statusCode {
+			return nil
+		}
+	}
+
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+
+	return errType.New("unexpected HTTP response from %s %s: %d %s", resp.Request.Method, redactedUrl(resp.Request), resp.StatusCode, truncate(string(body), 512)).
+		WithProperty(PropertyStatusCode, resp.StatusCode).
+		WithProperty(PropertyResponseBody, string(body))
+}
+
+// StatusCode returns the status code of the response err was created from by CheckResponse.
+func StatusCode(err error) (int, bool) {
+	statusCode, ok := errorx.ExtractProperty(err, PropertyStatusCode)
+	if !ok {
+		return 0, false
+	}
+
+	return statusCode.(int), true
+}
+
+// redactedUrl returns the URL of req without its query, as it may contain user principal names and e-mail addresses.
+func redactedUrl(req *http.Request) string {
+	if req == nil || req.URL == nil {
+		return ""
+	}
+
+	url := *req.URL
+	url.RawQuery = ""
+	url.User = nil
+	return url.String()
+}
+
+func truncate(value string, length int) string {
+	if len(value) <= length {
+		return value
+	}
+
+	return fmt.Sprintf("%s... (%d bytes)", value[:length], len(value))
+}
@@ -0,0 +1,225 @@
+package httpclient
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/joomcode/errorx"
+	"github.com/stretchr/testify/assert"
+)
+
+var testError = errorx.NewNamespace("test").NewType("http_error")
+
+func testConfig() Config {
+	return Config{
+		Target:        "test",
+		Timeout:       time.Second,
+		MaxRetries:    2,
+		BaseBackoff:   time.Millisecond,
+		MaxBackoff:    5 * time.Millisecond,
+		MaxRetryAfter: 2 * time.Second,
+	}
+}
+
+// respondWith returns a server answering the attempts of a request with the given status codes in order, repeating
+// the last one, and the number of attempts made.
+func respondWith(t *testing.T, header http.Header, statusCodes ...int) (*httptest.Server, *int32) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempt := int(atomic.AddInt32(&attempts, 1)) - 1
+		if attempt >= len(statusCodes) {
+			attempt = len(statusCodes) - 1
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		for key, values := range header {
+			w.Header()[key] = values
+		}
+		w.WriteHeader(statusCodes[attempt])
+		_, _ = w.Write(body)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, &attempts
+}
+
+func TestRetriesServiceUnavailable(t *testing.T) {
+	server, attempts := respondWith(t, nil, http.StatusServiceUnavailable, http.StatusOK)
+
+	resp, err := New(testConfig()).Get(server.URL)
+	assert.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int32(2), atomic.LoadInt32(attempts))
+}
+
+func TestDoesntRetryNonIdempotentServiceUnavailable(t *testing.T) {
+	server, attempts := respondWith(t, nil, http.StatusServiceUnavailable, http.StatusCreated)
+
+	resp, err := New(testConfig()).Post(server.URL, "application/json", bytes.NewBufferString(`{"displayName":"group"}`))
+	assert.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, int32(1), atomic.LoadInt32(attempts))
+}
+
+func TestRetriesRepeatableRequests(t *testing.T) {
+	server, attempts := respondWith(t, nil, http.StatusServiceUnavailable, http.StatusOK)
+
+	req, err := http.NewRequestWithContext(WithRepeatable(context.Background()), "POST", server.URL, bytes.NewBufferString(`{"displayName":"group"}`))
+	assert.NoError(t, err)
+	resp, err := New(testConfig()).Do(req)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int32(2), atomic.LoadInt32(attempts))
+	// The body is replayed for the retry
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, `{"displayName":"group"}`, string(body))
+}
+
+func TestRetriesThrottledWithRetryAfter(t *testing.T) {
+	server, attempts := respondWith(t, http.Header{"Retry-After": []string{"1"}}, http.StatusTooManyRequests, http.StatusOK)
+
+	start := time.Now()
+	resp, err := New(testConfig()).Get(server.URL)
+	assert.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int32(2), atomic.LoadInt32(attempts))
+	assert.GreaterOrEqual(t, time.Since(start), time.Second)
+}
+
+func TestDoesntWaitLongerThanMaxRetryAfter(t *testing.T) {
+	server, attempts := respondWith(t, http.Header{"Retry-After": []string{"3600"}}, http.StatusTooManyRequests)
+
+	resp, err := New(testConfig()).Get(server.URL)
+	assert.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, int32(1), atomic.LoadInt32(attempts))
+}
+
+func TestGivesUpAfterMaxRetries(t *testing.T) {
+	server, attempts := respondWith(t, nil, http.StatusBadGateway)
+
+	resp, err := New(testConfig()).Get(server.URL)
+	assert.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	assert.Equal(t, int32(3), atomic.LoadInt32(attempts))
+}
+
+func TestDoesntRetryNonIdempotentServerErrors(t *testing.T) {
+	server, attempts := respondWith(t, nil, http.StatusInternalServerError, http.StatusCreated)
+
+	resp, err := New(testConfig()).Post(server.URL, "application/json", bytes.NewBufferString("{}"))
+	assert.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	assert.Equal(t, int32(1), atomic.LoadInt32(attempts))
+}
+
+func TestDoesntRetryClientErrors(t *testing.T) {
+	server, attempts := respondWith(t, nil, http.StatusNotFound, http.StatusOK)
+
+	resp, err := New(testConfig()).Get(server.URL)
+	assert.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Equal(t, int32(1), atomic.LoadInt32(attempts))
+}
+
+func TestRetriesConnectionErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	url := server.URL
+	server.Close()
+
+	start := time.Now()
+	_, err := New(testConfig()).Get(url)
+	assert.Error(t, err)
+	// Two retries, each waiting at least half of the backoff
+	assert.GreaterOrEqual(t, time.Since(start), 1500*time.Microsecond)
+}
+
+func TestTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer server.Close()
+
+	conf := testConfig()
+	conf.Timeout = 10 * time.Millisecond
+	conf.MaxRetries = 0
+
+	start := time.Now()
+	_, err := New(conf).Get(server.URL)
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	delay, ok := parseRetryAfter("120")
+	assert.True(t, ok)
+	assert.Equal(t, 2*time.Minute, delay)
+
+	delay, ok = parseRetryAfter(time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	assert.True(t, ok)
+	assert.Greater(t, delay, 59*time.Minute)
+
+	delay, ok = parseRetryAfter("Mon, 02 Jan 2006 15:04:05 GMT")
+	assert.True(t, ok)
+	assert.Equal(t, time.Duration(0), delay)
+
+	_, ok = parseRetryAfter("")
+	assert.False(t, ok)
+	_, ok = parseRetryAfter("soon")
+	assert.False(t, ok)
+}
+
+func TestCheckResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"error":{"code":"Request_BadRequest"}}`))
+	}))
+	defer server.Close()
+
+	resp, err := New(testConfig()).Get(server.URL + "/v1.0/users?$filter=mail")
+	assert.NoError(t, err)
+
+	err = CheckResponse(resp, testError, http.StatusOK)
+	assert.True(t, errorx.IsOfType(err, testError))
+	assert.Contains(t, err.Error(), "GET "+server.URL+"/v1.0/users: 400")
+	assert.NotContains(t, err.Error(), "filter")
+	assert.Contains(t, err.Error(), "Request_BadRequest")
+
+	statusCode, ok := StatusCode(err)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+	body, ok := errorx.ExtractProperty(err, PropertyResponseBody)
+	assert.True(t, ok)
+	assert.Equal(t, `{"error":{"code":"Request_BadRequest"}}`, body)
+
+	_, ok = StatusCode(testError.New("no response"))
+	assert.False(t, ok)
+
+	assert.NoError(t, CheckResponse(&http.Response{StatusCode: http.StatusNoContent}, testError))
+	assert.NoError(t, CheckResponse(&http.Response{StatusCode: http.StatusCreated}, testError, http.StatusOK, http.StatusCreated))
+}
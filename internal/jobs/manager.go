@@ -0,0 +1,467 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/joomcode/errorx"
+	"go.dfds.cloud/aad-aws-sync/internal/audit"
+	"go.dfds.cloud/aad-aws-sync/internal/config"
+	"go.dfds.cloud/aad-aws-sync/internal/store"
+	"go.dfds.cloud/aad-aws-sync/internal/tracing"
+	"go.dfds.cloud/aad-aws-sync/internal/util"
+	"go.dfds.cloud/orchestrator"
+	"go.uber.org/zap"
+)
+
+var (
+	JobsError     = errorx.NewNamespace("jobs")
+	JobNotFound   = JobsError.NewType("job_not_found")
+	JobInProgress = JobsError.NewType("job_in_progress")
+	JobNotRunning = JobsError.NewType("job_not_running")
+	RunNotFound   = JobsError.NewType("run_not_found")
+	// RunHistoryUnavailable is returned for runs that may be in the run history, while the store is unavailable
+	RunHistoryUnavailable = JobsError.NewType("run_history_unavailable")
+)
+
+// Job describes a job, its schedule and its most recent runs.
+type Job struct {
+	Name       string `json:"name"`
+	Enabled    bool   `json:"enabled"`
+	Interval   string `json:"interval"`
+	InProgress bool   `json:"inProgress"`
+	CurrentRun *Run   `json:"currentRun,omitempty"`
+	Runs       []Run  `json:"runs"`
+	// RunsUnavailable is set if the run history can't be read, e.g. on a standby, which doesn't have the state store
+	// open. Runs is empty then.
+	RunsUnavailable bool `json:"runsUnavailable,omitempty"`
+}
+
+type jobState struct {
+	handler func(ctx context.Context) error
+	current *runState
+	cancel  context.CancelFunc
+	// claimed is set while current is a run claimed by Trigger that no start of the Orchestrator picked up yet
+	claimed bool
+	// exclusive is set while the job is kept from starting, see RunExclusive
+	exclusive bool
+	history   []*runState
+}
+
+// Manager adds run tracking and cancellation on top of the jobs of an Orchestrator.
+type Manager struct {
+	orc         *orchestrator.Orchestrator
+	store       store.Store
+	historySize int
+	// runRetention is the number of runs per job kept in the store
+	runRetention int
+	// historyUnavailable is set while the store is a store.UnavailableStore, see restoreHistory
+	historyUnavailable bool
+	mu                 sync.Mutex
+	jobs               map[string]*jobState
+}
+
+// NewManager creates a Manager that keeps the last historySize runs of every job in memory, and persists the last
+// runRetention runs of every job to st, so the run history survives restarts.
+func NewManager(orc *orchestrator.Orchestrator, st store.Store, historySize int, runRetention int) *Manager {
+	return &Manager{
+		orc:          orc,
+		store:        st,
+		historySize:  historySize,
+		runRetention: runRetention,
+		jobs:         map[string]*jobState{},
+	}
+}
+
+// AddJob registers a job with the Orchestrator, wrapping its handler so every run is tracked by the Manager. The run
+// history of the job is restored from the store.
+//
+// The Orchestrator only reads schedules from the environment, <configPrefix>_<NAME>_ENABLE and _INTERVAL, so the
+// schedule is exported to those environment variables first.
+func (m *Manager) AddJob(configPrefix string, name string, schedule config.JobSchedule, handler func(ctx context.Context) error) {
+	m.mu.Lock()
+	state := &jobState{handler: handler}
+	m.jobs[name] = state
+	m.restoreHistory(name, state)
+	m.mu.Unlock()
+
+	envPrefix := fmt.Sprintf("%s_%s", configPrefix, strings.ToUpper(name))
+	_ = os.Setenv(envPrefix+"_ENABLE", strconv.FormatBool(schedule.Enable))
+	if schedule.Interval != "" {
+		_ = os.Setenv(envPrefix+"_INTERVAL", schedule.Interval)
+	}
+	m.orc.AddJob(configPrefix, orchestrator.NewJob(name, m.wrap(name, handler)), &orchestrator.Schedule{})
+}
+
+// SetStore replaces the store runs are persisted to, and restores the run history of all jobs from it. Used by an
+// instance that opens the state store once it is elected leader.
+func (m *Manager) SetStore(st store.Store) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.store = st
+	m.historyUnavailable = false
+	for name, state := range m.jobs {
+		m.restoreHistory(name, state)
+	}
+}
+
+// restoreHistory loads the run history of a job from the store, and records whether the store is unavailable. Must be
+// called with m.mu held.
+func (m *Manager) restoreHistory(name string, state *jobState) {
+	history, err := m.loadHistory(name)
+	if errorx.IsOfType(err, store.Unavailable) {
+		m.historyUnavailable = true
+		return
+	}
+	if err != nil {
+		util.Logger.Warn("Unable to load run history of job from state store", zap.String("job", name), zap.Error(err))
+		return
+	}
+	state.history = history
+}
+
+func (m *Manager) wrap(name string, handler func(ctx context.Context) error) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		run := m.startRun(name, cancel)
+		if run == nil {
+			util.Logger.Info("Skipping run of job, it is in progress or an operation holds it", zap.String("job", name))
+			return nil
+		}
+
+		return m.execute(ctx, name, handler, run)
+	}
+}
+
+// execute runs the handler of a job for a run started by startRun, and ends the run once the handler returns.
+func (m *Manager) execute(ctx context.Context, name string, handler func(ctx context.Context) error, run *runState) error {
+	ctx, span := tracing.StartJobSpan(ctx, name, run.run.ID)
+	defer span.End()
+
+	actorKind := audit.ActorKindJob
+	if run.run.Trigger == TriggerCli {
+		actorKind = audit.ActorKindCli
+	}
+	ctx = audit.WithActor(ctx, audit.Actor{Kind: actorKind, Name: name, RunId: run.run.ID})
+	err := handler(context.WithValue(ctx, runCtxKey{}, run))
+	tracing.RecordError(span, err)
+	m.endRun(name, run, ctx.Err() != nil, err)
+
+	return err
+}
+
+func newRunState(name string, trigger string) *runState {
+	return &runState{run: Run{
+		ID:        uuid.NewString(),
+		Job:       name,
+		Trigger:   trigger,
+		Status:    RunStatusRunning,
+		StartedAt: time.Now(),
+		Mutations: map[string]int{},
+	}}
+}
+
+// startRun tracks a run of a job started by the Orchestrator: the run claimed by Trigger if there is one, a new
+// scheduled run otherwise. Returns nil if a run is in progress, e.g. one started by RunNow, or the job is kept from
+// starting, see RunExclusive.
+//
+// The Orchestrator starts every run with the same context, so a scheduled start racing the one of Trigger can't be
+// told apart from it. Whichever comes first picks up the claimed run and the other is skipped, so the job still runs
+// once, under the ID returned by Trigger.
+func (m *Manager) startRun(name string, cancel context.CancelFunc) *runState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	state := m.jobs[name]
+	if state.exclusive || (state.current != nil && !state.claimed) {
+		return nil
+	}
+	if !state.claimed {
+		state.current = newRunState(name, TriggerSchedule)
+	}
+	state.claimed = false
+	state.cancel = cancel
+
+	return state.current
+}
+
+func (m *Manager) endRun(name string, run *runState, cancelled bool, err error) {
+	status := RunStatusSucceeded
+	if cancelled {
+		status = RunStatusCancelled
+	} else if err != nil {
+		status = RunStatusFailed
+	}
+	run.finish(status, err)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	state := m.jobs[name]
+	state.current = nil
+	state.cancel = nil
+	state.history = append([]*runState{run}, state.history...)
+	if len(state.history) > m.historySize {
+		state.history = state.history[:m.historySize]
+	}
+
+	if err := m.saveRun(run.snapshot()); err != nil {
+		util.Logger.Warn("Unable to persist job run to state store", zap.String("job", name), zap.String("runId", run.run.ID), zap.Error(err))
+	}
+}
+
+// runKeyPrefix is the prefix of the keys of all persisted runs of a job. Keys sort by the start of the run.
+func runKeyPrefix(name string) string {
+	return name + "/"
+}
+
+func runKey(run Run) string {
+	return runKeyPrefix(run.Job) + store.TimeKey(run.StartedAt) + "/" + run.ID
+}
+
+// loadHistory returns the most recent persisted runs of a job, newest first.
+func (m *Manager) loadHistory(name string) ([]*runState, error) {
+	var runs []Run
+	err := m.store.List(store.BucketRuns, runKeyPrefix(name), func(key string, value []byte) error {
+		var run Run
+		if err := json.Unmarshal(value, &run); err != nil {
+			return err
+		}
+		runs = append(runs, run)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	history := make([]*runState, 0, m.historySize)
+	for i := len(runs) - 1; i >= 0 && len(history) < m.historySize; i-- {
+		history = append(history, &runState{run: runs[i]})
+	}
+
+	return history, nil
+}
+
+// saveRun persists a finished run, and removes the oldest runs of the job beyond the retention.
+func (m *Manager) saveRun(run Run) error {
+	if err := m.store.Put(store.BucketRuns, runKey(run), run); err != nil {
+		return err
+	}
+
+	var keys []string
+	err := m.store.List(store.BucketRuns, runKeyPrefix(run.Job), func(key string, value []byte) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < len(keys)-m.runRetention; i++ {
+		if err := m.store.Delete(store.BucketRuns, keys[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// List returns all jobs, sorted by name.
+func (m *Manager) List() []Job {
+	m.mu.Lock()
+	names := make([]string, 0, len(m.jobs))
+	for name := range m.jobs {
+		names = append(names, name)
+	}
+	m.mu.Unlock()
+	sort.Strings(names)
+
+	jobs := make([]Job, 0, len(names))
+	for _, name := range names {
+		job, err := m.Get(name)
+		if err == nil {
+			jobs = append(jobs, job)
+		}
+	}
+
+	return jobs
+}
+
+// Get returns a single job.
+func (m *Manager) Get(name string) (Job, error) {
+	orcJob, exists := m.orc.Jobs[name]
+	if !exists {
+		return Job{}, JobNotFound.New("job %s not found", name)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	state, exists := m.jobs[name]
+	if !exists {
+		return Job{}, JobNotFound.New("job %s not found", name)
+	}
+
+	job := Job{
+		Name:            name,
+		Enabled:         orcJob.Schedule.Enabled(),
+		Interval:        orcJob.Schedule.Interval().String(),
+		InProgress:      orcJob.Status.InProgress(),
+		Runs:            make([]Run, 0, len(state.history)),
+		RunsUnavailable: m.historyUnavailable,
+	}
+	if state.current != nil {
+		current := state.current.snapshot()
+		job.CurrentRun = &current
+	}
+	for _, run := range state.history {
+		job.Runs = append(job.Runs, run.snapshot())
+	}
+
+	return job, nil
+}
+
+// GetRun returns a run of a job by ID, whether it is still in progress or part of the run history.
+func (m *Manager) GetRun(name string, runId string) (Run, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	state, exists := m.jobs[name]
+	if !exists {
+		return Run{}, JobNotFound.New("job %s not found", name)
+	}
+
+	if state.current != nil && state.current.run.ID == runId {
+		return state.current.snapshot(), nil
+	}
+	for _, run := range state.history {
+		if run.run.ID == runId {
+			return run.snapshot(), nil
+		}
+	}
+	if m.historyUnavailable {
+		return Run{}, RunHistoryUnavailable.New("run %s of job %s may be in the run history, which can't be read from the store", runId, name)
+	}
+
+	return Run{}, RunNotFound.New("run %s of job %s not found", runId, name)
+}
+
+// Trigger starts a run of a job outside its schedule and returns the ID the run will get.
+func (m *Manager) Trigger(name string) (string, error) {
+	run, err := m.claimRun(name)
+	if err != nil {
+		return "", err
+	}
+
+	m.orc.Jobs[name].Run()
+
+	return run.run.ID, nil
+}
+
+// claimRun makes a new triggered run the current run of a job, for the next start of the Orchestrator to pick up, see
+// startRun. Returns a JobInProgress error if a run is in progress or the job is kept from starting.
+func (m *Manager) claimRun(name string) (*runState, error) {
+	orcJob, exists := m.orc.Jobs[name]
+	if !exists {
+		return nil, JobNotFound.New("job %s not found", name)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	state, exists := m.jobs[name]
+	if !exists {
+		return nil, JobNotFound.New("job %s not found", name)
+	}
+	if orcJob.Status.InProgress() || state.current != nil || state.exclusive {
+		return nil, JobInProgress.New("job %s is in progress", name)
+	}
+
+	state.current = newRunState(name, TriggerApi)
+	state.claimed = true
+
+	return state.current, nil
+}
+
+// RunNow runs a job right away and waits for it to finish, outside of the Orchestrator, e.g. for a run started from
+// the command line. The run is tracked and persisted like scheduled runs, with the given trigger, and returned along
+// with the error of the handler. Returns a JobInProgress error without running the job if a run is in progress.
+func (m *Manager) RunNow(ctx context.Context, name string, trigger string) (Run, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	m.mu.Lock()
+	state, exists := m.jobs[name]
+	if !exists {
+		m.mu.Unlock()
+		return Run{}, JobNotFound.New("job %s not found", name)
+	}
+	orcJob := m.orc.Jobs[name]
+	if orcJob.Status.InProgress() || state.current != nil || state.exclusive {
+		m.mu.Unlock()
+		return Run{}, JobInProgress.New("job %s is in progress", name)
+	}
+	run := newRunState(name, trigger)
+	state.current = run
+	state.cancel = cancel
+	m.mu.Unlock()
+
+	err := m.execute(ctx, name, state.handler, run)
+
+	return run.snapshot(), err
+}
+
+// RunExclusive runs fn while no run of the job is in progress, and keeps the job from starting until fn returns, e.g.
+// to sync a single Capability without racing a run of the job that syncs all of them. Scheduled runs that would start
+// meanwhile are skipped. Returns a JobInProgress error without running fn if a run is in progress.
+func (m *Manager) RunExclusive(name string, fn func() error) error {
+	m.mu.Lock()
+	state, exists := m.jobs[name]
+	if !exists {
+		m.mu.Unlock()
+		return JobNotFound.New("job %s not found", name)
+	}
+	if state.current != nil || state.exclusive {
+		m.mu.Unlock()
+		return JobInProgress.New("job %s is in progress", name)
+	}
+	state.exclusive = true
+	m.mu.Unlock()
+
+	defer func() {
+		m.mu.Lock()
+		state.exclusive = false
+		m.mu.Unlock()
+	}()
+
+	return fn()
+}
+
+// Cancel stops the current run of a job. Handlers check for cancellation between steps, so the run ends shortly after.
+func (m *Manager) Cancel(name string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	state, exists := m.jobs[name]
+	if !exists {
+		return "", JobNotFound.New("job %s not found", name)
+	}
+	if state.current == nil || state.cancel == nil {
+		return "", JobNotRunning.New("job %s is not running", name)
+	}
+
+	state.cancel()
+
+	return state.current.run.ID, nil
+}
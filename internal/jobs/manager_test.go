@@ -0,0 +1,344 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/joomcode/errorx"
+	"github.com/stretchr/testify/assert"
+	"go.dfds.cloud/aad-aws-sync/internal/config"
+	"go.dfds.cloud/aad-aws-sync/internal/store"
+	"go.dfds.cloud/aad-aws-sync/internal/util"
+	"go.dfds.cloud/orchestrator"
+	"go.uber.org/zap"
+)
+
+func newTestManager(t *testing.T, metricsNamespace string, historySize int) *Manager {
+	return newTestManagerWithStore(t, metricsNamespace, store.NewMemoryStore(), historySize, historySize)
+}
+
+func newTestManagerWithStore(t *testing.T, metricsNamespace string, st store.Store, historySize int, runRetention int) *Manager {
+	orc := orchestrator.NewOrchestrator(context.Background(), &sync.WaitGroup{}, metricsNamespace)
+	return NewManager(orc, st, historySize, runRetention)
+}
+
+func waitForRun(t *testing.T, m *Manager, name string, runId string) Run {
+	var run Run
+	assert.Eventually(t, func() bool {
+		var err error
+		run, err = m.GetRun(name, runId)
+		return err == nil && run.Status != RunStatusRunning
+	}, 5*time.Second, 10*time.Millisecond)
+
+	return run
+}
+
+func TestManager_Trigger(t *testing.T) {
+	t.Setenv("AAS_TEST_JOB_MUTATING_ENABLE", "false")
+	t.Setenv("AAS_TEST_JOB_MUTATING_INTERVAL", "15m")
+	m := newTestManager(t, "jobs_test_trigger", 2)
+
+	calls := 0
+	m.AddJob("AAS_TEST_JOB", "mutating", config.JobSchedule{}, func(ctx context.Context) error {
+		calls++
+		CountMutation(ctx, "groupCreated")
+		CountMutations(ctx, "memberAdded", 3)
+		if calls == 2 {
+			return errors.New("downstream unavailable")
+		}
+		return nil
+	})
+
+	jobs := m.List()
+	assert.Len(t, jobs, 1)
+	assert.Equal(t, "mutating", jobs[0].Name)
+	assert.False(t, jobs[0].Enabled)
+	assert.Equal(t, "15m0s", jobs[0].Interval)
+	assert.Len(t, jobs[0].Runs, 0)
+
+	runId, err := m.Trigger("mutating")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, runId)
+
+	run := waitForRun(t, m, "mutating", runId)
+	assert.Equal(t, RunStatusSucceeded, run.Status)
+	assert.Equal(t, TriggerApi, run.Trigger)
+	assert.NotNil(t, run.EndedAt)
+	assert.Equal(t, map[string]int{"groupCreated": 1, "memberAdded": 3}, run.Mutations)
+
+	runId, err = m.Trigger("mutating")
+	assert.NoError(t, err)
+	run = waitForRun(t, m, "mutating", runId)
+	assert.Equal(t, RunStatusFailed, run.Status)
+	assert.Equal(t, "downstream unavailable", run.Error)
+
+	runId, err = m.Trigger("mutating")
+	assert.NoError(t, err)
+	waitForRun(t, m, "mutating", runId)
+
+	// History is limited to the most recent runs, newest first
+	job, err := m.Get("mutating")
+	assert.NoError(t, err)
+	assert.Len(t, job.Runs, 2)
+	assert.Equal(t, runId, job.Runs[0].ID)
+	assert.Equal(t, RunStatusFailed, job.Runs[1].Status)
+
+	_, err = m.Trigger("missing")
+	assert.True(t, errorx.IsOfType(err, JobNotFound))
+
+	_, err = m.Get("missing")
+	assert.True(t, errorx.IsOfType(err, JobNotFound))
+
+	_, err = m.GetRun("mutating", "missing")
+	assert.True(t, errorx.IsOfType(err, RunNotFound))
+}
+
+func TestManager_Cancel(t *testing.T) {
+	m := newTestManager(t, "jobs_test_cancel", 10)
+
+	started := make(chan struct{})
+	m.AddJob("AAS_TEST_JOB", "blocking", config.JobSchedule{}, func(ctx context.Context) error {
+		close(started)
+		<-ctx.Done()
+		// Handlers return nil when cancelled
+		return nil
+	})
+
+	_, err := m.Cancel("blocking")
+	assert.True(t, errorx.IsOfType(err, JobNotRunning))
+
+	runId, err := m.Trigger("blocking")
+	assert.NoError(t, err)
+	<-started
+
+	job, err := m.Get("blocking")
+	assert.NoError(t, err)
+	assert.True(t, job.InProgress)
+	assert.NotNil(t, job.CurrentRun)
+	assert.Equal(t, runId, job.CurrentRun.ID)
+	assert.Equal(t, RunStatusRunning, job.CurrentRun.Status)
+
+	_, err = m.Trigger("blocking")
+	assert.True(t, errorx.IsOfType(err, JobInProgress))
+
+	cancelledId, err := m.Cancel("blocking")
+	assert.NoError(t, err)
+	assert.Equal(t, runId, cancelledId)
+
+	run := waitForRun(t, m, "blocking", runId)
+	assert.Equal(t, RunStatusCancelled, run.Status)
+
+	_, err = m.Cancel("missing")
+	assert.True(t, errorx.IsOfType(err, JobNotFound))
+}
+
+func TestManager_RunExclusive(t *testing.T) {
+	util.Logger = zap.NewNop()
+	m := newTestManager(t, "jobs_test_exclusive", 10)
+
+	started := make(chan struct{}, 1)
+	calls := 0
+	m.AddJob("AAS_TEST_JOB", "exclusive", config.JobSchedule{}, func(ctx context.Context) error {
+		calls++
+		started <- struct{}{}
+		<-ctx.Done()
+		return nil
+	})
+
+	err := m.RunExclusive("exclusive", func() error {
+		// Neither triggered nor scheduled runs start meanwhile
+		_, err := m.Trigger("exclusive")
+		assert.True(t, errorx.IsOfType(err, JobInProgress))
+
+		m.orc.Jobs["exclusive"].Run()
+		assert.Eventually(t, func() bool { return !m.orc.Jobs["exclusive"].Status.InProgress() }, 5*time.Second, 10*time.Millisecond)
+
+		// Nor do other exclusive operations
+		assert.True(t, errorx.IsOfType(m.RunExclusive("exclusive", func() error { return nil }), JobInProgress))
+
+		return errors.New("sync failed")
+	})
+	assert.EqualError(t, err, "sync failed")
+	assert.Zero(t, calls)
+	job, err := m.Get("exclusive")
+	assert.NoError(t, err)
+	assert.Empty(t, job.Runs)
+
+	runId, err := m.Trigger("exclusive")
+	assert.NoError(t, err)
+	<-started
+	assert.True(t, errorx.IsOfType(m.RunExclusive("exclusive", func() error { return nil }), JobInProgress))
+	_, err = m.Cancel("exclusive")
+	assert.NoError(t, err)
+	waitForRun(t, m, "exclusive", runId)
+
+	assert.NoError(t, m.RunExclusive("exclusive", func() error { return nil }))
+	assert.True(t, errorx.IsOfType(m.RunExclusive("missing", func() error { return nil }), JobNotFound))
+}
+
+func TestManager_RunNow(t *testing.T) {
+	util.Logger = zap.NewNop()
+	st := store.NewMemoryStore()
+	m := newTestManagerWithStore(t, "jobs_test_run_now", st, 10, 10)
+
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	m.AddJob("AAS_TEST_JOB", "now", config.JobSchedule{}, func(ctx context.Context) error {
+		CountMutation(ctx, "groupCreated")
+		started <- struct{}{}
+		<-release
+		return errors.New("downstream error")
+	})
+
+	done := make(chan Run)
+	go func() {
+		run, err := m.RunNow(context.Background(), "now", TriggerCli)
+		assert.EqualError(t, err, "downstream error")
+		done <- run
+	}()
+	<-started
+
+	// Neither triggered, scheduled nor other immediate runs start meanwhile
+	_, err := m.Trigger("now")
+	assert.True(t, errorx.IsOfType(err, JobInProgress))
+	_, err = m.RunNow(context.Background(), "now", TriggerCli)
+	assert.True(t, errorx.IsOfType(err, JobInProgress))
+	m.orc.Jobs["now"].Run()
+	assert.Eventually(t, func() bool { return !m.orc.Jobs["now"].Status.InProgress() }, 5*time.Second, 10*time.Millisecond)
+
+	close(release)
+	run := <-done
+	assert.Equal(t, TriggerCli, run.Trigger)
+	assert.Equal(t, RunStatusFailed, run.Status)
+	assert.Equal(t, "downstream error", run.Error)
+	assert.Equal(t, map[string]int{"groupCreated": 1}, run.Mutations)
+
+	// The run is persisted like scheduled ones
+	restarted := newTestManagerWithStore(t, "jobs_test_run_now_restarted", st, 10, 10)
+	restarted.AddJob("AAS_TEST_JOB", "now", config.JobSchedule{}, func(ctx context.Context) error { return nil })
+	persisted, err := restarted.GetRun("now", run.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, TriggerCli, persisted.Trigger)
+
+	_, err = m.RunNow(context.Background(), "missing", TriggerCli)
+	assert.True(t, errorx.IsOfType(err, JobNotFound))
+}
+
+func TestManager_TriggerRacingSchedule(t *testing.T) {
+	util.Logger = zap.NewNop()
+	m := newTestManager(t, "jobs_test_trigger_race", 10)
+	m.AddJob("AAS_TEST_JOB", "racing", config.JobSchedule{}, func(ctx context.Context) error { return nil })
+
+	claimed, err := m.claimRun("racing")
+	assert.NoError(t, err)
+
+	// Nothing else starts while the run is claimed
+	_, err = m.Trigger("racing")
+	assert.True(t, errorx.IsOfType(err, JobInProgress))
+	_, err = m.RunNow(context.Background(), "racing", TriggerCli)
+	assert.True(t, errorx.IsOfType(err, JobInProgress))
+	assert.True(t, errorx.IsOfType(m.RunExclusive("racing", func() error { return nil }), JobInProgress))
+
+	// The first start picks up the claimed run, whether it is the one of Trigger or a scheduled one
+	run := m.startRun("racing", func() {})
+	assert.Same(t, claimed, run)
+	assert.Equal(t, TriggerApi, run.run.Trigger)
+	assert.Nil(t, m.startRun("racing", func() {}))
+
+	m.endRun("racing", run, false, nil)
+	run = m.startRun("racing", func() {})
+	assert.NotNil(t, run)
+	assert.NotEqual(t, claimed.run.ID, run.run.ID)
+	assert.Equal(t, TriggerSchedule, run.run.Trigger)
+}
+
+func TestManager_PersistsRuns(t *testing.T) {
+	st := store.NewMemoryStore()
+	m := newTestManagerWithStore(t, "jobs_test_persist", st, 2, 3)
+	m.AddJob("AAS_TEST_JOB", "persisted", config.JobSchedule{}, func(ctx context.Context) error {
+		CountMutation(ctx, "groupCreated")
+		return nil
+	})
+
+	var runIds []string
+	for i := 0; i < 4; i++ {
+		runId, err := m.Trigger("persisted")
+		assert.NoError(t, err)
+		waitForRun(t, m, "persisted", runId)
+		runIds = append(runIds, runId)
+		// The run is persisted once it has been moved to the history
+		assert.Eventually(t, func() bool {
+			job, err := m.Get("persisted")
+			return err == nil && job.CurrentRun == nil && len(job.Runs) > 0 && job.Runs[0].ID == runId
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+
+	// Runs beyond the retention are removed from the store
+	var persisted []string
+	assert.NoError(t, st.List(store.BucketRuns, "persisted/", func(key string, value []byte) error {
+		persisted = append(persisted, key)
+		return nil
+	}))
+	assert.Len(t, persisted, 3)
+
+	// A new Manager, e.g. after a restart, restores the most recent runs
+	restarted := newTestManagerWithStore(t, "jobs_test_persist_restarted", st, 2, 3)
+	restarted.AddJob("AAS_TEST_JOB", "persisted", config.JobSchedule{}, func(ctx context.Context) error { return nil })
+
+	job, err := restarted.Get("persisted")
+	assert.NoError(t, err)
+	assert.Len(t, job.Runs, 2)
+	assert.Equal(t, runIds[3], job.Runs[0].ID)
+	assert.Equal(t, runIds[2], job.Runs[1].ID)
+	assert.Equal(t, RunStatusSucceeded, job.Runs[0].Status)
+	assert.Equal(t, map[string]int{"groupCreated": 1}, job.Runs[0].Mutations)
+
+	run, err := restarted.GetRun("persisted", runIds[3])
+	assert.NoError(t, err)
+	assert.Equal(t, TriggerApi, run.Trigger)
+
+	// A standby only opens the store once elected, until then it reports the run history as unavailable
+	standby := newTestManagerWithStore(t, "jobs_test_persist_standby", store.NewUnavailableStore("standby"), 2, 3)
+	standby.AddJob("AAS_TEST_JOB", "persisted", config.JobSchedule{}, func(ctx context.Context) error { return nil })
+	job, err = standby.Get("persisted")
+	assert.NoError(t, err)
+	assert.Empty(t, job.Runs)
+	assert.True(t, job.RunsUnavailable)
+	_, err = standby.GetRun("persisted", runIds[3])
+	assert.True(t, errorx.IsOfType(err, RunHistoryUnavailable))
+
+	standby.SetStore(st)
+	job, err = standby.Get("persisted")
+	assert.NoError(t, err)
+	assert.Len(t, job.Runs, 2)
+	assert.Equal(t, runIds[3], job.Runs[0].ID)
+	assert.False(t, job.RunsUnavailable)
+	_, err = standby.GetRun("persisted", "missing")
+	assert.True(t, errorx.IsOfType(err, RunNotFound))
+}
+
+func TestCountMutation(t *testing.T) {
+	// Outside of a job run, counting is a no-op
+	CountMutation(context.Background(), "groupCreated")
+
+	run := &runState{run: Run{Mutations: map[string]int{}}}
+	ctx := context.WithValue(context.Background(), runCtxKey{}, run)
+	CountMutation(ctx, "groupCreated")
+	CountMutations(ctx, "groupCreated", 2)
+	CountMutations(ctx, "memberAdded", 0)
+
+	assert.Equal(t, map[string]int{"groupCreated": 3}, run.snapshot().Mutations)
+}
+
+func TestTrackMutations(t *testing.T) {
+	ctx, mutations := TrackMutations(context.Background())
+	assert.Equal(t, map[string]int{}, mutations())
+
+	CountMutation(ctx, "groupCreated")
+	CountMutations(ctx, "memberAdded", 2)
+
+	assert.Equal(t, map[string]int{"groupCreated": 1, "memberAdded": 2}, mutations())
+}
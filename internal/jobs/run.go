@@ -0,0 +1,103 @@
+package jobs
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	RunStatusRunning   = "running"
+	RunStatusSucceeded = "succeeded"
+	RunStatusFailed    = "failed"
+	RunStatusCancelled = "cancelled"
+)
+
+const (
+	TriggerSchedule = "schedule"
+	TriggerApi      = "api"
+	TriggerCli      = "cli"
+)
+
+// Run is a single execution of a job.
+type Run struct {
+	ID              string         `json:"id"`
+	Job             string         `json:"job"`
+	Trigger         string         `json:"trigger"`
+	Status          string         `json:"status"`
+	StartedAt       time.Time      `json:"startedAt"`
+	EndedAt         *time.Time     `json:"endedAt,omitempty"`
+	DurationSeconds float64        `json:"durationSeconds"`
+	Error           string         `json:"error,omitempty"`
+	Mutations       map[string]int `json:"mutations"`
+}
+
+// runState is the mutable state of a Run, shared between the job handler and API readers.
+type runState struct {
+	mu  sync.Mutex
+	run Run
+}
+
+func (r *runState) countMutations(kind string, count int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.run.Mutations[kind] += count
+}
+
+func (r *runState) finish(status string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	endedAt := time.Now()
+	r.run.EndedAt = &endedAt
+	r.run.DurationSeconds = endedAt.Sub(r.run.StartedAt).Seconds()
+	r.run.Status = status
+	if err != nil {
+		r.run.Error = err.Error()
+	}
+}
+
+// snapshot returns a copy of the Run that is safe to hand out while the job is still running.
+func (r *runState) snapshot() Run {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	run := r.run
+	if run.EndedAt == nil {
+		run.DurationSeconds = time.Since(run.StartedAt).Seconds()
+	}
+	run.Mutations = make(map[string]int, len(r.run.Mutations))
+	for kind, count := range r.run.Mutations {
+		run.Mutations[kind] = count
+	}
+
+	return run
+}
+
+type runCtxKey struct{}
+
+// CountMutation records a change made to a downstream system by the job run in ctx. It is a no-op outside of job
+// runs, e.g. in event handlers.
+func CountMutation(ctx context.Context, kind string) {
+	CountMutations(ctx, kind, 1)
+}
+
+// CountMutations records count changes of the same kind made by the job run in ctx.
+func CountMutations(ctx context.Context, kind string, count int) {
+	if count == 0 {
+		return
+	}
+	if run, ok := ctx.Value(runCtxKey{}).(*runState); ok {
+		run.countMutations(kind, count)
+	}
+}
+
+// TrackMutations returns a context in which mutations are recorded outside of job runs, e.g. for a single API
+// request. The returned function reports the mutations recorded so far.
+func TrackMutations(ctx context.Context) (context.Context, func() map[string]int) {
+	state := &runState{run: Run{Mutations: map[string]int{}}}
+
+	return context.WithValue(ctx, runCtxKey{}, state), func() map[string]int {
+		return state.snapshot().Mutations
+	}
+}
@@ -2,12 +2,15 @@ package k8s
 
 import (
 	"context"
+	"go.dfds.cloud/aad-aws-sync/internal/metrics"
+	"go.dfds.cloud/aad-aws-sync/internal/tracing"
 	"gopkg.in/yaml.v2"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/utils/env"
+	"net/http"
 )
 
 type RoleMapping struct {
@@ -96,6 +99,9 @@ func GetK8sClient() (*kubernetes.Clientset, error) {
 	if err != nil {
 		return nil, err
 	}
+	config.WrapTransport = func(rt http.RoundTripper) http.RoundTripper {
+		return metrics.NewTransport(metrics.TargetKubernetes, tracing.NewTransport(metrics.TargetKubernetes, rt))
+	}
 
 	client, err := kubernetes.NewForConfig(config)
 	if err != nil {
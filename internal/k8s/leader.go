@@ -0,0 +1,174 @@
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.dfds.cloud/aad-aws-sync/internal/util"
+	"go.uber.org/zap"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+const serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+var metricIsLeader = promauto.NewGauge(prometheus.GaugeOpts{
+	Name:      "leader_election_is_leader",
+	Help:      "1 if this instance holds the leader election Lease, 0 otherwise",
+	Namespace: "aad_aws_sync",
+})
+
+type LeaderElectionConfig struct {
+	LeaseName      string
+	LeaseNamespace string
+	// Identity identifies this instance in the Lease. Defaults to the hostname, i.e. the Pod name.
+	Identity      string
+	LeaseDuration time.Duration
+	RenewDeadline time.Duration
+	RetryPeriod   time.Duration
+	// PodLabel, if set, is set to "true" on the Pod of the leader, named by Identity, while it leads. A Service
+	// selecting on it routes requests to the leader only.
+	PodLabel string
+}
+
+// LeaderElector elects a single leader among the replicas of the service using a Kubernetes Lease.
+type LeaderElector struct {
+	client  kubernetes.Interface
+	conf    LeaderElectionConfig
+	leading atomic.Bool
+}
+
+func NewLeaderElector(client kubernetes.Interface, conf LeaderElectionConfig) (*LeaderElector, error) {
+	if conf.Identity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		conf.Identity = hostname
+	}
+
+	if conf.LeaseNamespace == "" {
+		namespace, err := os.ReadFile(serviceAccountNamespaceFile)
+		if err != nil {
+			return nil, errors.New("no leader election Lease namespace configured, and unable to detect the namespace of the Pod")
+		}
+		conf.LeaseNamespace = strings.TrimSpace(string(namespace))
+	}
+
+	return &LeaderElector{client: client, conf: conf}, nil
+}
+
+// IsLeader reports whether this instance currently holds the Lease.
+func (l *LeaderElector) IsLeader() bool {
+	return l.leading.Load()
+}
+
+// ActiveLeader returns the identity of the instance holding the Lease, or "" if no instance holds it: there is no
+// Lease, the leader released it, or the leader hasn't renewed it within its duration.
+func (l *LeaderElector) ActiveLeader(ctx context.Context) (string, error) {
+	lease, err := l.client.CoordinationV1().Leases(l.conf.LeaseNamespace).Get(ctx, l.conf.LeaseName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	spec := lease.Spec
+	if spec.HolderIdentity == nil || spec.RenewTime == nil || spec.LeaseDurationSeconds == nil {
+		return "", nil
+	}
+	if time.Since(spec.RenewTime.Time) > time.Duration(*spec.LeaseDurationSeconds)*time.Second {
+		return "", nil
+	}
+
+	return *spec.HolderIdentity, nil
+}
+
+// Run campaigns for the Lease until ctx is cancelled or leadership is lost. onStartedLeading is called with a context
+// that is cancelled once leadership is lost. onStoppedLeading is called when Run returns, whether this instance was
+// leading or not. The Lease is released when ctx is cancelled, so a standby can take over right away.
+func (l *LeaderElector) Run(ctx context.Context, onStartedLeading func(ctx context.Context), onStoppedLeading func()) error {
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock: &resourcelock.LeaseLock{
+			LeaseMeta: metav1.ObjectMeta{
+				Name:      l.conf.LeaseName,
+				Namespace: l.conf.LeaseNamespace,
+			},
+			Client:     l.client.CoordinationV1(),
+			LockConfig: resourcelock.ResourceLockConfig{Identity: l.conf.Identity},
+		},
+		LeaseDuration:   l.conf.LeaseDuration,
+		RenewDeadline:   l.conf.RenewDeadline,
+		RetryPeriod:     l.conf.RetryPeriod,
+		ReleaseOnCancel: true,
+		Name:            l.conf.LeaseName,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				l.leading.Store(true)
+				metricIsLeader.Set(1)
+				l.labelPod(ctx, true)
+				onStartedLeading(ctx)
+			},
+			OnStoppedLeading: func() {
+				l.leading.Store(false)
+				metricIsLeader.Set(0)
+				// ctx is cancelled by now
+				labelCtx, cancel := context.WithTimeout(context.Background(), l.conf.RenewDeadline)
+				defer cancel()
+				l.labelPod(labelCtx, false)
+				onStoppedLeading()
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// A restarted container keeps the labels of its Pod, so it may still be labelled as the leader
+	l.labelPod(ctx, false)
+
+	elector.Run(ctx)
+
+	return nil
+}
+
+// labelPod sets or removes the leader label on the Pod of this instance. Failing to do so is logged, since requests
+// routed to a standby are rejected by RequireLeader, and a Pod that went away takes its labels with it.
+func (l *LeaderElector) labelPod(ctx context.Context, leading bool) {
+	if l.conf.PodLabel == "" {
+		return
+	}
+
+	// A merge patch removes a label set to null
+	var value *string
+	if leading {
+		leader := "true"
+		value = &leader
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels": map[string]*string{l.conf.PodLabel: value},
+		},
+	})
+	if err != nil {
+		util.Logger.Error("Unable to label Pod as leader", zap.Error(err))
+		return
+	}
+
+	_, err = l.client.CoreV1().Pods(l.conf.LeaseNamespace).Patch(ctx, l.conf.Identity, types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		util.Logger.Error("Unable to label Pod as leader", zap.String("pod", l.conf.Identity), zap.Bool("leading", leading), zap.Error(err))
+	}
+}
@@ -0,0 +1,180 @@
+package k8s
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.dfds.cloud/aad-aws-sync/internal/util"
+	"go.uber.org/zap"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newTestLeaderElector(t *testing.T, client *fake.Clientset, identity string) *LeaderElector {
+	elector, err := NewLeaderElector(client, LeaderElectionConfig{
+		LeaseName:      "aad-aws-sync",
+		LeaseNamespace: "default",
+		Identity:       identity,
+		LeaseDuration:  time.Second,
+		RenewDeadline:  500 * time.Millisecond,
+		RetryPeriod:    100 * time.Millisecond,
+	})
+	assert.NoError(t, err)
+
+	return elector
+}
+
+func leaseHolder(client *fake.Clientset) string {
+	lease, err := client.CoordinationV1().Leases("default").Get(context.Background(), "aad-aws-sync", metav1.GetOptions{})
+	if err != nil || lease.Spec.HolderIdentity == nil {
+		return ""
+	}
+
+	return *lease.Spec.HolderIdentity
+}
+
+func TestLeaderElector_Failover(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	first := newTestLeaderElector(t, client, "first")
+	second := newTestLeaderElector(t, client, "second")
+
+	firstCtx, cancelFirst := context.WithCancel(context.Background())
+	firstStarted := make(chan struct{})
+	firstStopped := make(chan struct{})
+	go first.Run(firstCtx, func(ctx context.Context) { close(firstStarted) }, func() { close(firstStopped) })
+
+	select {
+	case <-firstStarted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("first instance never became leader")
+	}
+	assert.True(t, first.IsLeader())
+	assert.Equal(t, "first", leaseHolder(client))
+
+	secondCtx, cancelSecond := context.WithCancel(context.Background())
+	defer cancelSecond()
+	secondStarted := make(chan struct{})
+	go second.Run(secondCtx, func(ctx context.Context) { close(secondStarted) }, func() {})
+
+	// The second instance stays a standby while the first one holds the Lease
+	time.Sleep(300 * time.Millisecond)
+	assert.False(t, second.IsLeader())
+
+	// Once the leader goes away, the standby takes over
+	cancelFirst()
+	select {
+	case <-firstStopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("first instance never stopped leading")
+	}
+	assert.False(t, first.IsLeader())
+
+	select {
+	case <-secondStarted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("second instance never became leader")
+	}
+	assert.True(t, second.IsLeader())
+	assert.Equal(t, "second", leaseHolder(client))
+}
+
+func TestLeaderElector_PodLabel(t *testing.T) {
+	util.Logger = zap.NewNop()
+	// The container was restarted while leading, so the Pod is still labelled as the leader
+	client := fake.NewSimpleClientset(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Name:      "first",
+		Namespace: "default",
+		Labels:    map[string]string{"app": "aad-aws-sync", "aad-aws-sync/leader": "true"},
+	}})
+	elector := newTestLeaderElector(t, client, "first")
+	elector.conf.PodLabel = "aad-aws-sync/leader"
+
+	podLabels := func() map[string]string {
+		pod, err := client.CoreV1().Pods("default").Get(context.Background(), "first", metav1.GetOptions{})
+		assert.NoError(t, err)
+		return pod.Labels
+	}
+
+	// Hold the Lease, so the instance stays a standby
+	holder := newTestLeaderElector(t, client, "holder")
+	holderCtx, cancelHolder := context.WithCancel(context.Background())
+	holderStarted := make(chan struct{})
+	go holder.Run(holderCtx, func(ctx context.Context) { close(holderStarted) }, func() {})
+	<-holderStarted
+
+	ctx, cancel := context.WithCancel(context.Background())
+	started := make(chan struct{})
+	stopped := make(chan struct{})
+	go elector.Run(ctx, func(ctx context.Context) { close(started) }, func() { close(stopped) })
+
+	assert.Eventually(t, func() bool {
+		_, ok := podLabels()["aad-aws-sync/leader"]
+		return !ok
+	}, 5*time.Second, 50*time.Millisecond)
+	assert.Equal(t, "aad-aws-sync", podLabels()["app"])
+
+	cancelHolder()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("instance never became leader")
+	}
+	assert.Equal(t, "true", podLabels()["aad-aws-sync/leader"])
+
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("instance never stopped leading")
+	}
+	assert.NotContains(t, podLabels(), "aad-aws-sync/leader")
+	assert.Equal(t, "aad-aws-sync", podLabels()["app"])
+}
+
+func TestNewLeaderElector_Defaults(t *testing.T) {
+	elector, err := NewLeaderElector(fake.NewSimpleClientset(), LeaderElectionConfig{LeaseName: "aad-aws-sync", LeaseNamespace: "default"})
+	assert.NoError(t, err)
+	assert.NotEmpty(t, elector.conf.Identity)
+	assert.False(t, elector.IsLeader())
+}
+
+func TestLeaderElector_ActiveLeader(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	elector := newTestLeaderElector(t, client, "cli")
+	ctx := context.Background()
+
+	// No Lease yet
+	leader, err := elector.ActiveLeader(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "", leader)
+
+	holder := "pod-a"
+	duration := int32(15)
+	lease := &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{Name: "aad-aws-sync", Namespace: "default"},
+		Spec: coordinationv1.LeaseSpec{
+			HolderIdentity:       &holder,
+			LeaseDurationSeconds: &duration,
+			RenewTime:            &metav1.MicroTime{Time: time.Now()},
+		},
+	}
+	_, err = client.CoordinationV1().Leases("default").Create(ctx, lease, metav1.CreateOptions{})
+	assert.NoError(t, err)
+
+	leader, err = elector.ActiveLeader(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "pod-a", leader)
+
+	// A Lease that hasn't been renewed within its duration is not held
+	lease.Spec.RenewTime = &metav1.MicroTime{Time: time.Now().Add(-time.Minute)}
+	_, err = client.CoordinationV1().Leases("default").Update(ctx, lease, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+
+	leader, err = elector.ActiveLeader(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "", leader)
+}
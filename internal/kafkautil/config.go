@@ -1,9 +1,16 @@
 package kafkautil
 
+import (
+	"fmt"
+	"time"
+
+	"github.com/segmentio/kafka-go/sasl/plain"
+)
+
 // ConsumerConfig allows one to configure a Kafka consumer using
 // environment variables.
 type ConsumerConfig struct {
-	GroupID string `envconfig:"group_id",required:"true"`
+	GroupID string `envconfig:"group_id" required:"true"`
 	Topic   string `required:"true"`
 }
 
@@ -13,11 +20,49 @@ type ProducerConfig struct {
 	Topic string `required:"true"`
 }
 
-// AuthConfig allows one to configure auth with a plain SASL
-// authnetication mechanism to the Kafka brokers.
+// AuthConfig allows one to configure auth to the Kafka brokers. Mechanism
+// selects the SASL authentication mechanism, one of "plain", "scram-sha-256",
+// "scram-sha-512" or "oauthbearer". The settings of the selected mechanism are
+// read from the matching MECHANISM_* block.
+//
+// With Tls enabled, TlsCaFile can point to a PEM bundle of CAs used to verify
+// the brokers, and TlsCertFile/TlsKeyFile to a client certificate for mutual TLS.
 type AuthConfig struct {
 	Brokers          []string          `required:"true"`
 	Mechanism        string            `required:"true"`
 	MechanismOptions map[string]string `envconfig:"MECHANISM_OPTIONS"`
 	Tls              bool              `required:"true"`
+	TlsCaFile        string            `envconfig:"TLS_CA_FILE"`
+	TlsCertFile      string            `envconfig:"TLS_CERT_FILE"`
+	TlsKeyFile       string            `envconfig:"TLS_KEY_FILE"`
+
+	Plain       plain.Mechanism   `envconfig:"MECHANISM_PLAIN"`
+	Scram       ScramConfig       `envconfig:"MECHANISM_SCRAM"`
+	OAuthBearer OAuthBearerConfig `envconfig:"MECHANISM_OAUTHBEARER"`
+}
+
+// String describes the AuthConfig without any of the mechanism settings, as
+// those contain credentials.
+func (c AuthConfig) String() string {
+	return fmt.Sprintf("{Brokers:%v Mechanism:%s Tls:%t TlsCaFile:%s TlsCertFile:%s}", c.Brokers, c.Mechanism, c.Tls, c.TlsCaFile, c.TlsCertFile)
+}
+
+// ScramConfig holds the credentials for the SCRAM-SHA-256 and SCRAM-SHA-512
+// mechanisms.
+type ScramConfig struct {
+	Username string
+	Password string
+}
+
+// OAuthBearerConfig holds the client credentials used to fetch tokens for the
+// OAUTHBEARER mechanism. TokenEndpoint defaults to the Azure AD v2.0 token
+// endpoint of TenantId.
+type OAuthBearerConfig struct {
+	TenantId      string `envconfig:"TENANT_ID"`
+	ClientId      string `envconfig:"CLIENT_ID"`
+	ClientSecret  string `envconfig:"CLIENT_SECRET"`
+	Scope         string
+	TokenEndpoint string `envconfig:"TOKEN_ENDPOINT"`
+	// RefreshSkew is how long before the expiry of a token a new one is fetched, see util.TokenClient
+	RefreshSkew time.Duration `envconfig:"REFRESH_SKEW" default:"2m"`
 }
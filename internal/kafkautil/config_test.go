@@ -3,14 +3,48 @@ package kafkautil
 import (
 	"fmt"
 	"testing"
+
+	"github.com/kelseyhightower/envconfig"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestConfigResolver(t *testing.T) {
+	t.Setenv("AAS_KAFKA_AUTH_BROKERS", "localhost:9092,localhost:9093")
+	t.Setenv("AAS_KAFKA_AUTH_MECHANISM", "scram-sha-512")
+	t.Setenv("AAS_KAFKA_AUTH_TLS", "true")
+	t.Setenv("AAS_KAFKA_AUTH_TLS_CA_FILE", "/etc/kafka/ca.pem")
+	t.Setenv("AAS_KAFKA_AUTH_MECHANISM_PLAIN_USERNAME", "plainuser")
+	t.Setenv("AAS_KAFKA_AUTH_MECHANISM_SCRAM_USERNAME", "scramuser")
+	t.Setenv("AAS_KAFKA_AUTH_MECHANISM_SCRAM_PASSWORD", "scramsecret")
+	t.Setenv("AAS_KAFKA_AUTH_MECHANISM_OAUTHBEARER_CLIENT_SECRET", "oauthsecret")
+
 	var conf AuthConfig
-	//err := envconfig.Process("AAS_KAFKA", &conf)
-	//if err != nil {
-	//	log.Fatal("Failed to process auth configurations", zap.Error(err))
-	//}
-	
-	fmt.Printf("%+v\n", conf)
+	err := envconfig.Process("AAS_KAFKA_AUTH", &conf)
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"localhost:9092", "localhost:9093"}, conf.Brokers)
+	assert.Equal(t, "scram-sha-512", conf.Mechanism)
+	assert.True(t, conf.Tls)
+	assert.Equal(t, "/etc/kafka/ca.pem", conf.TlsCaFile)
+	assert.Equal(t, "plainuser", conf.Plain.Username)
+	assert.Equal(t, "scramuser", conf.Scram.Username)
+	assert.Equal(t, "scramsecret", conf.Scram.Password)
+	assert.Equal(t, "oauthsecret", conf.OAuthBearer.ClientSecret)
+}
+
+func TestAuthConfig_String(t *testing.T) {
+	conf := AuthConfig{
+		Brokers:          []string{"localhost:9092"},
+		Mechanism:        "scram-sha-256",
+		MechanismOptions: map[string]string{"token": "optionsecret"},
+		Scram:            ScramConfig{Username: "scramuser", Password: "scramsecret"},
+		OAuthBearer:      OAuthBearerConfig{ClientSecret: "oauthsecret"},
+	}
+
+	for _, formatted := range []string{conf.String(), fmt.Sprintf("%v", conf), fmt.Sprintf("%+v", conf)} {
+		assert.Contains(t, formatted, "scram-sha-256")
+		assert.NotContains(t, formatted, "scramsecret")
+		assert.NotContains(t, formatted, "oauthsecret")
+		assert.NotContains(t, formatted, "optionsecret")
+	}
 }
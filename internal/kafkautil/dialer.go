@@ -2,49 +2,48 @@ package kafkautil
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
-	"github.com/kelseyhightower/envconfig"
-	"github.com/segmentio/kafka-go/sasl"
-	"github.com/segmentio/kafka-go/sasl/plain"
+	"os"
 	"strings"
 	"time"
 
 	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/scram"
 )
 
 // NewDialer configures a connection dialer using the supplied AuthConfig
 func NewDialer(authConfig AuthConfig) (*kafka.Dialer, error) {
-	// Configure TLS
-
 	var tlsConfig *tls.Config
 	var saslMechanism sasl.Mechanism
+	var err error
 
+	// Configure TLS
 	if authConfig.Tls {
-		tlsConfig = &tls.Config{
-			MinVersion:               tls.VersionTLS12,
-			CurvePreferences:         []tls.CurveID{tls.CurveP521, tls.CurveP384, tls.CurveP256},
-			PreferServerCipherSuites: true,
-			CipherSuites: []uint16{
-				tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
-				tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
-				tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
-				tls.TLS_RSA_WITH_AES_256_CBC_SHA,
-			},
+		tlsConfig, err = newTlsConfig(authConfig)
+		if err != nil {
+			return nil, err
 		}
 	}
 
 	// Configure SASL mechanism
-	for k, v := range authConfig.MechanismOptions {
-		fmt.Printf("Key: %s, Value: %s\n", k, v)
-	}
 	switch strings.ToLower(authConfig.Mechanism) {
 	case "plain":
-		var plainConf plain.Mechanism
-		err := envconfig.Process("AAS_KAFKA_AUTH_MECHANISM_PLAIN", &plainConf)
+		saslMechanism = authConfig.Plain
+	case "scram-sha-256":
+		saslMechanism, err = scram.Mechanism(scram.SHA256, authConfig.Scram.Username, authConfig.Scram.Password)
+		if err != nil {
+			return nil, err
+		}
+	case "scram-sha-512":
+		saslMechanism, err = scram.Mechanism(scram.SHA512, authConfig.Scram.Username, authConfig.Scram.Password)
 		if err != nil {
 			return nil, err
 		}
-		saslMechanism = plainConf
+	case "oauthbearer":
+		saslMechanism = NewOAuthBearerMechanism(authConfig.OAuthBearer)
 	default:
 		saslMechanism = nil
 	}
@@ -58,3 +57,44 @@ func NewDialer(authConfig AuthConfig) (*kafka.Dialer, error) {
 		ClientID:      "aadawssync",
 	}, nil
 }
+
+func newTlsConfig(authConfig AuthConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:               tls.VersionTLS12,
+		CurvePreferences:         []tls.CurveID{tls.CurveP521, tls.CurveP384, tls.CurveP256},
+		PreferServerCipherSuites: true,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+		},
+	}
+
+	if authConfig.TlsCaFile != "" {
+		caBundle, err := os.ReadFile(authConfig.TlsCaFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA bundle: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caBundle) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", authConfig.TlsCaFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if authConfig.TlsCertFile != "" || authConfig.TlsKeyFile != "" {
+		if authConfig.TlsCertFile == "" || authConfig.TlsKeyFile == "" {
+			return nil, errors.New("both a client certificate and key are required for mutual TLS")
+		}
+
+		cert, err := tls.LoadX509KeyPair(authConfig.TlsCertFile, authConfig.TlsKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
@@ -1,7 +1,19 @@
 package kafkautil
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestNewDialerSasl(t *testing.T) {
@@ -76,3 +88,83 @@ func TestNewDialerTls(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestNewDialerScram(t *testing.T) {
+	for mechanism, name := range map[string]string{"scram-sha-256": "SCRAM-SHA-256", "SCRAM-SHA-512": "SCRAM-SHA-512"} {
+		dialer, err := NewDialer(AuthConfig{
+			Mechanism: mechanism,
+			Scram:     ScramConfig{Username: "user", Password: "password"},
+		})
+		assert.NoError(t, err)
+		assert.NotNil(t, dialer.SASLMechanism)
+		assert.Equal(t, name, dialer.SASLMechanism.Name())
+	}
+}
+
+func TestNewDialerOAuthBearer(t *testing.T) {
+	dialer, err := NewDialer(AuthConfig{Mechanism: "oauthbearer"})
+	assert.NoError(t, err)
+	assert.NotNil(t, dialer.SASLMechanism)
+	assert.Equal(t, "OAUTHBEARER", dialer.SASLMechanism.Name())
+}
+
+func TestNewDialerMutualTls(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "client.pem")
+	keyFile := filepath.Join(dir, "client-key.pem")
+	writeTestCertificate(t, certFile, keyFile)
+
+	dialer, err := NewDialer(AuthConfig{
+		Mechanism:   "plain",
+		Tls:         true,
+		TlsCaFile:   certFile,
+		TlsCertFile: certFile,
+		TlsKeyFile:  keyFile,
+	})
+	assert.NoError(t, err)
+	assert.NotNil(t, dialer.TLS.RootCAs)
+	assert.Len(t, dialer.TLS.Certificates, 1)
+
+	_, err = NewDialer(AuthConfig{Tls: true, TlsCertFile: certFile})
+	assert.Error(t, err)
+
+	_, err = NewDialer(AuthConfig{Tls: true, TlsCaFile: keyFile})
+	assert.Error(t, err)
+
+	_, err = NewDialer(AuthConfig{Tls: true, TlsCaFile: filepath.Join(dir, "missing.pem")})
+	assert.Error(t, err)
+}
+
+func writeTestCertificate(t *testing.T, certFile string, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "aadawssync"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,71 @@
+package kafkautil
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/segmentio/kafka-go/sasl"
+	"go.dfds.cloud/aad-aws-sync/internal/entraid"
+	"go.dfds.cloud/aad-aws-sync/internal/httpclient"
+	"go.dfds.cloud/aad-aws-sync/internal/metrics"
+	"go.dfds.cloud/aad-aws-sync/internal/util"
+)
+
+// OAuthBearerMechanism implements the SASL OAUTHBEARER mechanism (RFC 7628),
+// using access tokens fetched with the OAuth 2.0 client credentials grant.
+type OAuthBearerMechanism struct {
+	config      OAuthBearerConfig
+	httpClient  *http.Client
+	tokenClient *util.TokenClient
+}
+
+func NewOAuthBearerMechanism(conf OAuthBearerConfig) *OAuthBearerMechanism {
+	payload := &OAuthBearerMechanism{
+		config:     conf,
+		httpClient: httpclient.New(httpclient.DefaultConfig(metrics.TargetEntraId)),
+	}
+	payload.tokenClient = util.NewTokenClient(payload.getNewToken)
+	if conf.RefreshSkew > 0 {
+		payload.tokenClient.SetRefreshSkew(conf.RefreshSkew)
+	}
+	return payload
+}
+
+func (m *OAuthBearerMechanism) Name() string {
+	return "OAUTHBEARER"
+}
+
+func (m *OAuthBearerMechanism) Start(ctx context.Context) (sasl.StateMachine, []byte, error) {
+	err := m.tokenClient.RefreshAuth()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return m, []byte(fmt.Sprintf("n,,\x01auth=Bearer %s\x01\x01", m.tokenClient.GetToken())), nil
+}
+
+func (m *OAuthBearerMechanism) Next(ctx context.Context, challenge []byte) (bool, []byte, error) {
+	// On failure the broker responds with a JSON error document instead of an empty challenge
+	if len(challenge) > 0 {
+		return false, nil, fmt.Errorf("OAUTHBEARER authentication failed: %s", string(challenge))
+	}
+
+	return true, nil, nil
+}
+
+func (m *OAuthBearerMechanism) tokenEndpoint() string {
+	if m.config.TokenEndpoint != "" {
+		return m.config.TokenEndpoint
+	}
+
+	return fmt.Sprintf("https://login.microsoftonline.com/%s/oauth2/v2.0/token", m.config.TenantId)
+}
+
+func (m *OAuthBearerMechanism) getNewToken() (*util.RefreshAuthResponse, error) {
+	return entraid.RequestToken(m.httpClient, entraid.Credentials{
+		ClientId:      m.config.ClientId,
+		ClientSecret:  m.config.ClientSecret,
+		TokenEndpoint: m.tokenEndpoint(),
+	}, m.config.Scope)
+}
@@ -0,0 +1,68 @@
+package kafkautil
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOAuthBearerMechanism(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		assert.NoError(t, r.ParseForm())
+		assert.Equal(t, "client_credentials", r.Form.Get("grant_type"))
+		assert.Equal(t, "kafka-client", r.Form.Get("client_id"))
+		assert.Equal(t, "kafka-secret", r.Form.Get("client_secret"))
+		assert.Equal(t, "api://kafka/.default", r.Form.Get("scope"))
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"token_type":"Bearer","expires_in":3600,"access_token":"dummy-token"}`))
+	}))
+	defer server.Close()
+
+	mechanism := NewOAuthBearerMechanism(OAuthBearerConfig{
+		ClientId:      "kafka-client",
+		ClientSecret:  "kafka-secret",
+		Scope:         "api://kafka/.default",
+		TokenEndpoint: server.URL,
+	})
+	assert.Equal(t, "OAUTHBEARER", mechanism.Name())
+
+	sess, ir, err := mechanism.Start(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "n,,\x01auth=Bearer dummy-token\x01\x01", string(ir))
+
+	done, resp, err := sess.Next(context.Background(), []byte{})
+	assert.NoError(t, err)
+	assert.True(t, done)
+	assert.Nil(t, resp)
+
+	_, _, err = sess.Next(context.Background(), []byte(`{"status":"invalid_token"}`))
+	assert.Error(t, err)
+
+	// Token is cached until it expires
+	_, _, err = mechanism.Start(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, requests)
+}
+
+func TestOAuthBearerMechanism_TokenError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	mechanism := NewOAuthBearerMechanism(OAuthBearerConfig{TokenEndpoint: server.URL})
+
+	_, _, err := mechanism.Start(context.Background())
+	assert.Error(t, err)
+}
+
+func TestOAuthBearerMechanism_DefaultTokenEndpoint(t *testing.T) {
+	mechanism := NewOAuthBearerMechanism(OAuthBearerConfig{TenantId: "tenant"})
+	assert.Equal(t, "https://login.microsoftonline.com/tenant/oauth2/v2.0/token", mechanism.tokenEndpoint())
+}
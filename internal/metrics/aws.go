@@ -0,0 +1,64 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/smithy-go"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+var awsTargets = map[string]string{
+	"SSO Admin":     TargetSsoAdmin,
+	"Organizations": TargetOrganizations,
+	"identitystore": TargetIdentityStore,
+	"STS":           TargetSts,
+	"IAM":           TargetIam,
+}
+
+// AwsApiOptions records every attempt of the API calls of AWS SDK clients, labelled by AWS service. Use with
+// config.WithAPIOptions.
+var AwsApiOptions = []func(*middleware.Stack) error{addAwsMiddleware}
+
+func addAwsMiddleware(stack *middleware.Stack) error {
+	// Added first in the deserialize step, so API errors have been deserialised once the call returns
+	return stack.Deserialize.Add(middleware.DeserializeMiddlewareFunc("AadAwsSyncMetrics", func(ctx context.Context, in middleware.DeserializeInput, next middleware.DeserializeHandler) (middleware.DeserializeOutput, middleware.Metadata, error) {
+		start := time.Now()
+		out, metadata, err := next.HandleDeserialize(ctx, in)
+
+		statusCode := 0
+		if resp, ok := out.RawResponse.(*smithyhttp.Response); ok {
+			statusCode = resp.StatusCode
+		}
+		ObserveRequest(ctx, awsTarget(awsmiddleware.GetServiceID(ctx)), time.Since(start), statusCode, isAwsThrottle(statusCode, err), err)
+
+		return out, metadata, err
+	}), middleware.Before)
+}
+
+func awsTarget(serviceId string) string {
+	if target, ok := awsTargets[serviceId]; ok {
+		return target
+	}
+
+	return serviceId
+}
+
+func isAwsThrottle(statusCode int, err error) bool {
+	if statusCode == http.StatusTooManyRequests {
+		return true
+	}
+
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		_, throttle := retry.DefaultThrottleErrorCodes[apiErr.ErrorCode()]
+		return throttle
+	}
+
+	return false
+}
@@ -0,0 +1,117 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.dfds.cloud/aad-aws-sync/internal/handlerctx"
+)
+
+// Downstream systems called by the service, used as target label.
+const (
+	TargetGraph             = "graph"
+	TargetCapabilityService = "capabilityService"
+	TargetSsoAdmin          = "ssoAdmin"
+	TargetOrganizations     = "organizations"
+	TargetIdentityStore     = "identityStore"
+	TargetSts               = "sts"
+	TargetIam               = "iam"
+	TargetScim              = "scim"
+	TargetExchange          = "exchange"
+	TargetKubernetes        = "kubernetes"
+	TargetEntraId           = "entraId"
+)
+
+// unknownHandler is used as handler label for calls made outside of a job run, event handler or API request.
+const unknownHandler = "unknown"
+
+var metricRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name:      "downstream_requests_total",
+	Help:      "Requests made to downstream systems, by response status code",
+	Namespace: "aad_aws_sync",
+}, []string{"handler", "target", "code"})
+
+var metricRequestErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name:      "downstream_request_errors_total",
+	Help:      "Requests to downstream systems that failed, by reason: transport, client_error or server_error",
+	Namespace: "aad_aws_sync",
+}, []string{"handler", "target", "reason"})
+
+var metricThrottled = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name:      "downstream_throttled_total",
+	Help:      "Requests to downstream systems rejected because of throttling",
+	Namespace: "aad_aws_sync",
+}, []string{"handler", "target"})
+
+var metricRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:      "downstream_request_duration_seconds",
+	Help:      "Latency of requests to downstream systems",
+	Namespace: "aad_aws_sync",
+	Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+}, []string{"handler", "target"})
+
+// HandlerFromContext returns the name of the job, event or API operation ctx belongs to, for use as handler label.
+func HandlerFromContext(ctx context.Context) string {
+	if name := handlerctx.Name(ctx); name != "" {
+		return name
+	}
+
+	return unknownHandler
+}
+
+// ObserveRequest records a single request to a downstream system. statusCode is 0 if no response was received.
+func ObserveRequest(ctx context.Context, target string, duration time.Duration, statusCode int, throttled bool, err error) {
+	handler := HandlerFromContext(ctx)
+
+	code := strconv.Itoa(statusCode)
+	if statusCode == 0 {
+		code = "none"
+	}
+	metricRequests.WithLabelValues(handler, target, code).Inc()
+	metricRequestDuration.WithLabelValues(handler, target).Observe(duration.Seconds())
+
+	if throttled {
+		metricThrottled.WithLabelValues(handler, target).Inc()
+	}
+
+	switch {
+	case statusCode == 0 && err != nil:
+		metricRequestErrors.WithLabelValues(handler, target, "transport").Inc()
+	case statusCode >= 500:
+		metricRequestErrors.WithLabelValues(handler, target, "server_error").Inc()
+	case statusCode >= 400:
+		metricRequestErrors.WithLabelValues(handler, target, "client_error").Inc()
+	}
+}
+
+// Transport is an http.RoundTripper recording every request made through it.
+type Transport struct {
+	target string
+	next   http.RoundTripper
+}
+
+// NewTransport wraps next, labelling its requests with target. If next is nil, http.DefaultTransport is used.
+func NewTransport(target string, next http.RoundTripper) *Transport {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	return &Transport{target: target, next: next}
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+
+	statusCode := 0
+	if resp != nil {
+		statusCode = resp.StatusCode
+	}
+	ObserveRequest(req.Context(), t.target, time.Since(start), statusCode, statusCode == http.StatusTooManyRequests, err)
+
+	return resp, err
+}
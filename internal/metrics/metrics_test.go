@@ -0,0 +1,79 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/smithy-go"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"go.dfds.cloud/aad-aws-sync/internal/handlerctx"
+)
+
+func counterValue(t *testing.T, counter prometheus.Counter) float64 {
+	var metric dto.Metric
+	assert.NoError(t, counter.Write(&metric))
+	return metric.GetCounter().GetValue()
+}
+
+func TestHandlerFromContext(t *testing.T) {
+	assert.Equal(t, "unknown", HandlerFromContext(context.Background()))
+
+	ctx := handlerctx.WithName(context.Background(), "awsMapping")
+	assert.Equal(t, "awsMapping", HandlerFromContext(ctx))
+}
+
+func TestObserveRequest(t *testing.T) {
+	ctx := handlerctx.WithName(context.Background(), "testObserveRequest")
+
+	ObserveRequest(ctx, TargetGraph, time.Millisecond, 0, false, errors.New("connection refused"))
+	ObserveRequest(ctx, TargetGraph, time.Millisecond, 404, false, nil)
+	ObserveRequest(ctx, TargetGraph, time.Millisecond, 503, false, nil)
+
+	assert.Equal(t, float64(1), counterValue(t, metricRequests.WithLabelValues("testObserveRequest", TargetGraph, "none")))
+	assert.Equal(t, float64(1), counterValue(t, metricRequestErrors.WithLabelValues("testObserveRequest", TargetGraph, "transport")))
+	assert.Equal(t, float64(1), counterValue(t, metricRequestErrors.WithLabelValues("testObserveRequest", TargetGraph, "client_error")))
+	assert.Equal(t, float64(1), counterValue(t, metricRequestErrors.WithLabelValues("testObserveRequest", TargetGraph, "server_error")))
+}
+
+func TestTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/throttled" {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	ctx := handlerctx.WithName(context.Background(), "testTransport")
+	client := &http.Client{Transport: NewTransport(TargetCapabilityService, nil)}
+	for _, path := range []string{"/ok", "/ok", "/throttled"} {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+path, nil)
+		assert.NoError(t, err)
+		resp, err := client.Do(req)
+		assert.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	assert.Equal(t, float64(2), counterValue(t, metricRequests.WithLabelValues("testTransport", TargetCapabilityService, "200")))
+	assert.Equal(t, float64(1), counterValue(t, metricRequests.WithLabelValues("testTransport", TargetCapabilityService, "429")))
+	assert.Equal(t, float64(1), counterValue(t, metricThrottled.WithLabelValues("testTransport", TargetCapabilityService)))
+}
+
+func TestIsAwsThrottle(t *testing.T) {
+	assert.True(t, isAwsThrottle(http.StatusTooManyRequests, nil))
+	assert.True(t, isAwsThrottle(http.StatusBadRequest, &smithy.GenericAPIError{Code: "ThrottlingException"}))
+	assert.False(t, isAwsThrottle(http.StatusBadRequest, &smithy.GenericAPIError{Code: "ValidationException"}))
+	assert.False(t, isAwsThrottle(0, errors.New("connection refused")))
+}
+
+func TestAwsTarget(t *testing.T) {
+	assert.Equal(t, TargetSsoAdmin, awsTarget("SSO Admin"))
+	assert.Equal(t, "S3", awsTarget("S3"))
+}
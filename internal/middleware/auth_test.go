@@ -0,0 +1,44 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequireBearerToken(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name   string
+		token  string
+		header string
+		want   int
+	}{
+		{name: "valid token", token: "secret", header: "Bearer secret", want: http.StatusOK},
+		{name: "wrong token", token: "secret", header: "Bearer wrong", want: http.StatusUnauthorized},
+		{name: "missing header", token: "secret", header: "", want: http.StatusUnauthorized},
+		{name: "not a bearer token", token: "secret", header: "Basic secret", want: http.StatusUnauthorized},
+		{name: "no token configured", token: "", header: "Bearer ", want: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := gin.New()
+			router.GET("/", RequireBearerToken(tt.token), func(c *gin.Context) {
+				c.Status(http.StatusOK)
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.want, w.Code)
+		})
+	}
+}
@@ -0,0 +1,18 @@
+package middleware
+
+import (
+	"github.com/gin-gonic/gin"
+	"go.dfds.cloud/aad-aws-sync/internal/jobs"
+)
+
+func AddJobManager(manager *jobs.Manager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set("jobManager", manager)
+	}
+}
+
+func GetJobManager(c *gin.Context) *jobs.Manager {
+	managerA, _ := c.Get("jobManager")
+	m := managerA.(*jobs.Manager)
+	return m
+}
@@ -0,0 +1,20 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RequireLeader rejects requests unless this instance is the elected leader, since only the leader runs jobs, consumes
+// events and has the state store open. The aad-aws-sync-leader Service routes requests to the leader.
+func RequireLeader(isLeader func() bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !isLeader() {
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"message": "this instance is a standby, retry against the leader"})
+			return
+		}
+
+		c.Next()
+	}
+}
@@ -11,7 +11,7 @@ import (
 
 func TestAddOrchestrator(t *testing.T) {
 	backgroundJobWg := &sync.WaitGroup{}
-	orc := orchestrator.NewOrchestrator(context.Background(), backgroundJobWg)
+	orc := orchestrator.NewOrchestrator(context.Background(), backgroundJobWg, "aad_aws_sync_add")
 
 	f := AddOrchestrator(orc)
 	assert.NotNil(t, f)
@@ -24,7 +24,7 @@ func TestAddOrchestrator(t *testing.T) {
 
 func TestGetOrchestrator(t *testing.T) {
 	backgroundJobWg := &sync.WaitGroup{}
-	orc := orchestrator.NewOrchestrator(context.Background(), backgroundJobWg)
+	orc := orchestrator.NewOrchestrator(context.Background(), backgroundJobWg, "aad_aws_sync_get")
 
 	f := AddOrchestrator(orc)
 	assert.NotNil(t, f)
@@ -4,8 +4,10 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"go.dfds.cloud/aad-aws-sync/internal/entraid"
+	"go.dfds.cloud/aad-aws-sync/internal/httpclient"
+	"go.dfds.cloud/aad-aws-sync/internal/metrics"
 	"go.dfds.cloud/aad-aws-sync/internal/ssu_exchange/direct"
-	"go.dfds.cloud/aad-aws-sync/internal/util"
 	"io"
 	"net/http"
 )
@@ -22,12 +24,13 @@ type IClient interface {
 }
 
 type Config struct {
-	TenantId     string `json:"tenantId"`
-	ClientId     string `json:"clientId"`
-	ClientSecret string `json:"clientSecret"`
-	BaseUrl      string `json:"baseUrl"`
-	ManagedBy    string `json:"managedBy"`
-	EmailSuffix  string `json:"emailSuffix"`
+	TenantId     string             `json:"tenantId"`
+	ClientId     string             `json:"clientId"`
+	ClientSecret string             `json:"clientSecret"`
+	Auth         entraid.AuthConfig `json:"auth"`
+	BaseUrl      string             `json:"baseUrl"`
+	ManagedBy    string             `json:"managedBy"`
+	EmailSuffix  string             `json:"emailSuffix"`
 }
 
 func DoRequest[T any](client IClient, req *http.Request, rf *RequestFuncs) (*T, error) {
@@ -138,27 +141,27 @@ func NewRequestFuncs() *RequestFuncs {
 }
 
 func (c *ClientPowershellWrapper) HasTokenExpired() bool {
-	return c.tokenClient.Token.IsExpired()
+	return c.tokenClient.IsExpired()
 }
 
 func NewSsuExchangeClientPowershellWrapper(conf Config) IClient {
 	payload := &ClientPowershellWrapper{
-		httpClient: http.DefaultClient,
+		httpClient: httpclient.New(httpclient.DefaultConfig(metrics.TargetExchange)),
 		config:     conf,
 	}
 
-	payload.tokenClient = util.NewTokenClient(payload.getNewToken)
+	payload.tokenClient = entraid.NewTokenClient(conf.Auth, payload.getNewToken)
 
 	return payload
 }
 
 func NewSsuExchangeClientO365UnofficialApi(conf Config) IClient {
 	payload := &ClientO365UnofficialApi{
-		httpClient: http.DefaultClient,
+		httpClient: httpclient.New(httpclient.DefaultConfig(metrics.TargetExchange)),
 		config:     conf,
 	}
 
-	payload.tokenClient = util.NewTokenClient(payload.getNewToken)
+	payload.tokenClient = entraid.NewTokenClient(conf.Auth, payload.getNewToken)
 
 	return payload
 }
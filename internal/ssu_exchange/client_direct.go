@@ -5,14 +5,13 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"go.dfds.cloud/aad-aws-sync/internal/entraid"
+	"go.dfds.cloud/aad-aws-sync/internal/httpclient"
 	"go.dfds.cloud/aad-aws-sync/internal/ssu_exchange/direct"
 	"go.dfds.cloud/aad-aws-sync/internal/util"
-	"io"
 	"k8s.io/utils/env"
-	"log"
 	"net/http"
 	"net/url"
-	"strings"
 )
 
 type ClientO365UnofficialApi struct {
@@ -64,15 +63,7 @@ func (c *ClientO365UnofficialApi) GetAliases(ctx context.Context) ([]GetAliasesR
 
 		rf := NewRequestFuncs()
 		rf.PostResponse = func(req *http.Request, resp *http.Response) error {
-			if resp.StatusCode != 200 {
-				rawData, err := io.ReadAll(resp.Body)
-				if err != nil {
-					log.Fatal(err)
-				}
-				fmt.Println(string(rawData))
-				return fmt.Errorf("response returned unexpected status code: %d", resp.StatusCode)
-			}
-			return nil
+			return httpclient.CheckResponse(resp, HttpError, http.StatusOK)
 		}
 		payload, err := DoRequest[direct.O365ResponseWrapper[GetAliasesResponse]](c, req, rf)
 		if err != nil {
@@ -125,10 +116,7 @@ func (c *ClientO365UnofficialApi) CreateAlias(ctx context.Context, alias string,
 
 	rf := NewRequestFuncs()
 	rf.PostResponse = func(req *http.Request, resp *http.Response) error {
-		if resp.StatusCode != 200 {
-			return fmt.Errorf("response returned unexpected status code: %d", resp.StatusCode)
-		}
-		return nil
+		return httpclient.CheckResponse(resp, HttpError, http.StatusOK)
 	}
 	err = DoRequestWithoutDeserialise(c, req, rf)
 	if err != nil {
@@ -167,10 +155,7 @@ func (c *ClientO365UnofficialApi) RemoveAlias(ctx context.Context, alias string)
 
 	rf := NewRequestFuncs()
 	rf.PostResponse = func(req *http.Request, resp *http.Response) error {
-		if resp.StatusCode != 200 {
-			return fmt.Errorf("response returned unexpected status code: %d", resp.StatusCode)
-		}
-		return nil
+		return httpclient.CheckResponse(resp, HttpError, http.StatusOK)
 	}
 	err = DoRequestWithoutDeserialise(c, req, rf)
 	if err != nil {
@@ -206,10 +191,7 @@ func (c *ClientO365UnofficialApi) UpdateAlias(ctx context.Context, alias string,
 
 	rf := NewRequestFuncs()
 	rf.PostResponse = func(req *http.Request, resp *http.Response) error {
-		if resp.StatusCode != 200 {
-			return fmt.Errorf("response returned unexpected status code: %d", resp.StatusCode)
-		}
-		return nil
+		return httpclient.CheckResponse(resp, HttpError, http.StatusOK)
 	}
 	err = DoRequestWithoutDeserialise(c, req, rf)
 	if err != nil {
@@ -247,10 +229,7 @@ func (c *ClientO365UnofficialApi) AddDistributionGroupMember(ctx context.Context
 
 	rf := NewRequestFuncs()
 	rf.PostResponse = func(req *http.Request, resp *http.Response) error {
-		if resp.StatusCode != 200 {
-			return fmt.Errorf("response returned unexpected status code: %d", resp.StatusCode)
-		}
-		return nil
+		return httpclient.CheckResponse(resp, HttpError, http.StatusOK)
 	}
 	err = DoRequestWithoutDeserialise(c, req, rf)
 	if err != nil {
@@ -290,10 +269,7 @@ func (c *ClientO365UnofficialApi) RemoveDistributionGroupMember(ctx context.Cont
 
 	rf := NewRequestFuncs()
 	rf.PostResponse = func(req *http.Request, resp *http.Response) error {
-		if resp.StatusCode != 200 {
-			return fmt.Errorf("response returned unexpected status code: %d", resp.StatusCode)
-		}
-		return nil
+		return httpclient.CheckResponse(resp, HttpError, http.StatusOK)
 	}
 	err = DoRequestWithoutDeserialise(c, req, rf)
 	if err != nil {
@@ -306,7 +282,7 @@ func (c *ClientO365UnofficialApi) RemoveDistributionGroupMember(ctx context.Cont
 func (c *ClientO365UnofficialApi) RefreshAuth() error {
 	envToken := env.GetString("AAS_AZURE_TOKEN", "")
 	if envToken != "" {
-		c.tokenClient.Token = util.NewBearerToken(envToken)
+		c.tokenClient.SetToken(util.NewBearerToken(envToken))
 		return nil
 	}
 
@@ -315,41 +291,12 @@ func (c *ClientO365UnofficialApi) RefreshAuth() error {
 }
 
 func (c *ClientO365UnofficialApi) getNewToken() (*util.RefreshAuthResponse, error) {
-	reqPayload := url.Values{}
-	reqPayload.Set("client_id", c.config.ClientId)
-	reqPayload.Set("grant_type", "client_credentials")
-	reqPayload.Set("scope", "https://outlook.office365.com/.default")
-	reqPayload.Set("client_secret", c.config.ClientSecret)
-
-	req, err := http.NewRequest("POST", fmt.Sprintf("https://login.microsoftonline.com/%s/oauth2/v2.0/token", c.config.TenantId), strings.NewReader(reqPayload.Encode()))
-	if err != nil {
-		return nil, err
-	}
-
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-
-	resp, err := c.httpClient.Do(req)
-	if err != nil {
-		return nil, err
-	}
-
-	rawData, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	if resp.StatusCode != 200 {
-		return nil, err
-	}
-
-	var tokenResponse *util.RefreshAuthResponse
-
-	err = json.Unmarshal(rawData, &tokenResponse)
-	if err != nil {
-		return nil, err
-	}
-
-	return tokenResponse, nil
+	return entraid.RequestToken(c.httpClient, entraid.Credentials{
+		TenantId:     c.config.TenantId,
+		ClientId:     c.config.ClientId,
+		ClientSecret: c.config.ClientSecret,
+		Auth:         c.config.Auth,
+	}, "https://outlook.office365.com/.default")
 }
 
 func (c *ClientO365UnofficialApi) prepareHttpRequest(req *http.Request) error {
@@ -358,7 +305,7 @@ func (c *ClientO365UnofficialApi) prepareHttpRequest(req *http.Request) error {
 		return err
 	}
 
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.tokenClient.Token.GetToken()))
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.tokenClient.GetToken()))
 	req.Header.Set("User-Agent", "aad-aws-sync - github.com/dfds/aad-aws-sync")
 	return nil
 }
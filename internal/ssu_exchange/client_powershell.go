@@ -5,13 +5,12 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"go.dfds.cloud/aad-aws-sync/internal/entraid"
+	"go.dfds.cloud/aad-aws-sync/internal/httpclient"
 	"go.dfds.cloud/aad-aws-sync/internal/ssu_exchange/direct"
 	"go.dfds.cloud/aad-aws-sync/internal/util"
-	"io"
 	"k8s.io/utils/env"
 	"net/http"
-	"net/url"
-	"strings"
 )
 
 type ClientPowershellWrapper struct {
@@ -35,10 +34,7 @@ func (c *ClientPowershellWrapper) GetAliases(ctx context.Context) ([]GetAliasesR
 
 	rf := NewRequestFuncs()
 	rf.PostResponse = func(req *http.Request, resp *http.Response) error {
-		if resp.StatusCode != 200 {
-			return fmt.Errorf("response returned unexpected status code: %d", resp.StatusCode)
-		}
-		return nil
+		return httpclient.CheckResponse(resp, HttpError, http.StatusOK)
 	}
 	payload, err := DoRequest[[]GetAliasesResponse](c, req, rf)
 	if err != nil {
@@ -78,10 +74,7 @@ func (c *ClientPowershellWrapper) CreateAlias(ctx context.Context, alias string,
 
 	rf := NewRequestFuncs()
 	rf.PostResponse = func(req *http.Request, resp *http.Response) error {
-		if resp.StatusCode != 200 {
-			return fmt.Errorf("response returned unexpected status code: %d", resp.StatusCode)
-		}
-		return nil
+		return httpclient.CheckResponse(resp, HttpError, http.StatusOK)
 	}
 	err = DoRequestWithoutDeserialise(c, req, rf)
 	if err != nil {
@@ -115,10 +108,7 @@ func (c *ClientPowershellWrapper) RemoveAlias(ctx context.Context, alias string)
 
 	rf := NewRequestFuncs()
 	rf.PostResponse = func(req *http.Request, resp *http.Response) error {
-		if resp.StatusCode != 200 {
-			return fmt.Errorf("response returned unexpected status code: %d", resp.StatusCode)
-		}
-		return nil
+		return httpclient.CheckResponse(resp, HttpError, http.StatusOK)
 	}
 	err = DoRequestWithoutDeserialise(c, req, rf)
 	if err != nil {
@@ -159,10 +149,7 @@ func (c *ClientPowershellWrapper) AddDistributionGroupMember(ctx context.Context
 
 	rf := NewRequestFuncs()
 	rf.PostResponse = func(req *http.Request, resp *http.Response) error {
-		if resp.StatusCode != 200 {
-			return fmt.Errorf("response returned unexpected status code: %d", resp.StatusCode)
-		}
-		return nil
+		return httpclient.CheckResponse(resp, HttpError, http.StatusOK)
 	}
 	err = DoRequestWithoutDeserialise(c, req, rf)
 	if err != nil {
@@ -198,10 +185,7 @@ func (c *ClientPowershellWrapper) RemoveDistributionGroupMember(ctx context.Cont
 
 	rf := NewRequestFuncs()
 	rf.PostResponse = func(req *http.Request, resp *http.Response) error {
-		if resp.StatusCode != 200 {
-			return fmt.Errorf("response returned unexpected status code: %d", resp.StatusCode)
-		}
-		return nil
+		return httpclient.CheckResponse(resp, HttpError, http.StatusOK)
 	}
 	err = DoRequestWithoutDeserialise(c, req, rf)
 	if err != nil {
@@ -214,7 +198,7 @@ func (c *ClientPowershellWrapper) RemoveDistributionGroupMember(ctx context.Cont
 func (c *ClientPowershellWrapper) RefreshAuth() error {
 	envToken := env.GetString("AAS_AZURE_TOKEN", "")
 	if envToken != "" {
-		c.tokenClient.Token = util.NewBearerToken(envToken)
+		c.tokenClient.SetToken(util.NewBearerToken(envToken))
 		return nil
 	}
 
@@ -223,41 +207,12 @@ func (c *ClientPowershellWrapper) RefreshAuth() error {
 }
 
 func (c *ClientPowershellWrapper) getNewToken() (*util.RefreshAuthResponse, error) {
-	reqPayload := url.Values{}
-	reqPayload.Set("client_id", c.config.ClientId)
-	reqPayload.Set("grant_type", "client_credentials")
-	reqPayload.Set("scope", "ae87d685-cfcd-4019-8d4b-a82cc27fd2bc/.default")
-	reqPayload.Set("client_secret", c.config.ClientSecret)
-
-	req, err := http.NewRequest("POST", fmt.Sprintf("https://login.microsoftonline.com/%s/oauth2/v2.0/token", c.config.TenantId), strings.NewReader(reqPayload.Encode()))
-	if err != nil {
-		return nil, err
-	}
-
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-
-	resp, err := c.httpClient.Do(req)
-	if err != nil {
-		return nil, err
-	}
-
-	rawData, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	if resp.StatusCode != 200 {
-		return nil, err
-	}
-
-	var tokenResponse *util.RefreshAuthResponse
-
-	err = json.Unmarshal(rawData, &tokenResponse)
-	if err != nil {
-		return nil, err
-	}
-
-	return tokenResponse, nil
+	return entraid.RequestToken(c.httpClient, entraid.Credentials{
+		TenantId:     c.config.TenantId,
+		ClientId:     c.config.ClientId,
+		ClientSecret: c.config.ClientSecret,
+		Auth:         c.config.Auth,
+	}, "ae87d685-cfcd-4019-8d4b-a82cc27fd2bc/.default")
 }
 
 func (c *ClientPowershellWrapper) prepareHttpRequest(req *http.Request) error {
@@ -266,7 +221,7 @@ func (c *ClientPowershellWrapper) prepareHttpRequest(req *http.Request) error {
 		return err
 	}
 
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.tokenClient.Token.GetToken()))
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.tokenClient.GetToken()))
 	req.Header.Set("User-Agent", "aad-aws-sync - github.com/dfds/aad-aws-sync")
 	return nil
 }
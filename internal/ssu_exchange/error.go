@@ -0,0 +1,10 @@
+package ssu_exchange
+
+import (
+	"github.com/joomcode/errorx"
+)
+
+var (
+	ExchangeError = errorx.NewNamespace("ssuExchange")
+	HttpError     = ExchangeError.NewType("http_error")
+)
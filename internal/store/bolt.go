@@ -0,0 +1,121 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltOpenTimeout is how long opening a BoltStore waits for another process to close it.
+var boltOpenTimeout = 5 * time.Second
+
+// BoltStore is a Store kept in a local bbolt database file.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+func NewBoltStore(path string) (*BoltStore, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0o750)
+	if err != nil {
+		return nil, err
+	}
+
+	// bbolt locks the file, so fail rather than block forever if another process has it open
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: boltOpenTimeout})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, Locked.Wrap(err, "state store %s is open in another process", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range Buckets {
+			if _, err := tx.CreateBucketIfNotExists([]byte(bucket)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltStore{db: db}, nil
+}
+
+func (s *BoltStore) bucket(tx *bolt.Tx, bucket string) (*bolt.Bucket, error) {
+	b := tx.Bucket([]byte(bucket))
+	if b == nil {
+		return nil, UnknownBucket.New("unknown bucket %s", bucket)
+	}
+
+	return b, nil
+}
+
+func (s *BoltStore) Put(bucket string, key string, value any) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := s.bucket(tx, bucket)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), data)
+	})
+}
+
+func (s *BoltStore) Get(bucket string, key string, value any) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		b, err := s.bucket(tx, bucket)
+		if err != nil {
+			return err
+		}
+
+		data := b.Get([]byte(key))
+		if data == nil {
+			return NotFound.New("%s/%s not found", bucket, key)
+		}
+		return json.Unmarshal(data, value)
+	})
+}
+
+func (s *BoltStore) Delete(bucket string, key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := s.bucket(tx, bucket)
+		if err != nil {
+			return err
+		}
+		return b.Delete([]byte(key))
+	})
+}
+
+func (s *BoltStore) List(bucket string, prefix string, fn func(key string, value []byte) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		b, err := s.bucket(tx, bucket)
+		if err != nil {
+			return err
+		}
+
+		c := b.Cursor()
+		for k, v := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, v = c.Next() {
+			if err := fn(string(k), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
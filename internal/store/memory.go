@@ -0,0 +1,111 @@
+package store
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MemoryStore is a Store that only lives as long as the process. It is meant for tests and for running without
+// persistence.
+type MemoryStore struct {
+	mu      sync.RWMutex
+	buckets map[string]map[string][]byte
+}
+
+func NewMemoryStore() *MemoryStore {
+	s := &MemoryStore{buckets: map[string]map[string][]byte{}}
+	for _, bucket := range Buckets {
+		s.buckets[bucket] = map[string][]byte{}
+	}
+
+	return s
+}
+
+func (s *MemoryStore) bucket(bucket string) (map[string][]byte, error) {
+	b, ok := s.buckets[bucket]
+	if !ok {
+		return nil, UnknownBucket.New("unknown bucket %s", bucket)
+	}
+
+	return b, nil
+}
+
+func (s *MemoryStore) Put(bucket string, key string, value any) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, err := s.bucket(bucket)
+	if err != nil {
+		return err
+	}
+	b[key] = data
+
+	return nil
+}
+
+func (s *MemoryStore) Get(bucket string, key string, value any) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	b, err := s.bucket(bucket)
+	if err != nil {
+		return err
+	}
+
+	data, ok := b[key]
+	if !ok {
+		return NotFound.New("%s/%s not found", bucket, key)
+	}
+
+	return json.Unmarshal(data, value)
+}
+
+func (s *MemoryStore) Delete(bucket string, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, err := s.bucket(bucket)
+	if err != nil {
+		return err
+	}
+	delete(b, key)
+
+	return nil
+}
+
+func (s *MemoryStore) List(bucket string, prefix string, fn func(key string, value []byte) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	b, err := s.bucket(bucket)
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(b))
+	for key := range b {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if err := fn(key, b[key]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,88 @@
+package store
+
+import (
+	"sync"
+	"time"
+
+	"github.com/joomcode/errorx"
+)
+
+// Buckets group the records kept in a Store.
+const (
+	BucketRuns             = "runs"
+	BucketAudit            = "audit"
+	BucketCapSvcSnapshots  = "capsvcSnapshots"
+	BucketProcessedEvents  = "processedEvents"
+	BucketGraphDelta       = "graphDelta"
+	BucketDuplicateGroups  = "duplicateGroups"
+	BucketGuestInvitations = "guestInvitations"
+)
+
+var Buckets = []string{BucketRuns, BucketAudit, BucketCapSvcSnapshots, BucketProcessedEvents, BucketGraphDelta, BucketDuplicateGroups, BucketGuestInvitations}
+
+const (
+	BackendBolt   = "bolt"
+	BackendMemory = "memory"
+)
+
+var (
+	StoreError     = errorx.NewNamespace("store")
+	NotFound       = StoreError.NewType("not_found")
+	UnknownBackend = StoreError.NewType("unknown_backend")
+	UnknownBucket  = StoreError.NewType("unknown_bucket")
+	// Locked is returned when opening a Store another process has open.
+	Locked = StoreError.NewType("locked")
+	// Unavailable is returned by an UnavailableStore.
+	Unavailable = StoreError.NewType("unavailable")
+)
+
+// Store persists state between runs of the service. Records are kept in buckets, keyed by a string and stored as
+// JSON. Keys are ordered, so records that should be listed chronologically are given keys that sort by time.
+type Store interface {
+	// Put stores value under key, replacing any existing record.
+	Put(bucket string, key string, value any) error
+	// Get decodes the record stored under key into value. Returns a NotFound error if there is no such record.
+	Get(bucket string, key string, value any) error
+	// Delete removes the record stored under key. Deleting a record that doesn't exist is not an error.
+	Delete(bucket string, key string) error
+	// List calls fn with every record whose key starts with prefix, in key order. The value passed to fn is only
+	// valid until fn returns. fn must not modify the Store.
+	List(bucket string, prefix string, fn func(key string, value []byte) error) error
+	Close() error
+}
+
+// Open opens the Store of the given backend. path is only used by backends persisting to disk.
+func Open(backend string, path string) (Store, error) {
+	switch backend {
+	case BackendBolt:
+		return NewBoltStore(path)
+	case BackendMemory:
+		return NewMemoryStore(), nil
+	default:
+		return nil, UnknownBackend.New("unknown state store backend %s", backend)
+	}
+}
+
+var (
+	defaultMu    sync.RWMutex
+	defaultStore Store = NewMemoryStore()
+)
+
+// Default returns the Store of the service. Until SetDefault is called, e.g. in tests, it is an in-memory Store.
+func Default() Store {
+	defaultMu.RLock()
+	defer defaultMu.RUnlock()
+	return defaultStore
+}
+
+// SetDefault sets the Store returned by Default.
+func SetDefault(s Store) {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	defaultStore = s
+}
+
+// TimeKey formats t so that keys starting with it sort chronologically.
+func TimeKey(t time.Time) string {
+	return t.UTC().Format("20060102T150405.000000000Z")
+}
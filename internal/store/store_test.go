@@ -0,0 +1,118 @@
+package store
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/joomcode/errorx"
+	"github.com/stretchr/testify/assert"
+)
+
+type testRecord struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+func testStore(t *testing.T, s Store) {
+	var record testRecord
+	err := s.Get(BucketRuns, "missing", &record)
+	assert.True(t, errorx.IsOfType(err, NotFound))
+
+	assert.NoError(t, s.Put(BucketRuns, "job-b/2", testRecord{Name: "b2", Count: 2}))
+	assert.NoError(t, s.Put(BucketRuns, "job-a/1", testRecord{Name: "a1", Count: 1}))
+	assert.NoError(t, s.Put(BucketRuns, "job-b/1", testRecord{Name: "b1", Count: 1}))
+	assert.NoError(t, s.Put(BucketRuns, "job-b/1", testRecord{Name: "b1", Count: 3}))
+
+	assert.NoError(t, s.Get(BucketRuns, "job-b/1", &record))
+	assert.Equal(t, testRecord{Name: "b1", Count: 3}, record)
+
+	keys := []string{}
+	assert.NoError(t, s.List(BucketRuns, "job-b/", func(key string, value []byte) error {
+		keys = append(keys, key)
+		return nil
+	}))
+	assert.Equal(t, []string{"job-b/1", "job-b/2"}, keys)
+
+	stop := errors.New("stop")
+	assert.Equal(t, stop, s.List(BucketRuns, "", func(key string, value []byte) error {
+		return stop
+	}))
+
+	assert.NoError(t, s.Delete(BucketRuns, "job-b/1"))
+	assert.NoError(t, s.Delete(BucketRuns, "job-b/1"))
+	err = s.Get(BucketRuns, "job-b/1", &record)
+	assert.True(t, errorx.IsOfType(err, NotFound))
+
+	err = s.Put("missing", "key", record)
+	assert.True(t, errorx.IsOfType(err, UnknownBucket))
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore())
+}
+
+func TestBoltStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data", "state.db")
+	s, err := NewBoltStore(path)
+	assert.NoError(t, err)
+	testStore(t, s)
+
+	// Records survive reopening the database
+	assert.NoError(t, s.Close())
+	s, err = NewBoltStore(path)
+	assert.NoError(t, err)
+	defer s.Close()
+
+	var record testRecord
+	assert.NoError(t, s.Get(BucketRuns, "job-a/1", &record))
+	assert.Equal(t, testRecord{Name: "a1", Count: 1}, record)
+}
+
+func TestBoltStore_Locked(t *testing.T) {
+	defer func(timeout time.Duration) { boltOpenTimeout = timeout }(boltOpenTimeout)
+	boltOpenTimeout = 100 * time.Millisecond
+
+	path := filepath.Join(t.TempDir(), "state.db")
+	s, err := NewBoltStore(path)
+	assert.NoError(t, err)
+
+	_, err = NewBoltStore(path)
+	assert.True(t, errorx.IsOfType(err, Locked))
+
+	assert.NoError(t, s.Close())
+	s, err = NewBoltStore(path)
+	assert.NoError(t, err)
+	assert.NoError(t, s.Close())
+}
+
+func TestUnavailableStore(t *testing.T) {
+	s := NewUnavailableStore("only the leader has the state store open")
+
+	var record testRecord
+	err := s.Get(BucketRuns, "job-a/1", &record)
+	assert.True(t, errorx.IsOfType(err, Unavailable))
+	assert.EqualError(t, err, "store.unavailable: only the leader has the state store open")
+	assert.True(t, errorx.IsOfType(s.Put(BucketRuns, "job-a/1", record), Unavailable))
+	assert.True(t, errorx.IsOfType(s.Delete(BucketRuns, "job-a/1"), Unavailable))
+	assert.True(t, errorx.IsOfType(s.List(BucketRuns, "", func(key string, value []byte) error { return nil }), Unavailable))
+	assert.NoError(t, s.Close())
+}
+
+func TestOpen(t *testing.T) {
+	s, err := Open(BackendMemory, "")
+	assert.NoError(t, err)
+	assert.IsType(t, &MemoryStore{}, s)
+
+	_, err = Open("postgres", "")
+	assert.True(t, errorx.IsOfType(err, UnknownBackend))
+}
+
+func TestTimeKey(t *testing.T) {
+	earlier := time.Date(2023, 1, 2, 3, 4, 5, 6, time.UTC)
+	later := earlier.Add(time.Second)
+
+	assert.Equal(t, "20230102T030405.000000006Z", TimeKey(earlier))
+	assert.Less(t, TimeKey(earlier), TimeKey(later))
+}
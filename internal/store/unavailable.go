@@ -0,0 +1,33 @@
+package store
+
+// UnavailableStore stands in for the state store in an instance that can't open it, e.g. a standby while the leader
+// has it open. Every call fails with an Unavailable error, so readers can tell missing state from state they can't see.
+type UnavailableStore struct {
+	reason string
+}
+
+// NewUnavailableStore creates an UnavailableStore whose errors give reason, e.g. "only the leader has the state store
+// open".
+func NewUnavailableStore(reason string) *UnavailableStore {
+	return &UnavailableStore{reason: reason}
+}
+
+func (s *UnavailableStore) Put(bucket string, key string, value any) error {
+	return Unavailable.New("%s", s.reason)
+}
+
+func (s *UnavailableStore) Get(bucket string, key string, value any) error {
+	return Unavailable.New("%s", s.reason)
+}
+
+func (s *UnavailableStore) Delete(bucket string, key string) error {
+	return Unavailable.New("%s", s.reason)
+}
+
+func (s *UnavailableStore) List(bucket string, prefix string, fn func(key string, value []byte) error) error {
+	return Unavailable.New("%s", s.reason)
+}
+
+func (s *UnavailableStore) Close() error {
+	return nil
+}
@@ -0,0 +1,46 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const awsRequestIdKey = attribute.Key("aws.request_id")
+
+// AwsApiOptions starts a client span for every API call of AWS SDK clients, covering all of its attempts. Use with
+// config.WithAPIOptions.
+var AwsApiOptions = []func(*middleware.Stack) error{addAwsMiddleware}
+
+func addAwsMiddleware(stack *middleware.Stack) error {
+	// Added last in the initialize step, as the service and operation names are only known after the SDK's own
+	// initialize middlewares ran
+	return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("AadAwsSyncTracing", func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+		service := awsmiddleware.GetServiceID(ctx)
+		operation := awsmiddleware.GetOperationName(ctx)
+
+		ctx, span := Tracer().Start(ctx, service+"."+operation,
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(semconv.RPCSystemKey.String("aws-api"), semconv.RPCService(service), semconv.RPCMethod(operation)))
+		defer span.End()
+
+		out, metadata, err := next.HandleInitialize(ctx, in)
+
+		if requestId, ok := awsmiddleware.GetRequestIDMetadata(metadata); ok {
+			span.SetAttributes(awsRequestIdKey.String(requestId))
+		}
+		var respErr *smithyhttp.ResponseError
+		if errors.As(err, &respErr) {
+			span.SetAttributes(semconv.HTTPStatusCode(respErr.HTTPStatusCode()))
+		}
+		RecordError(span, err)
+
+		return out, metadata, err
+	}), middleware.After)
+}
@@ -0,0 +1,62 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Transport is an http.RoundTripper starting a client span for every request made through it, and propagating the
+// trace context in the request headers.
+type Transport struct {
+	target string
+	next   http.RoundTripper
+}
+
+// NewTransport wraps next, naming its spans after target. If next is nil, http.DefaultTransport is used.
+func NewTransport(target string, next http.RoundTripper) *Transport {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	return &Transport{target: target, next: next}
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// The query is left out of the URL, as it may contain user principal names and e-mail addresses
+	url := *req.URL
+	url.RawQuery = ""
+	url.User = nil
+
+	ctx, span := Tracer().Start(req.Context(), fmt.Sprintf("%s %s", t.target, req.Method),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.HTTPMethod(req.Method), semconv.HTTPURL(url.String()), semconv.NetPeerName(req.URL.Hostname())))
+	defer span.End()
+
+	// A RoundTripper must not modify the request it is given
+	req = req.Clone(ctx)
+	propagator.Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		RecordError(span, err)
+		return resp, err
+	}
+
+	span.SetAttributes(semconv.HTTPStatusCode(resp.StatusCode))
+	if resp.StatusCode >= 500 {
+		span.SetStatus(codes.Error, resp.Status)
+	}
+
+	return resp, err
+}
+
+// ExtractHttpHeaders returns a context carrying the trace context found in the headers of a request, if any.
+func ExtractHttpHeaders(ctx context.Context, header http.Header) context.Context {
+	return propagator.Extract(ctx, propagation.HeaderCarrier(header))
+}
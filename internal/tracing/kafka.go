@@ -0,0 +1,56 @@
+package tracing
+
+import (
+	"context"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// kafkaHeaderCarrier adapts the headers of a Kafka message to a propagation.TextMapCarrier.
+type kafkaHeaderCarrier struct {
+	headers *[]kafka.Header
+}
+
+func (c kafkaHeaderCarrier) Get(key string) string {
+	for _, header := range *c.headers {
+		if header.Key == key {
+			return string(header.Value)
+		}
+	}
+
+	return ""
+}
+
+func (c kafkaHeaderCarrier) Set(key string, value string) {
+	for i, header := range *c.headers {
+		if header.Key == key {
+			(*c.headers)[i].Value = []byte(value)
+			return
+		}
+	}
+
+	*c.headers = append(*c.headers, kafka.Header{Key: key, Value: []byte(value)})
+}
+
+func (c kafkaHeaderCarrier) Keys() []string {
+	keys := make([]string, 0, len(*c.headers))
+	for _, header := range *c.headers {
+		keys = append(keys, header.Key)
+	}
+
+	return keys
+}
+
+// InjectKafkaHeaders returns a copy of headers with the trace context of ctx added, replacing any trace context the
+// headers already had.
+func InjectKafkaHeaders(ctx context.Context, headers []kafka.Header) []kafka.Header {
+	injected := append([]kafka.Header(nil), headers...)
+	propagator.Inject(ctx, kafkaHeaderCarrier{headers: &injected})
+
+	return injected
+}
+
+// ExtractKafkaHeaders returns a context carrying the trace context found in headers, if any.
+func ExtractKafkaHeaders(ctx context.Context, headers []kafka.Header) context.Context {
+	return propagator.Extract(ctx, kafkaHeaderCarrier{headers: &headers})
+}
@@ -0,0 +1,106 @@
+package tracing
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "go.dfds.cloud/aad-aws-sync"
+
+// Attributes set on the root spans of job runs and events.
+const (
+	AttrJobName     = attribute.Key("aad_aws_sync.job.name")
+	AttrJobRunId    = attribute.Key("aad_aws_sync.job.run_id")
+	AttrEventType   = attribute.Key("aad_aws_sync.event.type")
+	AttrEventStatus = attribute.Key("aad_aws_sync.event.status")
+	AttrEventReason = attribute.Key("aad_aws_sync.event.reason")
+)
+
+// propagator is used for trace context in HTTP and Kafka headers, whether or not exporting is enabled.
+var propagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// Config configures exporting of spans over OTLP/gRPC.
+type Config struct {
+	Endpoint    string
+	Insecure    bool
+	SampleRatio float64
+	ServiceName string
+}
+
+// Init sets up the global TracerProvider to export spans to the OTLP collector at conf.Endpoint. Until Init is called,
+// e.g. when tracing is disabled, spans are not recorded. The returned function flushes pending spans, and must be
+// called on shutdown.
+func Init(ctx context.Context, conf Config) (func(context.Context) error, error) {
+	opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(conf.Endpoint)}
+	if conf.Insecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+
+	exporter, err := otlptracegrpc.New(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.New(ctx,
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+		resource.WithAttributes(semconv.ServiceName(conf.ServiceName)))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(conf.SampleRatio))))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagator)
+
+	return provider.Shutdown, nil
+}
+
+// Tracer returns the tracer used for all spans of the service.
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// StartJobSpan starts the root span of a job run.
+func StartJobSpan(ctx context.Context, name string, runId string) (context.Context, trace.Span) {
+	return Tracer().Start(ctx, "job "+name,
+		trace.WithNewRoot(),
+		trace.WithAttributes(AttrJobName.String(name), AttrJobRunId.String(runId)))
+}
+
+// StartEventSpan starts the root span of handling an event. If ctx carries the trace context of whoever published the
+// event, see ExtractKafkaHeaders, the span links to it.
+func StartEventSpan(ctx context.Context, eventType string, messageId string) (context.Context, trace.Span) {
+	opts := []trace.SpanStartOption{
+		trace.WithNewRoot(),
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(AttrEventType.String(eventType), semconv.MessagingMessageID(messageId)),
+	}
+	if link := trace.LinkFromContext(ctx); link.SpanContext.IsValid() {
+		opts = append(opts, trace.WithLinks(link))
+	}
+
+	return Tracer().Start(ctx, "event "+eventType, opts...)
+}
+
+// RecordError marks span as failed with err. It does nothing if err is nil.
+func RecordError(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
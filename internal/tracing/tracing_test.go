@@ -0,0 +1,120 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	return recorder
+}
+
+func TestTransport(t *testing.T) {
+	recorder := recordSpans(t)
+
+	var traceparent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	ctx, parent := StartJobSpan(context.Background(), "capSvc2Aad", "run-1")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/v1.0/users?$filter="+url.QueryEscape("mail eq 'user@dfds.com'"), nil)
+	assert.NoError(t, err)
+	resp, err := (&http.Client{Transport: NewTransport("graph", nil)}).Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	parent.End()
+
+	// The request given to the transport isn't modified
+	assert.Empty(t, req.Header.Get("traceparent"))
+	assert.NotEmpty(t, traceparent)
+
+	spans := recorder.Ended()
+	assert.Len(t, spans, 2)
+	span := spans[0]
+	assert.Equal(t, "graph GET", span.Name())
+	assert.Equal(t, trace.SpanKindClient, span.SpanKind())
+	assert.Equal(t, parent.SpanContext().SpanID(), span.Parent().SpanID())
+	assert.Contains(t, traceparent, span.SpanContext().SpanID().String())
+	assert.Contains(t, span.Attributes(), semconv.HTTPURL(server.URL+"/v1.0/users"))
+	assert.Contains(t, span.Attributes(), semconv.HTTPStatusCode(http.StatusServiceUnavailable))
+	assert.Equal(t, codes.Error, span.Status().Code)
+}
+
+func TestExtractHttpHeaders(t *testing.T) {
+	recordSpans(t)
+
+	ctx, span := StartJobSpan(context.Background(), "capSvc2Aad", "run-1")
+	defer span.End()
+
+	header := http.Header{}
+	propagator.Inject(ctx, propagation.HeaderCarrier(header))
+	extracted := trace.SpanContextFromContext(ExtractHttpHeaders(context.Background(), header))
+	assert.True(t, extracted.IsRemote())
+	assert.Equal(t, span.SpanContext().TraceID(), extracted.TraceID())
+
+	assert.False(t, trace.SpanContextFromContext(ExtractHttpHeaders(context.Background(), http.Header{})).IsValid())
+}
+
+func TestKafkaHeaders(t *testing.T) {
+	recordSpans(t)
+
+	ctx, span := StartJobSpan(context.Background(), "capSvc2Aad", "run-1")
+	defer span.End()
+
+	headers := InjectKafkaHeaders(ctx, []kafka.Header{{Key: "traceparent", Value: []byte("stale")}, {Key: "source", Value: []byte("test")}})
+	assert.Len(t, headers, 2)
+	assert.Equal(t, kafka.Header{Key: "source", Value: []byte("test")}, headers[1])
+
+	extracted := trace.SpanContextFromContext(ExtractKafkaHeaders(context.Background(), headers))
+	assert.True(t, extracted.IsRemote())
+	assert.Equal(t, span.SpanContext().TraceID(), extracted.TraceID())
+	assert.Equal(t, span.SpanContext().SpanID(), extracted.SpanID())
+
+	// Without a span there is nothing to propagate
+	assert.Empty(t, InjectKafkaHeaders(context.Background(), nil))
+}
+
+func TestStartEventSpan(t *testing.T) {
+	recorder := recordSpans(t)
+
+	_, publisher := StartJobSpan(context.Background(), "capSvc2Aad", "run-1")
+	publisher.End()
+	ctx := ExtractKafkaHeaders(context.Background(), InjectKafkaHeaders(trace.ContextWithSpan(context.Background(), publisher), nil))
+
+	_, span := StartEventSpan(ctx, "capability_created", "message-1")
+	RecordError(span, errors.New("handler failed"))
+	span.End()
+
+	spans := recorder.Ended()
+	assert.Len(t, spans, 2)
+	event := spans[1]
+	assert.Equal(t, "event capability_created", event.Name())
+	// Events start a trace of their own, linked to the one of the publisher
+	assert.NotEqual(t, publisher.SpanContext().TraceID(), event.SpanContext().TraceID())
+	assert.Len(t, event.Links(), 1)
+	assert.Equal(t, publisher.SpanContext().SpanID(), event.Links()[0].SpanContext.SpanID())
+	assert.Equal(t, codes.Error, event.Status().Code)
+	assert.Contains(t, event.Attributes(), AttrEventType.String("capability_created"))
+}
@@ -2,7 +2,10 @@ package util
 
 import (
 	"errors"
+	"sync"
 	"time"
+
+	"golang.org/x/sync/singleflight"
 )
 
 type BearerToken struct {
@@ -27,13 +30,31 @@ func (b *BearerToken) IsExpired() bool {
 	return currentTime.After(tokenExpirationTime)
 }
 
+// expiresWithin returns true if the token is empty, or expires within d.
+func (b *BearerToken) expiresWithin(d time.Duration) bool {
+	if b.token == "" {
+		return true
+	}
+
+	return time.Now().Add(d).After(time.Unix(b.expiresIn, 0))
+}
+
 func (b *BearerToken) GetToken() string {
 	return b.token
 }
 
+// DefaultRefreshSkew is how long before the expiry of its token a TokenClient fetches a new one, so requests in flight
+// don't fail with an expired token.
+const DefaultRefreshSkew = 2 * time.Minute
+
+// TokenClient caches the token returned by its refresh function until shortly before it expires. It is safe for
+// concurrent use, and concurrent refreshes are deduplicated into a single call of the refresh function.
 type TokenClient struct {
-	Token           *BearerToken
+	mu              sync.RWMutex
+	token           *BearerToken
+	refreshSkew     time.Duration
 	refreshAuthFunc func() (*RefreshAuthResponse, error)
+	refreshGroup    singleflight.Group
 }
 
 func NewBearerToken(token string) *BearerToken {
@@ -42,31 +63,82 @@ func NewBearerToken(token string) *BearerToken {
 
 func NewTokenClient(authFunc func() (*RefreshAuthResponse, error)) *TokenClient {
 	return &TokenClient{
-		Token:           &BearerToken{},
+		token:           &BearerToken{},
+		refreshSkew:     DefaultRefreshSkew,
 		refreshAuthFunc: authFunc,
 	}
 }
 
-func (c *TokenClient) RefreshAuth() error {
-	if c.Token != nil {
-		if !c.Token.IsExpired() {
-			//fmt.Println("Token has not expired, reusing token from cache")
-			return nil
-		}
-	}
+// SetRefreshSkew sets how long before the expiry of the cached token RefreshAuth fetches a new one.
+func (c *TokenClient) SetRefreshSkew(skew time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.refreshSkew = skew
+}
 
-	resp, err := c.refreshAuthFunc()
-	if err != nil {
-		return err
+// SetToken replaces the cached token, e.g. with one given through the environment.
+func (c *TokenClient) SetToken(token *BearerToken) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.token = token
+}
+
+// GetToken returns the cached token. Call RefreshAuth first to make sure it is valid.
+func (c *TokenClient) GetToken() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.token == nil {
+		return ""
 	}
-	if resp == nil {
-		return errors.New("unable to refresh authentication")
+	return c.token.GetToken()
+}
+
+// IsExpired returns true if there is no cached token, or if it has expired.
+func (c *TokenClient) IsExpired() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.token == nil || c.token.IsExpired()
+}
+
+// needsRefresh returns true if the cached token expires within the refresh skew.
+func (c *TokenClient) needsRefresh() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.token == nil || c.token.expiresWithin(c.refreshSkew)
+}
+
+func (c *TokenClient) RefreshAuth() error {
+	if !c.needsRefresh() {
+		return nil
 	}
 
-	currentTime := time.Now()
-	c.Token = &BearerToken{}
-	c.Token.expiresIn = currentTime.Unix() + resp.ExpiresIn
-	c.Token.token = resp.AccessToken
+	// Callers arriving while a refresh is in flight wait for it instead of requesting a token of their own
+	_, err, _ := c.refreshGroup.Do("refresh", func() (interface{}, error) {
+		// A refresh that completed just before this one started may have made it unnecessary
+		if !c.needsRefresh() {
+			return nil, nil
+		}
+
+		resp, err := c.refreshAuthFunc()
+		if err == nil && resp == nil {
+			err = errors.New("unable to refresh authentication")
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		currentTime := time.Now()
+		c.SetToken(&BearerToken{
+			token:     resp.AccessToken,
+			expiresIn: currentTime.Unix() + resp.ExpiresIn,
+		})
+
+		return nil, nil
+	})
+	// A token that is about to expire can still be used if refreshing it ahead of time failed
+	if err != nil && !c.IsExpired() {
+		return nil
+	}
 
-	return nil
+	return err
 }